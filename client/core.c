@@ -1,14 +1,79 @@
 #include "core.h"
+#include "../protocol/envelope.h"
 #include <stdlib.h>
 #include <stdio.h>
 #include <string.h>
 #include <unistd.h>
 #include <sys/socket.h>
 #include <arpa/inet.h>
+#include <time.h>
+
+#define DEFAULT_HEARTBEAT_INTERVAL 30
+#define DEFAULT_HEARTBEAT_TIMEOUT 90
+
+// Backoff when the server answers 429 / 503 or MSG_BUSY
+#define BUSY_RETRIES 4
+#define BUSY_BACKOFF_MS 500
+#define BUSY_BACKOFF_MAX_MS 8000
+#define BUSY_RECONNECT_MAX_SEC 60
+
+// Largest API response body read before it is unwrapped
+#define API_RESPONSE_MAX (64 * 1024 * 1024)
+
+// How long a request on the persistent API connection waits for its response
+#define API_MUX_TIMEOUT_SEC 60
+
+// Open a TCP connection to the server, upgrading to TLS if enabled.
+// Returns the socket or -1 on failure.
+static int _client_connect(ClientContext *ctx, int port, int recv_timeout_sec) {
+    struct sockaddr_in server;
+    struct timeval tv;
+
+    int sock = socket(AF_INET, SOCK_STREAM, 0);
+    if (sock == -1) return -1;
+
+    server.sin_addr.s_addr = inet_addr(ctx->server_host);
+    server.sin_family = AF_INET;
+    server.sin_port = htons(port);
+
+    if (recv_timeout_sec > 0) {
+        tv.tv_sec = recv_timeout_sec;
+        tv.tv_usec = 0;
+        setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+    }
+
+    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
+        close(sock);
+        return -1;
+    }
+
+    if (ctx->tls && proto_tls_connect(ctx->tls, sock, ctx->server_name) < 0) {
+        close(sock);
+        return -1;
+    }
+    return sock;
+}
+
+// The MSG_HELLO body: device ID and protocol plus ctx->agent_info's fields
+static void _client_format_hello(ClientContext *ctx, char *out, size_t size) {
+    char device_id[sizeof(ctx->device_id) * 2];
+    if (envelope_escape(device_id, sizeof(device_id), ctx->device_id) < 0) device_id[0] = '\0';
+
+    const char *rest = ctx->agent_info;
+    while (*rest == ' ' || *rest == '\t' || *rest == '\n' || *rest == '\r') rest++;
+    if (*rest == '{') {
+        rest++;
+        while (*rest == ' ' || *rest == '\t' || *rest == '\n' || *rest == '\r') rest++;
+    } else {
+        rest = "}";
+    }
+    snprintf(out, size, "{\"device_id\":\"%s\",\"protocol\":%d%s%s",
+             device_id, PROTOCOL_VERSION, (*rest == '}') ? "" : ",", rest);
+}
 
 static void _client_do_notification_connect(ClientContext *ctx) {
     struct sockaddr_in server;
-    char server_reply[BUFFER_SIZE];
+    char server_reply[BUFFER_SIZE + 1];
 
     ctx->notification_sock = socket(AF_INET, SOCK_STREAM, 0);
     if (ctx->notification_sock == -1) {
@@ -26,7 +91,7 @@ static void _client_do_notification_connect(ClientContext *ctx) {
     setsockopt(ctx->notification_sock, SOL_SOCKET, SO_SNDTIMEO, (const char*)&tv, sizeof tv);
 
     if (connect(ctx->notification_sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(ctx->notification_sock);
+        proto_close(ctx->notification_sock);
         ctx->notification_sock = -1;
         return;
     }
@@ -35,105 +100,425 @@ static void _client_do_notification_connect(ClientContext *ctx) {
     tv.tv_sec = 0; 
     setsockopt(ctx->notification_sock, SOL_SOCKET, SO_SNDTIMEO, (const char*)&tv, sizeof tv);
 
-    // Send Device ID
-    send_packet(ctx->notification_sock, ctx->device_id, strlen(ctx->device_id));
-    
-    if (recv_packet(ctx->notification_sock, server_reply) > 0) {
-         printf("\n[INFO] Connected to Notification Server: %s", server_reply);
+    // A message that stops halfway counts as a dead server
+    tv.tv_sec = ctx->heartbeat_timeout;
+    setsockopt(ctx->notification_sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+
+    if (ctx->tls && proto_tls_connect(ctx->tls, ctx->notification_sock, ctx->server_name) < 0) {
+        proto_close(ctx->notification_sock);
+        ctx->notification_sock = -1;
+        return;
+    }
+
+    // Greet with our device ID, version and capabilities
+    char hello[BUFFER_SIZE * 2];
+    _client_format_hello(ctx, hello, sizeof(hello));
+    send_message(ctx->notification_sock, MSG_HELLO, hello, strlen(hello));
+
+    uint8_t type = 0;
+    if (recv_packet_type(ctx->notification_sock, server_reply, &type) > 0 && type != MSG_BUSY && type != MSG_HELLO_REJECT) {
+         if (type == MSG_HELLO) {
+             const char *p = strstr(server_reply, "\"protocol\":");
+             ctx->server_protocol = p ? atoi(p + strlen("\"protocol\":")) : PROTOCOL_VERSION;
+             printf("\n[INFO] Connected to Notification Server (protocol %d)\n", ctx->server_protocol);
+         } else {
+             ctx->server_protocol = 1; // Older server: text greeting
+             printf("\n[INFO] Connected to Notification Server: %s", server_reply);
+         }
          fflush(stdout);
+         ctx->busy_backoff = 0;
     } else {
-        close(ctx->notification_sock);
+        if (type == MSG_HELLO_REJECT) {
+            // Too old for this server: only an upgrade helps, so retry rarely
+            ctx->busy_backoff = BUSY_RECONNECT_MAX_SEC;
+            printf("\n[ERROR] Server refused this agent: %s\n", server_reply);
+            fflush(stdout);
+        }
+        if (type == MSG_BUSY) {
+            // Server is at its connection limit: wait longer each time
+            ctx->busy_backoff = ctx->busy_backoff ? ctx->busy_backoff * 2 : 2;
+            if (ctx->busy_backoff > BUSY_RECONNECT_MAX_SEC) ctx->busy_backoff = BUSY_RECONNECT_MAX_SEC;
+            printf("\n[WARNING] Notification server busy, retrying in %ds\n", ctx->busy_backoff);
+            fflush(stdout);
+        }
+        proto_close(ctx->notification_sock);
         ctx->notification_sock = -1;
     }
 }
 
 void *listen_for_notifications(void *arg) {
     ClientContext *ctx = (ClientContext *)arg;
-    char buffer[BUFFER_SIZE];
+    char *buffer;
+    time_t last_recv = 0;
 
     while (ctx->running) {
         if (ctx->notification_sock == -1) {
             _client_do_notification_connect(ctx);
             if (ctx->notification_sock == -1) {
-                sleep(2); // Retry every 2 seconds
+                sleep(ctx->busy_backoff > 2 ? ctx->busy_backoff : 2); // Retry every 2 seconds, longer while busy
                 continue;
             }
+            last_recv = time(NULL);
         }
 
-        int read_size = recv_packet(ctx->notification_sock, buffer);
-        if (read_size > 0) {
-            if (ctx->on_message) {
-                ctx->on_message(buffer);
+        // Ping when idle, give up when the server stops answering
+        int ready = proto_wait_readable(ctx->notification_sock, ctx->heartbeat_interval * 1000);
+        if (ready == 0) {
+            if (time(NULL) - last_recv >= ctx->heartbeat_timeout) {
+                printf("\n[WARNING] No heartbeat from notification server. Reconnecting... ");
+                fflush(stdout);
+                proto_close(ctx->notification_sock);
+                ctx->notification_sock = -1;
             } else {
-                printf("\n[NOTIFICATION] %s", buffer);
+                send_message(ctx->notification_sock, MSG_PING, NULL, 0);
+            }
+            continue;
+        }
+
+        uint8_t type = 0;
+        int read_size = ready < 0 ? -1 : recv_message(ctx->notification_sock, &type, &buffer, ctx->max_message_size);
+        if (read_size >= 0) {
+            last_recv = time(NULL);
+            if (type == MSG_PING) {
+                send_message(ctx->notification_sock, MSG_PONG, NULL, 0);
+            } else if (type == MSG_SHUTDOWN) {
+                // Server restart: come back after the hinted delay, spread out
+                // so agents do not all reconnect in the same second
+                int after = read_size > 0 ? atoi(buffer) : 0;
+                if (after < 1) after = 1;
+                int wait = after + rand() % (after + 1);
+                printf("\n[INFO] Server is shutting down, reconnecting in %ds\n", wait);
                 fflush(stdout);
+                free(buffer);
+                proto_close(ctx->notification_sock);
+                ctx->notification_sock = -1;
+                sleep(wait);
+                continue;
+            } else if (type != MSG_PONG && read_size > 0) {
+                if (ctx->on_message) {
+                    ctx->on_message(type, buffer);
+                } else {
+                    printf("\n[NOTIFICATION] %s", buffer);
+                    fflush(stdout);
+                }
             }
+            free(buffer);
         } else {
-            // Socket error or peer closed
+            // Socket error, peer closed or oversized message
             if (ctx->running) {
                 printf("\n[WARNING] Lost connection to notification server. Reconnecting... ");
                 fflush(stdout);
             }
-            close(ctx->notification_sock);
+            proto_close(ctx->notification_sock);
             ctx->notification_sock = -1;
         }
     }
     return 0;
 }
 
-// Helper for API requests
-static int client_api_request(ClientContext *ctx, uint8_t type, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
+// Copy an API response body into out (size bytes including the NUL). An
+// envelope is unwrapped: its data on success, otherwise
+// {"error":message,"code":code,"request_id":id[,"retry_after_ms":n][,"data":data]}
+// so callers can report failures the same way for every route. Bodies from
+// servers that do not send envelopes are copied as is.
+static void _client_unwrap_response(const char *body, char *out, size_t size) {
+    envelope_t env;
+    size_t len;
+
+    if (size == 0) return;
+    if (!envelope_parse(body, &env)) {
+        len = strlen(body);
+        if (len >= size) len = size - 1;
+        memcpy(out, body, len);
+        out[len] = '\0';
+        return;
+    }
 
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
+    if (strcmp(env.code, "OK") == 0) {
+        const char *data = env.data ? env.data : "{}";
+        len = env.data ? env.data_len : 2;
+        if (len >= size) len = size - 1;
+        memcpy(out, data, len);
+        out[len] = '\0';
+        return;
+    }
 
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
+    char message[ENVELOPE_MESSAGE_SIZE * 2];
+    envelope_escape(message, sizeof(message), env.message);
+    int n = snprintf(out, size, "{\"error\":\"%s\",\"code\":\"%s\",\"request_id\":\"%s\"",
+                     message, env.code, env.request_id);
+    if (n >= 0 && (size_t)n < size && env.retry_after_ms > 0) {
+        n += snprintf(out + n, size - n, ",\"retry_after_ms\":%ld", env.retry_after_ms);
+    }
+    if (n >= 0 && env.data && (size_t)n + env.data_len + sizeof(",\"data\":}") <= size) {
+        n += snprintf(out + n, size - n, ",\"data\":%.*s", (int)env.data_len, env.data);
+    }
+    if (n >= 0 && (size_t)n + 1 < size) {
+        strcpy(out + n, "}");
+    }
+    printf("[API] Request %s failed: %s (%s)\n", env.request_id, env.code, env.message);
+}
 
-    tv.tv_sec = 10;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+// --- Persistent API connection ---
+// Requests are framed with an ID (api_mux_req_header_t) and wait on mux_cond
+// until the reader thread files their response under that ID.
+
+typedef struct mux_pending {
+    uint32_t id;
+    int done;
+    int status;         // 0 if the connection dropped first
+    char *body;         // Response body (malloc'd), NULL if none
+    uint32_t body_len;
+    struct mux_pending *next;
+} mux_pending_t;
+
+// Complete every waiting request, e.g. with status 0 when the connection
+// drops. Called with mux_lock held.
+static void _client_mux_fail_all(ClientContext *ctx, int status, const char *body) {
+    for (mux_pending_t *p = ctx->mux_pending; p; p = p->next) {
+        if (p->done) continue;
+        p->done = 1;
+        p->status = status;
+        p->body = body ? strdup(body) : NULL;
+        p->body_len = body ? (uint32_t)strlen(body) : 0;
+    }
+    pthread_cond_broadcast(&ctx->mux_cond);
+}
 
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
+static void *_client_mux_reader(void *arg) {
+    ClientContext *ctx = (ClientContext *)arg;
+    int sock = ctx->mux_sock; // Set before this thread starts; only cleared below
+    int fail_status = 0;
+    char *fail_body = NULL;
+
+    for (;;) {
+        api_mux_resp_header_t header;
+        if (proto_read_full(sock, &header, sizeof(header)) <= 0) break;
+        if (header.magic != PROTOCOL_MAGIC_MUX) {
+            printf("[ERROR] Bad frame on the API connection\n");
+            break;
+        }
+
+        uint32_t len = ntohl(header.len);
+        if (len > API_RESPONSE_MAX) {
+            printf("[ERROR] API response of %u bytes exceeds the limit\n", len);
+            break;
+        }
+        char *body = malloc(len + 1);
+        if (!body) break;
+        if (len > 0 && proto_read_full(sock, body, len) <= 0) {
+            free(body);
+            break;
+        }
+        body[len] = '\0';
+
+        uint32_t id = ntohl(header.request_id);
+        if (id == 0) {
+            // The server refused the whole connection (e.g. busy)
+            fail_status = ntohs(header.status);
+            fail_body = body;
+            break;
+        }
+
+        pthread_mutex_lock(&ctx->mux_lock);
+        mux_pending_t *p = ctx->mux_pending;
+        while (p && p->id != id) p = p->next;
+        if (p && !p->done) {
+            p->done = 1;
+            p->status = ntohs(header.status);
+            p->body = body;
+            p->body_len = len;
+            pthread_cond_broadcast(&ctx->mux_cond);
+        } else {
+            free(body); // Its caller gave up waiting
+        }
+        pthread_mutex_unlock(&ctx->mux_lock);
+    }
+
+    pthread_mutex_lock(&ctx->mux_lock);
+    ctx->mux_sock = -1;
+    _client_mux_fail_all(ctx, fail_status, fail_body);
+    pthread_mutex_unlock(&ctx->mux_lock);
+
+    free(fail_body);
+    proto_close(sock);
+    return 0;
+}
+
+// Open the connection if needed. Called with mux_lock held; returns the
+// socket or -1.
+static int _client_mux_connect(ClientContext *ctx) {
+    if (ctx->mux_sock != -1) return ctx->mux_sock;
+
+    if (ctx->mux_reader_started) {
+        // The old reader has already given up the connection and no longer
+        // takes mux_lock, so joining here cannot deadlock
+        pthread_join(ctx->mux_reader, NULL);
+        ctx->mux_reader_started = 0;
+    }
+
+    int sock = _client_connect(ctx, ctx->api_port, 0);
+    if (sock == -1) return -1;
+
+    ctx->mux_sock = sock;
+    if (pthread_create(&ctx->mux_reader, NULL, _client_mux_reader, ctx) != 0) {
+        ctx->mux_sock = -1;
+        proto_close(sock);
+        return -1;
+    }
+    ctx->mux_reader_started = 1;
+    return sock;
+}
+
+// Requests that change nothing on the server, or that it recognises when
+// they come again, so resending one after a lost response applies it once
+static int _client_mux_idempotent(uint8_t type) {
+    switch (type) {
+    case MSG_LIST_REQ:
+    case MSG_ADMIN_GET_STORED_LOGS_REQ:
+    case MSG_ADMIN_GET_COMMAND_HISTORY_REQ:
+    case MSG_ADMIN_LIST_PENDING_DEVICES_REQ:
+    case MSG_ADMIN_GET_FILE_TREE_REQ:
+    case MSG_ADMIN_STUCK_TRANSFERS_REQ:
+    case MSG_CLIENT_GET_FIREWALL_CONFIG_REQ:
+    case MSG_BACKUP_CHUNK_REQ:       // The server accepts a chunk it already has
+    case MSG_BACKUP_CHUNK_DATA_REQ:
+    case MSG_BACKUP_CHUNK_QUERY_REQ:
+    case MSG_BACKUP_CHUNK_PUT_REQ:
+    case MSG_BACKUP_RESUME_REQ:
+    case MSG_RESTORE_CHUNK_REQ:
+    case MSG_RESTORE_CHUNK_DATA_REQ:
+    case MSG_RESTORE_RESUME_REQ:
+        return 1;
+    default:
         return 0;
     }
+}
+
+static void _client_mux_unlink(ClientContext *ctx, mux_pending_t *pending) {
+    for (mux_pending_t **p = &ctx->mux_pending; *p; p = &(*p)->next) {
+        if (*p == pending) {
+            *p = pending->next;
+            break;
+        }
+    }
+}
+
+// Send one request on the persistent connection and wait for its response.
+// If the connection drops first it is reopened and the request sent once
+// more, provided the server cannot have acted on it: its header never went
+// out, or the request is idempotent. Same contract as _client_api_exchange.
+static int _client_mux_exchange(ClientContext *ctx, uint8_t type, const char *payload, uint32_t p_len, char **body, uint32_t *body_len) {
+    mux_pending_t pending;
 
-    int p_len = (json_payload != NULL) ? (int)strlen(json_payload) : 0;
+    for (int attempt = 0; attempt < 2; attempt++) {
+        memset(&pending, 0, sizeof(pending));
+
+        pthread_mutex_lock(&ctx->mux_lock);
+        int sock = _client_mux_connect(ctx);
+        if (sock == -1) {
+            pthread_mutex_unlock(&ctx->mux_lock);
+            return 0;
+        }
+        if (++ctx->mux_next_id == 0) ctx->mux_next_id = 1; // 0 means the whole connection
+        pending.id = ctx->mux_next_id;
+        pending.next = ctx->mux_pending;
+        ctx->mux_pending = &pending;
+        pthread_mutex_unlock(&ctx->mux_lock);
+
+        api_mux_req_header_t header;
+        header.magic = PROTOCOL_MAGIC_MUX;
+        header.type = type;
+        header.request_id = htonl(pending.id);
+        header.len = htonl(p_len);
+
+        // The reader keeps reading meanwhile; the transport serializes the two
+        pthread_mutex_lock(&ctx->mux_write_lock);
+        int r = proto_write(sock, &header, sizeof(header));
+        int sent = r >= 0; // A failed header write leaves the server nothing to act on
+        if (r >= 0 && p_len > 0) r = proto_write(sock, payload, p_len);
+        pthread_mutex_unlock(&ctx->mux_write_lock);
+        if (r < 0) {
+            shutdown(sock, SHUT_RDWR); // The reader fails every waiting request
+        }
+
+        struct timespec deadline;
+        clock_gettime(CLOCK_REALTIME, &deadline);
+        deadline.tv_sec += API_MUX_TIMEOUT_SEC;
+
+        pthread_mutex_lock(&ctx->mux_lock);
+        while (!pending.done) {
+            if (pthread_cond_timedwait(&ctx->mux_cond, &ctx->mux_lock, &deadline) != 0) break;
+        }
+        _client_mux_unlink(ctx, &pending);
+        pthread_mutex_unlock(&ctx->mux_lock);
+
+        if (!pending.done) {
+            printf("[ERROR] No response to API request 0x%02X after %ds\n", type, API_MUX_TIMEOUT_SEC);
+            return 0;
+        }
+        if (pending.status != 0) break;
+        if (sent && !_client_mux_idempotent(type)) {
+            printf("[ERROR] API connection dropped during request 0x%02X; not sending it again\n", type);
+            break;
+        }
+        free(pending.body);
+        pending.body = NULL;
+    }
+
+    if (pending.status == 0) return 0;
+    *body = pending.body;
+    *body_len = pending.body_len;
+    return pending.status;
+}
+
+// Send one request of p_len bytes and read the raw response body into *body
+// (malloc'd and NUL-terminated, caller frees; NULL if there is none).
+// Returns the response status, or 0 if the request could not be made.
+static int _client_api_exchange(ClientContext *ctx, uint8_t type, const char *payload, uint32_t p_len, char **body, uint32_t *body_len) {
+    int sock;
+
+    *body = NULL;
+    *body_len = 0;
+
+    if (ctx->api_persistent) {
+        return _client_mux_exchange(ctx, type, payload, p_len, body, body_len);
+    }
+
+    sock = _client_connect(ctx, ctx->api_port, 10);
+    if (sock == -1) {
+        return 0;
+    }
 
     if (p_len > 65535) {
         api_req_header_ext_t req_ext;
         req_ext.magic = PROTOCOL_MAGIC_EXT;
         req_ext.type = type;
-        req_ext.len = htonl((uint32_t)p_len);
-        if (send(sock, &req_ext, sizeof(req_ext), 0) < 0) {
-            close(sock);
+        req_ext.len = htonl(p_len);
+        if (proto_write(sock, &req_ext, sizeof(req_ext)) < 0) {
+            proto_close(sock);
             return 0;
         }
     } else {
         api_req_header_t req;
         req.type = type;
         req.len = htons((uint16_t)p_len);
-        if (send(sock, &req, sizeof(req), 0) < 0) {
-            close(sock);
+        if (proto_write(sock, &req, sizeof(req)) < 0) {
+            proto_close(sock);
             return 0;
         }
     }
 
     if (p_len > 0) {
-        if (send(sock, json_payload, p_len, 0) < 0) {
-            close(sock);
+        if (proto_write(sock, payload, p_len) < 0) {
+            proto_close(sock);
             return 0;
         }
     }
 
     uint8_t first_byte;
-    if (recv(sock, &first_byte, 1, 0) <= 0) {
-        close(sock);
+    if (proto_read_full(sock, &first_byte, 1) <= 0) {
+        proto_close(sock);
         return 0;
     }
 
@@ -146,8 +531,8 @@ static int client_api_request(ClientContext *ctx, uint8_t type, char *json_paylo
             uint32_t len;
             uint16_t status;
         } __attribute__((packed)) ext;
-        if (recv(sock, &ext, sizeof(ext), 0) <= 0) {
-            close(sock);
+        if (proto_read_full(sock, &ext, sizeof(ext)) <= 0) {
+            proto_close(sock);
             return 0;
         }
         resp_len = ntohl(ext.len);
@@ -157,41 +542,285 @@ static int client_api_request(ClientContext *ctx, uint8_t type, char *json_paylo
             uint16_t len;
             uint16_t status;
         } __attribute__((packed)) std;
-        if (recv(sock, &std, sizeof(std), 0) <= 0) {
-            close(sock);
+        if (proto_read_full(sock, &std, sizeof(std)) <= 0) {
+            proto_close(sock);
             return 0;
         }
         resp_len = ntohs(std.len);
         status = ntohs(std.status);
     }
 
+    if (resp_len > API_RESPONSE_MAX) {
+        printf("[ERROR] API response of %u bytes exceeds the limit\n", resp_len);
+        proto_close(sock);
+        return 0;
+    }
+
     // Receive Payload
-    if (resp_len > 0) {
-        if (response_buffer) {
-            int total_read = 0;
-            while (total_read < (int)resp_len) {
-                int r = recv(sock, response_buffer + total_read, (int)resp_len - total_read, 0);
-                if (r <= 0) break;
-                total_read += r;
-            }
-            response_buffer[resp_len] = '\0';
-        } else {
-            // Drain the socket if we don't have a buffer but server sent data
-            char junk[1024];
-            uint32_t remaining = resp_len;
-            while (remaining > 0) {
-                int to_read = remaining > sizeof(junk) ? sizeof(junk) : remaining;
-                int r = recv(sock, junk, to_read, 0);
-                if (r <= 0) break;
-                remaining -= r;
-            }
+    char *data = malloc(resp_len + 1);
+    if (!data) {
+        proto_close(sock);
+        return 0;
+    }
+    uint32_t total_read = 0;
+    while (total_read < resp_len) {
+        int r = proto_read(sock, data + total_read, resp_len - total_read);
+        if (r <= 0) break;
+        total_read += r;
+    }
+    data[total_read] = '\0';
+
+    proto_close(sock);
+    *body = data;
+    *body_len = total_read;
+    return status;
+}
+
+// _client_api_exchange, retried with exponential backoff while the server
+// answers 429 (rate limited) or 503 (busy). A retry_after_ms hint in the
+// response envelope is honoured.
+static int _client_api_exchange_retry(ClientContext *ctx, uint8_t type, const char *payload, uint32_t p_len, char **body, uint32_t *body_len) {
+    int delay_ms = BUSY_BACKOFF_MS;
+    int status = 0;
+
+    for (int attempt = 0; attempt <= BUSY_RETRIES; attempt++) {
+        status = _client_api_exchange(ctx, type, payload, p_len, body, body_len);
+        if ((status != 429 && status != 503) || attempt == BUSY_RETRIES) break;
+
+        int wait_ms = delay_ms + rand() % (delay_ms / 2 + 1); // Jitter spreads out retrying agents
+        envelope_t env;
+        if (*body && envelope_parse(*body, &env) && env.retry_after_ms > wait_ms) {
+            wait_ms = (int)env.retry_after_ms;
+        }
+        if (wait_ms > BUSY_BACKOFF_MAX_MS) wait_ms = BUSY_BACKOFF_MAX_MS;
+        free(*body);
+        *body = NULL;
+
+        printf("[INFO] Server busy (%d), retrying in %dms\n", status, wait_ms);
+        usleep((useconds_t)wait_ms * 1000);
+        delay_ms *= 2;
+    }
+    return status;
+}
+
+// Room for an unwrapped error object beyond the envelope it came from
+#define RESPONSE_SLACK 64
+
+// Unwrap a response body (see _client_unwrap_response) into a heap response.
+static void _client_set_response(client_response_t *response, int status, const char *body, uint32_t body_len) {
+    size_t size = (size_t)body_len + RESPONSE_SLACK;
+
+    response->status = status;
+    response->body = malloc(size);
+    response->len = 0;
+    if (!response->body) return;
+    _client_unwrap_response(body ? body : "", response->body, size);
+    response->len = (uint32_t)strlen(response->body);
+}
+
+// Same, taking ownership of body. response may be NULL to drop it.
+static void _client_take_response(char *body, uint32_t body_len, int status, client_response_t *response) {
+    if (response) _client_set_response(response, status, body, body_len);
+    free(body);
+}
+
+// Send one JSON request and unwrap the response into response (may be NULL).
+// Returns the response status, or 0 if the request could not be made.
+static int _client_api_send(ClientContext *ctx, uint8_t type, const char *json_payload, client_response_t *response) {
+    char *body;
+    uint32_t body_len;
+    uint32_t p_len = json_payload ? (uint32_t)strlen(json_payload) : 0;
+
+    int status = _client_api_exchange(ctx, type, json_payload, p_len, &body, &body_len);
+    if (status == 0) return 0;
+    _client_take_response(body, body_len, status, response);
+    return status;
+}
+
+// _client_api_send with backoff (see _client_api_exchange_retry)
+static int _client_api_send_retry(ClientContext *ctx, uint8_t type, const char *json_payload, client_response_t *response) {
+    char *body;
+    uint32_t body_len;
+    uint32_t p_len = json_payload ? (uint32_t)strlen(json_payload) : 0;
+
+    int status = _client_api_exchange_retry(ctx, type, json_payload, p_len, &body, &body_len);
+    if (status == 0) return 0;
+    _client_take_response(body, body_len, status, response);
+    return status;
+}
+
+// Copy the string value of "key" from a flat JSON object (no escapes).
+static int _json_get_string(const char *json, const char *key, char *out, size_t size) {
+    char pattern[64];
+    snprintf(pattern, sizeof(pattern), "\"%s\"", key);
+
+    const char *p = strstr(json, pattern);
+    if (!p) return 0;
+    p += strlen(pattern);
+    while (*p == ' ' || *p == ':') p++;
+    if (*p != '"') return 0;
+    p++;
+
+    const char *end = strchr(p, '"');
+    if (!end || (size_t)(end - p) >= size) return 0;
+    memcpy(out, p, end - p);
+    out[end - p] = '\0';
+    return 1;
+}
+
+// Insert "session_token" into a JSON object payload. Returns a malloc'd
+// payload, or NULL if there is no session (send the payload unchanged).
+static char *_client_attach_token(ClientContext *ctx, const char *json_payload) {
+    char token[sizeof(ctx->session_token)];
+
+    pthread_mutex_lock(&ctx->session_lock);
+    strcpy(token, ctx->session_token);
+    pthread_mutex_unlock(&ctx->session_lock);
+
+    if (token[0] == '\0') return NULL;
+
+    const char *body = json_payload ? json_payload : "";
+    while (*body == ' ' || *body == '\t' || *body == '\n' || *body == '\r') body++;
+
+    size_t size = strlen(body) + strlen(token) + 32;
+    char *out = malloc(size);
+    if (!out) return NULL;
+
+    if (*body != '{') {
+        // No payload: the token is the whole object
+        snprintf(out, size, "{\"session_token\":\"%s\"}", token);
+        return out;
+    }
+
+    const char *rest = body + 1;
+    while (*rest == ' ' || *rest == '\t' || *rest == '\n' || *rest == '\r') rest++;
+    snprintf(out, size, "{\"session_token\":\"%s\"%s%s", token, (*rest == '}') ? "" : ",", rest);
+    return out;
+}
+
+static void _client_format_login(char *out, size_t size, uint8_t type, const char *username, const char *password, const char *device_id) {
+    if (type == MSG_ADMIN_LOGIN_REQ) {
+        snprintf(out, size, "{\"username\": \"%s\", \"password\": \"%s\"}", username, password);
+    } else {
+        snprintf(out, size, "{\"username\": \"%s\", \"password\": \"%s\", \"device_id\": \"%s\"}", username, password, device_id);
+    }
+}
+
+// Log in with a prepared payload and keep the returned session token.
+static int _client_login_request(ClientContext *ctx, uint8_t type, const char *payload) {
+    client_response_t response = {0};
+    char token[sizeof(ctx->session_token)];
+    char must_change[8];
+
+    int status = _client_api_send_retry(ctx, type, payload, &response);
+    const char *body = response.body ? response.body : "";
+    if (status != 200) {
+        if (status != 0) printf("API Response (%d): %s\n", status, body);
+        client_free_response(&response);
+        return 0;
+    }
+
+    if (!_json_get_string(body, "session_token", token, sizeof(token))) {
+        token[0] = '\0';
+    }
+    if (!_json_get_string(body, "must_change_password", must_change, sizeof(must_change))) {
+        must_change[0] = '\0';
+    }
+    client_free_response(&response);
+
+    pthread_mutex_lock(&ctx->session_lock);
+    strcpy(ctx->session_token, token);
+    ctx->must_change_password = (strcmp(must_change, "true") == 0);
+    pthread_mutex_unlock(&ctx->session_lock);
+    return 1;
+}
+
+// Remember the credentials of a successful login for _client_relogin.
+static void _client_save_login(ClientContext *ctx, uint8_t type, const char *username, const char *password) {
+    pthread_mutex_lock(&ctx->session_lock);
+    ctx->login_type = type;
+    snprintf(ctx->login_username, sizeof(ctx->login_username), "%s", username);
+    snprintf(ctx->login_password, sizeof(ctx->login_password), "%s", password);
+    pthread_mutex_unlock(&ctx->session_lock);
+}
+
+// Log in again with the saved credentials after the session expired or was
+// revoked. Returns 1 if a new token was obtained.
+static int _client_relogin(ClientContext *ctx) {
+    uint8_t type;
+    char payload[BUFFER_SIZE];
+
+    pthread_mutex_lock(&ctx->session_lock);
+    type = ctx->login_type;
+    if (type != 0) {
+        _client_format_login(payload, sizeof(payload), type, ctx->login_username, ctx->login_password, ctx->device_id);
+    }
+    pthread_mutex_unlock(&ctx->session_lock);
+
+    if (type == 0) return 0;
+
+    printf("[INFO] Session expired, logging in again...\n");
+    return _client_login_request(ctx, type, payload);
+}
+
+// Authenticated API call: attaches the session token and retries once after
+// logging in again if the server answers 401. Returns the response status.
+static int _client_api_call(ClientContext *ctx, uint8_t type, char *json_payload, client_response_t *response) {
+    if (response) memset(response, 0, sizeof(*response));
+
+    char *authed = _client_attach_token(ctx, json_payload);
+    int status = _client_api_send_retry(ctx, type, authed ? authed : json_payload, response);
+    free(authed);
+
+    if (status == 401 && _client_relogin(ctx)) {
+        if (response) client_free_response(response);
+        authed = _client_attach_token(ctx, json_payload);
+        status = _client_api_send_retry(ctx, type, authed ? authed : json_payload, response);
+        free(authed);
+    }
+    return status;
+}
+
+// _client_api_call for the chunk routes, returning the raw response body in
+// *body (caller frees). With data the request is a chunk frame whose header
+// is json_payload; without, json_payload is sent as is.
+static int _client_chunk_call(ClientContext *ctx, uint8_t type, const char *json_payload, const void *data, uint32_t data_len, char **body, uint32_t *body_len) {
+    int status = 0;
+
+    for (int attempt = 0; attempt < 2; attempt++) {
+        char *authed = _client_attach_token(ctx, json_payload);
+        const char *payload = authed ? authed : json_payload;
+        char *frame = NULL;
+        uint32_t p_len = (uint32_t)strlen(payload);
+        if (data) {
+            frame = chunk_frame_build(payload, data, data_len, &p_len);
+            free(authed);
+            authed = NULL;
+            if (!frame) return 0;
+            payload = frame;
         }
-    } else if (response_buffer) {
-        response_buffer[0] = '\0';
+
+        status = _client_api_exchange_retry(ctx, type, payload, p_len, body, body_len);
+        free(frame);
+        free(authed);
+
+        if (status != 401 || attempt == 1 || !_client_relogin(ctx)) break;
+        free(*body);
+        *body = NULL;
     }
+    return status;
+}
 
-    close(sock);
-    return status == 200;
+// Helper for API requests
+static int client_api_request(ClientContext *ctx, uint8_t type, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, type, json_payload, response) == 200;
+}
+
+void client_free_response(client_response_t *response) {
+    if (!response) return;
+    free(response->body);
+    response->body = NULL;
+    response->len = 0;
 }
 
 ClientContext* client_init(char *host, int port, int api_port) {
@@ -200,71 +829,97 @@ ClientContext* client_init(char *host, int port, int api_port) {
     ctx->running = 1;
     ctx->on_message = NULL;
     strncpy(ctx->server_host, host, 255);
+    ctx->server_host[255] = '\0';
     ctx->server_port = port;
     ctx->api_port = api_port;
+    ctx->tls = NULL;
+    ctx->server_name[0] = '\0';
+    ctx->session_token[0] = '\0';
+    ctx->must_change_password = 0;
+    ctx->login_type = 0;
+    ctx->login_username[0] = '\0';
+    ctx->login_password[0] = '\0';
+    ctx->device_id[0] = '\0';
+    ctx->max_message_size = PROTO_DEFAULT_MAX_MESSAGE;
+    ctx->heartbeat_interval = DEFAULT_HEARTBEAT_INTERVAL;
+    ctx->heartbeat_timeout = DEFAULT_HEARTBEAT_TIMEOUT;
+    ctx->busy_backoff = 0;
+    ctx->agent_info[0] = '\0';
+    ctx->server_protocol = 0;
+    pthread_mutex_init(&ctx->session_lock, NULL);
+    ctx->api_persistent = 0;
+    ctx->mux_sock = -1;
+    ctx->mux_next_id = 0;
+    ctx->mux_pending = NULL;
+    ctx->mux_reader_started = 0;
+    pthread_mutex_init(&ctx->mux_lock, NULL);
+    pthread_mutex_init(&ctx->mux_write_lock, NULL);
+    pthread_cond_init(&ctx->mux_cond, NULL);
     return ctx;
 }
 
-void client_set_on_message(ClientContext *ctx, MessageCallback cb) {
-    ctx->on_message = cb;
+void client_set_agent_info(ClientContext *ctx, const char *agent_info) {
+    snprintf(ctx->agent_info, sizeof(ctx->agent_info), "%s", agent_info ? agent_info : "");
 }
 
-int client_login(ClientContext *ctx, char *username, char *password, char *device_id) {
-    // API Login uses ephemeral socket but needs config from ctx
-    
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    char payload[BUFFER_SIZE];
-    api_req_header_t req;
-    api_resp_header_t resp;
-    char response_body[BUFFER_SIZE];
+void client_set_persistent_api(ClientContext *ctx, int enable) {
+    ctx->api_persistent = enable;
+}
 
-    sprintf(payload, "{\"username\": \"%s\", \"password\": \"%s\", \"device_id\": \"%s\"}", username, password, device_id);
-    int payload_len = strlen(payload);
+// Drop the persistent API connection; the next request reconnects
+static void _client_mux_reset(ClientContext *ctx) {
+    pthread_mutex_lock(&ctx->mux_lock);
+    if (ctx->mux_sock != -1) shutdown(ctx->mux_sock, SHUT_RDWR);
+    pthread_mutex_unlock(&ctx->mux_lock);
+}
 
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
+void client_set_max_message_size(ClientContext *ctx, uint32_t max_size) {
+    ctx->max_message_size = max_size > 0 ? max_size : PROTO_DEFAULT_MAX_MESSAGE;
+}
 
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
+void client_set_heartbeat(ClientContext *ctx, int interval, int timeout) {
+    ctx->heartbeat_interval = interval > 0 ? interval : DEFAULT_HEARTBEAT_INTERVAL;
+    ctx->heartbeat_timeout = timeout > 0 ? timeout : DEFAULT_HEARTBEAT_TIMEOUT;
+    if (ctx->heartbeat_timeout <= ctx->heartbeat_interval) {
+        ctx->heartbeat_timeout = ctx->heartbeat_interval * 3;
+    }
+}
 
-    // Set timeout
-    tv.tv_sec = 5; 
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+int client_enable_tls(ClientContext *ctx, char *ca_file, char *cert_file, char *key_file, char *server_name) {
+    SSL_CTX *tls = proto_tls_client_ctx(ca_file, cert_file, key_file);
+    if (!tls) return 0;
 
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        perror("API Connect failed");
-        return 0;
+    // Called again after enrollment to pick up the new device certificate
+    _client_mux_reset(ctx);
+    if (ctx->tls) SSL_CTX_free(ctx->tls);
+    ctx->tls = tls;
+
+    if (server_name) {
+        strncpy(ctx->server_name, server_name, sizeof(ctx->server_name) - 1);
+        ctx->server_name[sizeof(ctx->server_name) - 1] = '\0';
     }
+    return 1;
+}
 
-    req.type = MSG_LOGIN_REQ;
-    req.len = htons(payload_len);
-    write(sock, &req, sizeof(req));
-    write(sock, payload, payload_len);
+void client_set_on_message(ClientContext *ctx, MessageCallback cb) {
+    ctx->on_message = cb;
+}
 
-    if (recv(sock, &resp, sizeof(resp), 0) <= 0) {
-        close(sock);
-        return 0;
-    }
+int client_login(ClientContext *ctx, char *username, char *password, char *device_id) {
+    // API Login uses ephemeral socket but needs config from ctx
+    char payload[BUFFER_SIZE];
 
-    int body_len = ntohs(resp.len);
-    if (body_len > BUFFER_SIZE) body_len = BUFFER_SIZE;
-    
-    int total_read = 0;
-    while(total_read < body_len) {
-        int r = recv(sock, response_body + total_read, body_len - total_read, 0);
-        if (r <= 0) break;
-        total_read += r;
-    }
-    response_body[total_read] = '\0';
+    _client_format_login(payload, sizeof(payload), MSG_LOGIN_REQ, username, password, device_id);
 
-    printf("API Response (%d): %s\n", ntohs(resp.status), response_body);
-    close(sock);
+    if (!_client_login_request(ctx, MSG_LOGIN_REQ, payload)) {
+        return 0;
+    }
 
-	return ntohs(resp.status) == 200;
+    // Keep the credentials so an expired session can be renewed transparently
+    strncpy(ctx->device_id, device_id, sizeof(ctx->device_id) - 1);
+    ctx->device_id[sizeof(ctx->device_id) - 1] = '\0';
+    _client_save_login(ctx, MSG_LOGIN_REQ, username, password);
+    return 1;
 }
 
 // Register probably needs context too now OR we pass host/port
@@ -275,55 +930,8 @@ int client_login(ClientContext *ctx, char *username, char *password, char *devic
 // BETTER: Update signature in core.h to `client_register_device(ClientContext *ctx, ...)`
 // But wait, user might call this before login?
 // `client_init` is called first. So `ctx` is available.
-int client_register_device(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-    int payload_len = strlen(json_payload);
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    // Set timeout
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        perror("API Connect failed");
-        return 0;
-    }
-
-    req.type = MSG_DEVICE_REQ;
-    req.len = htons(payload_len);
-    write(sock, &req, sizeof(req));
-    write(sock, json_payload, payload_len);
-
-    if (recv(sock, &resp, sizeof(resp), 0) <= 0) {
-        close(sock);
-        return 0;
-    }
-
-    int body_len = ntohs(resp.len);
-    if (body_len > BUFFER_SIZE) body_len = BUFFER_SIZE;
-    
-    int total_read = 0;
-    while(total_read < body_len) {
-        int r = recv(sock, response_buffer + total_read, body_len - total_read, 0);
-        if (r <= 0) break;
-        total_read += r;
-    }
-    response_buffer[total_read] = '\0';
-    close(sock);
-
-    return ntohs(resp.status) == 200;
+int client_register_device(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_DEVICE_REQ, json_payload, response);
 }
 
 void client_connect_notification(ClientContext *ctx, char *device_id) {
@@ -347,64 +955,26 @@ void client_connect_notification(ClientContext *ctx, char *device_id) {
 void client_close(ClientContext *ctx) {
     ctx->running = 0;
     if (ctx->notification_sock != -1) {
-        close(ctx->notification_sock);
+        proto_close(ctx->notification_sock);
     }
+    _client_mux_reset(ctx);
+    if (ctx->mux_reader_started) pthread_join(ctx->mux_reader, NULL);
+    if (ctx->tls) SSL_CTX_free(ctx->tls);
+    pthread_mutex_destroy(&ctx->session_lock);
+    pthread_mutex_destroy(&ctx->mux_lock);
+    pthread_mutex_destroy(&ctx->mux_write_lock);
+    pthread_cond_destroy(&ctx->mux_cond);
     free(ctx);
 }
 
 // Same here, needs ctx for config
-int client_get_online_users(ClientContext *ctx, char *json_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    // Set timeout
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        perror("API Connect failed");
-        return 0;
-    }
-
-    req.type = MSG_LIST_REQ;
-    req.len = 0; // No Payload
-    write(sock, &req, sizeof(req));
-
-    // Receive Response
-    if (recv(sock, &resp, sizeof(resp), 0) <= 0) {
-        close(sock);
-        return 0;
-    }
-
-    int body_len = ntohs(resp.len);
-    if (body_len > BUFFER_SIZE) body_len = BUFFER_SIZE;
-    
-    int total_read = 0;
-    while(total_read < body_len) {
-        int r = recv(sock, json_buffer + total_read, body_len - total_read, 0);
-        if (r <= 0) break;
-        total_read += r;
-    }
-    json_buffer[total_read] = '\0';
-    close(sock);
-
-    return ntohs(resp.status) == 200;
+int client_get_online_users(ClientContext *ctx, client_response_t *response) {
+    return client_api_request(ctx, MSG_LIST_REQ, NULL, response);
 }
 
 void client_send_message(ClientContext *ctx, char *message) {
     if (ctx->notification_sock != -1) {
-        send_packet(ctx->notification_sock, message, strlen(message));
+        send_message(ctx->notification_sock, MSG_SOCKET, message, strlen(message));
     }
 }
 
@@ -412,14 +982,16 @@ int client_send_and_wait(ClientContext *ctx, char *message, char *response_buffe
     if (ctx->notification_sock == -1) return 0;
     
     // Send
-    send_packet(ctx->notification_sock, message, strlen(message));
+    send_message(ctx->notification_sock, MSG_SOCKET, message, strlen(message));
     
     // Recv
     // WARNING: If listen_for_notifications thread is running, it might steal this packet!
-    int len = recv_packet(ctx->notification_sock, response_buffer);
-    if (len > 0) {
-        if (len >= buffer_size) response_buffer[buffer_size-1] = '\0';
-        else response_buffer[len] = '\0';
+    char packet[BUFFER_SIZE + 1];
+    int len = recv_packet(ctx->notification_sock, packet);
+    if (len > 0 && buffer_size > 0) {
+        if (len >= buffer_size) len = buffer_size - 1;
+        memcpy(response_buffer, packet, len);
+        response_buffer[len] = '\0';
         return 1;
     }
     return 0;
@@ -428,440 +1000,227 @@ int client_send_and_wait(ClientContext *ctx, char *message, char *response_buffe
 // --- Admin Functions ---
 
 int client_admin_login(ClientContext *ctx, char *username, char *password) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
     char payload[BUFFER_SIZE];
-    char response_body[BUFFER_SIZE];
-
-    sprintf(payload, "{\"username\": \"%s\", \"password\": \"%s\"}", username, password);
-    int payload_len = strlen(payload);
 
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
+    _client_format_login(payload, sizeof(payload), MSG_ADMIN_LOGIN_REQ, username, password, NULL);
 
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    req.type = MSG_ADMIN_LOGIN_REQ;
-    req.len = htons(payload_len);
-    write(sock, &req, sizeof(req));
-    write(sock, payload, payload_len);
-
-    if (recv(sock, &resp, sizeof(resp), 0) <= 0) {
-        close(sock);
+    if (!_client_login_request(ctx, MSG_ADMIN_LOGIN_REQ, payload)) {
         return 0;
     }
 
-    int body_len = ntohs(resp.len);
-    if (body_len > BUFFER_SIZE) body_len = BUFFER_SIZE;
-    
-    int total_read = 0;
-    while(total_read < body_len) {
-        int r = recv(sock, response_body + total_read, body_len - total_read, 0);
-        if (r <= 0) break;
-        total_read += r;
-    }
-    response_body[total_read] = '\0';
-
-    // printf("Admin API Response (%d): %s\n", ntohs(resp.status), response_body);
-    close(sock);
-
-	return ntohs(resp.status) == 200;
+    _client_save_login(ctx, MSG_ADMIN_LOGIN_REQ, username, password);
+    return 1;
 }
 
-int client_admin_get_logs(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    req.type = MSG_ADMIN_COMMAND_GETLOGS_REQ;
-    req.len = htons(strlen(json_payload));
-    
-    if (send(sock, &req, sizeof(req), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-    if (send(sock, json_payload, strlen(json_payload), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    if (recv(sock, &resp, sizeof(resp), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    if (resp.type != MSG_ADMIN_COMMAND_GETLOGS_RESP) {
-        close(sock);
-        return 0;
-    }
+int client_logout(ClientContext *ctx) {
+    // No re-login here: a 401 means the session is already gone
+    char *authed = _client_attach_token(ctx, NULL);
+    int status = authed ? _client_api_send(ctx, MSG_LOGOUT_REQ, authed, NULL) : 0;
+    free(authed);
 
-    int body_len = ntohs(resp.len);
-    if (body_len > BUFFER_SIZE) body_len = BUFFER_SIZE; // Safety cap
+    // Forget the session even if the server could not be reached
+    pthread_mutex_lock(&ctx->session_lock);
+    ctx->session_token[0] = '\0';
+    ctx->must_change_password = 0;
+    ctx->login_type = 0;
+    memset(ctx->login_password, 0, sizeof(ctx->login_password));
+    pthread_mutex_unlock(&ctx->session_lock);
 
-    int n = recv(sock, response_buffer, body_len, 0);
-    if (n >= 0) response_buffer[n] = '\0';
-    close(sock);
-    return ntohs(resp.status) == 200;
+    return status == 200;
 }
 
-int client_admin_view_logs(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
+int client_change_password(ClientContext *ctx, char *old_password, char *new_password, client_response_t *response) {
+    char payload[BUFFER_SIZE];
+    snprintf(payload, sizeof(payload), "{\"old_password\": \"%s\", \"new_password\": \"%s\"}", old_password, new_password);
 
-    req.type = MSG_ADMIN_GET_STORED_LOGS_REQ;
-    int p_len = (json_payload != NULL) ? strlen(json_payload) : 0;
-    req.len = htons(p_len);
-    
-    if (send(sock, &req, sizeof(req), 0) < 0) {
-        close(sock);
+    if (_client_api_call(ctx, MSG_CHANGE_PASSWORD_REQ, payload, response) != 200) {
         return 0;
     }
-    if (p_len > 0) {
-        if (send(sock, json_payload, p_len, 0) < 0) {
-            close(sock);
-            return 0;
-        }
-    }
 
-    if (recv(sock, &resp, sizeof(resp), 0) < 0) {
-        close(sock);
-        return 0;
-    }
+    // The session stays valid; re-logins from now on use the new password
+    pthread_mutex_lock(&ctx->session_lock);
+    ctx->must_change_password = 0;
+    snprintf(ctx->login_password, sizeof(ctx->login_password), "%s", new_password);
+    pthread_mutex_unlock(&ctx->session_lock);
+    return 1;
+}
 
-    // if (resp.type != MSG_ADMIN_GET_STORED_LOGS_RESP) return 0;
+int client_admin_get_logs(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_COMMAND_GETLOGS_REQ, json_payload, response) == 200;
+}
 
+int client_admin_view_logs(ClientContext *ctx, char *json_payload, client_response_t *response) {
     // Buffer might need to be large
-    int body_len = ntohs(resp.len);
-    int total_read = 0;
-    while(total_read < body_len) {
-        int r = recv(sock, response_buffer + total_read, body_len - total_read, 0);
-        if (r <= 0) break;
-        total_read += r;
-    }
-    response_buffer[total_read] = '\0';
-    
-    close(sock);
-    return ntohs(resp.status) == 200;
+    return client_api_request(ctx, MSG_ADMIN_GET_STORED_LOGS_REQ, json_payload, response);
 }
 
-int client_upload_logs(ClientContext *ctx, char *logs_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    req.type = MSG_CLIENT_COMMAND_GETLOG_REQ;
-    int p_len = strlen(logs_payload);
-    req.len = htons(p_len);
-    
-    send(sock, &req, sizeof(req), 0);
-    send(sock, logs_payload, p_len, 0);
-
+int client_upload_logs(ClientContext *ctx, char *logs_payload, client_response_t *response) {
     // Wait for Ack
-    recv(sock, &resp, sizeof(resp), 0);
-    int resp_len = ntohs(resp.len);
-    if (resp_len > BUFFER_SIZE) resp_len = BUFFER_SIZE;
-
-    int n = recv(sock, response_buffer, resp_len, 0);
-    if (n >= 0) response_buffer[n] = '\0';
-    
-    close(sock);
+    _client_api_call(ctx, MSG_CLIENT_COMMAND_GETLOG_REQ, logs_payload, response);
     return 1;
 }
 
-int client_admin_get_history(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
-
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
-
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
-
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    req.type = MSG_ADMIN_GET_COMMAND_HISTORY_REQ;
-    int p_len = (json_payload != NULL) ? strlen(json_payload) : 0;
-    req.len = htons(p_len);
-    
-    if (send(sock, &req, sizeof(req), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-    if (p_len > 0) {
-        if (send(sock, json_payload, p_len, 0) < 0) {
-            close(sock);
-            return 0;
-        }
-    }
-
-    if (recv(sock, &resp, sizeof(resp), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-
-    int len = ntohs(resp.len);
-    if (len > 0) {
-        int total_read = 0;
-        while (total_read < len) {
-            int r = recv(sock, response_buffer + total_read, len - total_read, 0);
-            if (r <= 0) break;
-            total_read += r;
-        }
-        response_buffer[len] = '\0';
-    } else {
-        response_buffer[0] = '\0';
-    }
-
-    close(sock);
-    return ntohs(resp.status) == 200;
+int client_report_command_status(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_CLIENT_COMMAND_STATUS_REQ, json_payload, response) == 200;
 }
 
-int client_get_firewall_config(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
-
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
+int client_admin_get_history(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_ADMIN_GET_COMMAND_HISTORY_REQ, json_payload, response);
+}
 
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
+int client_admin_cancel_command(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_CANCEL_COMMAND_REQ, json_payload, response) == 200;
+}
 
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+int client_admin_revoke_sessions(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_REVOKE_SESSION_REQ, json_payload, response) == 200;
+}
 
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
+int client_admin_create_enrollment_token(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_CREATE_ENROLLMENT_TOKEN_REQ, json_payload, response) == 200;
+}
 
-    req.type = MSG_CLIENT_GET_FIREWALL_CONFIG_REQ;
-    int p_len = (json_payload != NULL) ? strlen(json_payload) : 0;
-    req.len = htons(p_len);
-    
-    if (send(sock, &req, sizeof(req), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-    if (p_len > 0) {
-        if (send(sock, json_payload, p_len, 0) < 0) {
-            close(sock);
-            return 0;
-        }
-    }
+int client_admin_list_pending_devices(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_ADMIN_LIST_PENDING_DEVICES_REQ, json_payload, response);
+}
 
-    if (recv(sock, &resp, sizeof(resp), 0) < 0) {
-        close(sock);
-        return 0;
-    }
+int client_admin_approve_device(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_APPROVE_DEVICE_REQ, json_payload, response) == 200;
+}
 
-    int len = ntohs(resp.len);
-    if (len > 0) {
-        int total_read = 0;
-        while (total_read < len) {
-            int r = recv(sock, response_buffer + total_read, len - total_read, 0);
-            if (r <= 0) break;
-            total_read += r;
-        }
-        response_buffer[len] = '\0';
-    } else {
-        response_buffer[0] = '\0';
-    }
+int client_admin_reject_device(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_REJECT_DEVICE_REQ, json_payload, response) == 200;
+}
 
-    close(sock);
-    return ntohs(resp.status) == 200;
+int client_admin_retention_run(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_RETENTION_RUN_REQ, json_payload, response) == 200;
 }
 
-int client_admin_firewall_control(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    int sock;
-    struct sockaddr_in server;
-    struct timeval tv;
-    api_req_header_t req;
-    api_resp_header_t resp;
+int client_admin_backup_integrity(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_BACKUP_INTEGRITY_REQ, json_payload, response) == 200;
+}
 
-    sock = socket(AF_INET, SOCK_STREAM, 0);
-    if (sock == -1) return 0;
+int client_admin_stuck_transfers(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return _client_api_call(ctx, MSG_ADMIN_STUCK_TRANSFERS_REQ, json_payload, response) == 200;
+}
 
-    server.sin_addr.s_addr = inet_addr(ctx->server_host);
-    server.sin_family = AF_INET;
-    server.sin_port = htons(ctx->api_port);
+int client_get_firewall_config(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_CLIENT_GET_FIREWALL_CONFIG_REQ, json_payload, response);
+}
 
-    tv.tv_sec = 5;
-    tv.tv_usec = 0;
-    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+int client_admin_firewall_control(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    int status = _client_api_call(ctx, MSG_ADMIN_FIREWALL_CONTROL_REQ, json_payload, response);
+    printf("[DEBUG] Firewall Resp Status: %d\n", status);
+    return status == 200;
+}
 
-    if (connect(sock, (struct sockaddr *)&server, sizeof(server)) < 0) {
-        close(sock);
-        return 0;
-    }
+int client_file_sync(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_CLIENT_FILE_SYNC_REQ, json_payload, response);
+}
+int client_admin_get_file_tree(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_ADMIN_GET_FILE_TREE_REQ, json_payload, response);
+}
 
-    req.type = MSG_ADMIN_FIREWALL_CONTROL_REQ;
-    int p_len = (json_payload != NULL) ? strlen(json_payload) : 0;
-    req.len = htons(p_len);
-    
-    if (send(sock, &req, sizeof(req), 0) < 0) {
-        close(sock);
-        return 0;
-    }
-    if (p_len > 0) {
-        if (send(sock, json_payload, p_len, 0) < 0) {
-            close(sock);
-            return 0;
-        }
-    }
+int client_admin_restore(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_ADMIN_RESTORE_REQ, json_payload, response);
+}
 
-    if (recv(sock, &resp, sizeof(resp), 0) < 0) {
-        close(sock);
-        return 0;
-    }
+int client_backup_init(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_INIT_REQ, json_payload, response);
+}
 
-    printf("[DEBUG] Firewall Resp Status: %d\n", ntohs(resp.status));
+int client_backup_chunk(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_CHUNK_REQ, json_payload, response);
+}
 
-    int len = ntohs(resp.len);
-    if (len > 0) {
-        int total_read = 0;
-        while (total_read < len) {
-            int r = recv(sock, response_buffer + total_read, len - total_read, 0);
-            if (r <= 0) break;
-            total_read += r;
-        }
-        response_buffer[len] = '\0';
-    } else {
-        response_buffer[0] = '\0';
-    }
+int client_backup_chunk_data(ClientContext *ctx, char *header_json, const void *data, uint32_t data_len, client_response_t *response) {
+    char *body;
+    uint32_t body_len;
 
-    close(sock);
-    return ntohs(resp.status) == 200;
+    if (response) memset(response, 0, sizeof(*response));
+    int status = _client_chunk_call(ctx, MSG_BACKUP_CHUNK_DATA_REQ, header_json, data, data_len, &body, &body_len);
+    if (status == 0) return 0;
+    _client_take_response(body, body_len, status, response);
+    return status == 200;
 }
 
-int client_file_sync(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_CLIENT_FILE_SYNC_REQ, json_payload, response_buffer);
-}
-int client_admin_get_file_tree(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_ADMIN_GET_FILE_TREE_REQ, json_payload, response_buffer);
+int client_backup_chunk_query(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_CHUNK_QUERY_REQ, json_payload, response);
 }
 
-int client_admin_restore(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_ADMIN_RESTORE_REQ, json_payload, response_buffer);
-}
+int client_backup_chunk_put(ClientContext *ctx, char *header_json, const void *data, uint32_t data_len, client_response_t *response) {
+    char *body;
+    uint32_t body_len;
 
-int client_backup_init(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_BACKUP_INIT_REQ, json_payload, response_buffer);
+    if (response) memset(response, 0, sizeof(*response));
+    int status = _client_chunk_call(ctx, MSG_BACKUP_CHUNK_PUT_REQ, header_json, data, data_len, &body, &body_len);
+    if (status == 0) return 0;
+    _client_take_response(body, body_len, status, response);
+    return status == 200;
 }
 
-int client_backup_chunk(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_BACKUP_CHUNK_REQ, json_payload, response_buffer);
+int client_backup_finish(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_FINISH_REQ, json_payload, response);
 }
 
-int client_backup_finish(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_BACKUP_FINISH_REQ, json_payload, response_buffer);
+int client_backup_cancel(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_CANCEL_REQ, json_payload, response);
 }
 
-int client_backup_cancel(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_BACKUP_CANCEL_REQ, json_payload, response_buffer);
+int client_backup_resume(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_BACKUP_RESUME_REQ, json_payload, response);
 }
 
-int client_backup_resume(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_BACKUP_RESUME_REQ, json_payload, response_buffer);
+int client_restore_init(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_RESTORE_INIT_REQ, json_payload, response);
 }
 
-int client_restore_init(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_RESTORE_INIT_REQ, json_payload, response_buffer);
+int client_restore_chunk(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_RESTORE_CHUNK_REQ, json_payload, response);
 }
 
-int client_restore_chunk(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_RESTORE_CHUNK_REQ, json_payload, response_buffer);
+int client_restore_chunk_data(ClientContext *ctx, char *json_payload, client_response_t *header, void *data, uint32_t data_size, uint32_t *data_len) {
+    char *body;
+    uint32_t body_len;
+    char frame_header[CHUNK_FRAME_MAX_HEADER + 1];
+    char error[128];
+    const char *chunk;
+    uint32_t chunk_len;
+
+    *data_len = 0;
+    memset(header, 0, sizeof(*header));
+    int status = _client_chunk_call(ctx, MSG_RESTORE_CHUNK_DATA_REQ, json_payload, NULL, 0, &body, &body_len);
+    if (status == 0) return 0;
+    if (status != 200) {
+        // Errors are plain envelopes, not frames
+        _client_take_response(body, body_len, status, header);
+        return 0;
+    }
+
+    if (!body || chunk_frame_parse(body, body_len, frame_header, sizeof(frame_header), &chunk, &chunk_len) != 0) {
+        snprintf(error, sizeof(error), "{\"error\":\"Invalid chunk frame\"}");
+        _client_set_response(header, status, error, (uint32_t)strlen(error));
+        free(body);
+        return 0;
+    }
+    if (chunk_len > data_size) {
+        snprintf(error, sizeof(error), "{\"error\":\"Chunk of %u bytes exceeds the buffer\"}", chunk_len);
+        _client_set_response(header, status, error, (uint32_t)strlen(error));
+        free(body);
+        return 0;
+    }
+
+    _client_set_response(header, status, frame_header, (uint32_t)strlen(frame_header));
+    memcpy(data, chunk, chunk_len);
+    *data_len = chunk_len;
+    free(body);
+    return 1;
 }
 
-int client_restore_finish(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_RESTORE_FINISH_REQ, json_payload, response_buffer);
+int client_restore_finish(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_RESTORE_FINISH_REQ, json_payload, response);
 }
 
-int client_restore_resume(ClientContext *ctx, char *json_payload, char *response_buffer) {
-    return client_api_request(ctx, MSG_RESTORE_RESUME_REQ, json_payload, response_buffer);
+int client_restore_resume(ClientContext *ctx, char *json_payload, client_response_t *response) {
+    return client_api_request(ctx, MSG_RESTORE_RESUME_REQ, json_payload, response);
 }
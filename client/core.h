@@ -13,25 +13,92 @@ typedef struct {
     int server_port;
     int api_port;
     char device_id[256];
+    uint32_t max_message_size; // Largest notification accepted from the server
+    int heartbeat_interval;    // Ping the server after this many idle seconds
+    int heartbeat_timeout;     // Reconnect if the server is silent this long
+    int busy_backoff;          // Seconds to wait after MSG_BUSY (grows while busy)
+    char agent_info[BUFFER_SIZE]; // Extra MSG_HELLO fields (client_set_agent_info), JSON object
+    int server_protocol;       // From the server's greeting; 1 = server predates MSG_HELLO
+    // TLS (NULL = plain TCP)
+    SSL_CTX *tls;
+    char server_name[256]; // Expected server certificate name (optional)
+    // Session (set by client_login / client_admin_login)
+    char session_token[256];
+    int must_change_password;       // Server only accepts client_change_password until this is cleared
+    uint8_t login_type;             // MSG_LOGIN_REQ or MSG_ADMIN_LOGIN_REQ, 0 = not logged in
+    char login_username[128];       // Kept to log in again when the token expires
+    char login_password[128];
+    pthread_mutex_t session_lock;
+    // Persistent multiplexed API connection (client_set_persistent_api)
+    int api_persistent;
+    int mux_sock;                     // -1 until the first request connects
+    uint32_t mux_next_id;
+    struct mux_pending *mux_pending;  // Requests waiting for their response
+    pthread_t mux_reader;
+    int mux_reader_started;           // mux_reader must be joined
+    pthread_mutex_t mux_lock;         // Guards the fields above
+    pthread_mutex_t mux_write_lock;   // One request frame at a time (reads need no lock)
+    pthread_cond_t mux_cond;          // A response arrived or the connection dropped
 } ClientContext;
 
+// An API response on the heap. body is the unwrapped response (the
+// envelope's data, or {"error": ..., "code": ...}), NUL-terminated; len
+// excludes the NUL. body is NULL and status 0 when no response arrived.
+// Release with client_free_response. Functions taking a response accept
+// NULL to ignore it (except client_restore_chunk_data).
+typedef struct {
+    char *body;
+    uint32_t len;
+    int status;
+} client_response_t;
+
+void client_free_response(client_response_t *response);
+
 // Initialize Client Context
 ClientContext* client_init(char *host, int port, int api_port);
 
+// Enable TLS for all connections. cert_file/key_file may be empty before
+// the device has been issued a certificate. Returns 1 on success.
+int client_enable_tls(ClientContext *ctx, char *ca_file, char *cert_file, char *key_file, char *server_name);
+
+// Limit the size of a single notification (0 = default). A larger message
+// drops the connection, which is then re-established.
+void client_set_max_message_size(ClientContext *ctx, uint32_t max_size);
+
+// Heartbeat on the notification channel, in seconds (0 = default 30 / 90)
+void client_set_heartbeat(ClientContext *ctx, int interval, int timeout);
+
+// Send API requests over one long-lived connection instead of a connection
+// per request. Requests from several threads share it and may complete in
+// any order; it is reopened on the next request if it drops.
+void client_set_persistent_api(ClientContext *ctx, int enable);
+
+// Fields added to the MSG_HELLO greeting, as a JSON object, e.g.
+// {"agent_version": "1.6.0", "commands": [114], "capabilities": [...]}.
+// device_id and protocol are filled in. Call before client_connect_notification.
+void client_set_agent_info(ClientContext *ctx, const char *agent_info);
+
 // Login via API (Blocking, returns 1 on success, 0 on fail)
 int client_login(ClientContext *ctx, char *username, char *password, char *device_id);
-int client_register_device(ClientContext *ctx, char *json_payload, char *response_buffer);
+int client_register_device(ClientContext *ctx, char *json_payload, client_response_t *response);
 // Connect to Notification Socket and start listener
 void client_connect_notification(ClientContext *ctx, char *device_id);
 
 // Admin Login (No device id required)
 int client_admin_login(ClientContext *ctx, char *username, char *password);
 
+// Revoke the current session on the server and forget it locally
+int client_logout(ClientContext *ctx);
+
+// Change the password of the logged-in user (required when must_change_password is set)
+int client_change_password(ClientContext *ctx, char *old_password, char *new_password, client_response_t *response);
+
 // Stop Client
 void client_close(ClientContext *ctx);
 
-// Get list of online users via API (Returns 1 on success, stores JSON in buffer)
-int client_get_online_users(ClientContext *ctx, char *json_buffer);
+// Get list of online users (and their devices' agent versions) via API.
+// Returns 1 on success.
+int client_get_online_users(ClientContext *ctx, client_response_t *response);
 
 // --- CGo Helpers ---
 
@@ -41,33 +108,60 @@ void client_set_on_message(ClientContext *ctx, MessageCallback cb);
 // Send a simple message to Notification Server (Async, no wait for response)
 void client_send_message(ClientContext *ctx, char *message);
 
-// Send a message and wait for response on the same socket (Blocking)
+// Send a message and wait for response on the same socket (Blocking). The
+// response is truncated to buffer_size bytes including the NUL.
 // WARNING: This may conflict if background listener is running!
 int client_send_and_wait(ClientContext *ctx, char *message, char *response_buffer, int buffer_size);
 
-int client_admin_get_logs(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_admin_view_logs(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_admin_get_history(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_upload_logs(ClientContext *ctx, char *logs_payload, char *response_buffer);
-int client_get_firewall_config(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_admin_firewall_control(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_file_sync(ClientContext *ctx, char *json_payload, char *response_buffer);
+int client_admin_get_logs(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_view_logs(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_get_history(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_cancel_command(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_revoke_sessions(ClientContext *ctx, char *json_payload, client_response_t *response);
+
+// Device enrollment (admin)
+int client_admin_create_enrollment_token(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_list_pending_devices(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_approve_device(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_reject_device(ClientContext *ctx, char *json_payload, client_response_t *response);
+// Prune old backup versions now: {"device_id" (optional, all devices), "dry_run"}
+int client_admin_retention_run(ClientContext *ctx, char *json_payload, client_response_t *response);
+// Snapshots with missing or corrupted data: {"device_id" (optional), "scrub" (start a re-check)}
+int client_admin_backup_integrity(ClientContext *ctx, char *json_payload, client_response_t *response);
+// Uploads and restores with no recent activity: {"idle_minutes" (optional)}
+int client_admin_stuck_transfers(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_upload_logs(ClientContext *ctx, char *logs_payload, client_response_t *response);
+// Report progress/result of a server command: {"device_id","cmd_id","status","result","error"}
+int client_report_command_status(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_get_firewall_config(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_firewall_control(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_file_sync(ClientContext *ctx, char *json_payload, client_response_t *response);
 
 // Browse persistent directory tree on server
-int client_admin_get_file_tree(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_admin_restore(ClientContext *ctx, char *json_payload, char *response_buffer);
+int client_admin_get_file_tree(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_admin_restore(ClientContext *ctx, char *json_payload, client_response_t *response);
 
 // Backup operations
-int client_backup_init(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_backup_chunk(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_backup_finish(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_backup_cancel(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_backup_resume(ClientContext *ctx, char *json_payload, char *response_buffer);
+int client_backup_init(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_backup_chunk(ClientContext *ctx, char *json_payload, client_response_t *response);
+// Send a chunk as a binary frame. header_json names it (transfer_id, offset,
+// data_len, sha256); the data follows raw.
+int client_backup_chunk_data(ClientContext *ctx, char *header_json, const void *data, uint32_t data_len, client_response_t *response);
+// Deduplicated backup: which chunk hashes the server lacks, and store one
+// chunk (header_json: transfer_id, data_len, sha256) as a binary frame.
+int client_backup_chunk_query(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_backup_chunk_put(ClientContext *ctx, char *header_json, const void *data, uint32_t data_len, client_response_t *response);
+int client_backup_finish(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_backup_cancel(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_backup_resume(ClientContext *ctx, char *json_payload, client_response_t *response);
 
 // Restore functions
-int client_restore_init(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_restore_chunk(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_restore_finish(ClientContext *ctx, char *json_payload, char *response_buffer);
-int client_restore_resume(ClientContext *ctx, char *json_payload, char *response_buffer);
+int client_restore_init(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_restore_chunk(ClientContext *ctx, char *json_payload, client_response_t *response);
+// Fetch a chunk as a binary frame. The chunk header (data_len, sha256) or the
+// error goes to header; up to data_size bytes to data.
+int client_restore_chunk_data(ClientContext *ctx, char *json_payload, client_response_t *header, void *data, uint32_t data_size, uint32_t *data_len);
+int client_restore_finish(ClientContext *ctx, char *json_payload, client_response_t *response);
+int client_restore_resume(ClientContext *ctx, char *json_payload, client_response_t *response);
 
 #endif
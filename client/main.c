@@ -41,12 +41,13 @@ int main() {
         }
 
         if (choice == 1) {
-           char list_json[1024];
-           if (client_get_online_users(ctx, list_json)) {
-                printf("Online Users: %s\n", list_json);
+           client_response_t list;
+           if (client_get_online_users(ctx, &list)) {
+                printf("Online Users: %s\n", list.body);
            } else {
                 printf("Failed to get list.\n");
            }
+           client_free_response(&list);
         } else if (choice == 2) {
             break;
         } else {
@@ -0,0 +1,20 @@
+// Package clientcore holds Go helpers over the C client core that are
+// shared by the agent and the admin console.
+package clientcore
+
+/*
+#cgo CFLAGS: -I../../
+#include "../../client/core.h"
+*/
+import "C"
+
+import "unsafe"
+
+// TakeResponse copies an API response into Go memory and frees it. resp
+// must point at a client_response_t; cgo types are per package, so callers
+// pass it as unsafe.Pointer.
+func TakeResponse(resp unsafe.Pointer) string {
+	r := (*C.client_response_t)(resp)
+	defer C.client_free_response(r)
+	return C.GoStringN(r.body, C.int(r.len))
+}
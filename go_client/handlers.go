@@ -0,0 +1,127 @@
+package main
+
+/*
+#include <stdlib.h>
+#include "../client/core.h"
+#include "../protocol/protocol.h"
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"demo/network/go_client/clientcore"
+	"demo/network/go_client/internal/backup"
+	"demo/network/go_client/internal/command"
+	"demo/network/go_client/internal/config"
+	"demo/network/go_client/internal/firewall"
+	"demo/network/go_client/internal/logger"
+)
+
+// Payloads of the commands the server pushes on the notification channel
+type getLogsCmd struct {
+	LineCount int `json:"line_count"`
+}
+
+type restoreCmd struct {
+	FileUUID string `json:"file_uuid"`
+	Version  int    `json:"version"`
+}
+
+type firewallUpdateCmd struct{}
+
+// registerCommandHandlers maps server command types to their handlers.
+// A new remote command only needs an entry here.
+func registerCommandHandlers() {
+	command.Register(C.MSG_SERVER_COMMAND_GETLOG, "GET_LOGS", handleGetLogs)
+	command.Register(C.MSG_SERVER_RESTORE_CMD, "RESTORE", handleRestore)
+	command.Register(C.MSG_SERVER_FIREWALL_UPDATE_CMD, "FIREWALL_UPDATE", handleFirewallUpdate)
+}
+
+func handleGetLogs(cmdID uint, req getLogsCmd) (string, error) {
+	lineCount := req.LineCount
+	if lineCount <= 0 {
+		lineCount = 50 // Default
+	}
+
+	lines, err := logger.Tail(lineCount)
+	if err != nil {
+		return "", fmt.Errorf("error reading logs: %v", err)
+	}
+	content := strings.Join(lines, "\n")
+
+	// Older servers (no cmd_id) expect the logs as a plain upload
+	if cmdID == 0 {
+		uploadLogs(content)
+	}
+	return content, nil
+}
+
+func uploadLogs(content string) {
+	devCfg, _ := config.LoadDeviceConfig()
+	payloadMap := map[string]string{
+		"device_id": devCfg.DeviceID,
+		"content":   content,
+	}
+	jsonBytes, _ := json.Marshal(payloadMap)
+
+	cLogs := C.CString(string(jsonBytes))
+	var resp C.client_response_t
+	C.client_upload_logs(GlobalClientCtx, cLogs, &resp)
+	C.free(unsafe.Pointer(cLogs))
+
+	fmt.Printf("[Auto] Upload Response: %s\n", clientcore.TakeResponse(unsafe.Pointer(&resp)))
+}
+
+func handleRestore(cmdID uint, req restoreCmd) (string, error) {
+	if req.FileUUID == "" {
+		return "", fmt.Errorf("file_uuid required")
+	}
+	backup.QueueRestore(req.FileUUID, req.Version, cmdID)
+	return "", command.ErrDeferred
+}
+
+func handleFirewallUpdate(cmdID uint, req firewallUpdateCmd) (string, error) {
+	devCfg, _ := config.LoadDeviceConfig()
+	if devCfg.DeviceID == "" {
+		return "", fmt.Errorf("no device id")
+	}
+
+	payload := fmt.Sprintf(`{"device_id": "%s"}`, devCfg.DeviceID)
+	cPayload := C.CString(payload)
+	var resp C.client_response_t
+
+	fmt.Println("[Firewall] Fetching new config...")
+	res := C.client_get_firewall_config(GlobalClientCtx, cPayload, &resp)
+	C.free(unsafe.Pointer(cPayload))
+	respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
+	if res != 1 {
+		return "", fmt.Errorf("failed to fetch firewall config")
+	}
+
+	fmt.Printf("[Firewall] Config Received: %s\n", respStr)
+
+	var fwResp struct {
+		Enabled bool     `json:"enabled"`
+		Domains []string `json:"domains"`
+	}
+	if err := json.Unmarshal([]byte(respStr), &fwResp); err != nil {
+		return "", fmt.Errorf("failed to parse config: %v", err)
+	}
+
+	// Update Global State, then apply to hosts
+	config.UpdateFirewallConfig(fwResp.Enabled, fwResp.Domains)
+	hm := firewall.GetHostsManager()
+	if fwResp.Enabled {
+		hm.SetDomains(fwResp.Domains)
+		hm.SetEnabled(true)
+		fmt.Printf("[Firewall] Applied: Enabled (%d domains)\n", len(fwResp.Domains))
+	} else {
+		hm.SetEnabled(false)
+		fmt.Println("[Firewall] Applied: Disabled")
+	}
+	return fmt.Sprintf("enabled=%v domains=%d", fwResp.Enabled, len(fwResp.Domains)), nil
+}
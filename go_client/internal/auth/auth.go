@@ -1,11 +1,14 @@
 package auth
 
 type Credentials struct {
-	Username  string `json:"username"`
-	DeviceID  string `json:"device_id"`
-	Name      string `json:"name,omitempty"`
-	OSName    string `json:"os_name,omitempty"`
-	OSVersion string `json:"os_version,omitempty"`
-	Hostname  string `json:"hostname,omitempty"`
-	Arch      string `json:"arch,omitempty"`
+	Username        string `json:"username"`
+	Password        string `json:"password,omitempty"`
+	EnrollmentToken string `json:"enrollment_token,omitempty"`
+	DeviceID        string `json:"device_id"`
+	Name            string `json:"name,omitempty"`
+	OSName          string `json:"os_name,omitempty"`
+	OSVersion       string `json:"os_version,omitempty"`
+	Hostname        string `json:"hostname,omitempty"`
+	Arch            string `json:"arch,omitempty"`
+	CSR             string `json:"csr,omitempty"`
 }
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"io"
+)
+
+// Content-defined chunking: a cut is made where a rolling hash of the last
+// bytes matches a mask, so an insert or delete only changes the chunks
+// around it and the rest of the file still deduplicates against earlier
+// versions. This is the gear hash of FastCDC with normalized chunking: a
+// stricter mask before the average size, a looser one after it.
+const (
+	minChunkSize = 256 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 4 * 1024 * 1024 // Below the server's MaxChunkSize
+
+	maskSmall = (1 << 22) - 1 // Two bits more than log2(avgChunkSize)
+	maskLarge = (1 << 18) - 1 // Two bits fewer
+)
+
+// gear maps each byte to a random 64-bit value. It is fixed (splitmix64 from
+// a constant seed) so every agent cuts the same content the same way.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x2545F4914F6CDD1D)
+	for i := range gear {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// cutPoint returns the length of the chunk at the start of data. data holds
+// at least maxChunkSize bytes unless it is the end of the file.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if normal > n {
+		normal = n
+	}
+
+	var h uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker splits a stream into content-defined chunks.
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int // Next chunk begins here
+	end   int // Valid bytes in buf
+	eof   bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*maxChunkSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The slice is
+// only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && !c.eof {
+		// Keep the unread bytes and top up the buffer
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
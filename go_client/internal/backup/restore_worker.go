@@ -4,12 +4,16 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
 
+	"demo/network/go_client/clientcore"
+	"demo/network/go_client/internal/command"
 	"demo/network/go_client/internal/config"
 	dbpkg "demo/network/go_client/internal/db"
 	"demo/network/go_client/internal/logger"
@@ -26,12 +30,14 @@ type RestoreJob struct {
 	FileUUID   string
 	Version    int
 	TransferID string // Optional, for Resume
+	CmdID      uint   // Server command that asked for it (0 if unknown)
 }
 
 type RestoreWorker struct {
-	ticker     *time.Ticker
-	stop       chan bool
-	numWorkers int
+	ticker      *time.Ticker
+	stop        chan bool
+	numWorkers  int
+	expireAfter time.Duration
 }
 
 var (
@@ -40,11 +46,17 @@ var (
 	restoreOnce    sync.Once
 )
 
-func NewRestoreWorker(numWorkers int) *RestoreWorker {
+// NewRestoreWorker runs numWorkers restores at a time. Interrupted restores
+// are resumed unless they made no progress for expireAfter (0 = 24 hours).
+func NewRestoreWorker(numWorkers int, expireAfter time.Duration) *RestoreWorker {
+	if expireAfter <= 0 {
+		expireAfter = 24 * time.Hour
+	}
 	return &RestoreWorker{
-		ticker:     time.NewTicker(30 * time.Second),
-		stop:       make(chan bool),
-		numWorkers: numWorkers,
+		ticker:      time.NewTicker(30 * time.Second),
+		stop:        make(chan bool),
+		numWorkers:  numWorkers,
+		expireAfter: expireAfter,
 	}
 }
 
@@ -57,12 +69,12 @@ func (w *RestoreWorker) Start() {
 
 		go func() {
 			// Initial recovery
-			RestoreRecovery()
+			RestoreRecovery(w.expireAfter)
 
 			for {
 				select {
 				case <-w.ticker.C:
-					RestoreRecovery()
+					RestoreRecovery(w.expireAfter)
 				case <-w.stop:
 					return
 				}
@@ -75,7 +87,9 @@ func (w *RestoreWorker) Stop() {
 	w.stop <- true
 }
 
-func RestoreRecovery() {
+// RestoreRecovery queues the interrupted restores again, and gives up on
+// those with no progress for expireAfter.
+func RestoreRecovery(expireAfter time.Duration) {
 	db := dbpkg.Get()
 	if db == nil {
 		return
@@ -89,29 +103,31 @@ func RestoreRecovery() {
 				continue
 			}
 
+			if idle := time.Since(s.UpdatedAt); idle > expireAfter {
+				err := fmt.Errorf("restore expired after %s without progress", idle.Round(time.Minute))
+				dropRestore(&s, err)
+				command.Finish(s.CmdID, "", err)
+				continue
+			}
+
 			logger.Infof("[Restore] Recovering/Queuing interrupted session: %s", s.TransferID)
 			restoreQueue <- RestoreJob{
 				FileUUID:   s.FileUUID,
 				Version:    s.Version,
 				TransferID: s.TransferID,
+				CmdID:      s.CmdID,
 			}
 		}
 	}
 }
 
-func HandleRestoreCmd(payload string) {
-	var req struct {
-		FileUUID string `json:"file_uuid"`
-		Version  int    `json:"version"`
-	}
-	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		logger.Errorf("[Restore] Invalid Payload: %v", err)
-		return
-	}
-
+// QueueRestore schedules a restore asked for by the server. The outcome is
+// reported on cmdID once a worker has finished.
+func QueueRestore(fileUUID string, version int, cmdID uint) {
 	restoreQueue <- RestoreJob{
-		FileUUID: req.FileUUID,
-		Version:  req.Version,
+		FileUUID: fileUUID,
+		Version:  version,
+		CmdID:    cmdID,
 	}
 }
 
@@ -119,17 +135,20 @@ func restoreWorkerLoop() {
 	for job := range restoreQueue {
 		// Verify if we should process it
 		if _, loaded := activeRestores.LoadOrStore(job.FileUUID, true); loaded {
+			command.Finish(job.CmdID, "", fmt.Errorf("restore of %s already in progress", job.FileUUID))
 			continue // Already being restored
 		}
-		performRestore(job)
+		destPath, err := performRestore(job)
+		command.Finish(job.CmdID, destPath, err)
 		activeRestores.Delete(job.FileUUID)
 	}
 }
 
-func performRestore(job RestoreJob) {
+// performRestore downloads the file and returns where it was written.
+func performRestore(job RestoreJob) (string, error) {
 	devCfg, _ := config.LoadDeviceConfig()
 	if devCfg == nil || devCfg.DeviceID == "" || clientCtx == nil {
-		return
+		return "", fmt.Errorf("client not ready")
 	}
 
 	var session dbpkg.LocalRestoreSession
@@ -145,28 +164,38 @@ func performRestore(job RestoreJob) {
 		Status     string `json:"status"`
 	}
 
-	var respBuf [4096]C.char
+	var resp C.client_response_t
 	if job.TransferID != "" {
 		// RESUME
 		logger.Infof("[Restore] Resuming session %s", job.TransferID)
 		if db != nil {
 			if err := db.Where("transfer_id = ?", job.TransferID).First(&session).Error; err != nil {
 				logger.Errorf("[Restore] Session not found in DB: %s", job.TransferID)
-				return
+				return "", fmt.Errorf("restore session %s not found", job.TransferID)
 			}
 		}
 
 		resumePayload := map[string]interface{}{"transfer_id": job.TransferID}
 		jResume, _ := json.Marshal(resumePayload)
 		cResume := C.CString(string(jResume))
-		res := C.client_restore_resume(clientCtx, cResume, &respBuf[0])
+		res := C.client_restore_resume(clientCtx, cResume, &resp)
 		C.free(unsafe.Pointer(cResume))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 		if res == 0 {
+			var apiErr struct {
+				Code string `json:"code"`
+			}
+			if json.Unmarshal([]byte(respStr), &apiErr) == nil && apiErr.Code == "NOT_FOUND" {
+				// Expired or finished on the server: the .part can never complete
+				err := fmt.Errorf("restore %s is no longer active on the server", job.TransferID)
+				dropRestore(&session, err)
+				return "", err
+			}
 			logger.Errorf("[Restore] Resume Failed on Server for %s", job.TransferID)
-			return
+			return "", fmt.Errorf("resume failed on server")
 		}
-		json.Unmarshal([]byte(C.GoString(&respBuf[0])), &initResp)
+		json.Unmarshal([]byte(respStr), &initResp)
 	} else {
 		// NEW INIT
 		initPayload := map[string]interface{}{
@@ -176,18 +205,19 @@ func performRestore(job RestoreJob) {
 		}
 		jInit, _ := json.Marshal(initPayload)
 		cInit := C.CString(string(jInit))
-		res := C.client_restore_init(clientCtx, cInit, &respBuf[0])
+		res := C.client_restore_init(clientCtx, cInit, &resp)
 		C.free(unsafe.Pointer(cInit))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 		if res == 0 {
-			logger.Errorf("[Restore] Init Failed: %s", C.GoString(&respBuf[0]))
-			return
+			logger.Errorf("[Restore] Init Failed: %s", respStr)
+			return "", fmt.Errorf("init failed: %s", respStr)
 		}
-		json.Unmarshal([]byte(C.GoString(&respBuf[0])), &initResp)
+		json.Unmarshal([]byte(respStr), &initResp)
 
 		if initResp.Status != "ok" {
 			logger.Errorf("[Restore] Init Status: %s", initResp.Status)
-			return
+			return "", fmt.Errorf("init status: %s", initResp.Status)
 		}
 
 		// Determine Local Path
@@ -215,6 +245,7 @@ func performRestore(job RestoreJob) {
 			TotalSize:     initResp.TotalSize,
 			FileHash:      initResp.FileHash,
 			Status:        "IN_PROGRESS",
+			CmdID:         job.CmdID,
 			UpdatedAt:     time.Now(),
 		}
 		if db != nil {
@@ -228,7 +259,7 @@ func performRestore(job RestoreJob) {
 	file, err := os.OpenFile(session.LocalPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		logger.Errorf("[Restore] File Open Error: %v", err)
-		return
+		return "", err
 	}
 	defer file.Close()
 
@@ -256,6 +287,9 @@ func performRestore(job RestoreJob) {
 		existingFile.Close()
 	}
 
+	// One chunk buffer for the whole restore; the C client copies each
+	// chunk's bytes straight into it
+	chunkBuf := make([]byte, chunkSize)
 	for session.CurrentOffset < session.TotalSize {
 		toRead := int(session.TotalSize - session.CurrentOffset)
 		if toRead > chunkSize {
@@ -270,28 +304,32 @@ func performRestore(job RestoreJob) {
 		jChunk, _ := json.Marshal(chunkReq)
 		cChunk := C.CString(string(jChunk))
 
-		chunkRespBuf := make([]byte, 64*1024*1024)
-		res := C.client_restore_chunk(clientCtx, cChunk, (*C.char)(unsafe.Pointer(&chunkRespBuf[0])))
+		var dataLen C.uint32_t
+		res := C.client_restore_chunk_data(clientCtx, cChunk, &resp, unsafe.Pointer(&chunkBuf[0]), C.uint32_t(len(chunkBuf)), &dataLen)
 		C.free(unsafe.Pointer(cChunk))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 		if res == 0 {
-			logger.Errorf("[Restore] Chunk Pull Failed at %d", session.CurrentOffset)
-			return
+			logger.Errorf("[Restore] Chunk Pull Failed at %d: %s", session.CurrentOffset, respStr)
+			return "", fmt.Errorf("chunk pull failed at offset %d", session.CurrentOffset)
 		}
 
-		respStr := C.GoString((*C.char)(unsafe.Pointer(&chunkRespBuf[0])))
 		var chunkResp struct {
-			Data   string `json:"data"`
-			Status string `json:"status"`
+			DataLen int64  `json:"data_len"`
+			SHA256  string `json:"sha256"`
 		}
 		json.Unmarshal([]byte(respStr), &chunkResp)
 
-		if chunkResp.Status != "ok" {
-			logger.Errorf("[Restore] Chunk Status: %s at %d", chunkResp.Status, session.CurrentOffset)
-			return
+		data := chunkBuf[:dataLen]
+		chunkSum := sha256.Sum256(data)
+		if int64(len(data)) != chunkResp.DataLen || hex.EncodeToString(chunkSum[:]) != chunkResp.SHA256 {
+			logger.Errorf("[Restore] Chunk Checksum Mismatch at %d", session.CurrentOffset)
+			return "", fmt.Errorf("chunk checksum mismatch at offset %d", session.CurrentOffset)
+		}
+		if len(data) == 0 {
+			return "", fmt.Errorf("snapshot ended early at offset %d", session.CurrentOffset)
 		}
 
-		data, _ := hex.DecodeString(chunkResp.Data)
 		file.Write(data)
 		hash.Write(data)
 		session.CurrentOffset += int64(len(data))
@@ -306,8 +344,7 @@ func performRestore(job RestoreJob) {
 	finishReq := map[string]interface{}{"transfer_id": session.TransferID}
 	jFinish, _ := json.Marshal(finishReq)
 	cFinish := C.CString(string(jFinish))
-	var finishResp [1024]C.char
-	C.client_restore_finish(clientCtx, cFinish, &finishResp[0])
+	C.client_restore_finish(clientCtx, cFinish, nil)
 	C.free(unsafe.Pointer(cFinish))
 
 	file.Close()
@@ -315,24 +352,38 @@ func performRestore(job RestoreJob) {
 	finalHash := hex.EncodeToString(hash.Sum(nil))
 	if finalHash != session.FileHash {
 		logger.Errorf("[Restore] Hash Mismatch! Expected %s, got %s", session.FileHash, finalHash)
-		// We don't delete on mismatch if we want to resume, but here it's finished.
-		// Maybe mark as failed?
-		session.Status = "FAILED"
-		if db != nil {
-			db.Save(&session)
-		}
-	} else {
-		// Success: Move .part to final
-		destPath := session.LocalPath[:len(session.LocalPath)-5] // Strip .part
-		os.Remove(destPath)
-		if err := os.Rename(session.LocalPath, destPath); err != nil {
-			logger.Errorf("[Restore] Rename Failed: %v", err)
-		} else {
-			logger.Infof("[Restore] Successfully restored to %s", destPath)
-			session.Status = "DONE"
-			if db != nil {
-				db.Save(&session)
-			}
+		err := fmt.Errorf("hash mismatch: expected %s, got %s", session.FileHash, finalHash)
+		dropRestore(&session, err)
+		return "", err
+	}
+
+	// Success: Move .part to final
+	destPath := session.LocalPath[:len(session.LocalPath)-5] // Strip .part
+	os.Remove(destPath)
+	if err := os.Rename(session.LocalPath, destPath); err != nil {
+		logger.Errorf("[Restore] Rename Failed: %v", err)
+		return "", err
+	}
+	logger.Infof("[Restore] Successfully restored to %s", destPath)
+	session.Status = "DONE"
+	if db != nil {
+		db.Save(&session)
+	}
+	return destPath, nil
+}
+
+// dropRestore gives up on a restore: the session is marked FAILED and its
+// partial download removed. The caller reports the command.
+func dropRestore(session *dbpkg.LocalRestoreSession, reason error) {
+	logger.Errorf("[Restore] Giving up on %s: %v", session.TransferID, reason)
+	// Only ever the .part file, never a file the restore would replace
+	if strings.HasSuffix(session.LocalPath, ".part") {
+		if err := os.Remove(session.LocalPath); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("[Restore] Failed to remove %s: %v", session.LocalPath, err)
 		}
 	}
+	session.Status = "FAILED"
+	if db := dbpkg.Get(); db != nil && session.TransferID != "" {
+		db.Save(session)
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"time"
 	"unsafe"
 
+	"demo/network/go_client/clientcore"
 	"demo/network/go_client/internal/config"
 	dbpkg "demo/network/go_client/internal/db"
 	"demo/network/go_client/internal/logger"
@@ -147,7 +149,7 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 
 	var transferID string
 	var offset int64 = 0
-	var respBuf [4096]C.char
+	var resp C.client_response_t
 
 	// 2. Try Resume
 	resumePayload := map[string]interface{}{
@@ -158,9 +160,9 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 	}
 	jResume, _ := json.Marshal(resumePayload)
 	cResume := C.CString(string(jResume))
-	respBuf[0] = 0
-	res := C.client_backup_resume(clientCtx, cResume, &respBuf[0])
+	res := C.client_backup_resume(clientCtx, cResume, &resp)
 	C.free(unsafe.Pointer(cResume))
+	respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 	if res != 0 {
 		var resumeResp struct {
@@ -168,7 +170,7 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 			Offset     int64  `json:"offset"`
 			Status     string `json:"status"` // "found", "not_found", "mismatch"
 		}
-		json.Unmarshal([]byte(C.GoString(&respBuf[0])), &resumeResp)
+		json.Unmarshal([]byte(respStr), &resumeResp)
 		if resumeResp.Status == "found" {
 			transferID = resumeResp.TransferID
 			offset = resumeResp.Offset
@@ -187,64 +189,72 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 		}
 		jsonInit, _ := json.Marshal(initPayload)
 		cInit := C.CString(string(jsonInit))
-		respBuf[0] = 0
-		res := C.client_backup_init(clientCtx, cInit, &respBuf[0])
+		res := C.client_backup_init(clientCtx, cInit, &resp)
 		C.free(unsafe.Pointer(cInit))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 		if res == 0 {
-			return fmt.Errorf("backup_init failed: %s", C.GoString(&respBuf[0]))
+			return fmt.Errorf("backup_init failed: %s", respStr)
 		}
 
 		var initResp struct {
 			TransferID string `json:"transfer_id"`
 		}
-		json.Unmarshal([]byte(C.GoString(&respBuf[0])), &initResp)
+		json.Unmarshal([]byte(respStr), &initResp)
 		transferID = initResp.TransferID
 		offset = 0
 	}
 
-	// 4. Upload Chunks from current offset
+	// 4. Deduplicated upload when the server keeps a chunk store; older
+	// servers get the whole file from the current offset
+	if err := backupDedup(file, transferID); err != errNoDedup {
+		return err
+	}
+	file.Seek(0, 0)
+
 	hash := sha256.New()
 	if offset > 0 {
-		// If resuming, we can't easily recalculate partial hash without reading all previous data.
-		// For now, let's assume we don't verify full hash at the end if resumed, OR we must read from start.
-		// BETTER: Read from start to update hash, but skip upload until offset.
-		buffer := make([]byte, 128*1024)
-		var readAt int64 = 0
-		for readAt < offset {
-			toRead := offset - readAt
-			if toRead > int64(len(buffer)) {
-				toRead = int64(len(buffer))
-			}
-			n, _ := file.Read(buffer[:toRead])
-			if n == 0 {
-				break
-			}
-			hash.Write(buffer[:n])
-			readAt += int64(n)
-		}
+		// Read from start to update hash, but skip upload until offset
+		hashPrefix(file, hash, offset)
 	} else {
 		file.Seek(0, 0)
 	}
 
 	buffer := make([]byte, 16*1024*1024) // 16MB Chunk
+	resyncs := 0
 	for {
 		n, err := file.Read(buffer)
 		if n > 0 {
 			hash.Write(buffer[:n])
+			chunkSum := sha256.Sum256(buffer[:n])
 
-			chunkPayload := map[string]interface{}{
+			// The bytes go raw after the header; the server checks them
+			// against sha256 before accepting the chunk
+			chunkHeader := map[string]interface{}{
 				"transfer_id": transferID,
 				"offset":      offset,
 				"data_len":    int64(n),
-				"data":        hex.EncodeToString(buffer[:n]),
+				"sha256":      hex.EncodeToString(chunkSum[:]),
 			}
-			jsonChunk, _ := json.Marshal(chunkPayload)
+			jsonChunk, _ := json.Marshal(chunkHeader)
 			cChunk := C.CString(string(jsonChunk))
 
-			respBuf[0] = 0
-			res := C.client_backup_chunk(clientCtx, cChunk, &respBuf[0])
+			res := C.client_backup_chunk_data(clientCtx, cChunk, unsafe.Pointer(&buffer[0]), C.uint32_t(n), &resp)
 			C.free(unsafe.Pointer(cChunk))
+			respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			// The server is elsewhere in the upload (e.g. it expected a chunk
+			// whose response was lost): carry on from where it says
+			if res == 0 && resyncs < maxResyncs {
+				if serverOffset, ok := conflictOffset(respStr); ok && serverOffset <= totalSize {
+					resyncs++
+					logger.Infof("[Backup] Server is at offset %d of %s, not %d; continuing from there", serverOffset, f.CurrentPath, offset)
+					hash.Reset()
+					hashPrefix(file, hash, serverOffset)
+					offset = serverOffset
+					continue
+				}
+			}
 
 			if res == 0 {
 				cancelPayload := map[string]interface{}{"transfer_id": transferID}
@@ -252,7 +262,7 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 				cCancel := C.CString(string(jCancel))
 				C.client_backup_cancel(clientCtx, cCancel, nil)
 				C.free(unsafe.Pointer(cCancel))
-				return fmt.Errorf("backup_chunk failed at offset %d: %s", offset, C.GoString(&respBuf[0]))
+				return fmt.Errorf("backup_chunk failed at offset %d: %s", offset, respStr)
 			}
 
 			offset += int64(n)
@@ -273,13 +283,173 @@ func (w *BackupWorker) backupFile(f dbpkg.MonitoredFile, deviceID string) error
 	}
 	jsonFinish, _ := json.Marshal(finishPayload)
 	cFinish := C.CString(string(jsonFinish))
-	respBuf[0] = 0
-	res = C.client_backup_finish(clientCtx, cFinish, &respBuf[0])
+	res = C.client_backup_finish(clientCtx, cFinish, &resp)
 	C.free(unsafe.Pointer(cFinish))
+	respStr = clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 	if res == 0 {
-		return fmt.Errorf("backup_finish failed: %s", C.GoString(&respBuf[0]))
+		return fmt.Errorf("backup_finish failed: %s", respStr)
 	}
 
 	return nil
 }
+
+// maxResyncs bounds how often one upload jumps to the server's offset.
+const maxResyncs = 3
+
+// hashPrefix feeds the first n bytes of file to hash, leaving the file
+// positioned at n.
+func hashPrefix(file *os.File, hash io.Writer, n int64) {
+	file.Seek(0, 0)
+	buffer := make([]byte, 128*1024)
+	var readAt int64 = 0
+	for readAt < n {
+		toRead := n - readAt
+		if toRead > int64(len(buffer)) {
+			toRead = int64(len(buffer))
+		}
+		m, _ := file.Read(buffer[:toRead])
+		if m == 0 {
+			break
+		}
+		hash.Write(buffer[:m])
+		readAt += int64(m)
+	}
+}
+
+// conflictOffset reads the server's current_offset from a 409 answer to a
+// chunk that did not continue the upload.
+func conflictOffset(respStr string) (int64, bool) {
+	var conflict struct {
+		Code string `json:"code"`
+		Data *struct {
+			CurrentOffset int64 `json:"current_offset"`
+		} `json:"data"`
+	}
+	if json.Unmarshal([]byte(respStr), &conflict) != nil || conflict.Code != "CONFLICT" || conflict.Data == nil {
+		return 0, false
+	}
+	return conflict.Data.CurrentOffset, conflict.Data.CurrentOffset >= 0
+}
+
+// chunkQueryBatch is how many hashes go in one chunk query (the server
+// takes up to 1024).
+const chunkQueryBatch = 512
+
+// errNoDedup means the server has no chunk store (no MSG_BACKUP_CHUNK_QUERY_REQ route).
+var errNoDedup = errors.New("server does not deduplicate")
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// backupDedup uploads a file as content-defined chunks: it sends only the
+// chunks the server does not have from this device (any version) and finishes
+// the session with the list of chunks that make up the file.
+func backupDedup(file *os.File, transferID string) error {
+	// 1. Cut and hash the file
+	file.Seek(0, 0)
+	fileHash := sha256.New()
+	refs := []chunkRef{}
+	chunker := NewChunker(io.TeeReader(file, fileHash))
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk)
+		refs = append(refs, chunkRef{Hash: hex.EncodeToString(sum[:]), Size: len(chunk)})
+	}
+
+	// 2. Ask which chunks the server lacks
+	missing := make(map[string]bool)
+	for i := 0; i < len(refs); i += chunkQueryBatch {
+		batch := refs[i:min(i+chunkQueryBatch, len(refs))]
+		hashes := make([]string, len(batch))
+		for j, ref := range batch {
+			hashes[j] = ref.Hash
+		}
+		jQuery, _ := json.Marshal(map[string]interface{}{"transfer_id": transferID, "hashes": hashes})
+		cQuery := C.CString(string(jQuery))
+		var resp C.client_response_t
+		res := C.client_backup_chunk_query(clientCtx, cQuery, &resp)
+		C.free(unsafe.Pointer(cQuery))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+		if res == 0 {
+			var apiErr struct {
+				Code string `json:"code"`
+			}
+			if json.Unmarshal([]byte(respStr), &apiErr) == nil && apiErr.Code == "UNKNOWN_ROUTE" {
+				return errNoDedup
+			}
+			return fmt.Errorf("chunk query failed: %s", respStr)
+		}
+		var queryResp struct {
+			Missing []string `json:"missing"`
+		}
+		json.Unmarshal([]byte(respStr), &queryResp)
+		for _, hash := range queryResp.Missing {
+			missing[hash] = true
+		}
+	}
+
+	// 3. Send them. The file is read again: a chunk that changed since the
+	// first pass is not in the list, so the finish fails and the next run
+	// starts over.
+	file.Seek(0, 0)
+	chunker = NewChunker(file)
+	var sent, sentBytes int
+	for len(missing) > 0 {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		if !missing[hash] {
+			continue
+		}
+
+		jPut, _ := json.Marshal(map[string]interface{}{
+			"transfer_id": transferID,
+			"data_len":    len(chunk),
+			"sha256":      hash,
+		})
+		cPut := C.CString(string(jPut))
+		var resp C.client_response_t
+		res := C.client_backup_chunk_put(clientCtx, cPut, unsafe.Pointer(&chunk[0]), C.uint32_t(len(chunk)), &resp)
+		C.free(unsafe.Pointer(cPut))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
+		if res == 0 {
+			return fmt.Errorf("chunk upload failed: %s", respStr)
+		}
+		delete(missing, hash)
+		sent++
+		sentBytes += len(chunk)
+	}
+	logger.Infof("[Backup] %s: sent %d of %d chunks (%d bytes)", file.Name(), sent, len(refs), sentBytes)
+
+	// 4. Finish with the chunk list
+	jFinish, _ := json.Marshal(map[string]interface{}{
+		"transfer_id": transferID,
+		"file_hash":   hex.EncodeToString(fileHash.Sum(nil)),
+		"chunks":      refs,
+	})
+	cFinish := C.CString(string(jFinish))
+	var resp C.client_response_t
+	res := C.client_backup_finish(clientCtx, cFinish, &resp)
+	C.free(unsafe.Pointer(cFinish))
+	respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
+	if res == 0 {
+		return fmt.Errorf("backup_finish failed: %s", respStr)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// GenerateCSR creates a new P-256 key and a certificate request for deviceID.
+// The key never leaves the device; only the CSR is sent at registration.
+func GenerateCSR(deviceID string) (csrPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: deviceID},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create csr: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return csrPEM, keyPEM, nil
+}
+
+// Save writes the issued certificate and its private key (0600).
+func Save(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0o644)
+}
+
+// Exists reports whether both the certificate and key files are present.
+func Exists(certPath, keyPath string) bool {
+	if certPath == "" || keyPath == "" {
+		return false
+	}
+	if _, err := os.Stat(certPath); err != nil {
+		return false
+	}
+	_, err := os.Stat(keyPath)
+	return err == nil
+}
@@ -0,0 +1,84 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"demo/network/go_client/internal/logger"
+)
+
+// ErrDeferred is returned by handlers that hand the work off (e.g. to the
+// restore workers) and report the outcome themselves.
+var ErrDeferred = errors.New("result reported later")
+
+type handler struct {
+	name string
+	run  func(cmdID uint, payload string) (string, error)
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[uint8]handler)
+)
+
+// Register maps a server message type to a handler. The payload is decoded
+// into T; the returned string is reported as the command's result and a
+// non-nil error as its failure.
+func Register[T any](msgType uint8, name string, fn func(cmdID uint, req T) (string, error)) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[msgType] = handler{
+		name: name,
+		run: func(cmdID uint, payload string) (string, error) {
+			var req T
+			if err := json.Unmarshal([]byte(payload), &req); err != nil {
+				return "", fmt.Errorf("invalid %s payload: %v", name, err)
+			}
+			return fn(cmdID, req)
+		},
+	}
+}
+
+// Types lists the registered message types, in order; the agent advertises
+// them in its hello so the server only sends commands it can handle.
+func Types() []int {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	types := make([]int, 0, len(handlers))
+	for t := range handlers {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	return types
+}
+
+// Dispatch runs the handler registered for msgType and reports the
+// command's progress to the server.
+func Dispatch(msgType uint8, payload string) {
+	handlersMu.RLock()
+	h, ok := handlers[msgType]
+	handlersMu.RUnlock()
+
+	cmdID := ID(payload)
+	if !ok {
+		logger.Errorf("[Command] No handler for message type 0x%02X", msgType)
+		Finish(cmdID, "", fmt.Errorf("unsupported command type 0x%02X", msgType))
+		return
+	}
+
+	logger.Infof("[Command] %s (cmd %d)", h.name, cmdID)
+	Report(cmdID, StatusAccepted, "", "")
+	Report(cmdID, StatusRunning, "", "")
+
+	result, err := h.run(cmdID, payload)
+	if err == ErrDeferred {
+		return
+	}
+	if err != nil {
+		logger.Errorf("[Command] %s failed: %v", h.name, err)
+	}
+	Finish(cmdID, result, err)
+}
@@ -0,0 +1,74 @@
+package command
+
+import (
+	"encoding/json"
+	"unsafe"
+
+	"demo/network/go_client/internal/config"
+	"demo/network/go_client/internal/logger"
+)
+
+/*
+#include <stdlib.h>
+#include "../../../client/core.h"
+*/
+import "C"
+
+// Statuses reported back to the server (see models.Command on the server)
+const (
+	StatusAccepted  = "ACCEPTED"
+	StatusRunning   = "RUNNING"
+	StatusCompleted = "COMPLETED"
+	StatusFailed    = "FAILED"
+)
+
+var clientCtx *C.ClientContext
+
+func SetClientContext(ctx unsafe.Pointer) {
+	clientCtx = (*C.ClientContext)(ctx)
+}
+
+// ID extracts the cmd_id the server adds to every command payload
+// (0 if missing, e.g. from an older server).
+func ID(payload string) uint {
+	var body struct {
+		CmdID uint `json:"cmd_id"`
+	}
+	json.Unmarshal([]byte(payload), &body)
+	return body.CmdID
+}
+
+// Report sends the status of a command. result is the command's output,
+// errMsg the reason for FAILED; both are only used with a final status.
+func Report(cmdID uint, status, result, errMsg string) bool {
+	if cmdID == 0 || clientCtx == nil {
+		return false
+	}
+	devCfg, _ := config.LoadDeviceConfig()
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"device_id": devCfg.DeviceID,
+		"cmd_id":    cmdID,
+		"status":    status,
+		"result":    result,
+		"error":     errMsg,
+	})
+	cPayload := C.CString(string(payload))
+	defer C.free(unsafe.Pointer(cPayload))
+
+	var resp C.client_response_t
+	defer C.client_free_response(&resp)
+	if C.client_report_command_status(clientCtx, cPayload, &resp) != 1 {
+		logger.Errorf("[Command] Failed to report %s for command %d: %s", status, cmdID, C.GoStringN(resp.body, C.int(resp.len)))
+		return false
+	}
+	return true
+}
+
+// Finish reports COMPLETED, or FAILED with err's message.
+func Finish(cmdID uint, result string, err error) bool {
+	if err != nil {
+		return Report(cmdID, StatusFailed, result, err.Error())
+	}
+	return Report(cmdID, StatusCompleted, result, "")
+}
@@ -10,14 +10,41 @@ import (
 // AppConfig structure for config.yml
 type AppConfig struct {
 	Client struct {
-		ServerHost    string   `yaml:"server_host"`
-		ServerPort    int      `yaml:"server_port"`
-		APIPort       int      `yaml:"api_port"`
-		LogDir        string   `yaml:"log_dir"`
-		MonitoredDirs []string `yaml:"monitored_dirs"`
+		ServerHost    string    `yaml:"server_host"`
+		ServerPort    int       `yaml:"server_port"`
+		APIPort       int       `yaml:"api_port"`
+		LogDir        string    `yaml:"log_dir"`
+		MonitoredDirs []string  `yaml:"monitored_dirs"`
+		TLS           TLSConfig `yaml:"tls"`
+		// Largest notification accepted from the server in bytes (0 = 1 MiB)
+		MaxMessageSize int `yaml:"max_message_size"`
+		// Notification channel keepalive in seconds (0 = 30 / 90)
+		Heartbeat struct {
+			IntervalSeconds int `yaml:"interval_seconds"`
+			TimeoutSeconds  int `yaml:"timeout_seconds"`
+		} `yaml:"heartbeat"`
+		// Send API requests over one long-lived connection shared by the
+		// workers instead of a connection per request
+		PersistentAPI bool `yaml:"persistent_api"`
+		// Token from the admin for registering this device (only used once,
+		// while device.json does not exist yet)
+		EnrollmentToken string `yaml:"enrollment_token"`
+		// Interrupted restores with no progress for this many hours are
+		// given up and their .part files removed (0 = 24)
+		RestoreExpireHours int `yaml:"restore_expire_hours"`
 	} `yaml:"client"`
 }
 
+// TLSConfig controls the encrypted connection to the server. The device
+// certificate is issued by the server at registration and saved to CertFile/KeyFile.
+type TLSConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
 // DeviceConfig structure for device.json (persisted device info)
 type DeviceConfig struct {
 	DeviceID string `json:"device_id"`
@@ -35,5 +35,6 @@ type LocalRestoreSession struct {
 	TotalSize     int64     `json:"total_size"`
 	FileHash      string    `json:"file_hash"`
 	Status        string    `json:"status"` // IN_PROGRESS, DONE, FAILED
+	CmdID         uint      `json:"cmd_id"` // Server command to report the outcome to
 	UpdatedAt     time.Time `json:"updated_at"`
 }
@@ -144,14 +144,15 @@ func (w *SyncWorker) doSync() {
 	defer C.free(unsafe.Pointer(cPayload))
 
 	// 3. Send to Server (Type 0xE5)
-	var respBuf [1024]C.char
+	var resp C.client_response_t
+	defer C.client_free_response(&resp)
 
 	// Ensure client_file_sync is available in core.h/c
-	res := C.client_file_sync(clientCtx, cPayload, &respBuf[0])
+	res := C.client_file_sync(clientCtx, cPayload, &resp)
 
 	// 4. Handle Response
 	if res == 1 {
-		respStr := C.GoString(&respBuf[0])
+		respStr := C.GoStringN(resp.body, C.int(resp.len))
 		fmt.Printf("[Sync] Server Response: %s\n", respStr)
 
 		if strings.Contains(respStr, "success") {
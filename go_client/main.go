@@ -2,14 +2,14 @@ package main
 
 /*
 #cgo CFLAGS: -I../
-#cgo LDFLAGS: ${SRCDIR}/../client_core.o ${SRCDIR}/../protocol.o
+#cgo LDFLAGS: ${SRCDIR}/../client_core.o ${SRCDIR}/../protocol.o ${SRCDIR}/../envelope.o -lssl -lcrypto
 #include <stdlib.h>
 #include <string.h>
 #include "../client/core.h"
 #include "../protocol/protocol.h"
 
 // Shim function to pass to C
-extern void on_message_shim(const char *msg);
+extern void on_message_shim(uint8_t type, const char *msg);
 */
 import "C"
 
@@ -22,8 +22,11 @@ import (
 	"time"
 	"unsafe"
 
+	"demo/network/go_client/clientcore"
 	"demo/network/go_client/internal/auth"
 	"demo/network/go_client/internal/backup"
+	"demo/network/go_client/internal/certs"
+	"demo/network/go_client/internal/command"
 	"demo/network/go_client/internal/config"
 	dbpkg "demo/network/go_client/internal/db"
 	"demo/network/go_client/internal/device"
@@ -35,128 +38,64 @@ import (
 
 var GlobalClientCtx *C.ClientContext
 
+// Version is the agent build, reported to the server in the hello. Set with
+// -ldflags "-X main.Version=..." (see Makefile).
+var Version = "1.0.0"
+
 //export goOnMessage
-func goOnMessage(msg *C.char) {
+func goOnMessage(msgType C.int, msg *C.char) {
 	goStr := C.GoString(msg)
-	fmt.Printf("\n[Notification] Received: %s\n", goStr)
-
-	// Check for "GET_LOGS" command
-	// Parsing JSON payload from server command?
-	// The server sends: `msgType` + `payload`.
-	// For now, let's assume the payload IS the JSON string like `{"line_count": 50}` or `GET_LOGS {"line_count": 50}`?
-	// Protocol says msg is char*.
-	// If the server sends `MSG_SERVER_COMMAND_GETLOG` (0xD3) with payload `{"line_count": 50}`,
-	// The C layer might pass the raw payload string to this callback if configured.
-	// Assume `goStr` is the payload.
-
-	if strings.Contains(goStr, "GET_LOGS") || strings.Contains(goStr, "line_count") {
-		fmt.Println("[Auto] Triggering Log Upload...")
-
-		// Parse line count
-		lineCount := 50 // Default
-		var cmdPayload map[string]interface{}
-		// Try to find JSON in the string
-		start := strings.Index(goStr, "{")
-		if start != -1 {
-			json.Unmarshal([]byte(goStr[start:]), &cmdPayload)
-			if lc, ok := cmdPayload["line_count"].(float64); ok {
-				lineCount = int(lc)
-			}
-		}
-
-		// Read Logs
-		lines, err := logger.Tail(lineCount)
-		var content string
-		if err != nil {
-			content = fmt.Sprintf("Error reading logs: %v", err)
-		} else {
-			content = strings.Join(lines, "\n")
-		}
-
-		// Wrap in JSON with Device ID (We need to load it)
-		devCfg, _ := config.LoadDeviceConfig()
-
-		payloadMap := map[string]string{
-			"device_id": devCfg.DeviceID,
-			"content":   content,
-		}
-		jsonBytes, _ := json.Marshal(payloadMap)
-		logs := string(jsonBytes)
-
-		cLogs := C.CString(logs)
-		var resp [1024]C.char
-		// Use GlobalClientCtx
-		C.client_upload_logs(GlobalClientCtx, cLogs, &resp[0])
-		C.free(unsafe.Pointer(cLogs))
+	fmt.Printf("\n[Notification] Received (0x%02X): %s\n", int(msgType), goStr)
 
-		fmt.Printf("[Auto] Upload Response: %s\n", C.GoString(&resp[0]))
-		// fmt.Print("Choice: ") // Prompt restore
+	// Plain text notifications carry no command
+	if msgType == C.MSG_SOCKET {
+		return
 	}
+	command.Dispatch(uint8(msgType), goStr)
+}
 
-	if strings.Contains(goStr, "RESTORE_CMD") {
-		backup.HandleRestoreCmd(goStr)
-		// fmt.Print("Choice: ")
+// enableTLS (re)configures TLS on the client context. The device certificate
+// is only passed once it has been issued by the server.
+func enableTLS(ctx *C.ClientContext, tlsCfg config.TLSConfig) bool {
+	certFile, keyFile := "", ""
+	if certs.Exists(tlsCfg.CertFile, tlsCfg.KeyFile) {
+		certFile, keyFile = tlsCfg.CertFile, tlsCfg.KeyFile
 	}
-	// 2. FIREWALL_UPDATE
-	if strings.Contains(goStr, "FIREWALL_UPDATE") {
-		fmt.Println("[Auto] Triggering Firewall Config Refresh...")
-		// We need Context and DeviceID.
-		// GlobalClientCtx is available.
-		devCfg, _ := config.LoadDeviceConfig()
-		if devCfg.DeviceID == "" {
-			fmt.Println("[Error] Cannot refresh firewall: No Device ID.")
-			return
-		}
-
-		cDevID := C.CString(devCfg.DeviceID)
-		var resp [4096]C.char // Buffer for config
-		// Call C function to fetch config
-		// Wait.. `client_get_firewall_config` needs to be exported or available?
-		// It IS available in `core.c` but `main.go` needs to call it via C.
-		// `client_get_firewall_config` signature: (ctx, json_payload, resp_buffer)
-		// Payload: `{"device_id": "..."}`
 
-		payload := fmt.Sprintf(`{"device_id": "%s"}`, devCfg.DeviceID)
-		cPayload := C.CString(payload)
+	cCA := C.CString(tlsCfg.CAFile)
+	cCert := C.CString(certFile)
+	cKey := C.CString(keyFile)
+	cName := C.CString(tlsCfg.ServerName)
+	defer C.free(unsafe.Pointer(cCA))
+	defer C.free(unsafe.Pointer(cCert))
+	defer C.free(unsafe.Pointer(cKey))
+	defer C.free(unsafe.Pointer(cName))
 
-		fmt.Println("[Firewall] Fetching new config...")
-		res := C.client_get_firewall_config(GlobalClientCtx, cPayload, &resp[0])
+	return C.client_enable_tls(ctx, cCA, cCert, cKey, cName) == 1
+}
 
-		C.free(unsafe.Pointer(cDevID))
-		C.free(unsafe.Pointer(cPayload))
+// forcePasswordChange asks for a new password until the server accepts it.
+// Until then the session is only allowed to change the password.
+func forcePasswordChange(ctx *C.ClientContext, reader *bufio.Reader, current string) {
+	for ctx.must_change_password == 1 {
+		fmt.Println("[Info] Your password must be changed before continuing.")
+		fmt.Print("Enter New Password: ")
+		newPass, _ := reader.ReadString('\n')
+		newPass = strings.TrimSpace(newPass)
+
+		cOld := C.CString(current)
+		cNew := C.CString(newPass)
+		var resp C.client_response_t
+		res := C.client_change_password(ctx, cOld, cNew, &resp)
+		C.free(unsafe.Pointer(cOld))
+		C.free(unsafe.Pointer(cNew))
+		respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 		if res == 1 {
-			respStr := C.GoString(&resp[0])
-			fmt.Printf("[Firewall] Config Received: %s\n", respStr)
-
-			// Parse JSON
-			var fwResp struct {
-				Enabled bool     `json:"enabled"`
-				Domains []string `json:"domains"`
-			}
-			if err := json.Unmarshal([]byte(respStr), &fwResp); err != nil {
-				fmt.Printf("[Firewall] Failed to parse config: %v\n", err)
-			} else {
-				// Update Global State
-				config.UpdateFirewallConfig(fwResp.Enabled, fwResp.Domains)
-
-				// Apply to Hosts
-				status := config.GlobalFirewall
-				hm := firewall.GetHostsManager()
-
-				if status.Enabled {
-					hm.SetDomains(status.Domains)
-					hm.SetEnabled(true)
-					fmt.Printf("[Firewall] Applied: Enabled (%d domains)\n", len(status.Domains))
-				} else {
-					hm.SetEnabled(false)
-					fmt.Println("[Firewall] Applied: Disabled")
-				}
-			}
-		} else {
-			fmt.Println("[Firewall] Failed to fetch config.")
+			fmt.Println("Password changed.")
+			return
 		}
-		fmt.Print("Choice: ")
+		fmt.Printf("[Error] Password change failed: %s\n", respStr)
 	}
 }
 
@@ -185,6 +124,24 @@ func main() {
 	ctx := C.client_init(cHost, C.int(appCfg.Client.ServerPort), C.int(appCfg.Client.APIPort))
 	defer C.client_close(ctx)
 	GlobalClientCtx = ctx
+	C.client_set_max_message_size(ctx, C.uint32_t(appCfg.Client.MaxMessageSize))
+	C.client_set_heartbeat(ctx, C.int(appCfg.Client.Heartbeat.IntervalSeconds), C.int(appCfg.Client.Heartbeat.TimeoutSeconds))
+	if appCfg.Client.PersistentAPI {
+		C.client_set_persistent_api(ctx, 1)
+	}
+
+	tlsCfg := appCfg.Client.TLS
+	if tlsCfg.Enabled {
+		if !enableTLS(ctx, tlsCfg) {
+			fmt.Println("[Error] Failed to initialize TLS. Check client.tls in config.yml")
+			return
+		}
+		if certs.Exists(tlsCfg.CertFile, tlsCfg.KeyFile) {
+			fmt.Println("[Init] TLS enabled with device certificate.")
+		} else {
+			fmt.Println("[Init] TLS enabled (no device certificate yet).")
+		}
+	}
 
 	// Init File Sync Context
 	filesync.SetClientContext(unsafe.Pointer(ctx))
@@ -198,6 +155,9 @@ func main() {
 	// Init Backup Context
 	backup.SetClientContext(unsafe.Pointer(ctx))
 
+	// Command status reports
+	command.SetClientContext(unsafe.Pointer(ctx))
+
 	// Start Backup Worker
 	backupWorker := backup.NewBackupWorker()
 	backupWorker.Start()
@@ -205,13 +165,28 @@ func main() {
 	defer backupWorker.Stop()
 
 	// Start Restore Worker Pool
-	restoreWorker := backup.NewRestoreWorker(3)
+	restoreWorker := backup.NewRestoreWorker(3, time.Duration(appCfg.Client.RestoreExpireHours)*time.Hour)
 	restoreWorker.Start()
 	defer restoreWorker.Stop()
 
 	// Register Callback
+	registerCommandHandlers()
 	C.client_set_on_message(ctx, C.MessageCallback(C.on_message_shim))
 
+	// Hello: what this agent is and can do
+	capabilities := []string{"binary_chunks", "dedup_chunks"}
+	if appCfg.Client.PersistentAPI {
+		capabilities = append(capabilities, "persistent_api")
+	}
+	agentInfo, _ := json.Marshal(map[string]interface{}{
+		"agent_version": Version,
+		"commands":      command.Types(),
+		"capabilities":  capabilities,
+	})
+	cAgentInfo := C.CString(string(agentInfo))
+	C.client_set_agent_info(ctx, cAgentInfo)
+	C.free(unsafe.Pointer(cAgentInfo))
+
 	// Load Device Config
 	devCfg, err := config.LoadDeviceConfig()
 	if err != nil {
@@ -227,42 +202,76 @@ func main() {
 	password, _ := reader.ReadString('\n')
 	password = strings.TrimSpace(password)
 
-	// Device Registration Flow
-	if devCfg.DeviceID == "" {
-		fmt.Println("[Info] Device not registered. Gathering System Info...")
+	// Device Registration Flow. A registered device without a certificate
+	// registers again: the server issues an approved device a new one.
+	needCert := tlsCfg.Enabled && !certs.Exists(tlsCfg.CertFile, tlsCfg.KeyFile)
+	if devCfg.DeviceID == "" || needCert {
+		if devCfg.DeviceID == "" {
+			fmt.Println("[Info] Device not registered. Gathering System Info...")
+		} else {
+			fmt.Println("[Info] No device certificate, asking the server for one...")
+		}
 
 		sysInfo, err := device.GetSystemInfo()
 		if err != nil {
 			fmt.Printf("[Error] Failed to get system info: %v\n", err)
 		}
+		deviceID := sysInfo.UUID
+		if devCfg.DeviceID != "" {
+			deviceID = devCfg.DeviceID
+		}
 
 		regPayload := auth.Credentials{
-			Username:  username,
-			DeviceID:  sysInfo.UUID,
-			Name:      sysInfo.Hostname,
-			OSName:    sysInfo.OSName,
-			OSVersion: sysInfo.OSVersion,
-			Hostname:  sysInfo.Hostname,
-			Arch:      sysInfo.Arch,
+			Username:        username,
+			Password:        password,
+			EnrollmentToken: config.GlobalAppConfig.Client.EnrollmentToken,
+			DeviceID:        deviceID,
+			Name:            sysInfo.Hostname,
+			OSName:          sysInfo.OSName,
+			OSVersion:       sysInfo.OSVersion,
+			Hostname:        sysInfo.Hostname,
+			Arch:            sysInfo.Arch,
+		}
+
+		// Ask the server for a device certificate along with the registration
+		var certKeyPEM []byte
+		if needCert {
+			csrPEM, keyPEM, err := certs.GenerateCSR(deviceID)
+			if err != nil {
+				fmt.Printf("[Error] Failed to create certificate request: %v\n", err)
+			} else {
+				regPayload.CSR = string(csrPEM)
+				certKeyPEM = keyPEM
+			}
 		}
 
 		jsonData, _ := json.Marshal(regPayload)
 		cJSON := C.CString(string(jsonData))
-		var respBuffer [1024]C.char
 
 		for {
 			fmt.Println("[Info] Sending Device Registration Request...")
-			success := C.client_register_device(ctx, cJSON, &respBuffer[0])
+			var resp C.client_response_t
+			success := C.client_register_device(ctx, cJSON, &resp)
+			respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 			if success == 1 {
-				respStr := C.GoString(&respBuffer[0])
 				fmt.Printf("[Success] Registration Response: %s\n", respStr)
 
 				var respMap map[string]interface{}
 				json.Unmarshal([]byte(respStr), &respMap)
+				if certPEM, ok := respMap["certificate"].(string); ok && certKeyPEM != nil {
+					if err := certs.Save(tlsCfg.CertFile, tlsCfg.KeyFile, []byte(certPEM), certKeyPEM); err != nil {
+						fmt.Printf("[Error] Failed to save device certificate: %v\n", err)
+					} else if enableTLS(ctx, tlsCfg) {
+						fmt.Println("[Info] Device certificate saved and loaded.")
+					}
+				}
 				if did, ok := respMap["device_id"].(string); ok {
 					devCfg.DeviceID = did
 					config.SaveDeviceConfig(devCfg)
 					fmt.Println("[Info] Device ID saved.")
+					if respMap["status"] == "PENDING" {
+						fmt.Println("[Info] Device is waiting for admin approval; login will be retried until then.")
+					}
 					break
 				}
 			} else {
@@ -290,23 +299,24 @@ func main() {
 			fmt.Println("Login Successful!")
 			break
 		}
-		fmt.Println("[Error] Login Failed! Retrying in 5s...")
+		fmt.Println("[Error] Login Failed (device may be waiting for approval)! Retrying in 5s...")
 		time.Sleep(5 * time.Second)
 	}
+	forcePasswordChange(ctx, reader, password)
 
 	// --- FETCH FIREWALL CONFIG ON STARTUP ---
 	fmt.Println("[Init] Fetching Firewall Config...")
 	cDevID := C.CString(devCfg.DeviceID)
 	payload := fmt.Sprintf(`{"device_id": "%s"}`, devCfg.DeviceID)
 	cPayload := C.CString(payload)
-	var resp [4096]C.char
+	var resp C.client_response_t
 
-	res := C.client_get_firewall_config(ctx, cPayload, &resp[0])
+	res := C.client_get_firewall_config(ctx, cPayload, &resp)
 	C.free(unsafe.Pointer(cDevID))
 	C.free(unsafe.Pointer(cPayload))
+	respStr := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 	if res == 1 {
-		respStr := C.GoString(&resp[0])
 		fmt.Printf("[Init] Firewall Config: %s\n", respStr)
 
 		var fwResp struct {
@@ -1,7 +1,8 @@
 #include <stdio.h>
+#include <stdint.h>
 
-extern void goOnMessage(char *msg);
+extern void goOnMessage(int type, char *msg);
 
-void on_message_shim(const char *msg) {
-    if (msg) goOnMessage((char*)msg);
+void on_message_shim(uint8_t type, const char *msg) {
+    if (msg) goOnMessage(type, (char*)msg);
 }
@@ -18,6 +18,13 @@ type AppConfig struct {
 		ServerHost string `yaml:"server_host"`
 		ServerPort int    `yaml:"server_port"`
 		APIPort    int    `yaml:"api_port"`
+		TLS        struct {
+			Enabled    bool   `yaml:"enabled"`
+			CAFile     string `yaml:"ca_file"`
+			CertFile   string `yaml:"cert_file"` // Certificate with CN=ADMIN_CONSOLE (server_go issue-cert)
+			KeyFile    string `yaml:"key_file"`
+			ServerName string `yaml:"server_name"`
+		} `yaml:"tls"`
 	} `yaml:"admin"`
 }
 
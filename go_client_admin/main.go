@@ -2,7 +2,7 @@ package main
 
 /*
 #cgo CFLAGS: -I../
-#cgo LDFLAGS: ${SRCDIR}/../client_core.o ${SRCDIR}/../protocol.o
+#cgo LDFLAGS: ${SRCDIR}/../client_core.o ${SRCDIR}/../protocol.o ${SRCDIR}/../envelope.o -lssl -lcrypto
 #include <stdlib.h>
 #include "../client/core.h"
 #include "../protocol/protocol.h"
@@ -11,6 +11,7 @@ import "C"
 
 import (
 	"bufio"
+	"demo/network/go_client/clientcore"
 	"demo/network/go_client_admin/config"
 	"encoding/json"
 	"fmt"
@@ -20,6 +21,58 @@ import (
 	"unsafe"
 )
 
+// Version is the console build, reported in the hello like an agent's.
+// Set with -ldflags "-X main.Version=..." (see Makefile).
+var Version = "1.0.0"
+
+// forcePasswordChange asks for a new password until the server accepts it.
+// Until then the session is only allowed to change the password.
+func forcePasswordChange(ctx *C.ClientContext, reader *bufio.Reader, current string) {
+	for ctx.must_change_password == 1 {
+		fmt.Println("[Info] Your password must be changed before continuing.")
+		fmt.Print("Enter New Password: ")
+		newPass, _ := reader.ReadString('\n')
+		newPass = strings.TrimSpace(newPass)
+
+		cOld := C.CString(current)
+		cNew := C.CString(newPass)
+		var resp C.client_response_t
+		res := C.client_change_password(ctx, cOld, cNew, &resp)
+		C.free(unsafe.Pointer(cOld))
+		C.free(unsafe.Pointer(cNew))
+		body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+		if res == 1 {
+			fmt.Println("Password changed.")
+			return
+		}
+		printFailure("[Error] Password change failed", body)
+	}
+}
+
+// apiError is how the client core reports a failed request (see
+// _client_unwrap_response in client/core.c).
+type apiError struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+}
+
+// printFailure reports a failed request with the server's error code and the
+// request ID to look up in the server log.
+func printFailure(what, body string) {
+	var apiErr apiError
+	if json.Unmarshal([]byte(body), &apiErr) != nil || apiErr.Code == "" {
+		if body == "" {
+			fmt.Printf("%s.\n", what)
+		} else {
+			fmt.Printf("%s: %s\n", what, body)
+		}
+		return
+	}
+	fmt.Printf("%s: %s [%s, request %s]\n", what, apiErr.Error, apiErr.Code, apiErr.RequestID)
+}
+
 func main() {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("--- GO ADMIN CLIENT ---")
@@ -38,6 +91,23 @@ func main() {
 	ctx := C.client_init(cHost, C.int(appCfg.Admin.ServerPort), C.int(appCfg.Admin.APIPort))
 	defer C.client_close(ctx)
 
+	if tlsCfg := appCfg.Admin.TLS; tlsCfg.Enabled {
+		cCA := C.CString(tlsCfg.CAFile)
+		cCert := C.CString(tlsCfg.CertFile)
+		cKey := C.CString(tlsCfg.KeyFile)
+		cName := C.CString(tlsCfg.ServerName)
+		ok := C.client_enable_tls(ctx, cCA, cCert, cKey, cName)
+		C.free(unsafe.Pointer(cCA))
+		C.free(unsafe.Pointer(cCert))
+		C.free(unsafe.Pointer(cKey))
+		C.free(unsafe.Pointer(cName))
+		if ok != 1 {
+			fmt.Println("[Error] Failed to initialize TLS. Check admin.tls in config.yml")
+			return
+		}
+		fmt.Println("[Init] TLS enabled.")
+	}
+
 	// Login
 	fmt.Print("Enter Admin Username: ")
 	username, _ := reader.ReadString('\n')
@@ -66,8 +136,13 @@ func main() {
 		fmt.Println("[Error] Login Failed! Retrying in 5s...")
 		time.Sleep(5 * time.Second)
 	}
+	forcePasswordChange(ctx, reader, password)
 
 	// Connect Notification (Optional for Admin but good for state)
+	agentInfo, _ := json.Marshal(map[string]string{"agent_version": Version})
+	cAgentInfo := C.CString(string(agentInfo))
+	C.client_set_agent_info(ctx, cAgentInfo)
+	C.free(unsafe.Pointer(cAgentInfo))
 	C.client_connect_notification(ctx, cDev)
 
 	for {
@@ -78,7 +153,16 @@ func main() {
 		fmt.Println("5. Firewall Control")
 		fmt.Println("6. Browse File Tree")
 		fmt.Println("7. Restore File")
-		fmt.Println("8. Exit")
+		fmt.Println("8. Revoke Sessions")
+		fmt.Println("9. Create Enrollment Token")
+		fmt.Println("10. List Pending Devices")
+		fmt.Println("11. Approve Device")
+		fmt.Println("12. Reject Device")
+		fmt.Println("13. Cancel Command")
+		fmt.Println("14. Backup Retention")
+		fmt.Println("15. Backup Integrity")
+		fmt.Println("16. Stuck Transfers")
+		fmt.Println("17. Exit")
 		fmt.Print("Choice: ")
 
 		choiceStr, _ := reader.ReadString('\n')
@@ -87,13 +171,31 @@ func main() {
 
 		switch choice {
 		case 1:
-			var buffer [1024]C.char
-			res := C.client_get_online_users(ctx, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_get_online_users(ctx, &resp)
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 			if res == 1 {
-				goStr := C.GoString(&buffer[0])
-				fmt.Printf("Online Users: %s\n", goStr)
+				var online struct {
+					Devices []struct {
+						DeviceID     string `json:"device_id"`
+						AgentVersion string `json:"agent_version"`
+						Protocol     int    `json:"protocol"`
+					} `json:"devices"`
+				}
+				json.Unmarshal([]byte(body), &online)
+				fmt.Printf("Online Devices (%d):\n", len(online.Devices))
+				for _, d := range online.Devices {
+					version := d.AgentVersion
+					switch {
+					case version == "" && d.Protocol == 1:
+						version = "legacy agent (no version)"
+					case version == "":
+						version = "-"
+					}
+					fmt.Printf("  %-40s %s\n", d.DeviceID, version)
+				}
 			} else {
-				fmt.Println("Failed to fetch user list.")
+				printFailure("Failed to fetch user list", body)
 			}
 
 		case 2:
@@ -117,14 +219,15 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 			cPayload := C.CString(string(jsonBytes))
 
-			var buffer [1024]C.char
-			res := C.client_admin_get_logs(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_get_logs(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
-				fmt.Printf("Response: %s\n", C.GoString(&buffer[0]))
+				fmt.Printf("Response: %s\n", body)
 			} else {
-				fmt.Println("Request Failed.")
+				printFailure("Request Failed", body)
 			}
 
 		case 3:
@@ -137,14 +240,15 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 			cPayload := C.CString(string(jsonBytes))
 
-			var buffer [65535]C.char // Larger buffer for logs
-			res := C.client_admin_view_logs(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_view_logs(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
-				fmt.Printf("Stored Logs:\n%s\n", C.GoString(&buffer[0]))
+				fmt.Printf("Stored Logs:\n%s\n", body)
 			} else {
-				fmt.Println("Failed to fetch stored logs.")
+				printFailure("Failed to fetch stored logs", body)
 			}
 
 		case 4:
@@ -177,14 +281,15 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 			cPayload := C.CString(string(jsonBytes))
 
-			var buffer [65535]C.char
-			res := C.client_admin_get_history(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_get_history(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
-				fmt.Printf("Command History:\n%s\n", C.GoString(&buffer[0]))
+				fmt.Printf("Command History:\n%s\n", body)
 			} else {
-				fmt.Println("Failed to fetch command history.")
+				printFailure("Failed to fetch command history", body)
 			}
 
 		case 5:
@@ -232,15 +337,15 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 
 			cPayload := C.CString(string(jsonBytes))
-			var buffer [1024]C.char
-			res := C.client_admin_firewall_control(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_firewall_control(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
 				fmt.Println("Success: Config Updated.")
 			} else {
-				fmt.Println("Request Failed.")
-				fmt.Printf("Error Details: %s\n", C.GoString(&buffer[0]))
+				printFailure("Request Failed", body)
 			}
 
 		case 6:
@@ -274,14 +379,15 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 			cPayload := C.CString(string(jsonBytes))
 
-			var buffer [65535]C.char
-			res := C.client_admin_get_file_tree(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_get_file_tree(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
-				fmt.Printf("File Tree:\n%s\n", C.GoString(&buffer[0]))
+				fmt.Printf("File Tree:\n%s\n", body)
 			} else {
-				fmt.Println("Failed to fetch file tree.")
+				printFailure("Failed to fetch file tree", body)
 			}
 
 		case 7:
@@ -310,17 +416,218 @@ func main() {
 			jsonBytes, _ := json.Marshal(payload)
 			cPayload := C.CString(string(jsonBytes))
 
-			var buffer [1024]C.char
-			res := C.client_admin_restore(ctx, cPayload, &buffer[0])
+			var resp C.client_response_t
+			res := C.client_admin_restore(ctx, cPayload, &resp)
 			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
 
 			if res == 1 {
-				fmt.Printf("Response: %s\n", C.GoString(&buffer[0]))
+				fmt.Printf("Response: %s\n", body)
 			} else {
-				fmt.Println("Restore Trigger Failed.")
+				printFailure("Restore Trigger Failed", body)
 			}
 
 		case 8:
+			// Revoke Sessions (e.g. lost device)
+			fmt.Print("Enter Device ID (empty to revoke by username): ")
+			target, _ := reader.ReadString('\n')
+			target = strings.TrimSpace(target)
+
+			payload := map[string]string{"device_id": target}
+			if target == "" {
+				fmt.Print("Enter Username: ")
+				user, _ := reader.ReadString('\n')
+				payload = map[string]string{"username": strings.TrimSpace(user)}
+			}
+			jsonBytes, _ := json.Marshal(payload)
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_revoke_sessions(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+			} else {
+				printFailure("Request Failed", body)
+			}
+
+		case 9:
+			// Create Enrollment Token (handed to whoever sets up the device)
+			fmt.Print("Bind to Username (empty for any): ")
+			user, _ := reader.ReadString('\n')
+			fmt.Print("Group (optional): ")
+			group, _ := reader.ReadString('\n')
+			fmt.Print("Max Uses (default 1): ")
+			usesStr, _ := reader.ReadString('\n')
+			maxUses := 1
+			fmt.Sscanf(strings.TrimSpace(usesStr), "%d", &maxUses)
+			fmt.Print("Expires in Hours (0 = never, default 24): ")
+			hoursStr, _ := reader.ReadString('\n')
+			hours := 24
+			fmt.Sscanf(strings.TrimSpace(hoursStr), "%d", &hours)
+
+			payload := map[string]interface{}{
+				"username":         strings.TrimSpace(user),
+				"group":            strings.TrimSpace(group),
+				"max_uses":         maxUses,
+				"expires_in_hours": hours,
+			}
+			jsonBytes, _ := json.Marshal(payload)
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_create_enrollment_token(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+				fmt.Println("Put the token in the device's config.yml (client.enrollment_token); it is not shown again.")
+			} else {
+				printFailure("Request Failed", body)
+			}
+
+		case 10:
+			// List Pending Devices
+			cPayload := C.CString("{}")
+			var resp C.client_response_t
+			res := C.client_admin_list_pending_devices(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Pending Devices:\n%s\n", body)
+			} else {
+				printFailure("Failed to fetch pending devices", body)
+			}
+
+		case 11, 12:
+			// Approve / Reject Device
+			fmt.Print("Enter Device ID: ")
+			target, _ := reader.ReadString('\n')
+			payload := map[string]string{"device_id": strings.TrimSpace(target)}
+			if choice == 11 {
+				fmt.Print("Group (empty to keep): ")
+				group, _ := reader.ReadString('\n')
+				payload["group"] = strings.TrimSpace(group)
+			}
+			jsonBytes, _ := json.Marshal(payload)
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			var res C.int
+			if choice == 11 {
+				res = C.client_admin_approve_device(ctx, cPayload, &resp)
+			} else {
+				res = C.client_admin_reject_device(ctx, cPayload, &resp)
+			}
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+			} else {
+				printFailure("Request Failed", body)
+			}
+
+		case 13:
+			// Cancel a queued command (IDs are shown in the command history)
+			fmt.Print("Enter Command ID: ")
+			idStr, _ := reader.ReadString('\n')
+			var cmdID int
+			fmt.Sscanf(strings.TrimSpace(idStr), "%d", &cmdID)
+
+			jsonBytes, _ := json.Marshal(map[string]int{"cmd_id": cmdID})
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_cancel_command(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+			} else {
+				printFailure("Request Failed", body)
+			}
+
+		case 14:
+			// Prune old backup versions now (the server also does it periodically)
+			fmt.Print("Enter Device ID (empty for all): ")
+			target, _ := reader.ReadString('\n')
+			fmt.Print("Dry run? (Y/n): ")
+			dry, _ := reader.ReadString('\n')
+			dry = strings.ToLower(strings.TrimSpace(dry))
+
+			payload := map[string]interface{}{
+				"device_id": strings.TrimSpace(target),
+				"dry_run":   dry != "n" && dry != "no",
+			}
+			jsonBytes, _ := json.Marshal(payload)
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_retention_run(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+			} else {
+				printFailure("Retention run failed", body)
+			}
+
+		case 15:
+			// Snapshots the server found damaged; optionally re-check everything
+			fmt.Print("Enter Device ID (empty for all): ")
+			target, _ := reader.ReadString('\n')
+			fmt.Print("Start a scrub now? (y/N): ")
+			scrub, _ := reader.ReadString('\n')
+			scrub = strings.ToLower(strings.TrimSpace(scrub))
+
+			payload := map[string]interface{}{
+				"device_id": strings.TrimSpace(target),
+				"scrub":     scrub == "y" || scrub == "yes",
+			}
+			jsonBytes, _ := json.Marshal(payload)
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_backup_integrity(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Response: %s\n", body)
+			} else {
+				printFailure("Request Failed", body)
+			}
+
+		case 16:
+			// Uploads and restores the agents stopped working on
+			fmt.Print("Idle for at least how many minutes? (empty for server default): ")
+			idleStr, _ := reader.ReadString('\n')
+			var idle int
+			fmt.Sscanf(strings.TrimSpace(idleStr), "%d", &idle)
+
+			jsonBytes, _ := json.Marshal(map[string]int{"idle_minutes": idle})
+			cPayload := C.CString(string(jsonBytes))
+
+			var resp C.client_response_t
+			res := C.client_admin_stuck_transfers(ctx, cPayload, &resp)
+			C.free(unsafe.Pointer(cPayload))
+			body := clientcore.TakeResponse(unsafe.Pointer(&resp))
+
+			if res == 1 {
+				fmt.Printf("Stuck Transfers:\n%s\n", body)
+			} else {
+				printFailure("Failed to fetch stuck transfers", body)
+			}
+
+		case 17:
+			C.client_logout(ctx)
 			return
 		}
 	}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"demo/network/go_server/app/services"
 	"demo/network/go_server/server"
 	"encoding/json"
 	"fmt"
@@ -26,7 +27,7 @@ func HandleAdminGetLogs(sock int, payload string) {
 	}
 
 	// Use Service
-	cmd, err := AdminSvc.QueueGetLogs(req.TargetDeviceID, lc)
+	cmd, err := AdminSvc.QueueGetLogs(req.TargetDeviceID, lc, actorID(sock))
 	if err != nil {
 		server.SendResponse(sock, 0xD2, 500, map[string]string{"error": "Failed to queue command"})
 		return
@@ -74,3 +75,31 @@ func HandleAdminGetCommandHistory(sock int, payload string) {
 	respBytes, _ := json.Marshal(cmds)
 	server.SendResponse(sock, 0xDB, 200, map[string]string{"history": string(respBytes)})
 }
+
+// HandleAdminCancelCommand cancels a queued command: {"cmd_id": 12}
+func HandleAdminCancelCommand(sock int, payload string) {
+	var req struct {
+		CmdID uint `json:"cmd_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.CmdID == 0 {
+		server.SendResponse(sock, 0xCC, 400, map[string]string{"error": "cmd_id required"})
+		return
+	}
+
+	cmd, err := CmdSvc.CancelCommand(req.CmdID, actorID(sock))
+	switch err {
+	case nil:
+	case services.ErrCommandNotFound:
+		server.SendResponse(sock, 0xCC, 404, map[string]string{"error": "Command not found"})
+		return
+	case services.ErrInvalidCommandStatus:
+		server.SendResponse(sock, 0xCC, 409, map[string]string{"error": fmt.Sprintf("Command is already %s", cmd.Status)})
+		return
+	default:
+		server.SendResponse(sock, 0xCC, 500, map[string]string{"error": "Failed to cancel command"})
+		return
+	}
+
+	fmt.Printf("[Admin] Command %d for %s cancelled by user %d\n", cmd.ID, cmd.DeviceID, cmd.CancelledBy)
+	server.SendResponse(sock, 0xCC, 200, map[string]string{"status": "Command Cancelled", "cmd_id": fmt.Sprint(cmd.ID)})
+}
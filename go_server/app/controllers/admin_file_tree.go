@@ -18,19 +18,19 @@ func HandleAdminGetFileTree(adminSock int, payload string) {
 
 	var req services.TreeQuery
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(adminSock, 0xE9, 400, `{"error": "Invalid Payload"}`)
+		server.SendError(adminSock, 0xE9, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	if req.DeviceID == "" {
-		server.SendResponse(adminSock, 0xE9, 400, `{"error": "Missing Device ID"}`)
+		server.SendError(adminSock, 0xE9, 400, server.CodeInvalidPayload, "Missing Device ID")
 		return
 	}
 
 	resp, err := directoryTreeSvc.GetTree(req)
 	if err != nil {
 		fmt.Printf("[Error] Failed to get tree: %v\n", err)
-		server.SendResponse(adminSock, 0xE9, 500, `{"error": "Internal Server Error"}`)
+		server.SendError(adminSock, 0xE9, 500, server.CodeInternal, "Internal Server Error")
 		return
 	}
 
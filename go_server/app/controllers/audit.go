@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/server"
+	"encoding/json"
+)
+
+// RecordAudit stores who made a request and how it was answered. Requests
+// without a session are recorded by address. Registered as server.Audit.
+func RecordAudit(r *server.Request) {
+	if AuditSvc == nil {
+		return
+	}
+
+	var req struct {
+		TargetDeviceID string `json:"target_device_id"`
+		DeviceID       string `json:"device_id"`
+		Username       string `json:"username"`
+	}
+	json.Unmarshal([]byte(r.Payload), &req)
+
+	target := req.TargetDeviceID
+	if target == "" {
+		target = req.DeviceID
+	}
+	if target == "" {
+		target = req.Username
+	}
+
+	event := &models.AuditEvent{
+		MsgType: r.Route.Type,
+		Action:  r.Route.Name,
+		Target:  target,
+		IP:      server.PeerIP(r.Sock),
+		Status:  r.Status,
+		Allowed: r.Status != 401 && r.Status != 403 && r.Status != 429,
+	}
+	if p := r.Principal; p != nil {
+		event.UserID, event.Role, event.SessionID, event.DeviceID = p.UserID, p.Role, p.SessionID, p.DeviceID
+	}
+	AuditSvc.Record(event)
+}
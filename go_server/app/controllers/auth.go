@@ -3,10 +3,12 @@ package controllers
 import (
 	"demo/network/go_server/app/dto"
 	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/services"
 	"demo/network/go_server/global"
 	"demo/network/go_server/server"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 func HandleLogin(sock int, payload string) {
@@ -19,14 +21,9 @@ func HandleLogin(sock int, payload string) {
 
 	fmt.Printf("[Controller] Login Attempt: %s (Device: %s)\n", req.Username, req.DeviceID)
 
-	var user models.User
-	if result := global.DB.Where("username = ?", req.Username).First(&user); result.Error != nil {
-		server.SendResponse(sock, 0xA2, 401, map[string]string{"error": "User not found"})
-		return
-	}
-
-	if user.Password != req.Password {
-		server.SendResponse(sock, 0xA2, 401, map[string]string{"error": "Invalid Password"})
+	user, err := UserSvc.Authenticate(req.Username, req.Password)
+	if err != nil {
+		sendLoginError(sock, 0xA2, err)
 		return
 	}
 
@@ -37,8 +34,28 @@ func HandleLogin(sock int, payload string) {
 		server.SendResponse(sock, 0xA2, 403, map[string]string{"error": "Device not registered"})
 		return
 	}
+	switch device.Status {
+	case models.DeviceStatusPending:
+		server.SendError(sock, 0xA2, 403, server.CodeDevicePending, "Device waiting for approval")
+		return
+	case models.DeviceStatusRejected:
+		server.SendError(sock, 0xA2, 403, server.CodeDeviceRejected, "Device rejected")
+		return
+	}
 
-	server.SendResponse(sock, 0xA2, 200, map[string]string{"message": "Login Successful", "user_id": fmt.Sprint(user.ID)})
+	token, session, err := SessionSvc.Issue(user, device.DeviceID, false)
+	if err != nil {
+		server.SendResponse(sock, 0xA2, 500, map[string]string{"error": "Failed to create session"})
+		return
+	}
+
+	server.SendResponse(sock, 0xA2, 200, map[string]string{
+		"message":              "Login Successful",
+		"user_id":              fmt.Sprint(user.ID),
+		"session_token":        token,
+		"expires_at":           session.ExpiresAt.Format(time.RFC3339),
+		"must_change_password": fmt.Sprint(session.PasswordChangeRequired),
+	})
 }
 
 func HandleAdminLogin(sock int, payload string) {
@@ -51,32 +68,84 @@ func HandleAdminLogin(sock int, payload string) {
 
 	fmt.Printf("[Controller] Admin Login Attempt: %s\n", req.Username)
 
-	// Hardcoded Admin Check or DB Check
-	// For simplicity, let's assume admin user must be in DB with username "admin"
-	// Or even simpler as per request: "check username == admin && password == admin" ??
-	// The user said: "check username == admin và mật khẩu"
-	// Let's check DB for the user first.
+	user, err := UserSvc.Authenticate(req.Username, req.Password)
+	if err != nil {
+		sendLoginError(sock, 0xD7, err)
+		return
+	}
 
-	var user models.User
-	if result := global.DB.Where("username = ?", req.Username).First(&user); result.Error != nil {
-		server.SendResponse(sock, 0xD7, 401, map[string]string{"error": "User not found"})
+	// Any role with console permissions may log in; what it can do is
+	// checked per route (server.RoutePermissions)
+	if !models.CanUseConsole(user.Role) {
+		server.SendResponse(sock, 0xD7, 403, map[string]string{"error": "Not an admin user"})
 		return
 	}
 
-	if user.Password != req.Password {
-		server.SendResponse(sock, 0xD7, 401, map[string]string{"error": "Invalid Password"})
+	// No Device Check
+	token, session, err := SessionSvc.Issue(user, "", true)
+	if err != nil {
+		server.SendResponse(sock, 0xD7, 500, map[string]string{"error": "Failed to create session"})
 		return
 	}
 
-	// Check if username is "admin" strictly if requested, or just allow any valid user?
-	// User said: "check username == admin".
-	if user.Username != "admin" {
-		server.SendResponse(sock, 0xD7, 403, map[string]string{"error": "Not an admin user"})
+	server.SendResponse(sock, 0xD7, 200, map[string]string{
+		"message":              "Admin Login Successful",
+		"role":                 user.Role,
+		"session_token":        token,
+		"expires_at":           session.ExpiresAt.Format(time.RFC3339),
+		"must_change_password": fmt.Sprint(session.PasswordChangeRequired),
+	})
+}
+
+func sendLoginError(sock int, respType int, err error) {
+	switch err {
+	case services.ErrUserNotFound:
+		server.SendResponse(sock, respType, 401, map[string]string{"error": "User not found"})
+	case services.ErrInvalidPassword:
+		server.SendResponse(sock, respType, 401, map[string]string{"error": "Invalid Password"})
+	default:
+		server.SendResponse(sock, respType, 500, map[string]string{"error": "Internal Error"})
+	}
+}
+
+// HandleChangePassword lets a logged-in user replace their password. This is
+// the only request (besides logout) allowed while a change is required.
+func HandleChangePassword(sock int, payload string) {
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendResponse(sock, 0xA6, 400, map[string]string{"error": "Invalid JSON"})
 		return
 	}
 
-	// No Device Check
-	server.SendResponse(sock, 0xD7, 200, map[string]string{"message": "Admin Login Successful"})
+	principal := server.CurrentPrincipal(sock)
+	if principal == nil {
+		server.SendResponse(sock, 0xA6, 401, map[string]string{"error": "Not logged in"})
+		return
+	}
+
+	err := UserSvc.ChangePassword(principal.UserID, req.OldPassword, req.NewPassword)
+	switch err {
+	case nil:
+	case services.ErrInvalidPassword:
+		server.SendResponse(sock, 0xA6, 401, map[string]string{"error": "Invalid Password"})
+		return
+	case services.ErrWeakPassword, services.ErrSamePassword:
+		server.SendResponse(sock, 0xA6, 400, map[string]string{"error": err.Error()})
+		return
+	default:
+		server.SendResponse(sock, 0xA6, 500, map[string]string{"error": "Failed to change password"})
+		return
+	}
+
+	if err := SessionSvc.PasswordChanged(principal.SessionID, principal.UserID); err != nil {
+		fmt.Printf("[Auth] Failed to update sessions after password change: %v\n", err)
+	}
+
+	fmt.Printf("[Auth] Password changed for user %d\n", principal.UserID)
+	server.SendResponse(sock, 0xA6, 200, map[string]string{"message": "Password changed"})
 }
 
 func HandleDeviceRegister(sock int, payload string) {
@@ -89,20 +158,59 @@ func HandleDeviceRegister(sock int, payload string) {
 
 	fmt.Printf("[Controller] Device Register Attempt: %s / %s\n", req.Username, req.DeviceID)
 
-	// Validate User (Assuming user must exist to register device, or at least provided creds - for now just username check)
-	// In a real scenario, we might want to auth the user first, but here we just trust the username for registration flow as per prompt implying "auto register".
-	// However, we should probably check if user exists.
-	var user models.User
-	if result := global.DB.Where("username = ?", req.Username).First(&user); result.Error != nil {
-		server.SendResponse(sock, 0xC2, 404, map[string]string{"error": "User not found"})
+	// An enrollment token, if given, must be valid even when tokens are optional
+	var token *models.EnrollmentToken
+	if req.EnrollmentToken != "" {
+		token, err = EnrollmentSvc.CheckToken(req.EnrollmentToken)
+		if err != nil {
+			sendEnrollmentError(sock, err)
+			return
+		}
+	} else if EnrollmentSvc.RequireToken {
+		sendEnrollmentError(sock, services.ErrEnrollmentTokenRequired)
+		return
+	}
+
+	// Owner: the user the token is bound to, otherwise the registering user
+	// has to prove who they are
+	var user *models.User
+	if token != nil && token.UserID != 0 {
+		user, err = UserSvc.GetByID(token.UserID)
+	} else {
+		user, err = UserSvc.Authenticate(req.Username, req.Password)
+	}
+	if err != nil {
+		sendLoginError(sock, 0xC2, err)
 		return
 	}
 
 	// Check if device already exists
-	var device models.Device
-	if result := global.DB.Where("device_id = ?", req.DeviceID).First(&device); result.Error == nil {
+	if device, err := EnrollmentSvc.GetDevice(req.DeviceID); err == nil {
+		if device.UserID != user.ID {
+			server.SendResponse(sock, 0xC2, 409, map[string]string{"error": "Device registered to another user"})
+			return
+		}
 		// Already registered
-		server.SendResponse(sock, 0xC2, 200, map[string]string{"message": "Device already registered", "device_id": device.DeviceID})
+		resp := map[string]string{"message": "Device already registered", "device_id": device.DeviceID, "status": device.Status}
+
+		// An approved device without a usable certificate (it registered
+		// before TLS was on, or lost its key) asks again with a CSR
+		if req.CSR != "" && CertSvc != nil && device.Status == models.DeviceStatusApproved {
+			certPEM, serial, err := CertSvc.SignDeviceCSR(device.DeviceID, req.CSR)
+			if err != nil {
+				fmt.Printf("[Controller] CSR rejected for %s: %v\n", device.DeviceID, err)
+				server.SendResponse(sock, 0xC2, 400, map[string]string{"error": "Invalid certificate request"})
+				return
+			}
+			if err := EnrollmentSvc.Reissue(device, serial, token); err != nil {
+				sendEnrollmentError(sock, err)
+				return
+			}
+			fmt.Printf("[Enrollment] Issued a new certificate to %s (%s)\n", device.DeviceID, user.Username)
+			resp["message"] = "Device already registered, certificate issued"
+			resp["certificate"] = certPEM
+		}
+		server.SendResponse(sock, 0xC2, 200, resp)
 		return
 	}
 
@@ -117,10 +225,41 @@ func HandleDeviceRegister(sock int, payload string) {
 		Arch:      req.Arch,
 	}
 
-	if err := global.DB.Create(&newDevice).Error; err != nil {
-		server.SendResponse(sock, 0xC2, 500, map[string]string{"error": "Failed to register device"})
+	// Issue the device its own client certificate (CN = device_id)
+	var certPEM string
+	if req.CSR != "" && CertSvc != nil {
+		var serial string
+		certPEM, serial, err = CertSvc.SignDeviceCSR(req.DeviceID, req.CSR)
+		if err != nil {
+			fmt.Printf("[Controller] CSR rejected for %s: %v\n", req.DeviceID, err)
+			server.SendResponse(sock, 0xC2, 400, map[string]string{"error": "Invalid certificate request"})
+			return
+		}
+		newDevice.CertSerial = serial
+	}
+
+	if err := EnrollmentSvc.Register(&newDevice, token); err != nil {
+		sendEnrollmentError(sock, err)
 		return
 	}
 
-	server.SendResponse(sock, 0xC2, 200, map[string]string{"message": "Device registered successfully", "device_id": newDevice.DeviceID})
+	message := "Device registered successfully"
+	if newDevice.Status == models.DeviceStatusPending {
+		message = "Device registered, waiting for admin approval"
+		fmt.Printf("[Enrollment] Device %s (%s) is waiting for approval\n", newDevice.DeviceID, user.Username)
+	}
+	resp := map[string]string{"message": message, "device_id": newDevice.DeviceID, "status": newDevice.Status}
+	if certPEM != "" {
+		resp["certificate"] = certPEM
+	}
+	server.SendResponse(sock, 0xC2, 200, resp)
+}
+
+func sendEnrollmentError(sock int, err error) {
+	switch err {
+	case services.ErrEnrollmentTokenRequired, services.ErrInvalidEnrollmentToken:
+		server.SendResponse(sock, 0xC2, 403, map[string]string{"error": err.Error()})
+	default:
+		server.SendResponse(sock, 0xC2, 500, map[string]string{"error": "Failed to register device"})
+	}
 }
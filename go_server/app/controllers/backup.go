@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"demo/network/go_server/app/services"
 	"demo/network/go_server/server"
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -34,22 +36,54 @@ type BackupChunkReq struct {
 	Data       string `json:"data"` // Hex encoded or base64
 }
 
+// BackupChunkDataReq is the header of a binary chunk frame; the bytes follow
+// it raw.
+type BackupChunkDataReq struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+	DataLen    int64  `json:"data_len"`
+	SHA256     string `json:"sha256"`
+}
+
 type BackupFinishReq struct {
+	TransferID string              `json:"transfer_id"`
+	ServerPath string              `json:"server_path"` // Ignored: the server picks the storage key
+	FileHash   string              `json:"file_hash"`
+	Chunks     []services.ChunkRef `json:"chunks"` // Set for a deduplicated upload: the file's chunks in order
+}
+
+// BackupChunkQueryReq asks which chunks of a deduplicated upload the server
+// still needs.
+type BackupChunkQueryReq struct {
+	TransferID string   `json:"transfer_id"`
+	Hashes     []string `json:"hashes"`
+}
+
+type BackupChunkQueryResp struct {
+	Missing []string `json:"missing"`
+}
+
+// BackupChunkPutReq is the header of a content-addressed chunk frame.
+type BackupChunkPutReq struct {
 	TransferID string `json:"transfer_id"`
-	ServerPath string `json:"server_path"`
-	FileHash   string `json:"file_hash"`
+	DataLen    int64  `json:"data_len"`
+	SHA256     string `json:"sha256"`
 }
 
 func HandleBackupInit(clientID int, payload string) {
 	var req BackupInitReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0xF2, 400, `{"error": "Invalid Payload"}`)
+		server.SendError(clientID, 0xF2, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	session, err := BackupSvc.InitSession(req.DeviceID, req.FileUUID, req.FileName, req.TotalSize, req.HeadHash)
+	if errors.Is(err, services.ErrInvalidFileName) {
+		server.SendError(clientID, 0xF2, 400, server.CodeInvalidPayload, err.Error())
+		return
+	}
 	if err != nil {
-		server.SendResponse(clientID, 0xF2, 500, fmt.Sprintf(`{"error": "%v"}`, err))
+		server.SendError(clientID, 0xF2, 500, server.CodeInternal, err.Error())
 		return
 	}
 
@@ -59,31 +93,123 @@ func HandleBackupInit(clientID int, payload string) {
 func HandleBackupChunk(clientID int, payload string) {
 	var req BackupChunkReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0xF4, 400, `{"error": "Invalid Payload"}`)
+		server.SendError(clientID, 0xF4, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	fmt.Printf("[Backup] Chunk Received: %s (Offset: %d, Len: %d)\n", req.TransferID, req.Offset, req.DataLen)
 
 	err := BackupSvc.UpdateChunk(req.TransferID, req.Offset, req.DataLen, req.Data)
+	if errors.Is(err, services.ErrOffsetMismatch) {
+		sendOffsetConflict(clientID, 0xF4, err)
+		return
+	}
 	if err != nil {
-		server.SendResponse(clientID, 0xF4, 500, fmt.Sprintf(`{"error": "%v"}`, err))
+		server.SendError(clientID, 0xF4, 500, server.CodeInternal, err.Error())
 		return
 	}
 
 	server.SendResponse(clientID, 0xF4, 200, `{"status": "chunk_received"}`)
 }
 
+func HandleBackupChunkData(clientID int, payload string) {
+	var req BackupChunkDataReq
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(clientID, 0xFB, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	fmt.Printf("[Backup] Chunk Received: %s (Offset: %d, Len: %d)\n", req.TransferID, req.Offset, req.DataLen)
+
+	err := BackupSvc.WriteChunk(req.TransferID, req.Offset, req.DataLen, req.SHA256, server.RequestData(clientID))
+	if err == services.ErrChecksumMismatch {
+		server.SendError(clientID, 0xFB, 400, server.CodeChecksumMismatch, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrOffsetMismatch) {
+		sendOffsetConflict(clientID, 0xFB, err)
+		return
+	}
+	if err != nil {
+		server.SendError(clientID, 0xFB, 500, server.CodeInternal, err.Error())
+		return
+	}
+
+	server.SendResponse(clientID, 0xFB, 200, `{"status": "chunk_received"}`)
+}
+
+// sendOffsetConflict answers a chunk that does not continue the upload with
+// 409 and {"current_offset": n} as data, where the agent should go on from.
+func sendOffsetConflict(clientID int, msgType int, err error) {
+	var offsetErr *services.OffsetError
+	if !errors.As(err, &offsetErr) {
+		server.SendError(clientID, msgType, 409, server.CodeConflict, err.Error())
+		return
+	}
+	server.SendErrorData(clientID, msgType, 409, server.CodeConflict, err.Error(), map[string]int64{"current_offset": offsetErr.CurrentOffset})
+}
+
+func HandleBackupChunkQuery(clientID int, payload string) {
+	var req BackupChunkQueryReq
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(clientID, 0xEB, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	missing, err := BackupSvc.MissingChunks(req.TransferID, req.Hashes)
+	if err != nil {
+		server.SendError(clientID, 0xEB, 400, server.CodeInvalidPayload, err.Error())
+		return
+	}
+
+	server.SendResponse(clientID, 0xEB, 200, BackupChunkQueryResp{Missing: missing})
+}
+
+func HandleBackupChunkPut(clientID int, payload string) {
+	var req BackupChunkPutReq
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(clientID, 0xED, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	err := BackupSvc.PutChunk(req.TransferID, req.SHA256, req.DataLen, server.RequestData(clientID))
+	switch err {
+	case nil:
+		server.SendResponse(clientID, 0xED, 200, `{"status": "chunk_stored"}`)
+	case services.ErrChecksumMismatch:
+		server.SendError(clientID, 0xED, 400, server.CodeChecksumMismatch, err.Error())
+	case services.ErrInvalidChunkHash:
+		server.SendError(clientID, 0xED, 400, server.CodeInvalidPayload, err.Error())
+	case services.ErrChunkTooLarge:
+		server.SendError(clientID, 0xED, 413, server.CodeTooLarge, err.Error())
+	default:
+		server.SendError(clientID, 0xED, 500, server.CodeInternal, err.Error())
+	}
+}
+
 func HandleBackupFinish(clientID int, payload string) {
 	var req BackupFinishReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0xF6, 400, `{"error": "Invalid Payload"}`)
+		server.SendError(clientID, 0xF6, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
-	err := BackupSvc.FinishSession(req.TransferID, req.ServerPath, req.FileHash)
-	if err != nil {
-		server.SendResponse(clientID, 0xF6, 500, fmt.Sprintf(`{"error": "%v"}`, err))
+	var err error
+	if req.Chunks != nil {
+		err = BackupSvc.FinishChunkedSession(req.TransferID, req.FileHash, req.Chunks)
+	} else {
+		err = BackupSvc.FinishSession(req.TransferID, req.FileHash)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrFileHashMismatch):
+		server.SendError(clientID, 0xF6, 400, server.CodeChecksumMismatch, err.Error())
+		return
+	case errors.Is(err, services.ErrIncompleteUpload):
+		server.SendError(clientID, 0xF6, 409, server.CodeConflict, err.Error())
+		return
+	default:
+		server.SendError(clientID, 0xF6, 500, server.CodeInternal, err.Error())
 		return
 	}
 
@@ -105,7 +231,7 @@ func HandleBackupCancel(clientID int, payload string) {
 func HandleBackupResume(clientID int, payload string) {
 	var req BackupResumeReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0xF9, 400, `{"error": "Invalid Payload"}`)
+		server.SendError(clientID, 0xF9, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/services"
 	"demo/network/go_server/server"
 	"encoding/json"
 	"fmt"
@@ -32,3 +34,50 @@ func HandleClientLogUpload(sock int, payload string) {
 
 	server.SendResponse(sock, 0xD5, 200, map[string]string{"status": "Logs Saved"})
 }
+
+// HandleClientCommandStatus records a device's progress report for a command
+// it was sent: {"device_id": "...", "cmd_id": 12, "status": "COMPLETED",
+// "result": "...", "error": "..."}
+func HandleClientCommandStatus(sock int, payload string) {
+	var req struct {
+		DeviceID string               `json:"device_id"`
+		CmdID    uint                 `json:"cmd_id"`
+		Status   models.CommandStatus `json:"status"`
+		Result   string               `json:"result"`
+		Error    string               `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.CmdID == 0 {
+		server.SendResponse(sock, 0xDF, 400, map[string]string{"error": "Invalid Payload"})
+		return
+	}
+
+	cmd, updated, err := CmdSvc.ReportStatus(req.DeviceID, req.CmdID, req.Status, req.Result, req.Error)
+	switch err {
+	case nil:
+	case services.ErrCommandNotFound:
+		server.SendResponse(sock, 0xDF, 404, map[string]string{"error": "Command not found"})
+		return
+	case services.ErrInvalidCommandStatus:
+		server.SendResponse(sock, 0xDF, 409, map[string]string{"error": fmt.Sprintf("Command is %s", cmd.Status)})
+		return
+	default:
+		server.SendResponse(sock, 0xDF, 500, map[string]string{"error": "Failed to update command"})
+		return
+	}
+
+	if !updated {
+		server.SendResponse(sock, 0xDF, 200, map[string]string{"status": string(cmd.Status)})
+		return
+	}
+
+	fmt.Printf("[Command] %d on %s: %s\n", cmd.ID, cmd.DeviceID, cmd.Status)
+
+	// GET_LOGS output also goes to the stored logs view
+	if cmd.CommandType == 0xD3 && cmd.Status == models.StatusCompleted && req.Result != "" {
+		if err := LogSvc.StoreCommandLog(cmd.DeviceID, req.Result, cmd.ID); err != nil {
+			fmt.Printf("[Command] Failed to store logs of command %d: %v\n", cmd.ID, err)
+		}
+	}
+
+	server.SendResponse(sock, 0xDF, 200, map[string]string{"status": string(cmd.Status)})
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/services"
+	"demo/network/go_server/server"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HandleAdminCreateEnrollmentToken mints a token for registering devices:
+// {"username": "alice", "group": "laptops", "max_uses": 1, "expires_in_hours": 24}
+// All fields are optional; the token is only shown in this response.
+func HandleAdminCreateEnrollmentToken(sock int, payload string) {
+	var req struct {
+		Username       string `json:"username"`
+		Group          string `json:"group"`
+		MaxUses        int    `json:"max_uses"`
+		ExpiresInHours int    `json:"expires_in_hours"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendResponse(sock, 0xC4, 400, map[string]string{"error": "Invalid Payload"})
+		return
+	}
+
+	var userID uint
+	if req.Username != "" {
+		user, err := UserSvc.GetByUsername(req.Username)
+		if err != nil {
+			server.SendResponse(sock, 0xC4, 404, map[string]string{"error": "User not found"})
+			return
+		}
+		userID = user.ID
+	}
+
+	ttl := time.Duration(req.ExpiresInHours) * time.Hour
+	token, record, err := EnrollmentSvc.CreateToken(userID, req.Group, req.MaxUses, ttl, actorID(sock))
+	if err != nil {
+		server.SendResponse(sock, 0xC4, 500, map[string]string{"error": "Failed to create token"})
+		return
+	}
+
+	fmt.Printf("[Enrollment] Token %d created by user %d (user=%q group=%q uses=%d)\n",
+		record.ID, record.CreatedBy, req.Username, record.Group, record.MaxUses)
+
+	resp := map[string]string{
+		"status":           "Token Created",
+		"enrollment_token": token,
+		"max_uses":         fmt.Sprint(record.MaxUses),
+	}
+	if record.ExpiresAt != nil {
+		resp["expires_at"] = record.ExpiresAt.Format(time.RFC3339)
+	}
+	server.SendResponse(sock, 0xC4, 200, resp)
+}
+
+func HandleAdminListPendingDevices(sock int, payload string) {
+	devices, err := EnrollmentSvc.ListPending()
+	if err != nil {
+		server.SendResponse(sock, 0xC6, 500, map[string]string{"error": "Failed to list devices"})
+		return
+	}
+
+	respBytes, _ := json.Marshal(devices)
+	server.SendResponse(sock, 0xC6, 200, map[string]string{"devices": string(respBytes)})
+}
+
+// HandleAdminApproveDevice: {"device_id": "...", "group": "optional"}
+func HandleAdminApproveDevice(sock int, payload string) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Group    string `json:"group"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.DeviceID == "" {
+		server.SendResponse(sock, 0xC8, 400, map[string]string{"error": "device_id required"})
+		return
+	}
+
+	device, err := EnrollmentSvc.Approve(req.DeviceID, req.Group, actorID(sock))
+	if err != nil {
+		sendReviewError(sock, 0xC8, err)
+		return
+	}
+
+	fmt.Printf("[Enrollment] Device %s approved by user %d\n", device.DeviceID, device.ReviewedBy)
+	server.SendResponse(sock, 0xC8, 200, map[string]string{"status": "Device Approved", "device_id": device.DeviceID})
+
+	// Commands queued while it was pending can go out now if it is connected
+	go server.ProcessCommandQueue(device.DeviceID)
+}
+
+// HandleAdminRejectDevice: {"device_id": "..."}. Also ends its sessions,
+// in case the device had been approved before.
+func HandleAdminRejectDevice(sock int, payload string) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.DeviceID == "" {
+		server.SendResponse(sock, 0xCA, 400, map[string]string{"error": "device_id required"})
+		return
+	}
+
+	device, err := EnrollmentSvc.Reject(req.DeviceID, actorID(sock))
+	if err != nil {
+		sendReviewError(sock, 0xCA, err)
+		return
+	}
+	if _, err := SessionSvc.RevokeDevice(device.DeviceID); err != nil {
+		fmt.Printf("[Enrollment] Failed to revoke sessions of %s: %v\n", device.DeviceID, err)
+	}
+
+	fmt.Printf("[Enrollment] Device %s rejected by user %d\n", device.DeviceID, device.ReviewedBy)
+	server.SendResponse(sock, 0xCA, 200, map[string]string{"status": "Device Rejected", "device_id": device.DeviceID})
+}
+
+func sendReviewError(sock int, respType int, err error) {
+	if err == services.ErrDeviceNotFound {
+		server.SendResponse(sock, respType, 404, map[string]string{"error": "Device not found"})
+		return
+	}
+	server.SendResponse(sock, respType, 500, map[string]string{"error": "Failed to update device"})
+}
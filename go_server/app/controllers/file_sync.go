@@ -22,12 +22,12 @@ func HandleClientFileSync(clientID int, payload string) {
 	var req FileSyncRequest
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
 		fmt.Printf("[Error] Failed to unmarshal file sync payload: %v\n", err)
-		server.SendResponse(clientID, 0xE7, 0, `{"status": "error", "message": "Invalid Payload"}`)
+		server.SendError(clientID, 0xE7, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	if req.DeviceID == "" {
-		server.SendResponse(clientID, 0xE7, 0, `{"status": "error", "message": "Missing Device ID"}`)
+		server.SendError(clientID, 0xE7, 400, server.CodeInvalidPayload, "Missing Device ID")
 		return
 	}
 
@@ -35,7 +35,7 @@ func HandleClientFileSync(clientID int, payload string) {
 	err := FileHistorySvc.SyncEvents(req.DeviceID, req.Events)
 	if err != nil {
 		fmt.Printf("[Error] Failed to sync events: %v\n", err)
-		server.SendResponse(clientID, 0xE7, 0, `{"status": "error", "message": "DB Error"}`)
+		server.SendError(clientID, 0xE7, 500, server.CodeInternal, "DB Error")
 		return
 	}
 
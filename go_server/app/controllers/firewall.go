@@ -22,7 +22,7 @@ func HandleAdminFirewallControl(sock int, payload string) {
 	}
 
 	// Use FirewallService
-	err := FirewallSvc.UpdateConfig(req.TargetDeviceID, req.Enable, req.Categories)
+	err := FirewallSvc.UpdateConfig(req.TargetDeviceID, req.Enable, req.Categories, actorID(sock))
 	if err != nil {
 		server.SendResponse(sock, 0xE2, 500, map[string]string{"error": "Failed to update config"})
 		return
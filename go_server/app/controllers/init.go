@@ -12,6 +12,15 @@ var (
 	TreeSvc        *services.DirectoryTreeService
 	BackupSvc      *services.BackupService
 	RestoreSvc     *services.RestoreService
+	CertSvc        *services.CertService
+	SessionSvc     *services.SessionService
+	UserSvc        *services.UserService
+	AuditSvc       *services.AuditService
+	EnrollmentSvc  *services.EnrollmentService
+	CmdSvc         *services.CommandService
+	RetentionSvc   *services.RetentionService
+	ScrubSvc       *services.ScrubService
+	ReaperSvc      *services.ReaperService
 )
 
 func Init(fSvc *services.FirewallService, aSvc *services.AdminService, lSvc *services.LogService, fhSvc *services.FileHistoryService, tSvc *services.DirectoryTreeService, bSvc *services.BackupService, rSvc *services.RestoreService) {
@@ -27,3 +36,40 @@ func Init(fSvc *services.FirewallService, aSvc *services.AdminService, lSvc *ser
 func SetBackupService(svc *services.BackupService) {
 	BackupSvc = svc
 }
+
+// SetCertService enables issuing device client certificates at registration.
+func SetCertService(svc *services.CertService) {
+	CertSvc = svc
+}
+
+func SetSessionService(svc *services.SessionService) {
+	SessionSvc = svc
+}
+
+func SetUserService(svc *services.UserService) {
+	UserSvc = svc
+}
+
+func SetAuditService(svc *services.AuditService) {
+	AuditSvc = svc
+}
+
+func SetEnrollmentService(svc *services.EnrollmentService) {
+	EnrollmentSvc = svc
+}
+
+func SetCommandService(svc *services.CommandService) {
+	CmdSvc = svc
+}
+
+func SetRetentionService(svc *services.RetentionService) {
+	RetentionSvc = svc
+}
+
+func SetScrubService(svc *services.ScrubService) {
+	ScrubSvc = svc
+}
+
+func SetReaperService(svc *services.ReaperService) {
+	ReaperSvc = svc
+}
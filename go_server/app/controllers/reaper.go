@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/server"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HandleAdminStuckTransfers lists the uploads and restores in progress with
+// no activity for a while: {"idle_minutes": 30}. Without idle_minutes the
+// server's stuck_after_minutes applies.
+func HandleAdminStuckTransfers(sock int, payload string) {
+	var req struct {
+		IdleMinutes int `json:"idle_minutes"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.IdleMinutes < 0 {
+		server.SendError(sock, 0x80, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	backups, restores, err := ReaperSvc.Stuck(time.Duration(req.IdleMinutes) * time.Minute)
+	if err != nil {
+		fmt.Printf("[Error] Failed to list stuck transfers: %v\n", err)
+		server.SendError(sock, 0x80, 500, server.CodeInternal, "Internal Server Error")
+		return
+	}
+	if backups == nil {
+		backups = []models.BackupSession{}
+	}
+	if restores == nil {
+		restores = []models.RestoreSession{}
+	}
+
+	server.SendResponse(sock, 0x80, 200, map[string]interface{}{
+		"expire_after": ReaperSvc.ExpireAfter().String(),
+		"backups":      backups,
+		"restores":     restores,
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"demo/network/go_server/server"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 )
 
 type AdminRestoreReq struct {
@@ -15,6 +16,7 @@ type AdminRestoreReq struct {
 type AdminRestoreResp struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	CmdID   uint   `json:"cmd_id,omitempty"`
 }
 
 type RestoreInitReq struct {
@@ -55,6 +57,10 @@ type RestoreChunkResp struct {
 	Status  string `json:"status"`
 }
 
+// maxChunkSize caps one binary restore chunk; the whole chunk is buffered
+// once while it is sent.
+const maxChunkSize = 16 * 1024 * 1024
+
 type RestoreFinishReq struct {
 	TransferID string `json:"transfer_id"`
 }
@@ -62,37 +68,35 @@ type RestoreFinishReq struct {
 func HandleAdminRestore(clientID int, payload string) {
 	var req AdminRestoreReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0x71, 400, `{"status": "error", "message": "Invalid Payload"}`)
+		server.SendError(clientID, 0x71, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
-	// 1. Send Command to Device
-	cmdPayload := map[string]interface{}{
-		"op":        "RESTORE_CMD",
-		"file_uuid": req.FileUUID,
-		"version":   req.Version,
+	// Queued like any other command, so the device reports the outcome
+	cmd, sent, err := AdminSvc.QueueRestore(req.DeviceID, req.FileUUID, req.Version, actorID(clientID))
+	if err != nil {
+		server.SendError(clientID, 0x71, 500, server.CodeInternal, "Failed to queue restore")
+		return
 	}
-	jCmd, _ := json.Marshal(cmdPayload)
 
-	success := server.SendToDevice(req.DeviceID, 0x72, string(jCmd))
-	if !success {
-		server.SendResponse(clientID, 0x71, 200, AdminRestoreResp{Status: "error", Message: "Device Offline"})
+	if !sent {
+		server.SendResponse(clientID, 0x71, 200, AdminRestoreResp{Status: "queued", Message: "Device offline or not approved; restore queued", CmdID: cmd.ID})
 		return
 	}
 
-	server.SendResponse(clientID, 0x71, 200, AdminRestoreResp{Status: "ok", Message: "Restore command sent to device"})
+	server.SendResponse(clientID, 0x71, 200, AdminRestoreResp{Status: "ok", Message: "Restore command sent to device", CmdID: cmd.ID})
 }
 
 func HandleRestoreInit(clientID int, payload string) {
 	var req RestoreInitReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0x74, 400, `{"status": "error"}`)
+		server.SendError(clientID, 0x74, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	session, err := RestoreSvc.InitSession(req.DeviceID, req.FileUUID, req.Version)
 	if err != nil {
-		server.SendResponse(clientID, 0x74, 200, RestoreInitResp{Status: "error"})
+		server.SendError(clientID, 0x74, 404, server.CodeNotFound, err.Error())
 		return
 	}
 
@@ -108,13 +112,13 @@ func HandleRestoreInit(clientID int, payload string) {
 func HandleRestoreResume(clientID int, payload string) {
 	var req RestoreResumeReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0x7A, 400, `{"status": "error"}`)
+		server.SendError(clientID, 0x7A, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	session, err := RestoreSvc.ResumeSession(req.TransferID)
 	if err != nil {
-		server.SendResponse(clientID, 0x7A, 200, RestoreResumeResp{Status: "error"})
+		server.SendError(clientID, 0x7A, 404, server.CodeNotFound, err.Error())
 		return
 	}
 
@@ -130,13 +134,13 @@ func HandleRestoreResume(clientID int, payload string) {
 func HandleRestoreChunk(clientID int, payload string) {
 	var req RestoreChunkReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0x76, 400, `{"status": "error"}`)
+		server.SendError(clientID, 0x76, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	data, err := RestoreSvc.GetChunk(req.TransferID, req.Offset, req.Size)
 	if err != nil {
-		server.SendResponse(clientID, 0x76, 200, RestoreChunkResp{Status: "error"})
+		server.SendError(clientID, 0x76, 409, server.CodeConflict, err.Error())
 		return
 	}
 
@@ -147,15 +151,41 @@ func HandleRestoreChunk(clientID int, payload string) {
 	})
 }
 
+// HandleRestoreChunkData answers with a binary chunk frame: the header
+// carries the length and SHA-256, the bytes follow raw.
+func HandleRestoreChunkData(clientID int, payload string) {
+	var req RestoreChunkReq
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(clientID, 0x7C, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+	if req.Size <= 0 || req.Size > maxChunkSize {
+		server.SendError(clientID, 0x7C, 400, server.CodeInvalidPayload, "Invalid chunk size")
+		return
+	}
+
+	chunk, n, err := RestoreSvc.OpenChunk(req.TransferID, req.Offset, int64(req.Size))
+	if err != nil {
+		server.SendError(clientID, 0x7C, 409, server.CodeConflict, err.Error())
+		return
+	}
+	defer chunk.Close()
+
+	header := server.ChunkHeader{TransferID: req.TransferID, Offset: req.Offset, DataLen: n}
+	if err := server.SendChunk(clientID, 0x7C, header, chunk); err != nil {
+		fmt.Printf("[Restore] Chunk %s at %d: %v\n", req.TransferID, req.Offset, err)
+	}
+}
+
 func HandleRestoreFinish(clientID int, payload string) {
 	var req RestoreFinishReq
 	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		server.SendResponse(clientID, 0x78, 400, `{"status": "error"}`)
+		server.SendError(clientID, 0x78, 400, server.CodeInvalidPayload, "Invalid Payload")
 		return
 	}
 
 	if err := RestoreSvc.FinishSession(req.TransferID); err != nil {
-		server.SendResponse(clientID, 0x78, 200, `{"status": "error"}`)
+		server.SendError(clientID, 0x78, 409, server.CodeConflict, err.Error())
 		return
 	}
 
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/services"
+	"demo/network/go_server/server"
+	"encoding/json"
+	"fmt"
+)
+
+// HandleAdminRetentionRun applies the retention policies now:
+// {"device_id": "dev-1", "dry_run": true}. Without device_id it covers
+// every device.
+func HandleAdminRetentionRun(sock int, payload string) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		DryRun   bool   `json:"dry_run"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(sock, 0x7E, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	run, pruned, err := RetentionSvc.Run(req.DeviceID, req.DryRun)
+	if err == services.ErrRetentionRunning {
+		server.SendError(sock, 0x7E, 409, server.CodeBusy, "A retention run is already in progress")
+		return
+	}
+	if run == nil {
+		fmt.Printf("[Error] Retention run failed: %v\n", err)
+		server.SendError(sock, 0x7E, 500, server.CodeInternal, "Failed to start retention run")
+		return
+	}
+
+	// A failed run still reports what it pruned before the error (run.error)
+	if pruned == nil {
+		pruned = []models.PrunedSnapshot{}
+	}
+	server.SendResponse(sock, 0x7E, 200, map[string]interface{}{"run": run, "pruned": pruned})
+}
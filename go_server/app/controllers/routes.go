@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/server"
+)
+
+// Routes is every API message the server answers, registered in main with
+// server.Register. RespType is also used for validation and panic errors.
+var Routes = []server.Route{
+	// Sessions
+	{Type: 0xA1, Name: "MSG_LOGIN_REQ", RespType: 0xA2, Handler: HandleLogin, Public: true, Device: true,
+		Schema: server.Schema{"username": server.Required(server.String), "password": server.Required(server.String), "device_id": server.Optional(server.String)}},
+	{Type: 0xA3, Name: "MSG_LOGOUT_REQ", RespType: 0xA4, Handler: HandleLogout},
+	{Type: 0xA5, Name: "MSG_CHANGE_PASSWORD_REQ", RespType: 0xA6, Handler: HandleChangePassword,
+		Schema: server.Schema{"old_password": server.Required(server.String), "new_password": server.Required(server.String)}},
+	{Type: 0xD6, Name: "MSG_ADMIN_LOGIN_REQ", RespType: 0xD7, Handler: HandleAdminLogin, Public: true,
+		Schema: server.Schema{"username": server.Required(server.String), "password": server.Required(server.String)}},
+	{Type: 0xDC, Name: "MSG_ADMIN_REVOKE_SESSION_REQ", RespType: 0xDD, Handler: HandleAdminRevokeSessions, Permission: models.PermManageSessions,
+		Schema: server.Schema{"device_id": server.Optional(server.String), "username": server.Optional(server.String)}},
+
+	// Devices and enrollment
+	{Type: 0xB1, Name: "MSG_LIST_REQ", RespType: 0xB2, Handler: HandleListUsers, Permission: models.PermListDevices},
+	{Type: 0xC1, Name: "MSG_DEVICE_REQ", RespType: 0xC2, Handler: HandleDeviceRegister, Public: true,
+		Schema: server.Schema{"device_id": server.Required(server.String), "username": server.Optional(server.String), "enrollment_token": server.Optional(server.String), "csr": server.Optional(server.String)}},
+	{Type: 0xC3, Name: "MSG_ADMIN_CREATE_ENROLLMENT_TOKEN_REQ", RespType: 0xC4, Handler: HandleAdminCreateEnrollmentToken, Permission: models.PermManageDevices,
+		Schema: server.Schema{"username": server.Optional(server.String), "group": server.Optional(server.String), "max_uses": server.Optional(server.Number), "expires_in_hours": server.Optional(server.Number)}},
+	{Type: 0xC5, Name: "MSG_ADMIN_LIST_PENDING_DEVICES_REQ", RespType: 0xC6, Handler: HandleAdminListPendingDevices, Permission: models.PermListDevices},
+	{Type: 0xC7, Name: "MSG_ADMIN_APPROVE_DEVICE_REQ", RespType: 0xC8, Handler: HandleAdminApproveDevice, Permission: models.PermManageDevices,
+		Schema: server.Schema{"device_id": server.Required(server.String), "group": server.Optional(server.String)}},
+	{Type: 0xC9, Name: "MSG_ADMIN_REJECT_DEVICE_REQ", RespType: 0xCA, Handler: HandleAdminRejectDevice, Permission: models.PermManageDevices,
+		Schema: server.Schema{"device_id": server.Required(server.String)}},
+
+	// Commands and logs
+	{Type: 0xCB, Name: "MSG_ADMIN_CANCEL_COMMAND_REQ", RespType: 0xCC, Handler: HandleAdminCancelCommand, Permission: models.PermCancelCommands,
+		Schema: server.Schema{"cmd_id": server.Required(server.Number)}},
+	{Type: 0xD1, Name: "MSG_ADMIN_COMMAND_GETLOGS_REQ", RespType: 0xD2, Handler: HandleAdminGetLogs, Permission: models.PermRequestLogs,
+		Schema: server.Schema{"target_device_id": server.Required(server.String)}},
+	{Type: 0xD4, Name: "MSG_CLIENT_COMMAND_GETLOG_REQ", RespType: 0xD5, Handler: HandleClientLogUpload, Device: true,
+		Schema: server.Schema{"device_id": server.Optional(server.String), "content": server.Optional(server.String)}},
+	{Type: 0xD8, Name: "MSG_ADMIN_GET_STORED_LOGS_REQ", RespType: 0xD9, Handler: HandleAdminGetStoredLogs, Permission: models.PermViewLogs,
+		Schema: server.Schema{"target_device_id": server.Optional(server.String)}},
+	{Type: 0xDA, Name: "MSG_ADMIN_GET_COMMAND_HISTORY_REQ", RespType: 0xDB, Handler: HandleAdminGetCommandHistory, Permission: models.PermViewHistory,
+		Schema: server.Schema{"target_device_id": server.Optional(server.String), "page": server.Optional(server.Number), "size": server.Optional(server.Number)}},
+	// Older consoles send the response type as the request
+	{Type: 0xDB, Name: "MSG_ADMIN_GET_COMMAND_HISTORY_RESP", RespType: 0xDB, Handler: HandleAdminGetCommandHistory, Permission: models.PermViewHistory},
+	{Type: 0xDE, Name: "MSG_CLIENT_COMMAND_STATUS_REQ", RespType: 0xDF, Handler: HandleClientCommandStatus, Device: true,
+		Schema: server.Schema{"cmd_id": server.Required(server.Number), "status": server.Required(server.String), "result": server.Optional(server.String), "error": server.Optional(server.String)}},
+
+	// Firewall
+	{Type: 0xE1, Name: "MSG_ADMIN_FIREWALL_CONTROL_REQ", RespType: 0xE2, Handler: HandleAdminFirewallControl, Permission: models.PermFirewall,
+		Schema: server.Schema{"target_device_id": server.Required(server.String), "enable": server.Optional(server.Bool), "categories": server.Optional(server.Array)}},
+	{Type: 0xE4, Name: "MSG_CLIENT_GET_FIREWALL_CONFIG_REQ", RespType: 0xE5, Handler: HandleClientGetFirewallConfig, Device: true,
+		Schema: server.Schema{"device_id": server.Optional(server.String)}},
+
+	// File tree
+	{Type: 0xE6, Name: "MSG_CLIENT_FILE_SYNC_REQ", RespType: 0xE7, Handler: HandleClientFileSync, Device: true,
+		Schema: server.Schema{"device_id": server.Optional(server.String), "events": server.Optional(server.Array)}},
+	{Type: 0xE8, Name: "MSG_ADMIN_GET_FILE_TREE_REQ", RespType: 0xE9, Handler: HandleAdminGetFileTree, Permission: models.PermBrowseFiles,
+		Schema: server.Schema{"device_id": server.Required(server.String), "parent_id": server.Optional(server.Number), "page": server.Optional(server.Number), "size": server.Optional(server.Number), "show_deleted": server.Optional(server.Bool)}},
+
+	// Backup
+	{Type: 0xF1, Name: "MSG_BACKUP_INIT_REQ", RespType: 0xF2, Handler: HandleBackupInit, Device: true,
+		Schema: server.Schema{"device_id": server.Required(server.String), "file_uuid": server.Required(server.String), "file_name": server.Required(server.String), "total_size": server.Optional(server.Number), "head_hash": server.Optional(server.String)}},
+	{Type: 0xF3, Name: "MSG_BACKUP_CHUNK_REQ", RespType: 0xF4, Handler: HandleBackupChunk, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "offset": server.Required(server.Number), "data_len": server.Required(server.Number), "data": server.Optional(server.String)}},
+	{Type: 0xFA, Name: "MSG_BACKUP_CHUNK_DATA_REQ", RespType: 0xFB, Handler: HandleBackupChunkData, Device: true, Binary: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "offset": server.Required(server.Number), "data_len": server.Required(server.Number), "sha256": server.Optional(server.String)}},
+	{Type: 0xEA, Name: "MSG_BACKUP_CHUNK_QUERY_REQ", RespType: 0xEB, Handler: HandleBackupChunkQuery, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "hashes": server.Required(server.Array)}},
+	{Type: 0xEC, Name: "MSG_BACKUP_CHUNK_PUT_REQ", RespType: 0xED, Handler: HandleBackupChunkPut, Device: true, Binary: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "data_len": server.Required(server.Number), "sha256": server.Required(server.String)}},
+	{Type: 0xF5, Name: "MSG_BACKUP_FINISH_REQ", RespType: 0xF6, Handler: HandleBackupFinish, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "server_path": server.Optional(server.String), "file_hash": server.Optional(server.String), "chunks": server.Optional(server.Array)}},
+	{Type: 0xF7, Name: "MSG_BACKUP_CANCEL_REQ", Handler: HandleBackupCancel, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String)}},
+	{Type: 0xF8, Name: "MSG_BACKUP_RESUME_REQ", RespType: 0xF9, Handler: HandleBackupResume, Device: true,
+		Schema: server.Schema{"device_id": server.Required(server.String), "file_uuid": server.Required(server.String), "head_hash": server.Optional(server.String), "total_size": server.Optional(server.Number)}},
+	{Type: 0x7D, Name: "MSG_ADMIN_RETENTION_RUN_REQ", RespType: 0x7E, Handler: HandleAdminRetentionRun, Permission: models.PermManageBackups,
+		Schema: server.Schema{"device_id": server.Optional(server.String), "dry_run": server.Optional(server.Bool)}},
+	{Type: 0xEE, Name: "MSG_ADMIN_BACKUP_INTEGRITY_REQ", RespType: 0xEF, Handler: HandleAdminBackupIntegrity, Permission: models.PermManageBackups,
+		Schema: server.Schema{"device_id": server.Optional(server.String), "scrub": server.Optional(server.Bool)}},
+	{Type: 0x7F, Name: "MSG_ADMIN_STUCK_TRANSFERS_REQ", RespType: 0x80, Handler: HandleAdminStuckTransfers, Permission: models.PermManageBackups,
+		Schema: server.Schema{"idle_minutes": server.Optional(server.Number)}},
+
+	// Restore
+	{Type: 0x70, Name: "MSG_ADMIN_RESTORE_REQ", RespType: 0x71, Handler: HandleAdminRestore, Permission: models.PermRestore,
+		Schema: server.Schema{"device_id": server.Required(server.String), "file_uuid": server.Required(server.String), "version": server.Optional(server.Number)}},
+	{Type: 0x73, Name: "MSG_RESTORE_INIT_REQ", RespType: 0x74, Handler: HandleRestoreInit, Device: true,
+		Schema: server.Schema{"device_id": server.Required(server.String), "file_uuid": server.Required(server.String), "version": server.Optional(server.Number)}},
+	{Type: 0x75, Name: "MSG_RESTORE_CHUNK_REQ", RespType: 0x76, Handler: HandleRestoreChunk, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "offset": server.Required(server.Number), "size": server.Required(server.Number)}},
+	{Type: 0x7B, Name: "MSG_RESTORE_CHUNK_DATA_REQ", RespType: 0x7C, Handler: HandleRestoreChunkData, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String), "offset": server.Required(server.Number), "size": server.Required(server.Number)}},
+	{Type: 0x77, Name: "MSG_RESTORE_FINISH_REQ", RespType: 0x78, Handler: HandleRestoreFinish, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String)}},
+	{Type: 0x79, Name: "MSG_RESTORE_RESUME_REQ", RespType: 0x7A, Handler: HandleRestoreResume, Device: true,
+		Schema: server.Schema{"transfer_id": server.Required(server.String)}},
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/services"
+	"demo/network/go_server/server"
+	"encoding/json"
+	"fmt"
+)
+
+// HandleAdminBackupIntegrity lists the snapshots whose stored data was found
+// missing or corrupted: {"device_id": "dev-1", "scrub": true}. With scrub it
+// also starts re-verifying every snapshot in the background.
+func HandleAdminBackupIntegrity(sock int, payload string) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Scrub    bool   `json:"scrub"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendError(sock, 0xEF, 400, server.CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+
+	if req.Scrub {
+		if err := ScrubSvc.Start(); err == services.ErrScrubRunning {
+			server.SendError(sock, 0xEF, 409, server.CodeBusy, "A scrub is already in progress")
+			return
+		}
+	}
+
+	flagged, err := ScrubSvc.Flagged(req.DeviceID)
+	if err != nil {
+		fmt.Printf("[Error] Failed to list flagged snapshots: %v\n", err)
+		server.SendError(sock, 0xEF, 500, server.CodeInternal, "Internal Server Error")
+		return
+	}
+	if flagged == nil {
+		flagged = []models.BackupSnapshot{}
+	}
+	server.SendResponse(sock, 0xEF, 200, map[string]interface{}{"scrub_started": req.Scrub, "flagged": flagged})
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/global"
+	"demo/network/go_server/server"
+	"encoding/json"
+	"fmt"
+)
+
+// Transfers are addressed by transfer_id only, so ownership is checked
+// against the device that opened them.
+var backupTransferRoutes = map[int]bool{0xEA: true, 0xEC: true, 0xF3: true, 0xF5: true, 0xF7: true, 0xFA: true}
+var restoreTransferRoutes = map[int]bool{0x75: true, 0x77: true, 0x79: true, 0x7B: true}
+
+// Routes still open to a session that must change its password first.
+var passwordChangeRoutes = map[int]bool{
+	0xA3: true, // MSG_LOGOUT_REQ
+	0xA5: true, // MSG_CHANGE_PASSWORD_REQ
+}
+
+// Authenticate validates the session_token of a request and checks that the
+// session may act on the device / transfer named in the payload.
+// Registered as server.Authenticate.
+func Authenticate(sock int, msgType int, payload string) (*server.Principal, bool) {
+	var req struct {
+		SessionToken string `json:"session_token"`
+		DeviceID     string `json:"device_id"`
+		TransferID   string `json:"transfer_id"`
+	}
+	json.Unmarshal([]byte(payload), &req)
+
+	if req.SessionToken == "" {
+		server.SendResponse(sock, 0, 401, map[string]string{"error": "Session token required"})
+		return nil, false
+	}
+
+	session, err := SessionSvc.Validate(req.SessionToken)
+	if err != nil {
+		server.SendResponse(sock, 0, 401, map[string]string{"error": "Invalid or expired session"})
+		return nil, false
+	}
+
+	if session.PasswordChangeRequired && !passwordChangeRoutes[msgType] {
+		server.SendError(sock, 0, 403, server.CodePasswordChangeRequired, "Password change required")
+		return nil, false
+	}
+
+	principal := &server.Principal{
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		DeviceID:  session.DeviceID,
+		IsAdmin:   session.IsAdmin,
+		Role:      session.Role,
+	}
+
+	if server.AdminRoutes[msgType] {
+		if !session.IsAdmin {
+			server.SendResponse(sock, 0, 403, map[string]string{"error": "Admin session required"})
+			return nil, false
+		}
+		return principal, true
+	}
+
+	if server.DeviceRoutes[msgType] {
+		if session.IsAdmin || session.DeviceID == "" {
+			server.SendResponse(sock, 0, 403, map[string]string{"error": "Device session required"})
+			return nil, false
+		}
+		if req.DeviceID != "" && req.DeviceID != session.DeviceID {
+			fmt.Printf("[Auth] Session of %s tried to act as device %s\n", session.DeviceID, req.DeviceID)
+			server.SendResponse(sock, 0, 403, map[string]string{"error": "Session does not match device"})
+			return nil, false
+		}
+		if req.TransferID != "" && !ownsTransfer(msgType, req.TransferID, session.DeviceID) {
+			fmt.Printf("[Auth] Device %s tried to use transfer %s\n", session.DeviceID, req.TransferID)
+			server.SendResponse(sock, 0, 403, map[string]string{"error": "Transfer belongs to another device"})
+			return nil, false
+		}
+	}
+
+	return principal, true
+}
+
+// actorID is the user behind the request on sock (0 if unauthenticated).
+func actorID(sock int) uint {
+	if principal := server.CurrentPrincipal(sock); principal != nil {
+		return principal.UserID
+	}
+	return 0
+}
+
+func ownsTransfer(msgType int, transferID, deviceID string) bool {
+	if backupTransferRoutes[msgType] {
+		session, err := BackupSvc.GetSession(transferID)
+		return err == nil && session.DeviceID == deviceID
+	}
+	if restoreTransferRoutes[msgType] {
+		session, err := RestoreSvc.GetSession(transferID)
+		return err == nil && session.DeviceID == deviceID
+	}
+	return true
+}
+
+func HandleLogout(sock int, payload string) {
+	principal := server.CurrentPrincipal(sock)
+	if principal == nil {
+		server.SendResponse(sock, 0xA4, 401, map[string]string{"error": "Not logged in"})
+		return
+	}
+
+	if err := SessionSvc.Revoke(principal.SessionID); err != nil {
+		server.SendResponse(sock, 0xA4, 500, map[string]string{"error": "Failed to revoke session"})
+		return
+	}
+
+	server.SendResponse(sock, 0xA4, 200, map[string]string{"message": "Logged out"})
+}
+
+// HandleAdminRevokeSessions revokes all sessions of a device or a user,
+// e.g. for a lost laptop: {"device_id": "..."} or {"username": "..."}
+func HandleAdminRevokeSessions(sock int, payload string) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		server.SendResponse(sock, 0xDD, 400, map[string]string{"error": "Invalid Payload"})
+		return
+	}
+
+	var count int64
+	var err error
+	switch {
+	case req.DeviceID != "":
+		count, err = SessionSvc.RevokeDevice(req.DeviceID)
+	case req.Username != "":
+		var user models.User
+		if result := global.DB.Where("username = ?", req.Username).First(&user); result.Error != nil {
+			server.SendResponse(sock, 0xDD, 404, map[string]string{"error": "User not found"})
+			return
+		}
+		count, err = SessionSvc.RevokeUser(user.ID)
+	default:
+		server.SendResponse(sock, 0xDD, 400, map[string]string{"error": "device_id or username required"})
+		return
+	}
+
+	if err != nil {
+		server.SendResponse(sock, 0xDD, 500, map[string]string{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	fmt.Printf("[Auth] Revoked %d session(s) (device=%q user=%q)\n", count, req.DeviceID, req.Username)
+	server.SendResponse(sock, 0xDD, 200, map[string]string{"status": "Sessions Revoked", "count": fmt.Sprint(count)})
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"demo/network/go_server/server"
 	"encoding/json"
+	"fmt"
 )
 
 func HandleListUsers(sock int, payload string) {
@@ -18,6 +19,30 @@ func HandleListUsers(sock int, payload string) {
 
 	respBytes, _ := json.Marshal(resp)
 
+	// Agent version of each online device, for the console
+	type onlineDevice struct {
+		DeviceID     string `json:"device_id"`
+		AgentVersion string `json:"agent_version"`
+		Protocol     int    `json:"protocol"`
+	}
+	devices := make([]onlineDevice, 0, len(users))
+	known := make(map[string]bool)
+	if EnrollmentSvc != nil {
+		registered, err := EnrollmentSvc.ListDevices(users)
+		if err != nil {
+			fmt.Printf("[Go] Failed to load online devices: %v\n", err)
+		}
+		for _, d := range registered {
+			devices = append(devices, onlineDevice{d.DeviceID, d.AgentVersion, d.ProtocolVersion})
+			known[d.DeviceID] = true
+		}
+	}
+	for _, id := range users {
+		if !known[id] {
+			devices = append(devices, onlineDevice{DeviceID: id}) // e.g. console sessions
+		}
+	}
+
 	// Send Response (Type 0xB2? Protocol usually implies Request+1, but existing C code uses 0x??)
 	// Protocol Check: MSG_LIST_REQ = 0xB1. Response usually 0xB2?
 	// C code used MSG_LOGIN_RESP (0xA2) or generic 200 OK.
@@ -26,7 +51,7 @@ func HandleListUsers(sock int, payload string) {
 	// Wait, protocol.h says MSG_LIST_RESP 0xB2?
 	// Let's assume 0xB2.
 
-	server.SendResponse(sock, 0xB2, 200, map[string]string{"users_json": string(respBytes)})
+	server.SendResponse(sock, 0xB2, 200, map[string]interface{}{"users_json": string(respBytes), "devices": devices})
 	// Note: Client expects "users" array in the root of JSON or "users" inside?
 	// C client expects: `{"users": [...]}`.
 	// My SendResponse wraps map into json.
@@ -7,11 +7,14 @@ type ProtocolLoginRequest struct {
 }
 
 type ProtocolDeviceRequest struct {
-	Username  string `json:"username"`
-	DeviceID  string `json:"device_id"`
-	Name      string `json:"name,omitempty"`
-	OSName    string `json:"os_name,omitempty"`
-	OSVersion string `json:"os_version,omitempty"`
-	Hostname  string `json:"hostname,omitempty"`
-	Arch      string `json:"arch,omitempty"`
+	Username        string `json:"username"`
+	Password        string `json:"password,omitempty"`         // Not needed with a token bound to a user
+	EnrollmentToken string `json:"enrollment_token,omitempty"` // Issued by an admin (MSG_ADMIN_CREATE_ENROLLMENT_TOKEN_REQ)
+	DeviceID        string `json:"device_id"`
+	Name            string `json:"name,omitempty"`
+	OSName          string `json:"os_name,omitempty"`
+	OSVersion       string `json:"os_version,omitempty"`
+	Hostname        string `json:"hostname,omitempty"`
+	Arch            string `json:"arch,omitempty"`
+	CSR             string `json:"csr,omitempty"` // PEM certificate request for a device client certificate
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent records who made a request and whether it was allowed.
+// UserID is 0 for requests without a valid session.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	Role      string    `gorm:"size:20" json:"role"`
+	SessionID uint      `json:"session_id"`
+	DeviceID  string    `gorm:"size:64" json:"device_id"` // Agent session's device
+	IP        string    `gorm:"size:64" json:"ip"`
+	MsgType   int       `json:"msg_type"`
+	Action    string    `gorm:"size:64" json:"action"`
+	Target    string    `gorm:"index;size:255" json:"target"` // Device the request was about, if any
+	Status    int       `json:"status"`                       // Of the response, 0 = none sent
+	Allowed   bool      `json:"allowed"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
@@ -11,6 +11,17 @@ const (
 	BackupCanceled   BackupStatus = "CANCELED"
 	BackupFailed     BackupStatus = "FAILED"
 	BackupDone       BackupStatus = "DONE"
+	BackupExpired    BackupStatus = "EXPIRED" // No activity for too long; partial data removed
+)
+
+// IntegrityStatus is what the last check of a snapshot's data found.
+type IntegrityStatus string
+
+const (
+	IntegrityUnchecked IntegrityStatus = ""
+	IntegrityOK        IntegrityStatus = "OK"
+	IntegrityMissing   IntegrityStatus = "MISSING"   // File or chunk gone, or shorter than recorded
+	IntegrityCorrupted IntegrityStatus = "CORRUPTED" // Content no longer matches its hash
 )
 
 // BackupSession tracks an ongoing backup process
@@ -25,7 +36,7 @@ type BackupSession struct {
 	TotalSize      int64        `json:"total_size"`
 	FileHeadHash   string       `gorm:"size:64" json:"file_head_hash"` // Hash of first 64KB
 	Status         BackupStatus `gorm:"size:20" json:"status"`
-	LastUpdateTime time.Time    `json:"last_update_time"`
+	LastUpdateTime time.Time    `gorm:"index" json:"last_update_time"` // Last chunk or query
 	CreatedAt      time.Time    `json:"created_at"`
 	UpdatedAt      time.Time    `json:"updated_at"`
 }
@@ -36,8 +47,16 @@ type BackupSnapshot struct {
 	DeviceID   string    `gorm:"index;size:64" json:"device_id"`
 	FileUUID   string    `gorm:"index;size:64" json:"file_uuid"`
 	Version    int       `json:"version"`
-	ServerPath string    `json:"server_path"` // Path on server storage
+	ServerPath string    `json:"server_path"`            // Path on server storage, before storage backends (empty otherwise)
+	Backend    string    `gorm:"size:32" json:"backend"` // Storage backend holding the data ("" when Chunked)
+	StorageKey string    `json:"storage_key"`            // Key of the data in Backend
+	Chunked    bool      `json:"chunked"`                // Stored as a chunk manifest (SnapshotChunk)
 	FileSize   int64     `json:"file_size"`
 	FileHash   string    `gorm:"size:64" json:"file_hash"` // SHA256
 	CreatedAt  time.Time `json:"created_at"`
+
+	// Result of the last check of the stored data (finish, then scrubs)
+	Integrity      IntegrityStatus `gorm:"index;size:20" json:"integrity"`
+	IntegrityError string          `json:"integrity_error,omitempty"`
+	VerifiedAt     *time.Time      `json:"verified_at"`
 }
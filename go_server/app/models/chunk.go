@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// Chunk is a piece of file content in the deduplicated store, kept once no
+// matter how many snapshots (or devices) contain it.
+type Chunk struct {
+	Hash      string    `gorm:"primaryKey;size:64" json:"hash"` // SHA256 of the content
+	Size      int64     `json:"size"`
+	Backend   string    `gorm:"size:32" json:"backend"` // Storage backend holding it
+	RefCount  int       `gorm:"index" json:"ref_count"` // Manifest entries using it
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChunkOwner records that a device has uploaded a chunk. A device only
+// learns of, and may reference, the chunks it has sent itself.
+type ChunkOwner struct {
+	DeviceID  string `gorm:"primaryKey;size:64" json:"device_id"`
+	ChunkHash string `gorm:"primaryKey;size:64;index" json:"chunk_hash"`
+}
+
+// SnapshotChunk is one entry of a snapshot's manifest: the file is its
+// chunks in Seq order.
+type SnapshotChunk struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	SnapshotID uint   `gorm:"index" json:"snapshot_id"`
+	Seq        int    `json:"seq"`
+	FileOffset int64  `json:"offset"`
+	ChunkHash  string `gorm:"index;size:64" json:"chunk_hash"`
+	Size       int64  `json:"size"`
+
+	Backend string `gorm:"->;-:migration" json:"-"` // The chunk's, filled in by GetManifestRange
+}
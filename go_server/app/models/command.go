@@ -1,24 +1,98 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
 type CommandStatus string
 
+// A command goes PENDING -> SENT when pushed to the device, then the device
+// reports ACCEPTED -> RUNNING -> COMPLETED (succeeded) or FAILED.
+// Undelivered commands end as EXPIRED, CANCELLED (by an admin) or FAILED
+// (no acknowledgement after MaxAttempts sends).
 const (
 	StatusPending   CommandStatus = "PENDING"
 	StatusSent      CommandStatus = "SENT"
+	StatusAccepted  CommandStatus = "ACCEPTED"
+	StatusRunning   CommandStatus = "RUNNING"
 	StatusCompleted CommandStatus = "COMPLETED"
 	StatusFailed    CommandStatus = "FAILED"
+	StatusExpired   CommandStatus = "EXPIRED"
+	StatusCancelled CommandStatus = "CANCELLED"
 )
 
+// commandStatusOrder ranks statuses so a late or repeated report cannot move
+// a command backwards.
+var commandStatusOrder = map[CommandStatus]int{
+	StatusPending:   0,
+	StatusSent:      1,
+	StatusAccepted:  2,
+	StatusRunning:   3,
+	StatusCompleted: 4,
+	StatusFailed:    4,
+	StatusExpired:   4,
+	StatusCancelled: 4,
+}
+
+// Finished reports whether the status is final.
+func (s CommandStatus) Finished() bool {
+	return commandStatusOrder[s] == 4
+}
+
+// CanMoveTo reports whether a device report may change s to next.
+func (s CommandStatus) CanMoveTo(next CommandStatus) bool {
+	rank, ok := commandStatusOrder[next]
+	return ok && next != StatusPending && next != StatusSent &&
+		next != StatusExpired && next != StatusCancelled &&
+		!s.Finished() && rank > commandStatusOrder[s]
+}
+
 type Command struct {
-	ID          uint          `gorm:"primaryKey"`
-	DeviceID    string        `gorm:"index"`
-	CommandType int           `gorm:"not null"` // e.g. 0xD3 (GET_LOGS)
-	Payload     string        `gorm:"type:text"`
-	Status      CommandStatus `gorm:"default:'PENDING'"`
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID            uint          `gorm:"primaryKey"`
+	DeviceID      string        `gorm:"index"`
+	CommandType   int           `gorm:"not null"` // e.g. 0xD3 (GET_LOGS)
+	Payload       string        `gorm:"type:text"`
+	Status        CommandStatus `gorm:"default:'PENDING'"`
+	CreatedBy     uint          `gorm:"index"`     // User who queued it (0 = system)
+	Priority      int           `gorm:"default:0"` // Higher is sent first
+	ExpiresAt     *time.Time    `gorm:"index"`     // Not delivered after this (nil = never expires)
+	Attempts      int           // Times it was sent
+	MaxAttempts   int           // Sends without acknowledgement before it fails
+	NextAttemptAt *time.Time    // Earliest time for the next send (retry backoff)
+	CancelledBy   uint
+	Error         string         `gorm:"type:text"` // Reason for FAILED (from the device or the dispatcher)
+	ResultID      *uint          // Output reported by the device, if any
+	Result        *CommandResult `gorm:"foreignKey:ResultID"`
+	SentAt        *time.Time
+	AcceptedAt    *time.Time
+	StartedAt     *time.Time
+	FinishedAt    *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// CommandResult is the body a device sent back with its final status,
+// e.g. the log lines for GET_LOGS.
+type CommandResult struct {
+	ID        uint   `gorm:"primaryKey"`
+	CommandID uint   `gorm:"index"`
+	DeviceID  string `gorm:"index"`
+	Body      string `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+// WirePayload is the payload pushed to the device: the stored JSON with the
+// command's cmd_id added, so the device can report back on it.
+func (c *Command) WirePayload() string {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(c.Payload), &body); err != nil || body == nil {
+		return c.Payload
+	}
+	body["cmd_id"] = c.ID
+	out, err := json.Marshal(body)
+	if err != nil {
+		return c.Payload
+	}
+	return string(out)
 }
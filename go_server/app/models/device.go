@@ -1,14 +1,38 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Device approval states
+const (
+	DeviceStatusPending  = "PENDING"
+	DeviceStatusApproved = "APPROVED"
+	DeviceStatusRejected = "REJECTED"
+)
 
 type Device struct {
 	gorm.Model
-	UserID    uint   `gorm:"not null"`
-	DeviceID  string `gorm:"size:255;uniqueIndex;not null"` // UUID from client
-	Name      string
-	OSName    string
-	OSVersion string
-	Hostname  string
-	Arch      string
+	UserID     uint   `gorm:"not null"`
+	DeviceID   string `gorm:"size:255;uniqueIndex;not null"` // UUID from client
+	Name       string
+	OSName     string
+	OSVersion  string
+	Hostname   string
+	Arch       string
+	CertSerial string `gorm:"size:64"`       // Serial of the issued client certificate (hex)
+	Status     string `gorm:"size:20;index"` // See DeviceStatus*; empty rows are migrated at startup
+	Group      string `gorm:"column:device_group;size:100"`
+	ReviewedBy uint   // Admin who approved or rejected the device
+	ReviewedAt *time.Time
+	LastSeenAt *time.Time // Last heartbeat or message on the notification channel
+	LastIP     string     `gorm:"size:64"`
+
+	// From the agent's hello on the notification channel
+	AgentVersion    string `gorm:"size:32"`
+	ProtocolVersion int    // 1 = agent predates the hello
+	Commands        string `gorm:"size:255"` // Command types it handles, comma-separated
+	Capabilities    string `gorm:"size:255"` // Comma-separated, e.g. "binary_chunks"
 }
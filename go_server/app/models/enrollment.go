@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// EnrollmentToken lets a new device register. Admins hand the token to the
+// person setting up the machine; only its SHA-256 is stored.
+type EnrollmentToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TokenHash string     `gorm:"uniqueIndex;size:64" json:"-"`
+	UserID    uint       `gorm:"index" json:"user_id"`                      // Owner of devices enrolled with it; 0 = the registering user
+	Group     string     `gorm:"column:device_group;size:100" json:"group"` // Assigned to enrolled devices
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at"` // nil = no expiry
+	CreatedBy uint       `json:"created_by"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Hello is an agent's greeting (MSG_HELLO). Protocol 1 agents send none and
+// are described by a Hello with only DeviceID and Protocol set.
+type Hello struct {
+	DeviceID     string   `json:"device_id"`
+	Protocol     int      `json:"protocol"`
+	AgentVersion string   `json:"agent_version"`
+	Commands     []int    `json:"commands"`     // Server command types it handles
+	Capabilities []string `json:"capabilities"` // e.g. "binary_chunks"
+}
+
+// HelloRejection refuses an agent; MinVersion is passed on to it.
+type HelloRejection struct {
+	Reason     string
+	MinVersion string
+}
+
+func (r *HelloRejection) Error() string { return r.Reason }
+
+// JoinCommands formats Hello.Commands for Device.Commands.
+func JoinCommands(commands []int) string {
+	parts := make([]string, len(commands))
+	for i, c := range commands {
+		parts[i] = strconv.Itoa(c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// SplitCommands parses Device.Commands.
+func SplitCommands(commands string) []int {
+	var out []int
+	for _, part := range strings.Split(commands, ",") {
+		if c, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			out = append(out, c)
+		}
+	}
+	return out
+}
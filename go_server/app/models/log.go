@@ -8,5 +8,6 @@ type Log struct {
 	ID        uint   `gorm:"primaryKey"`
 	DeviceID  string `gorm:"index"`
 	Content   string `gorm:"type:text"`
+	CommandID uint   `gorm:"index"` // GET_LOGS command it answers (0 = unsolicited upload)
 	CreatedAt time.Time
 }
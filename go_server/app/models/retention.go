@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// RetentionRun is one pass of the backup garbage collector over the
+// snapshots of one device, or all of them.
+type RetentionRun struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	DeviceID        string     `gorm:"index;size:64" json:"device_id"` // Empty = all devices
+	DryRun          bool       `json:"dry_run"`                        // Nothing was deleted
+	SnapshotsPruned int        `json:"snapshots_pruned"`
+	ChunksDeleted   int        `json:"chunks_deleted"`
+	BytesFreed      int64      `json:"bytes_freed"`
+	Error           string     `json:"error,omitempty"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+}
+
+// PrunedSnapshot is a snapshot a run removed, or would have in a dry run.
+type PrunedSnapshot struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	RunID     uint      `gorm:"index" json:"run_id"`
+	DeviceID  string    `gorm:"index;size:64" json:"device_id"`
+	FileUUID  string    `gorm:"size:64" json:"file_uuid"`
+	Version   int       `json:"version"`
+	FileSize  int64     `json:"file_size"`
+	Chunked   bool      `json:"chunked"`
+	Reason    string    `gorm:"size:20" json:"reason"` // "retention" or "deleted"
+	TakenAt   time.Time `json:"taken_at"`              // When the snapshot was made
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,59 @@
+package models
+
+const (
+	RoleAdmin    = "admin"    // Everything, including firewall policy, restores, sessions and enrollment
+	RoleOperator = "operator" // Helpdesk: browse trees and pull logs
+	RoleAuditor  = "auditor"  // Read-only
+	RoleUser     = "user"     // Device owner, no console access
+)
+
+type Permission string
+
+const (
+	PermListDevices    Permission = "devices.list"
+	PermViewLogs       Permission = "logs.view"
+	PermRequestLogs    Permission = "logs.request"
+	PermViewHistory    Permission = "commands.view"
+	PermBrowseFiles    Permission = "files.browse"
+	PermFirewall       Permission = "firewall.control"
+	PermRestore        Permission = "files.restore"
+	PermManageSessions Permission = "sessions.manage"
+	PermManageDevices  Permission = "devices.manage" // Enrollment tokens, approving devices
+	PermCancelCommands Permission = "commands.cancel"
+	PermManageBackups  Permission = "backups.manage" // Retention runs
+)
+
+var RolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermListDevices, PermViewLogs, PermRequestLogs, PermViewHistory,
+		PermBrowseFiles, PermFirewall, PermRestore, PermManageSessions,
+		PermManageDevices, PermCancelCommands, PermManageBackups,
+	},
+	RoleOperator: {
+		PermListDevices, PermViewLogs, PermRequestLogs, PermViewHistory, PermBrowseFiles,
+		PermCancelCommands,
+	},
+	RoleAuditor: {
+		PermListDevices, PermViewLogs, PermViewHistory, PermBrowseFiles,
+	},
+	RoleUser: {},
+}
+
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// CanUseConsole reports whether the role may log in to the admin console.
+func CanUseConsole(role string) bool {
+	return len(RolePermissions[role]) > 0
+}
+
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range RolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
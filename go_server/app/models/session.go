@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a login session. Only the SHA-256 of the token is stored, so a
+// database leak does not hand out usable tokens.
+type Session struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	TokenHash string `gorm:"uniqueIndex;size:64" json:"-"`
+	UserID    uint   `gorm:"index" json:"user_id"`
+	DeviceID  string `gorm:"index;size:255" json:"device_id"` // Empty for admin sessions
+	IsAdmin   bool   `json:"is_admin"`                        // Console session (MSG_ADMIN_LOGIN_REQ)
+	Role      string `gorm:"size:20" json:"role"`             // User's role when issued; Validate fills in the current one
+	// Set while the user still has to replace a default/reset password;
+	// such a session may only change the password or log out.
+	PasswordChangeRequired bool       `json:"password_change_required"`
+	ExpiresAt              time.Time  `json:"expires_at"`
+	RevokedAt              *time.Time `json:"revoked_at"`
+	CreatedAt              time.Time  `json:"created_at"`
+}
@@ -4,7 +4,9 @@ import "gorm.io/gorm"
 
 type User struct {
 	gorm.Model
-	Username string   `gorm:"size:255;uniqueIndex;not null"`
-	Password string   `gorm:"not null"`
-	Devices  []Device `gorm:"foreignKey:UserID"`
+	Username           string   `gorm:"size:255;uniqueIndex;not null"`
+	Password           string   `gorm:"not null"` // bcrypt hash (legacy rows may still be plaintext until next login)
+	MustChangePassword bool     `gorm:"default:false"`
+	Role               string   `gorm:"size:20"` // See role.go; empty rows are migrated at startup
+	Devices            []Device `gorm:"foreignKey:UserID"`
 }
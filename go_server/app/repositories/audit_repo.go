@@ -0,0 +1,19 @@
+package repositories
+
+import (
+	"demo/network/go_server/app/models"
+
+	"gorm.io/gorm"
+)
+
+type AuditRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditRepository(db *gorm.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+func (r *AuditRepository) Create(event *models.AuditEvent) error {
+	return r.db.Create(event).Error
+}
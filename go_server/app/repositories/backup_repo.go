@@ -2,11 +2,16 @@ package repositories
 
 import (
 	"demo/network/go_server/app/models"
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// ErrSessionExpired means an upload stopped being in progress, typically
+// expired as idle, while a request was working on it; the change was dropped.
+var ErrSessionExpired = errors.New("upload is no longer in progress")
+
 type BackupRepository struct {
 	db *gorm.DB
 }
@@ -25,9 +30,18 @@ func (r *BackupRepository) GetSessionByTransferID(transferID string) (*models.Ba
 	return &session, err
 }
 
+// UpdateSession saves an upload that is still in progress, so a late chunk
+// cannot bring back one that expired meanwhile (ErrSessionExpired).
 func (r *BackupRepository) UpdateSession(session *models.BackupSession) error {
 	session.LastUpdateTime = time.Now()
-	return r.db.Save(session).Error
+	result := r.db.Model(session).Where("status = ?", models.BackupInProgress).Select("*").Updates(session)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionExpired
+	}
+	return nil
 }
 
 func (r *BackupRepository) GetLatestVersion(deviceID, fileUUID string) (int, error) {
@@ -58,6 +72,13 @@ func (r *BackupRepository) GetActiveSession(deviceID, fileUUID string) (*models.
 	return &session, err
 }
 
+// GetInProgressSessions lists every upload that has not finished yet.
+func (r *BackupRepository) GetInProgressSessions() ([]models.BackupSession, error) {
+	var sessions []models.BackupSession
+	err := r.db.Where("status = ?", models.BackupInProgress).Find(&sessions).Error
+	return sessions, err
+}
+
 func (r *BackupRepository) GetLatestSnapshot(deviceID, fileUUID string, snapshot *models.BackupSnapshot) error {
 	return r.db.Where("device_id = ? AND file_uuid = ?", deviceID, fileUUID).
 		Order("version desc").First(snapshot).Error
@@ -67,3 +88,96 @@ func (r *BackupRepository) GetSnapshotByVersion(deviceID, fileUUID string, versi
 	return r.db.Where("device_id = ? AND file_uuid = ? AND version = ?", deviceID, fileUUID, version).
 		First(snapshot).Error
 }
+
+// ListSnapshotDevices returns every device that has snapshots.
+func (r *BackupRepository) ListSnapshotDevices() ([]string, error) {
+	var deviceIDs []string
+	err := r.db.Model(&models.BackupSnapshot{}).Distinct("device_id").Pluck("device_id", &deviceIDs).Error
+	return deviceIDs, err
+}
+
+// GetDeviceSnapshots lists a device's snapshots by file, newest version first.
+func (r *BackupRepository) GetDeviceSnapshots(deviceID string) ([]models.BackupSnapshot, error) {
+	var snapshots []models.BackupSnapshot
+	err := r.db.Where("device_id = ?", deviceID).Order("file_uuid, version desc").Find(&snapshots).Error
+	return snapshots, err
+}
+
+func (r *BackupRepository) DeleteSnapshot(id uint) error {
+	return r.db.Delete(&models.BackupSnapshot{}, id).Error
+}
+
+// GetSnapshotsAfter pages through every snapshot by ID.
+func (r *BackupRepository) GetSnapshotsAfter(afterID uint, limit int) ([]models.BackupSnapshot, error) {
+	var snapshots []models.BackupSnapshot
+	err := r.db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&snapshots).Error
+	return snapshots, err
+}
+
+// UpdateIntegrity saves the result of checking a snapshot's data.
+func (r *BackupRepository) UpdateIntegrity(snapshot *models.BackupSnapshot) error {
+	return r.db.Model(snapshot).Select("integrity", "integrity_error", "verified_at", "file_hash").Updates(snapshot).Error
+}
+
+// GetFlaggedSnapshots lists the snapshots whose data was found missing or
+// corrupted, optionally for one device.
+func (r *BackupRepository) GetFlaggedSnapshots(deviceID string) ([]models.BackupSnapshot, error) {
+	var snapshots []models.BackupSnapshot
+	query := r.db.Where("integrity IN ?", []models.IntegrityStatus{models.IntegrityMissing, models.IntegrityCorrupted})
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	err := query.Order("device_id, file_uuid, version desc").Find(&snapshots).Error
+	return snapshots, err
+}
+
+// TouchSession records activity on an upload that does not otherwise update
+// it (chunk queries and puts).
+func (r *BackupRepository) TouchSession(id uint) error {
+	return r.db.Model(&models.BackupSession{}).Where("id = ?", id).Update("last_update_time", time.Now()).Error
+}
+
+// GetIdleSessions lists the uploads in progress with no activity since
+// before, oldest first. Rows from before last_update_time was kept fall
+// back to updated_at.
+func (r *BackupRepository) GetIdleSessions(before time.Time) ([]models.BackupSession, error) {
+	var sessions []models.BackupSession
+	err := r.db.Where("status = ? AND COALESCE(last_update_time, updated_at) < ?", models.BackupInProgress, before).
+		Order("COALESCE(last_update_time, updated_at)").Find(&sessions).Error
+	return sessions, err
+}
+
+// ExpireSession marks an upload expired if it is still in progress and has
+// been idle since before; false if it moved on meanwhile.
+func (r *BackupRepository) ExpireSession(id uint, before time.Time) (bool, error) {
+	result := r.db.Model(&models.BackupSession{}).
+		Where("id = ? AND status = ? AND COALESCE(last_update_time, updated_at) < ?", id, models.BackupInProgress, before).
+		Update("status", models.BackupExpired)
+	return result.RowsAffected > 0, result.Error
+}
+
+// CancelSession marks an upload canceled if it is still in progress; false
+// if it already finished, failed or expired.
+func (r *BackupRepository) CancelSession(id uint) (bool, error) {
+	result := r.db.Model(&models.BackupSession{}).
+		Where("id = ? AND status = ?", id, models.BackupInProgress).
+		Update("status", models.BackupCanceled)
+	return result.RowsAffected > 0, result.Error
+}
+
+// VersionInUse reports whether a version's storage directory still belongs
+// to someone besides the given upload: another upload in progress or a
+// finished snapshot.
+func (r *BackupRepository) VersionInUse(session *models.BackupSession) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.BackupSession{}).
+		Where("device_id = ? AND file_uuid = ? AND version = ? AND status = ? AND id <> ?", session.DeviceID, session.FileUUID, session.Version, models.BackupInProgress, session.ID).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = r.db.Model(&models.BackupSnapshot{}).
+		Where("device_id = ? AND file_uuid = ? AND version = ?", session.DeviceID, session.FileUUID, session.Version).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,196 @@
+package repositories
+
+import (
+	"demo/network/go_server/app/models"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ChunkRepository struct {
+	db *gorm.DB
+}
+
+func NewChunkRepository(db *gorm.DB) *ChunkRepository {
+	return &ChunkRepository{db: db}
+}
+
+// FindHashes returns which of hashes are in the store and uploaded by the
+// device.
+func (r *ChunkRepository) FindHashes(deviceID string, hashes []string) ([]string, error) {
+	var found []string
+	if len(hashes) == 0 {
+		return found, nil
+	}
+	err := r.db.Model(&models.Chunk{}).
+		Joins("JOIN chunk_owners ON chunk_owners.chunk_hash = chunks.hash AND chunk_owners.device_id = ?", deviceID).
+		Where("chunks.hash IN ?", hashes).Pluck("chunks.hash", &found).Error
+	return found, err
+}
+
+// TouchChunks renews the created_at of those of hashes the device uploaded,
+// so the sweep's grace period starts over as if they were stored again.
+func (r *ChunkRepository) TouchChunks(deviceID string, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return r.db.Model(&models.Chunk{}).
+		Where("hash IN ?", hashes).
+		Where("EXISTS (SELECT 1 FROM chunk_owners WHERE chunk_owners.chunk_hash = chunks.hash AND chunk_owners.device_id = ?)", deviceID).
+		Update("created_at", time.Now()).Error
+}
+
+// CreateChunk records a stored chunk as uploaded by the device. Recording
+// one again renews its created_at, so the sweep's grace period starts over,
+// and its backend, where it was just written.
+func (r *ChunkRepository) CreateChunk(chunk *models.Chunk, deviceID string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"created_at", "backend"})}).Create(chunk).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ChunkOwner{DeviceID: deviceID, ChunkHash: chunk.Hash}).Error
+	})
+}
+
+// CreateSnapshot stores a snapshot with its manifest and takes a reference
+// on every chunk the manifest uses, in one transaction. It fails if a chunk
+// is not in the store with the size the manifest gives it, or was not
+// uploaded by the snapshot's device.
+func (r *ChunkRepository) CreateSnapshot(snapshot *models.BackupSnapshot, manifest []models.SnapshotChunk) error {
+	refs := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, entry := range manifest {
+		if size, ok := sizes[entry.ChunkHash]; ok && size != entry.Size {
+			return fmt.Errorf("chunk %s is listed as both %d and %d bytes", entry.ChunkHash, size, entry.Size)
+		}
+		refs[entry.ChunkHash]++
+		sizes[entry.ChunkHash] = entry.Size
+	}
+	// Same lock order in every transaction
+	hashes := make([]string, 0, len(refs))
+	for hash := range refs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, hash := range hashes {
+			res := tx.Model(&models.Chunk{}).
+				Where("hash = ? AND size = ?", hash, sizes[hash]).
+				Where("EXISTS (SELECT 1 FROM chunk_owners WHERE chunk_owners.chunk_hash = chunks.hash AND chunk_owners.device_id = ?)", snapshot.DeviceID).
+				Update("ref_count", gorm.Expr("ref_count + ?", refs[hash]))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return fmt.Errorf("chunk %s of %d bytes is not stored for device %s", hash, sizes[hash], snapshot.DeviceID)
+			}
+		}
+		if err := tx.Create(snapshot).Error; err != nil {
+			return err
+		}
+		if len(manifest) == 0 {
+			return nil
+		}
+		for i := range manifest {
+			manifest[i].SnapshotID = snapshot.ID
+		}
+		return tx.CreateInBatches(manifest, 500).Error
+	})
+}
+
+// GetManifestRange returns the manifest entries of a snapshot that overlap
+// the bytes [start, end), in file order, with the backend of each chunk.
+func (r *ChunkRepository) GetManifestRange(snapshotID uint, start, end int64) ([]models.SnapshotChunk, error) {
+	var entries []models.SnapshotChunk
+	err := r.db.Model(&models.SnapshotChunk{}).
+		Select("snapshot_chunks.*, chunks.backend").
+		Joins("LEFT JOIN chunks ON chunks.hash = snapshot_chunks.chunk_hash").
+		Where("snapshot_id = ? AND file_offset < ? AND file_offset + snapshot_chunks.size > ?", snapshotID, end, start).
+		Order("seq").Find(&entries).Error
+	return entries, err
+}
+
+// DeleteSnapshot removes a chunked snapshot and its manifest and drops its
+// references, in one transaction. Chunks left unreferenced stay in the
+// store until swept.
+func (r *ChunkRepository) DeleteSnapshot(snapshotID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var refs []struct {
+			ChunkHash string
+			Count     int
+		}
+		err := tx.Model(&models.SnapshotChunk{}).Select("chunk_hash, COUNT(*) AS count").
+			Where("snapshot_id = ?", snapshotID).Group("chunk_hash").Order("chunk_hash").Scan(&refs).Error
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			err := tx.Model(&models.Chunk{}).Where("hash = ?", ref.ChunkHash).
+				Update("ref_count", gorm.Expr("ref_count - ?", ref.Count)).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("snapshot_id = ?", snapshotID).Delete(&models.SnapshotChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.BackupSnapshot{}, snapshotID).Error
+	})
+}
+
+// CountRefs returns how many manifest entries of the given snapshots use
+// each chunk.
+func (r *ChunkRepository) CountRefs(snapshotIDs []uint) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(snapshotIDs) == 0 {
+		return counts, nil
+	}
+	var refs []struct {
+		ChunkHash string
+		Count     int
+	}
+	err := r.db.Model(&models.SnapshotChunk{}).Select("chunk_hash, COUNT(*) AS count").
+		Where("snapshot_id IN ?", snapshotIDs).Group("chunk_hash").Scan(&refs).Error
+	for _, ref := range refs {
+		counts[ref.ChunkHash] = ref.Count
+	}
+	return counts, err
+}
+
+func (r *ChunkRepository) FindChunks(hashes []string) ([]models.Chunk, error) {
+	var chunks []models.Chunk
+	if len(hashes) == 0 {
+		return chunks, nil
+	}
+	err := r.db.Where("hash IN ?", hashes).Find(&chunks).Error
+	return chunks, err
+}
+
+// FindUnreferenced lists chunks no snapshot uses that were stored before
+// the given time, by hash from after.
+func (r *ChunkRepository) FindUnreferenced(before time.Time, after string, limit int) ([]models.Chunk, error) {
+	var chunks []models.Chunk
+	err := r.db.Where("ref_count <= 0 AND created_at < ? AND hash > ?", before, after).
+		Order("hash").Limit(limit).Find(&chunks).Error
+	return chunks, err
+}
+
+// DeleteUnreferenced removes a chunk's row, and who uploaded it, if it is
+// still unreferenced and was not stored or renewed since before.
+func (r *ChunkRepository) DeleteUnreferenced(hash string, before time.Time) (bool, error) {
+	deleted := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("hash = ? AND ref_count <= 0 AND created_at < ?", hash, before).Delete(&models.Chunk{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		deleted = true
+		return tx.Where("chunk_hash = ?", hash).Delete(&models.ChunkOwner{}).Error
+	})
+	return deleted && err == nil, err
+}
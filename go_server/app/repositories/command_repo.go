@@ -2,6 +2,7 @@ package repositories
 
 import (
 	"demo/network/go_server/app/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -22,15 +23,63 @@ func (r *CommandRepository) Update(cmd *models.Command) error {
 	return r.DB.Save(cmd).Error
 }
 
+func (r *CommandRepository) GetByID(id uint) (*models.Command, error) {
+	var cmd models.Command
+	err := r.DB.First(&cmd, id).Error
+	return &cmd, err
+}
+
+func (r *CommandRepository) CreateResult(result *models.CommandResult) error {
+	return r.DB.Create(result).Error
+}
+
+// duePending selects PENDING commands that have not expired and whose retry
+// backoff has passed.
+func (r *CommandRepository) duePending(now time.Time) *gorm.DB {
+	return r.DB.Model(&models.Command{}).
+		Where("status = ?", models.StatusPending).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now)
+}
+
+// GetPendingByDevice returns the commands that are due for sending, highest
+// priority first, oldest first within a priority.
 func (r *CommandRepository) GetPendingByDevice(deviceID string) ([]models.Command, error) {
 	var commands []models.Command
-	result := r.DB.Where("device_id = ? AND status = ?", deviceID, models.StatusPending).Find(&commands)
+	result := r.duePending(time.Now()).
+		Where("device_id = ?", deviceID).
+		Order("priority desc, created_at asc, id asc").
+		Find(&commands)
+	return commands, result.Error
+}
+
+// GetDevicesWithDueCommands lists devices that have something to send.
+func (r *CommandRepository) GetDevicesWithDueCommands() ([]string, error) {
+	var deviceIDs []string
+	err := r.duePending(time.Now()).Distinct().Pluck("device_id", &deviceIDs).Error
+	return deviceIDs, err
+}
+
+// GetUnacknowledged returns commands sent before the given time that the
+// device never accepted.
+func (r *CommandRepository) GetUnacknowledged(sentBefore time.Time) ([]models.Command, error) {
+	var commands []models.Command
+	result := r.DB.Where("status = ? AND sent_at < ?", models.StatusSent, sentBefore).Find(&commands)
 	return commands, result.Error
 }
 
+// ExpireOverdue marks undelivered commands past their expiry as EXPIRED.
+func (r *CommandRepository) ExpireOverdue() (int64, error) {
+	now := time.Now()
+	result := r.DB.Model(&models.Command{}).
+		Where("status IN ? AND expires_at <= ?", []models.CommandStatus{models.StatusPending, models.StatusSent}, now).
+		Updates(map[string]interface{}{"status": models.StatusExpired, "finished_at": now, "updated_at": now})
+	return result.RowsAffected, result.Error
+}
+
 func (r *CommandRepository) GetHistory(deviceID string, limit, offset int) ([]models.Command, error) {
 	var commands []models.Command
-	query := r.DB.Model(&models.Command{}).Order("created_at desc")
+	query := r.DB.Model(&models.Command{}).Preload("Result").Order("created_at desc")
 	if deviceID != "" {
 		query = query.Where("device_id = ?", deviceID)
 	}
@@ -2,6 +2,7 @@ package repositories
 
 import (
 	"demo/network/go_server/app/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -26,3 +27,42 @@ func (r *DeviceRepository) GetByDeviceID(deviceID string) (*models.DeviceConfig,
 func (r *DeviceRepository) Upsert(config *models.DeviceConfig) error {
 	return r.DB.Save(config).Error
 }
+
+func (r *DeviceRepository) GetDevice(deviceID string) (*models.Device, error) {
+	var device models.Device
+	err := r.DB.Where("device_id = ?", deviceID).First(&device).Error
+	return &device, err
+}
+
+func (r *DeviceRepository) CreateDevice(device *models.Device) error {
+	return r.DB.Create(device).Error
+}
+
+func (r *DeviceRepository) UpdateDevice(device *models.Device) error {
+	return r.DB.Save(device).Error
+}
+
+func (r *DeviceRepository) ListDevicesByStatus(status string) ([]models.Device, error) {
+	var devices []models.Device
+	err := r.DB.Where("status = ?", status).Order("created_at asc").Find(&devices).Error
+	return devices, err
+}
+
+// SetAgentInfo stores what the device's agent reported in its hello.
+func (r *DeviceRepository) SetAgentInfo(deviceID, version string, protocol int, commands, capabilities string) error {
+	return r.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).
+		Updates(map[string]interface{}{"agent_version": version, "protocol_version": protocol, "commands": commands, "capabilities": capabilities}).Error
+}
+
+// ListDevicesByIDs returns the devices among deviceIDs that are registered.
+func (r *DeviceRepository) ListDevicesByIDs(deviceIDs []string) ([]models.Device, error) {
+	var devices []models.Device
+	err := r.DB.Where("device_id IN ?", deviceIDs).Order("device_id asc").Find(&devices).Error
+	return devices, err
+}
+
+// Touch records when and from where a device was last seen.
+func (r *DeviceRepository) Touch(deviceID, ip string, at time.Time) error {
+	return r.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).
+		Updates(map[string]interface{}{"last_seen_at": at, "last_ip": ip}).Error
+}
@@ -0,0 +1,37 @@
+package repositories
+
+import (
+	"demo/network/go_server/app/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type EnrollmentRepository struct {
+	db *gorm.DB
+}
+
+func NewEnrollmentRepository(db *gorm.DB) *EnrollmentRepository {
+	return &EnrollmentRepository{db: db}
+}
+
+func (r *EnrollmentRepository) Create(token *models.EnrollmentToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r *EnrollmentRepository) GetByTokenHash(hash string) (*models.EnrollmentToken, error) {
+	var token models.EnrollmentToken
+	err := r.db.Where("token_hash = ?", hash).First(&token).Error
+	return &token, err
+}
+
+// Use counts one registration against the token. It fails (false) if the
+// token was used up, revoked or expired in the meantime, so two devices
+// cannot race for the last use.
+func (r *EnrollmentRepository) Use(id uint) (bool, error) {
+	result := r.db.Model(&models.EnrollmentToken{}).
+		Where("id = ? AND uses < max_uses AND revoked_at IS NULL", id).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	return result.RowsAffected == 1, result.Error
+}
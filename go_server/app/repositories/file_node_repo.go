@@ -31,6 +31,15 @@ func (r *FileNodeRepository) FindByUUID(uuid string) (*models.FileNode, error) {
 	return &node, nil
 }
 
+// FindDeviceNode looks up a file of one device by UUID.
+func (r *FileNodeRepository) FindDeviceNode(deviceID, uuid string) (*models.FileNode, error) {
+	var node models.FileNode
+	if err := r.db.Where("device_id = ? AND uuid = ?", deviceID, uuid).First(&node).Error; err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
 func (r *FileNodeRepository) FindByPath(deviceID, path string) (*models.FileNode, error) {
 	var node models.FileNode
 	if err := r.db.Where("device_id = ? AND path = ? AND is_deleted = false", deviceID, path).First(&node).Error; err != nil {
@@ -2,6 +2,7 @@ package repositories
 
 import (
 	"demo/network/go_server/app/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -27,3 +28,35 @@ func (r *RestoreRepository) GetSessionByTransferID(transferID string) (*models.R
 func (r *RestoreRepository) UpdateSession(session *models.RestoreSession) error {
 	return r.db.Save(session).Error
 }
+
+// IsRestoring reports whether a version is being sent to a device.
+func (r *RestoreRepository) IsRestoring(deviceID, fileUUID string, version int) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.RestoreSession{}).
+		Where("device_id = ? AND file_uuid = ? AND version = ? AND status = ?", deviceID, fileUUID, version, models.RestoreInProgress).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// TouchSession records that a device is still downloading.
+func (r *RestoreRepository) TouchSession(id uint) error {
+	return r.db.Model(&models.RestoreSession{}).Where("id = ?", id).Update("last_update_time", time.Now()).Error
+}
+
+// GetIdleSessions lists the restores in progress with no activity since
+// before, oldest first.
+func (r *RestoreRepository) GetIdleSessions(before time.Time) ([]models.RestoreSession, error) {
+	var sessions []models.RestoreSession
+	err := r.db.Where("status = ? AND COALESCE(last_update_time, updated_at) < ?", models.RestoreInProgress, before).
+		Order("COALESCE(last_update_time, updated_at)").Find(&sessions).Error
+	return sessions, err
+}
+
+// ExpireIdleSessions marks every restore idle since before expired and
+// returns how many there were.
+func (r *RestoreRepository) ExpireIdleSessions(before time.Time) (int64, error) {
+	result := r.db.Model(&models.RestoreSession{}).
+		Where("status = ? AND COALESCE(last_update_time, updated_at) < ?", models.RestoreInProgress, before).
+		Update("status", models.RestoreExpired)
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,30 @@
+package repositories
+
+import (
+	"demo/network/go_server/app/models"
+
+	"gorm.io/gorm"
+)
+
+type RetentionRepository struct {
+	db *gorm.DB
+}
+
+func NewRetentionRepository(db *gorm.DB) *RetentionRepository {
+	return &RetentionRepository{db: db}
+}
+
+func (r *RetentionRepository) CreateRun(run *models.RetentionRun) error {
+	return r.db.Create(run).Error
+}
+
+func (r *RetentionRepository) UpdateRun(run *models.RetentionRun) error {
+	return r.db.Save(run).Error
+}
+
+func (r *RetentionRepository) CreatePruned(pruned []models.PrunedSnapshot) error {
+	if len(pruned) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(pruned, 500).Error
+}
@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"demo/network/go_server/app/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type SessionRepository struct {
+	db *gorm.DB
+}
+
+func NewSessionRepository(db *gorm.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+func (r *SessionRepository) Create(session *models.Session) error {
+	return r.db.Create(session).Error
+}
+
+func (r *SessionRepository) GetByTokenHash(hash string) (*models.Session, error) {
+	var session models.Session
+	err := r.db.Where("token_hash = ?", hash).First(&session).Error
+	return &session, err
+}
+
+// GetUserRole returns the current role of a user; not found once the user
+// is deleted.
+func (r *SessionRepository) GetUserRole(userID uint) (string, error) {
+	var user models.User
+	err := r.db.Select("role").First(&user, userID).Error
+	return user.Role, err
+}
+
+func (r *SessionRepository) Revoke(id uint) error {
+	return r.db.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeWhere revokes every active session matching the condition and
+// returns how many were revoked.
+func (r *SessionRepository) RevokeWhere(query string, args ...interface{}) (int64, error) {
+	result := r.db.Model(&models.Session{}).
+		Where("revoked_at IS NULL AND expires_at > ?", time.Now()).
+		Where(query, args...).
+		Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+func (r *SessionRepository) ClearPasswordChange(id uint) error {
+	return r.db.Model(&models.Session{}).Where("id = ?", id).Update("password_change_required", false).Error
+}
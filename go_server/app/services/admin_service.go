@@ -3,6 +3,7 @@ package services
 import (
 	"demo/network/go_server/app/models"
 	"demo/network/go_server/app/repositories"
+	"encoding/json"
 	"fmt"
 )
 
@@ -18,9 +19,9 @@ func NewAdminService(cmdRepo *repositories.CommandRepository, cmdSvc *CommandSer
 	}
 }
 
-func (s *AdminService) QueueGetLogs(deviceID string, lineCount int) (*models.Command, error) {
+func (s *AdminService) QueueGetLogs(deviceID string, lineCount int, createdBy uint) (*models.Command, error) {
 	payload := fmt.Sprintf(`{"command":"GET_LOGS", "line_count": %d}`, lineCount)
-	cmd, err := s.CommandSvc.CreateCommand(deviceID, 0xD3, payload)
+	cmd, err := s.CommandSvc.CreateCommand(deviceID, 0xD3, payload, createdBy)
 	if err != nil {
 		return nil, err
 	}
@@ -31,6 +32,21 @@ func (s *AdminService) QueueGetLogs(deviceID string, lineCount int) (*models.Com
 	return cmd, nil
 }
 
+// QueueRestore asks a device to pull a file version back from the server.
+// The bool reports whether it was delivered right away.
+func (s *AdminService) QueueRestore(deviceID, fileUUID string, version int, createdBy uint) (*models.Command, bool, error) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"op":        "RESTORE_CMD",
+		"file_uuid": fileUUID,
+		"version":   version,
+	})
+	cmd, err := s.CommandSvc.CreateCommand(deviceID, 0x72, string(payload), createdBy)
+	if err != nil {
+		return nil, false, err
+	}
+	return cmd, s.CommandSvc.TrySendImmediately(cmd), nil
+}
+
 func (s *AdminService) GetCommandHistory(deviceID string, page, size int) ([]models.Command, error) {
 	offset := (page - 1) * size
 	return s.CmdRepo.GetHistory(deviceID, size, offset)
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"fmt"
+	"time"
+)
+
+type AuditService struct {
+	repo *repositories.AuditRepository
+}
+
+func NewAuditService(repo *repositories.AuditRepository) *AuditService {
+	return &AuditService{repo: repo}
+}
+
+// Record stores one audit event. Failures are logged, never returned: a
+// broken audit table must not take the console down.
+func (s *AuditService) Record(event *models.AuditEvent) {
+	event.CreatedAt = time.Now()
+	if err := s.repo.Create(event); err != nil {
+		fmt.Printf("[Audit] Failed to record %s by user %d: %v\n", event.Action, event.UserID, err)
+	}
+}
@@ -1,24 +1,76 @@
 package services
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"demo/network/go_server/app/models"
 	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrChecksumMismatch means a chunk's bytes do not match the checksum
+	// sent with them; nothing past the chunk's offset should be trusted.
+	ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+	// ErrOffsetMismatch means a chunk does not start where the upload left
+	// off (current_offset); uploads are written in order, without gaps or
+	// overlaps.
+	ErrOffsetMismatch = errors.New("chunk offset does not follow the upload")
+	// ErrIncompleteUpload means an upload was finished before all of its
+	// bytes arrived. The session is failed.
+	ErrIncompleteUpload = errors.New("upload incomplete")
+	// ErrFileHashMismatch means the stored file does not hash to the
+	// file_hash sent at finish. The session is failed.
+	ErrFileHashMismatch = errors.New("file hash mismatch")
+	// ErrInvalidFileName means an upload's file name or UUID cannot be part
+	// of a storage key, e.g. "../x". The upload is refused.
+	ErrInvalidFileName = errors.New("invalid file name")
+)
+
+// OffsetError is an ErrOffsetMismatch that says where the upload stands, so
+// the agent can carry on from there.
+type OffsetError struct {
+	Offset        int64 // Where the chunk started
+	CurrentOffset int64 // Where the next chunk must start
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("%v: got %d, expected %d", ErrOffsetMismatch, e.Offset, e.CurrentOffset)
+}
+
+func (e *OffsetError) Unwrap() error {
+	return ErrOffsetMismatch
+}
+
+// BackupService receives uploads. A whole-file upload is written to a
+// partial file under storagePath and moved to the active storage backend
+// once finished and verified.
 type BackupService struct {
 	repo        *repositories.BackupRepository
+	chunks      *ChunkService
+	backends    *storage.Backends
 	storagePath string
 }
 
-func NewBackupService(repo *repositories.BackupRepository, storagePath string) *BackupService {
-	return &BackupService{repo: repo, storagePath: storagePath}
+func NewBackupService(repo *repositories.BackupRepository, chunks *ChunkService, backends *storage.Backends, storagePath string) *BackupService {
+	return &BackupService{repo: repo, chunks: chunks, backends: backends, storagePath: storagePath}
+}
+
+// ChunkRef is one entry of the chunk list an agent sends to finish a
+// deduplicated upload.
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
 }
 
 func (s *BackupService) InitSession(deviceID, fileUUID, fileName string, totalSize int64, headHash string) (*models.BackupSession, error) {
@@ -29,7 +81,7 @@ func (s *BackupService) InitSession(deviceID, fileUUID, fileName string, totalSi
 	}
 	nextVersion := currentVersion + 1
 
-	// 2. Create session
+	// 2. Create session, once its name is known to stay in the storage path
 	session := &models.BackupSession{
 		TransferID:     uuid.New().String(),
 		DeviceID:       deviceID,
@@ -42,21 +94,40 @@ func (s *BackupService) InitSession(deviceID, fileUUID, fileName string, totalSi
 		Status:         models.BackupInProgress,
 		LastUpdateTime: time.Now(),
 	}
+	partial, err := s.partialPath(session)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := s.repo.CreateSession(session); err != nil {
 		return nil, err
 	}
 
 	// 3. Ensure Storage Directory Exists
-	dir := filepath.Join(s.storagePath, deviceID, fileUUID, fmt.Sprintf("v%d", nextVersion))
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create storage directory: %v", err)
 	}
 
 	return session, nil
 }
 
+// UpdateChunk writes a hex-encoded chunk (the JSON chunk route).
 func (s *BackupService) UpdateChunk(transferID string, offset int64, dataLen int64, hexData string) error {
+	data, err := hex.DecodeString(hexData)
+	if err != nil {
+		return fmt.Errorf("failed to decode chunk data: %v", err)
+	}
+
+	if int64(len(data)) != dataLen {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", dataLen, len(data))
+	}
+
+	return s.WriteChunk(transferID, offset, dataLen, "", bytes.NewReader(data))
+}
+
+// WriteChunk streams dataLen bytes from r into the upload at offset. If
+// checksum (hex SHA-256) is set, the bytes must match it.
+func (s *BackupService) WriteChunk(transferID string, offset int64, dataLen int64, checksum string, r io.Reader) error {
 	session, err := s.repo.GetSessionByTransferID(transferID)
 	if err != nil {
 		return err
@@ -66,37 +137,59 @@ func (s *BackupService) UpdateChunk(transferID string, offset int64, dataLen int
 		return fmt.Errorf("session is not in progress: %s", session.Status)
 	}
 
-	// 1. Decode Data
-	data, err := hex.DecodeString(hexData)
-	if err != nil {
-		return fmt.Errorf("failed to decode chunk data: %v", err)
+	// A chunk sent again after its response was lost is already written
+	if offset >= 0 && offset+dataLen <= session.CurrentOffset {
+		return nil
 	}
-
-	if int64(len(data)) != dataLen {
-		return fmt.Errorf("data length mismatch: expected %d, got %d", dataLen, len(data))
+	if offset != session.CurrentOffset {
+		return &OffsetError{Offset: offset, CurrentOffset: session.CurrentOffset}
+	}
+	if offset+dataLen > session.TotalSize {
+		return fmt.Errorf("chunk ends at %d, past the announced %d bytes", offset+dataLen, session.TotalSize)
 	}
 
-	// 2. Write to File
-	path := filepath.Join(s.storagePath, session.DeviceID, session.FileUUID, fmt.Sprintf("v%d", session.Version), session.FileName)
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	// 1. Write to File. An upload starting over drops whatever an earlier
+	// attempt at the same version left.
+	partial, err := s.partialPath(session)
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open file for writing: %v", err)
 	}
 	defer f.Close()
 
-	if _, err := f.WriteAt(data, offset); err != nil {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to chunk: %v", err)
+	}
+
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, sum), io.LimitReader(r, dataLen))
+	if err != nil {
 		return fmt.Errorf("failed to write data chunk: %v", err)
 	}
+	if n != dataLen {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", dataLen, n)
+	}
 
-	// 3. Update offset in DB (optional since we have offset in request, but good for progress)
-	if offset+dataLen > session.CurrentOffset {
-		session.CurrentOffset = offset + dataLen
-		return s.repo.UpdateSession(session)
+	// 2. Verify. The bad bytes are already on disk, but the offset is not
+	// advanced, so a resume sends the chunk again.
+	if checksum != "" && hex.EncodeToString(sum.Sum(nil)) != checksum {
+		return ErrChecksumMismatch
 	}
-	return nil
+
+	// 3. Advance the offset; the next chunk must start here
+	session.CurrentOffset = offset + dataLen
+	session.LastUpdateTime = time.Now()
+	return s.repo.UpdateSession(session)
 }
 
-func (s *BackupService) FinishSession(transferID, serverPath, fileHash string) error {
+func (s *BackupService) FinishSession(transferID, fileHash string) error {
 	session, err := s.repo.GetSessionByTransferID(transferID)
 	if err != nil {
 		return err
@@ -106,41 +199,280 @@ func (s *BackupService) FinishSession(transferID, serverPath, fileHash string) e
 		return fmt.Errorf("session is not in progress: %s", session.Status)
 	}
 
-	// 1. Generate serverPath if not provided by client
-	// Format: storagePath/deviceID/fileUUID/version/fileName (or just the directory)
-	finalPath := serverPath
-	if finalPath == "" {
-		finalPath = filepath.Join(s.storagePath, session.DeviceID, session.FileUUID, fmt.Sprintf("v%d", session.Version), session.FileName)
+	// 1. Storage key: deviceID/fileUUID/version/fileName. Sessions are
+	// checked at init; this catches one created before that.
+	key := storageKey(session)
+	partial, err := s.partialPath(session)
+	if err != nil {
+		return s.failSession(session, err)
+	}
+
+	// 2. Verify what was written: every byte, and the hash the agent sent
+	if session.CurrentOffset != session.TotalSize {
+		return s.failSession(session, fmt.Errorf("%w: %d of %d bytes written", ErrIncompleteUpload, session.CurrentOffset, session.TotalSize))
+	}
+	storedHash, err := hashFile(partial, session.TotalSize)
+	if err != nil {
+		return s.failSession(session, fmt.Errorf("%w: %v", ErrIncompleteUpload, err))
+	}
+	if fileHash != "" && fileHash != storedHash {
+		return s.failSession(session, fmt.Errorf("%w: stored %s, agent sent %s", ErrFileHashMismatch, storedHash, fileHash))
+	}
+
+	// 3. Hand the file to the storage backend
+	backendName, backend := s.backends.Active()
+	if err := storage.MoveFile(backend, key, partial); err != nil {
+		return fmt.Errorf("failed to store %s: %v", key, err)
 	}
+	os.Remove(filepath.Dir(partial)) // Only once empty
 
-	// 2. Create Snapshot
+	// 4. Create Snapshot
+	now := time.Now()
 	snapshot := &models.BackupSnapshot{
 		DeviceID:   session.DeviceID,
 		FileUUID:   session.FileUUID,
 		Version:    session.Version,
-		ServerPath: finalPath,
+		Backend:    backendName,
+		StorageKey: key,
 		FileSize:   session.TotalSize,
-		FileHash:   fileHash,
-		CreatedAt:  time.Now(),
+		FileHash:   storedHash,
+		CreatedAt:  now,
+		Integrity:  models.IntegrityOK,
+		VerifiedAt: &now,
 	}
 
 	if err := s.repo.CreateSnapshot(snapshot); err != nil {
 		return err
 	}
 
-	// 2. Mark Session as DONE
+	// 5. Mark Session as DONE
 	session.Status = models.BackupDone
 	return s.repo.UpdateSession(session)
 }
 
+// inProgress looks up a transfer that still takes data.
+func (s *BackupService) inProgress(transferID string) (*models.BackupSession, error) {
+	session, err := s.repo.GetSessionByTransferID(transferID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != models.BackupInProgress {
+		return nil, fmt.Errorf("session is not in progress: %s", session.Status)
+	}
+	return session, nil
+}
+
+// MissingChunks returns which of an upload's chunk hashes the server does
+// not have yet from its device; only those need to be sent.
+func (s *BackupService) MissingChunks(transferID string, hashes []string) ([]string, error) {
+	session, err := s.inProgress(transferID)
+	if err != nil {
+		return nil, err
+	}
+	s.repo.TouchSession(session.ID)
+	return s.chunks.Missing(session.DeviceID, hashes)
+}
+
+// PutChunk stores one content-addressed chunk of an upload.
+func (s *BackupService) PutChunk(transferID, hash string, size int64, r io.Reader) error {
+	session, err := s.inProgress(transferID)
+	if err != nil {
+		return err
+	}
+	s.repo.TouchSession(session.ID)
+	return s.chunks.Put(session.DeviceID, hash, size, r)
+}
+
+// FinishChunkedSession completes an upload whose content is the given
+// chunks, in order. Every chunk must be stored and together they must make
+// up the announced size.
+func (s *BackupService) FinishChunkedSession(transferID, fileHash string, refs []ChunkRef) error {
+	session, err := s.inProgress(transferID)
+	if err != nil {
+		return err
+	}
+
+	manifest := make([]models.SnapshotChunk, len(refs))
+	var offset int64
+	for i, ref := range refs {
+		if !validChunkHash(ref.Hash) || ref.Size <= 0 || ref.Size > MaxChunkSize {
+			return fmt.Errorf("invalid chunk %d in manifest", i)
+		}
+		manifest[i] = models.SnapshotChunk{Seq: i, FileOffset: offset, ChunkHash: ref.Hash, Size: ref.Size}
+		offset += ref.Size
+	}
+	if offset != session.TotalSize {
+		return fmt.Errorf("manifest covers %d bytes, expected %d", offset, session.TotalSize)
+	}
+
+	// Chunks were checked when stored; this also catches one lost since
+	storedHash, err := s.chunks.Verify(manifest, session.TotalSize)
+	if err != nil {
+		return s.failSession(session, fmt.Errorf("%w: %v", ErrIncompleteUpload, err))
+	}
+	if fileHash != "" && fileHash != storedHash {
+		return s.failSession(session, fmt.Errorf("%w: stored %s, agent sent %s", ErrFileHashMismatch, storedHash, fileHash))
+	}
+
+	now := time.Now()
+	snapshot := &models.BackupSnapshot{
+		DeviceID:   session.DeviceID,
+		FileUUID:   session.FileUUID,
+		Version:    session.Version,
+		Chunked:    true,
+		FileSize:   session.TotalSize,
+		FileHash:   storedHash,
+		CreatedAt:  now,
+		Integrity:  models.IntegrityOK,
+		VerifiedAt: &now,
+	}
+	if err := s.chunks.CreateSnapshot(snapshot, manifest); err != nil {
+		return err
+	}
+
+	// The version directory InitSession made holds at most the start of an
+	// earlier whole-file attempt
+	s.removePartial(session)
+
+	session.Status = models.BackupDone
+	return s.repo.UpdateSession(session)
+}
+
+// failSession marks an upload failed and drops its data, so the agent starts
+// the file over; returns err.
+func (s *BackupService) failSession(session *models.BackupSession, err error) error {
+	fmt.Printf("[Backup] %s failed: %v\n", session.TransferID, err)
+	s.removePartial(session)
+
+	session.Status = models.BackupFailed
+	if uerr := s.repo.UpdateSession(session); uerr != nil {
+		fmt.Printf("[Backup] Failed to mark %s failed: %v\n", session.TransferID, uerr)
+	}
+	return err
+}
+
+// removePartial deletes what an upload wrote, unless its version directory
+// is shared with another upload or a snapshot. An upload whose name would
+// leave the storage path never wrote anything, so nothing is removed.
+func (s *BackupService) removePartial(session *models.BackupSession) {
+	path, err := s.partialPath(session)
+	if err != nil {
+		return
+	}
+	if inUse, err := s.repo.VersionInUse(session); err != nil || inUse {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("[Backup] Failed to remove %s: %v\n", path, err)
+	}
+	os.Remove(filepath.Dir(path)) // Only once empty
+}
+
+// IdleSessions lists the uploads with no activity since before.
+func (s *BackupService) IdleSessions(before time.Time) ([]models.BackupSession, error) {
+	return s.repo.GetIdleSessions(before)
+}
+
+// ExpireIdle expires the uploads with no activity since before and removes
+// their partial files; the agent starts such a file over. Returns how many
+// were expired.
+func (s *BackupService) ExpireIdle(before time.Time) (int, error) {
+	sessions, err := s.repo.GetIdleSessions(before)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for i := range sessions {
+		session := &sessions[i]
+		// Conditional, so a chunk arriving meanwhile keeps the upload alive
+		ok, err := s.repo.ExpireSession(session.ID, before)
+		if err != nil {
+			return expired, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Printf("[Backup] %s expired (%s v%d, %d of %d bytes, idle since %s)\n", session.TransferID, session.FileUUID, session.Version, session.CurrentOffset, session.TotalSize, session.LastUpdateTime.Format(time.RFC3339))
+		session.Status = models.BackupExpired
+		s.removePartial(session) // Skips a name that would leave the storage path
+		expired++
+	}
+	return expired, nil
+}
+
+// partialPath is where the chunks of an upload are written. It is the
+// local backend's path for the upload's storage key, so there finishing
+// moves nothing. Fails with ErrInvalidFileName unless the key is valid and
+// each of its parts is a single segment.
+func (s *BackupService) partialPath(session *models.BackupSession) (string, error) {
+	key := storageKey(session)
+	if !storage.ValidKey(key) || strings.Count(key, "/") != 3 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFileName, session.FileName)
+	}
+	return filepath.Join(s.storagePath, filepath.FromSlash(key)), nil
+}
+
+// storageKey is the key a finished upload is stored under.
+func storageKey(session *models.BackupSession) string {
+	return fmt.Sprintf("%s/%s/v%d/%s", session.DeviceID, session.FileUUID, session.Version, session.FileName)
+}
+
+// Checkpoint makes unfinished uploads safe to resume after a restart: the
+// partial files are synced and each offset is clamped to what is actually
+// on disk. Run at shutdown once requests have drained; returns the number
+// of uploads left resumable.
+func (s *BackupService) Checkpoint() (int, error) {
+	sessions, err := s.repo.GetInProgressSessions()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range sessions {
+		session := &sessions[i]
+		var size int64
+		partial, err := s.partialPath(session)
+		if err != nil {
+			continue
+		}
+		if f, err := os.OpenFile(partial, os.O_WRONLY, 0); err == nil {
+			f.Sync()
+			if info, err := f.Stat(); err == nil {
+				size = info.Size()
+			}
+			f.Close()
+		}
+		if size < session.CurrentOffset {
+			fmt.Printf("[Backup] %s: offset %d beyond stored %d bytes, resuming from %d\n", session.TransferID, session.CurrentOffset, size, size)
+			session.CurrentOffset = size
+			if err := s.repo.UpdateSession(session); err != nil && err != repositories.ErrSessionExpired {
+				return i, err
+			}
+		}
+	}
+	return len(sessions), nil
+}
+
+// CancelSession cancels an upload in progress and removes its partial file.
+// An upload that already ended keeps its status.
 func (s *BackupService) CancelSession(transferID string) error {
 	session, err := s.repo.GetSessionByTransferID(transferID)
 	if err != nil {
 		return err
 	}
 
+	ok, err := s.repo.CancelSession(session.ID)
+	if err != nil || !ok {
+		return err
+	}
 	session.Status = models.BackupCanceled
-	return s.repo.UpdateSession(session)
+	s.removePartial(session)
+	return nil
+}
+
+// GetSession looks up a transfer (used to check which device owns it).
+func (s *BackupService) GetSession(transferID string) (*models.BackupSession, error) {
+	return s.repo.GetSessionByTransferID(transferID)
 }
 
 func (s *BackupService) GetActiveSession(deviceID, fileUUID string) (*models.BackupSession, error) {
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// CertService signs per-device client certificates with the server CA.
+// The certificate CN is the device_id, which the server checks on every
+// TLS connection.
+type CertService struct {
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	validity time.Duration
+}
+
+func NewCertService(caCertFile, caKeyFile string, validityDays int) (*CertService, error) {
+	certPEM, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key: %v", err)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("invalid CA certificate PEM")
+	}
+	caCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %v", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("invalid CA key PEM")
+	}
+	caKey, err := parsePrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key: %v", err)
+	}
+
+	if validityDays <= 0 {
+		validityDays = 365
+	}
+
+	return &CertService{
+		caCert:   caCert,
+		caKey:    caKey,
+		validity: time.Duration(validityDays) * 24 * time.Hour,
+	}, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("unsupported key type")
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// SignDeviceCSR issues a client certificate for deviceID from a PEM CSR.
+// The CN is always forced to deviceID regardless of what the CSR asks for.
+// Returns the certificate PEM and its serial number (hex).
+func (s *CertService) SignDeviceCSR(deviceID, csrPEM string) (string, string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", "", errors.New("invalid CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", "", fmt.Errorf("bad CSR signature: %v", err)
+	}
+
+	return s.issue(deviceID, csr.PublicKey)
+}
+
+// IssueKeyPair generates a fresh key and certificate for commonName (used by
+// the issue-cert server command, e.g. for the ADMIN_CONSOLE identity).
+func (s *CertService) IssueKeyPair(commonName string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	certPEM, _, err := s.issue(commonName, &key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return certPEM, string(keyPEM), nil
+}
+
+func (s *CertService) issue(commonName string, pub crypto.PublicKey) (string, string, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(s.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, pub, s.caKey)
+	if err != nil {
+		return "", "", fmt.Errorf("sign certificate: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return string(certPEM), serial.Text(16), nil
+}
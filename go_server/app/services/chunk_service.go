@@ -0,0 +1,467 @@
+package services
+
+import (
+	"crypto/sha256"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The chunk store keeps file content once per distinct chunk, keyed by its
+// SHA256: chunks/ab/abcdef... in the storage backend. Chunked snapshots are a manifest
+// of chunk hashes (SnapshotChunk), so an unchanged region of a new version,
+// or the same file on another device, costs no storage. Which chunks are
+// stored is only revealed per device (ChunkOwner): a chunk another device
+// stored must be uploaded again, proving possession, before it can be used.
+
+const (
+	// MaxChunkSize is the largest chunk the store accepts; agents cut
+	// chunks of at most 4 MiB.
+	MaxChunkSize = 8 * 1024 * 1024
+	// MaxChunkQuery caps the hashes in one MissingChunks call.
+	MaxChunkQuery = 1024
+)
+
+var (
+	ErrInvalidChunkHash = errors.New("invalid chunk hash")
+	ErrChunkTooLarge    = errors.New("chunk too large")
+)
+
+type ChunkService struct {
+	repo     *repositories.ChunkRepository
+	backends *storage.Backends
+	staging  string // Local directory chunks are checked in before storing
+	// Guards storing and removing, and is held while a chunk's row is
+	// written or deleted; never across a backend call
+	mu       sync.Mutex
+	changed  *sync.Cond      // Signalled when a chunk leaves removing
+	storing  map[string]int  // Puts writing each chunk, which the sweep skips
+	removing map[string]bool // Chunks the sweep is deleting, which Put waits for
+}
+
+func NewChunkService(repo *repositories.ChunkRepository, backends *storage.Backends, storagePath string) *ChunkService {
+	s := &ChunkService{
+		repo:     repo,
+		backends: backends,
+		staging:  filepath.Join(storagePath, "tmp"),
+		storing:  make(map[string]int),
+		removing: make(map[string]bool),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// validChunkHash accepts lowercase hex SHA256 only, since the hash becomes
+// a file name.
+func validChunkHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func chunkKey(hash string) string {
+	return "chunks/" + hash[:2] + "/" + hash
+}
+
+// open reads a manifest entry's chunk from the backend it is stored in.
+func (s *ChunkService) open(entry models.SnapshotChunk, offset, length int64) (io.ReadCloser, error) {
+	if entry.Backend == "" {
+		return nil, fmt.Errorf("%w: chunk %s is not in the store", storage.ErrNotExist, entry.ChunkHash)
+	}
+	backend, err := s.backends.Get(entry.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetRange(chunkKey(entry.ChunkHash), offset, length)
+}
+
+// Missing returns the hashes the device has not stored, in the order given
+// and without repeats. The chunks it reports present are renewed, so the
+// sweep leaves them to the snapshot that is about to reference them.
+func (s *ChunkService) Missing(deviceID string, hashes []string) ([]string, error) {
+	if len(hashes) > MaxChunkQuery {
+		return nil, fmt.Errorf("at most %d hashes per query", MaxChunkQuery)
+	}
+	for _, hash := range hashes {
+		if !validChunkHash(hash) {
+			return nil, ErrInvalidChunkHash
+		}
+	}
+
+	// Renewed before the lookup, so no chunk found is one the sweep is
+	// about to take
+	if err := s.repo.TouchChunks(deviceID, hashes); err != nil {
+		return nil, err
+	}
+	found, err := s.repo.FindHashes(deviceID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(hashes))
+	for _, hash := range found {
+		seen[hash] = true
+	}
+
+	missing := []string{}
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+// Put stores size bytes read from r as the chunk hash, uploaded by the
+// device. The content must hash to it; a chunk the device already stored is
+// not written again, only renewed as in Missing.
+func (s *ChunkService) Put(deviceID, hash string, size int64, r io.Reader) error {
+	if !validChunkHash(hash) {
+		return ErrInvalidChunkHash
+	}
+	if size > MaxChunkSize {
+		return ErrChunkTooLarge
+	}
+
+	key := chunkKey(hash)
+	if err := s.repo.TouchChunks(deviceID, []string{hash}); err != nil {
+		return err
+	}
+	if found, err := s.repo.FindHashes(deviceID, []string{hash}); err == nil && len(found) == 1 {
+		if chunks, err := s.repo.FindChunks(found); err == nil && len(chunks) == 1 {
+			if backend, err := s.backends.Get(chunks[0].Backend); err == nil {
+				if _, err := backend.Stat(key); err == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	if err := os.MkdirAll(s.staging, 0755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %v", err)
+	}
+	// Checked in a local file first, so only a chunk matching its hash is
+	// ever stored
+	tmp, err := os.CreateTemp(s.staging, hash+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create chunk file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once stored
+
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(r, size))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write chunk: %v", err)
+	}
+	if n != size {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", size, n)
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return ErrChecksumMismatch
+	}
+
+	name, backend := s.backends.Active()
+	s.mu.Lock()
+	for s.removing[hash] {
+		s.changed.Wait()
+	}
+	s.storing[hash]++
+	s.mu.Unlock()
+
+	err = storage.MoveFile(backend, key, tmp.Name())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storing[hash]--; s.storing[hash] == 0 {
+		delete(s.storing, hash)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store chunk: %v", err)
+	}
+	return s.repo.CreateChunk(&models.Chunk{Hash: hash, Size: size, Backend: name, CreatedAt: time.Now()}, deviceID)
+}
+
+// CreateSnapshot stores a chunked snapshot and references its chunks.
+func (s *ChunkService) CreateSnapshot(snapshot *models.BackupSnapshot, manifest []models.SnapshotChunk) error {
+	return s.repo.CreateSnapshot(snapshot, manifest)
+}
+
+// DeleteSnapshot removes a chunked snapshot and releases its chunks.
+func (s *ChunkService) DeleteSnapshot(snapshotID uint) error {
+	return s.repo.DeleteSnapshot(snapshotID)
+}
+
+// Freed estimates what deleting the given chunked snapshots releases: the
+// chunks they hold the only references to.
+func (s *ChunkService) Freed(snapshotIDs []uint) (int, int64, error) {
+	counts, err := s.repo.CountRefs(snapshotIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	hashes := make([]string, 0, len(counts))
+	for hash := range counts {
+		hashes = append(hashes, hash)
+	}
+
+	var n int
+	var bytes int64
+	for i := 0; i < len(hashes); i += MaxChunkQuery {
+		chunks, err := s.repo.FindChunks(hashes[i:min(i+MaxChunkQuery, len(hashes))])
+		if err != nil {
+			return n, bytes, err
+		}
+		for _, chunk := range chunks {
+			if chunk.RefCount <= counts[chunk.Hash] {
+				n++
+				bytes += chunk.Size
+			}
+		}
+	}
+	return n, bytes, nil
+}
+
+// Sweep deletes the chunks no snapshot has used since before. A chunk is
+// unreferenced between its upload and the finish of its session, so before
+// must leave room for uploads in progress. A dry run only counts them.
+func (s *ChunkService) Sweep(before time.Time, dryRun bool) (int, int64, error) {
+	var n int
+	var bytes int64
+	after := ""
+	for {
+		chunks, err := s.repo.FindUnreferenced(before, after, 500)
+		if err != nil || len(chunks) == 0 {
+			return n, bytes, err
+		}
+		for _, chunk := range chunks {
+			after = chunk.Hash
+			if dryRun {
+				n++
+				bytes += chunk.Size
+				continue
+			}
+
+			deleted, err := s.remove(chunk, before)
+			if err != nil {
+				return n, bytes, err
+			}
+			if deleted {
+				n++
+				bytes += chunk.Size
+			}
+		}
+	}
+}
+
+// remove deletes an unreferenced chunk's row and then its object, unless a
+// Put is storing it or it was renewed since before; the row is re-checked
+// under s.mu. A Put of the chunk waits until the object is gone.
+func (s *ChunkService) remove(chunk models.Chunk, before time.Time) (bool, error) {
+	s.mu.Lock()
+	if s.storing[chunk.Hash] > 0 {
+		s.mu.Unlock()
+		return false, nil
+	}
+	deleted, err := s.repo.DeleteUnreferenced(chunk.Hash, before)
+	if !deleted {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.removing[chunk.Hash] = true
+	s.mu.Unlock()
+
+	if err := s.deleteObject(chunk); err != nil {
+		fmt.Printf("[Retention] Failed to remove chunk %s: %v\n", chunk.Hash, err)
+	}
+
+	s.mu.Lock()
+	delete(s.removing, chunk.Hash)
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	return true, nil
+}
+
+func (s *ChunkService) deleteObject(chunk models.Chunk) error {
+	backend, err := s.backends.Get(chunk.Backend)
+	if err != nil {
+		return err
+	}
+	return backend.Delete(chunkKey(chunk.Hash))
+}
+
+// Verify reads a file's chunks in order, checking each against its hash,
+// and returns the SHA256 of the whole file. The manifest must cover exactly
+// size bytes.
+func (s *ChunkService) Verify(manifest []models.SnapshotChunk, size int64) (string, error) {
+	if err := s.fillBackends(manifest); err != nil {
+		return "", err
+	}
+	whole := sha256.New()
+	var offset int64
+	for _, entry := range manifest {
+		if entry.FileOffset != offset {
+			return "", fmt.Errorf("%w: manifest has no chunk at offset %d", ErrDataMissing, offset)
+		}
+		f, err := s.open(entry, 0, -1)
+		if errors.Is(err, storage.ErrNotExist) {
+			return "", fmt.Errorf("%w: chunk %s", ErrDataMissing, entry.ChunkHash)
+		}
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.New()
+		n, err := io.Copy(io.MultiWriter(whole, sum), f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read chunk %s: %v", entry.ChunkHash, err)
+		}
+		if n < entry.Size {
+			return "", fmt.Errorf("%w: chunk %s has %d of %d bytes", ErrDataMissing, entry.ChunkHash, n, entry.Size)
+		}
+		if n > entry.Size || hex.EncodeToString(sum.Sum(nil)) != entry.ChunkHash {
+			return "", fmt.Errorf("%w: chunk %s", ErrDataCorrupted, entry.ChunkHash)
+		}
+		offset += entry.Size
+	}
+	if offset != size {
+		return "", fmt.Errorf("%w: manifest covers %d of %d bytes", ErrDataMissing, offset, size)
+	}
+	return hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+// fillBackends looks up where the chunks of a manifest built from an
+// agent's list are stored. Entries of chunks not in the store keep "".
+func (s *ChunkService) fillBackends(manifest []models.SnapshotChunk) error {
+	var hashes []string
+	seen := make(map[string]bool)
+	for _, entry := range manifest {
+		if entry.Backend == "" && !seen[entry.ChunkHash] {
+			seen[entry.ChunkHash] = true
+			hashes = append(hashes, entry.ChunkHash)
+		}
+	}
+
+	backends := make(map[string]string, len(hashes))
+	for i := 0; i < len(hashes); i += MaxChunkQuery {
+		chunks, err := s.repo.FindChunks(hashes[i:min(i+MaxChunkQuery, len(hashes))])
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			backends[chunk.Hash] = chunk.Backend
+		}
+	}
+	for i := range manifest {
+		if manifest[i].Backend == "" {
+			manifest[i].Backend = backends[manifest[i].ChunkHash]
+		}
+	}
+	return nil
+}
+
+// VerifySnapshot checks the stored chunks of a chunked snapshot; see Verify.
+func (s *ChunkService) VerifySnapshot(snapshot *models.BackupSnapshot) (string, error) {
+	manifest, err := s.repo.GetManifestRange(snapshot.ID, 0, snapshot.FileSize)
+	if err != nil {
+		return "", err
+	}
+	return s.Verify(manifest, snapshot.FileSize)
+}
+
+// OpenRange reads n bytes at offset of a chunked snapshot, opening the
+// chunks as it reaches them. The caller closes it.
+func (s *ChunkService) OpenRange(snapshotID uint, offset, n int64) (io.ReadCloser, error) {
+	entries, err := s.repo.GetManifestRange(snapshotID, offset, offset+n)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestReader{store: s, entries: entries, pos: offset, end: offset + n}, nil
+}
+
+// manifestReader reads a byte range of a file from its manifest entries.
+type manifestReader struct {
+	store   *ChunkService
+	entries []models.SnapshotChunk
+	pos     int64
+	end     int64
+	chunk   io.ReadCloser
+	section io.Reader
+	stop    int64 // Where section ends
+}
+
+func (m *manifestReader) Read(p []byte) (int, error) {
+	for m.pos < m.end {
+		if m.section == nil {
+			if err := m.openAt(m.pos); err != nil {
+				return 0, err
+			}
+		}
+		n, err := m.section.Read(p)
+		m.pos += int64(n)
+		if err == io.EOF {
+			m.closeChunk()
+			err = nil
+			if m.pos < m.stop {
+				err = io.ErrUnexpectedEOF // Chunk file shorter than recorded
+			}
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// openAt opens the chunk holding the byte at pos.
+func (m *manifestReader) openAt(pos int64) error {
+	for len(m.entries) > 0 && m.entries[0].FileOffset+m.entries[0].Size <= pos {
+		m.entries = m.entries[1:]
+	}
+	if len(m.entries) == 0 || m.entries[0].FileOffset > pos {
+		return fmt.Errorf("no chunk holds offset %d", pos)
+	}
+	entry := m.entries[0]
+
+	end := entry.FileOffset + entry.Size
+	if end > m.end {
+		end = m.end
+	}
+	chunk, err := m.store.open(entry, pos-entry.FileOffset, end-pos)
+	if err != nil {
+		return err
+	}
+	m.chunk, m.stop = chunk, end
+	m.section = io.LimitReader(chunk, end-pos)
+	return nil
+}
+
+func (m *manifestReader) closeChunk() {
+	if m.chunk != nil {
+		m.chunk.Close()
+	}
+	m.chunk, m.section = nil, nil
+}
+
+func (m *manifestReader) Close() error {
+	m.closeChunk()
+	return nil
+}
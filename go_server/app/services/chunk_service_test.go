@@ -0,0 +1,205 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB opens an empty database holding the backup tables.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(
+		&models.Device{},
+		&models.FileNode{},
+		&models.BackupSession{},
+		&models.BackupSnapshot{},
+		&models.Chunk{},
+		&models.ChunkOwner{},
+		&models.SnapshotChunk{},
+		&models.RestoreSession{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestChunks returns a chunk store over an in-memory backend named "mem".
+func newTestChunks(t *testing.T, db *gorm.DB) (*ChunkService, *storage.Backends, *storage.Memory) {
+	t.Helper()
+	mem := storage.NewMemory()
+	backends, err := storage.NewBackends("mem", map[string]storage.Backend{"mem": mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChunkService(repositories.NewChunkRepository(db), backends, t.TempDir()), backends, mem
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func putChunk(t *testing.T, chunks *ChunkService, deviceID string, data []byte) string {
+	t.Helper()
+	hash := hashOf(data)
+	if err := chunks.Put(deviceID, hash, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put(%s): %v", deviceID, err)
+	}
+	return hash
+}
+
+func TestChunkPut(t *testing.T) {
+	data := []byte("chunk content")
+	tests := []struct {
+		name string
+		hash string
+		size int64
+		want error
+	}{
+		{"valid", hashOf(data), int64(len(data)), nil},
+		{"uppercase hash", "A" + hashOf(data)[1:], int64(len(data)), ErrInvalidChunkHash},
+		{"short hash", hashOf(data)[:10], int64(len(data)), ErrInvalidChunkHash},
+		{"too large", hashOf(data), MaxChunkSize + 1, ErrChunkTooLarge},
+		{"wrong content", hashOf([]byte("other content")), int64(len(data)), ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, _, mem := newTestChunks(t, newTestDB(t))
+			err := chunks.Put("dev-a", tt.hash, tt.size, bytes.NewReader(data))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Put = %v, want %v", err, tt.want)
+			}
+			objects, _ := mem.List("chunks/")
+			if stored := len(objects) == 1; stored != (tt.want == nil) {
+				t.Errorf("%d object(s) stored", len(objects))
+			}
+		})
+	}
+}
+
+func TestChunkDedupByDevice(t *testing.T) {
+	db := newTestDB(t)
+	chunks, _, mem := newTestChunks(t, db)
+	data := []byte("shared installer bytes")
+	hash := putChunk(t, chunks, "dev-a", data)
+
+	missing := func(deviceID string) []string {
+		t.Helper()
+		got, err := chunks.Missing(deviceID, []string{hash, hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := missing("dev-a"); len(got) != 0 {
+		t.Errorf("Missing(dev-a) = %v, want none", got)
+	}
+	// Another device is not told the chunk is stored, nor may it use it
+	if got := missing("dev-b"); len(got) != 1 || got[0] != hash {
+		t.Errorf("Missing(dev-b) = %v, want [%s]", got, hash)
+	}
+	manifest := func() []models.SnapshotChunk {
+		return []models.SnapshotChunk{{Seq: 0, FileOffset: 0, ChunkHash: hash, Size: int64(len(data))}}
+	}
+	snapshot := &models.BackupSnapshot{DeviceID: "dev-b", FileUUID: "file-1", Version: 1, Chunked: true, FileSize: int64(len(data))}
+	if err := chunks.CreateSnapshot(snapshot, manifest()); err == nil {
+		t.Fatal("dev-b referenced a chunk it never uploaded")
+	}
+
+	// Once it proves possession the chunk is shared, not stored twice
+	putChunk(t, chunks, "dev-b", data)
+	if got := missing("dev-b"); len(got) != 0 {
+		t.Errorf("Missing(dev-b) after Put = %v, want none", got)
+	}
+	if err := chunks.CreateSnapshot(snapshot, manifest()); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	objects, _ := mem.List("chunks/")
+	if len(objects) != 1 {
+		t.Errorf("%d objects stored, want 1", len(objects))
+	}
+
+	// The size is part of what a manifest must match
+	wrong := manifest()
+	wrong[0].Size++
+	other := &models.BackupSnapshot{DeviceID: "dev-a", FileUUID: "file-2", Version: 1, Chunked: true, FileSize: wrong[0].Size}
+	if err := chunks.CreateSnapshot(other, wrong); err == nil {
+		t.Error("a manifest with the wrong chunk size was accepted")
+	}
+}
+
+func TestChunkSweep(t *testing.T) {
+	db := newTestDB(t)
+	chunks, _, mem := newTestChunks(t, db)
+	old := time.Now().Add(-48 * time.Hour)
+
+	referenced := putChunk(t, chunks, "dev-a", []byte("referenced"))
+	renewed := putChunk(t, chunks, "dev-a", []byte("renewed"))
+	stale := putChunk(t, chunks, "dev-a", []byte("stale"))
+	fresh := putChunk(t, chunks, "dev-a", []byte("fresh"))
+
+	snapshot := &models.BackupSnapshot{DeviceID: "dev-a", FileUUID: "file-1", Version: 1, Chunked: true, FileSize: int64(len("referenced"))}
+	manifest := []models.SnapshotChunk{{ChunkHash: referenced, Size: int64(len("referenced"))}}
+	if err := chunks.CreateSnapshot(snapshot, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.Chunk{}).Where("hash IN ?", []string{referenced, renewed, stale}).Update("created_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Reported present to an agent, which is about to reference it
+	if _, err := chunks.Missing("dev-a", []string{renewed}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(-time.Hour)
+	if n, bytes, err := chunks.Sweep(before, true); err != nil || n != 1 || bytes != int64(len("stale")) {
+		t.Fatalf("dry run Sweep = %d, %d, %v; want 1, %d", n, bytes, err, len("stale"))
+	}
+	if _, err := mem.Stat(chunkKey(stale)); err != nil {
+		t.Fatalf("dry run removed a chunk: %v", err)
+	}
+
+	n, _, err := chunks.Sweep(before, false)
+	if err != nil || n != 1 {
+		t.Fatalf("Sweep = %d, %v; want 1", n, err)
+	}
+	for _, hash := range []string{referenced, renewed, fresh} {
+		if _, err := mem.Stat(chunkKey(hash)); err != nil {
+			t.Errorf("chunk %s removed: %v", hash[:8], err)
+		}
+	}
+	if _, err := mem.Stat(chunkKey(stale)); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("stale chunk kept: %v", err)
+	}
+	if got, _ := chunks.Missing("dev-a", []string{stale}); len(got) != 1 {
+		t.Error("swept chunk still reported present")
+	}
+
+	// Released by its snapshot, a chunk goes on the next sweep
+	if err := chunks.DeleteSnapshot(snapshot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := chunks.Sweep(before, false); err != nil || n != 1 {
+		t.Fatalf("Sweep after DeleteSnapshot = %d, %v; want 1", n, err)
+	}
+	if _, err := mem.Stat(chunkKey(referenced)); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("released chunk kept: %v", err)
+	}
+}
@@ -4,61 +4,380 @@ import (
 	"demo/network/go_server/app/models"
 	"demo/network/go_server/app/repositories"
 	"demo/network/go_server/server"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrCommandNotFound      = errors.New("command not found")
+	ErrInvalidCommandStatus = errors.New("invalid status transition")
 )
 
+// CommandPolicy sets how a command type is queued. Zero values fall back to
+// the CommandSettings defaults.
+type CommandPolicy struct {
+	Priority    int
+	TTL         time.Duration
+	MaxAttempts int
+}
+
+// CommandPolicies by command type. Firewall updates go first; a restore is
+// only useful while someone is waiting for it.
+var CommandPolicies = map[int]CommandPolicy{
+	0xE3: {Priority: 10, TTL: 7 * 24 * time.Hour}, // MSG_SERVER_FIREWALL_UPDATE_CMD
+	0x72: {Priority: 5, TTL: 24 * time.Hour},      // MSG_SERVER_RESTORE_CMD
+	0xD3: {Priority: 0, TTL: time.Hour},           // MSG_SERVER_COMMAND_GETLOG
+}
+
+// CommandSettings are the queue defaults (config.yml commands:).
+type CommandSettings struct {
+	DefaultTTL       time.Duration // 0 = commands never expire
+	MaxAttempts      int           // Sends without acknowledgement before FAILED
+	AckTimeout       time.Duration // How long a SENT command waits for ACCEPTED
+	RetryBackoff     time.Duration // Delay before the first resend, doubled each time
+	DispatchInterval time.Duration
+}
+
 type CommandService struct {
-	Repo *repositories.CommandRepository
+	Repo     *repositories.CommandRepository
+	settings CommandSettings
+	// Serializes status changes between the dispatcher, connect-time
+	// delivery and device reports (rows are saved whole). Not held while
+	// writing to a device (see claim and deliver).
+	mu   sync.Mutex
+	stop chan struct{}
 }
 
-func NewCommandService(repo *repositories.CommandRepository) *CommandService {
-	return &CommandService{Repo: repo}
+func NewCommandService(repo *repositories.CommandRepository, settings CommandSettings) *CommandService {
+	if settings.MaxAttempts <= 0 {
+		settings.MaxAttempts = 5
+	}
+	if settings.AckTimeout <= 0 {
+		settings.AckTimeout = time.Minute
+	}
+	if settings.RetryBackoff <= 0 {
+		settings.RetryBackoff = 30 * time.Second
+	}
+	if settings.DispatchInterval <= 0 {
+		settings.DispatchInterval = 15 * time.Second
+	}
+	return &CommandService{Repo: repo, settings: settings, stop: make(chan struct{})}
 }
 
-func (s *CommandService) CreateCommand(deviceID string, cmdType int, payload string) (*models.Command, error) {
+// CreateCommand queues a command for a device. createdBy is the acting
+// user (0 for commands the server issues on its own). Priority, expiry and
+// attempts come from CommandPolicies.
+func (s *CommandService) CreateCommand(deviceID string, cmdType int, payload string, createdBy uint) (*models.Command, error) {
+	policy := CommandPolicies[cmdType]
+	ttl := policy.TTL
+	if ttl == 0 {
+		ttl = s.settings.DefaultTTL
+	}
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = s.settings.MaxAttempts
+	}
+
+	now := time.Now()
 	cmd := &models.Command{
 		DeviceID:    deviceID,
 		CommandType: cmdType,
 		Payload:     payload,
 		Status:      models.StatusPending,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedBy:   createdBy,
+		Priority:    policy.Priority,
+		MaxAttempts: maxAttempts,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		cmd.ExpiresAt = &expiresAt
 	}
 	err := s.Repo.Create(cmd)
 	return cmd, err
 }
 
+// ProcessPendingCommands sends a device's due commands, highest priority
+// first. Called when the device connects and by the dispatcher.
 func (s *CommandService) ProcessPendingCommands(deviceID string) {
-	fmt.Printf("[Service] Processing Queue for %s\n", deviceID)
+	if !server.DeviceApproved(deviceID) {
+		fmt.Printf("[Service] Device %s is not approved; holding its commands.\n", deviceID)
+		return
+	}
+
 	cmds, err := s.Repo.GetPendingByDevice(deviceID)
 	if err != nil {
 		fmt.Printf("[Service] Error fetching pending commands: %v\n", err)
 		return
 	}
+	if len(cmds) == 0 {
+		return
+	}
 
-	for _, cmd := range cmds {
-		fmt.Printf("[Service] Sending Command %d (Type %d)\n", cmd.ID, cmd.CommandType)
-		success := server.SendToDevice(deviceID, cmd.CommandType, cmd.Payload)
-		if success {
-			fmt.Printf("[Service] Command %d sent successfully.\n", cmd.ID)
-			cmd.Status = models.StatusSent
-			cmd.UpdatedAt = time.Now()
-			s.Repo.Update(&cmd)
-		} else {
+	fmt.Printf("[Service] Processing Queue for %s (%d due)\n", deviceID, len(cmds))
+	for i := range cmds {
+		cmd := &cmds[i]
+		prev, ok := s.claim(cmd)
+		if !ok {
+			continue
+		}
+		fmt.Printf("[Service] Sending Command %d (Type %d, priority %d)\n", cmd.ID, cmd.CommandType, cmd.Priority)
+		if !s.deliver(cmd, prev) {
+			// Device went away; the rest waits for the next connect
 			fmt.Printf("[Service] Failed to send Command %d.\n", cmd.ID)
+			return
 		}
+		fmt.Printf("[Service] Command %d sent successfully.\n", cmd.ID)
 	}
 }
 
 // TrySendImmediately attempts to send and updates status if successful
+// (devices that are not approved yet just keep it queued).
 func (s *CommandService) TrySendImmediately(cmd *models.Command) bool {
-	success := server.SendToDevice(cmd.DeviceID, cmd.CommandType, cmd.Payload)
-	if success {
-		cmd.Status = models.StatusSent
-		cmd.UpdatedAt = time.Now()
-		s.Repo.Update(cmd)
+	if !server.DeviceApproved(cmd.DeviceID) {
+		return false
+	}
+	prev, ok := s.claim(cmd)
+	return ok && s.deliver(cmd, prev)
+}
+
+// supported fails a command the device's agent did not list in its hello,
+// instead of sending it something it cannot handle.
+func (s *CommandService) supported(cmd *models.Command) bool {
+	if server.DeviceSupports(cmd.DeviceID, cmd.CommandType) {
+		return true
+	}
+	fmt.Printf("[Service] Device %s does not support command type 0x%X; failing Command %d.\n", cmd.DeviceID, cmd.CommandType, cmd.ID)
+	now := time.Now()
+	cmd.Status = models.StatusFailed
+	cmd.Error = fmt.Sprintf("agent does not support command type 0x%X", cmd.CommandType)
+	cmd.FinishedAt = &now
+	cmd.UpdatedAt = now
+	s.Repo.Update(cmd)
+	return false
+}
+
+// claim marks a pending command SENT before it goes out, so no other sender
+// picks it up and the device's first report already finds it SENT. Returns
+// the command as it was, for deliver to roll back to; false if it is no
+// longer pending or the device's agent cannot run it.
+func (s *CommandService) claim(cmd *models.Command) (models.Command, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.Repo.GetByID(cmd.ID)
+	if err != nil || current.Status != models.StatusPending {
+		return models.Command{}, false
+	}
+	*cmd = *current
+	if !s.supported(cmd) {
+		return models.Command{}, false
+	}
+
+	prev := *cmd
+	now := time.Now()
+	cmd.Status = models.StatusSent
+	cmd.Attempts++
+	cmd.SentAt = &now
+	cmd.NextAttemptAt = nil
+	cmd.UpdatedAt = now
+	if err := s.Repo.Update(cmd); err != nil {
+		*cmd = prev
+		return prev, false
+	}
+	return prev, true
+}
+
+// deliver pushes a claimed command to the device, without holding s.mu so a
+// slow connection holds up no one else. If the device is offline the claim
+// is undone (only sends that reached the device count as attempts), unless
+// the command moved on meanwhile, e.g. was cancelled.
+func (s *CommandService) deliver(cmd *models.Command, prev models.Command) bool {
+	if server.SendToDevice(cmd.DeviceID, cmd.CommandType, cmd.WirePayload()) {
 		return true
 	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.Repo.GetByID(cmd.ID)
+	if err != nil || current.Status != models.StatusSent || current.Attempts != cmd.Attempts {
+		return false
+	}
+	prev.UpdatedAt = time.Now()
+	s.Repo.Update(&prev)
+	*cmd = prev
 	return false
 }
+
+// CancelCommand stops a command that has not been accepted by the device
+// yet. Running commands cannot be recalled.
+func (s *CommandService) CancelCommand(cmdID uint, cancelledBy uint) (*models.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd, err := s.Repo.GetByID(cmdID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrCommandNotFound
+		}
+		return nil, err
+	}
+	if cmd.Status != models.StatusPending && cmd.Status != models.StatusSent {
+		return cmd, ErrInvalidCommandStatus
+	}
+
+	now := time.Now()
+	cmd.Status = models.StatusCancelled
+	cmd.CancelledBy = cancelledBy
+	cmd.FinishedAt = &now
+	cmd.UpdatedAt = now
+	return cmd, s.Repo.Update(cmd)
+}
+
+// RunDispatcher expires old commands, schedules resends of unacknowledged
+// ones and delivers whatever is due to connected devices. It blocks; run it
+// in a goroutine until StopDispatcher.
+func (s *CommandService) RunDispatcher() {
+	ticker := time.NewTicker(s.settings.DispatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.dispatch()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// StopDispatcher ends RunDispatcher and waits for a running status change
+// to be saved. Call once, at shutdown.
+func (s *CommandService) StopDispatcher() {
+	close(s.stop)
+	s.mu.Lock()
+	s.mu.Unlock()
+}
+
+func (s *CommandService) dispatch() {
+	if n, err := s.Repo.ExpireOverdue(); err != nil {
+		fmt.Printf("[Dispatcher] Failed to expire commands: %v\n", err)
+	} else if n > 0 {
+		fmt.Printf("[Dispatcher] %d command(s) expired\n", n)
+	}
+
+	s.retryUnacknowledged()
+
+	deviceIDs, err := s.Repo.GetDevicesWithDueCommands()
+	if err != nil {
+		fmt.Printf("[Dispatcher] Failed to list due commands: %v\n", err)
+		return
+	}
+	online := make(map[string]bool)
+	for _, id := range server.GetOnlineUsers() {
+		online[id] = true
+	}
+	for _, deviceID := range deviceIDs {
+		if online[deviceID] {
+			s.ProcessPendingCommands(deviceID)
+		}
+	}
+}
+
+// retryUnacknowledged puts commands the device never accepted back in the
+// queue with exponential backoff, or fails them after MaxAttempts sends.
+func (s *CommandService) retryUnacknowledged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmds, err := s.Repo.GetUnacknowledged(time.Now().Add(-s.settings.AckTimeout))
+	if err != nil {
+		fmt.Printf("[Dispatcher] Failed to list unacknowledged commands: %v\n", err)
+		return
+	}
+
+	now := time.Now()
+	for _, cmd := range cmds {
+		if cmd.Attempts >= cmd.MaxAttempts {
+			cmd.Status = models.StatusFailed
+			cmd.Error = fmt.Sprintf("not acknowledged after %d attempts", cmd.Attempts)
+			cmd.FinishedAt = &now
+			fmt.Printf("[Dispatcher] Command %d failed: %s\n", cmd.ID, cmd.Error)
+		} else {
+			next := now.Add(retryDelay(s.settings.RetryBackoff, cmd.Attempts))
+			cmd.Status = models.StatusPending
+			cmd.NextAttemptAt = &next
+			fmt.Printf("[Dispatcher] Command %d not acknowledged; resending after %s\n", cmd.ID, next.Format(time.RFC3339))
+		}
+		cmd.UpdatedAt = now
+		s.Repo.Update(&cmd)
+	}
+}
+
+// retryDelay doubles the backoff with every attempt made (capped at 2^10).
+func retryDelay(backoff time.Duration, attempts int) time.Duration {
+	shift := attempts - 1
+	if shift < 0 {
+		shift = 0
+	}
+	if shift > 10 {
+		shift = 10
+	}
+	return backoff << shift
+}
+
+// ReportStatus applies a status reported by the device for one of its
+// commands. With a final status, result (if any) is stored as the
+// command's CommandResult and errMsg as the failure reason.
+// The bool is false for a repeated report (e.g. a retry after a lost
+// response), which is accepted without changing anything.
+func (s *CommandService) ReportStatus(deviceID string, cmdID uint, status models.CommandStatus, result, errMsg string) (*models.Command, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd, err := s.Repo.GetByID(cmdID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, false, ErrCommandNotFound
+		}
+		return nil, false, err
+	}
+	if cmd.DeviceID != deviceID {
+		return nil, false, ErrCommandNotFound
+	}
+
+	if cmd.Status == status {
+		return cmd, false, nil
+	}
+	if !cmd.Status.CanMoveTo(status) {
+		return cmd, false, ErrInvalidCommandStatus
+	}
+
+	now := time.Now()
+	switch status {
+	case models.StatusAccepted:
+		cmd.AcceptedAt = &now
+	case models.StatusRunning:
+		cmd.StartedAt = &now
+	case models.StatusCompleted, models.StatusFailed:
+		cmd.FinishedAt = &now
+		cmd.Error = errMsg
+		if result != "" {
+			res := &models.CommandResult{CommandID: cmd.ID, DeviceID: deviceID, Body: result}
+			if err := s.Repo.CreateResult(res); err != nil {
+				return nil, false, err
+			}
+			cmd.ResultID = &res.ID
+		}
+	}
+	cmd.Status = status
+	cmd.UpdatedAt = now
+	if err := s.Repo.Update(cmd); err != nil {
+		return nil, false, err
+	}
+	return cmd, true, nil
+}
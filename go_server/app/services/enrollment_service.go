@@ -0,0 +1,246 @@
+package services
+
+import (
+	"crypto/rand"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrEnrollmentTokenRequired = errors.New("enrollment token required")
+	ErrInvalidEnrollmentToken  = errors.New("invalid, expired or used enrollment token")
+	ErrDeviceNotFound          = errors.New("device not found")
+)
+
+// EnrollmentService decides which devices may register and whether they
+// have to wait for an admin before they can log in.
+type EnrollmentService struct {
+	tokens          *repositories.EnrollmentRepository
+	devices         *repositories.DeviceRepository
+	RequireToken    bool
+	RequireApproval bool
+	MinAgentVersion string // Agents below this are refused on connect ("" = any)
+}
+
+func NewEnrollmentService(tokens *repositories.EnrollmentRepository, devices *repositories.DeviceRepository, requireToken, requireApproval bool) *EnrollmentService {
+	return &EnrollmentService{
+		tokens:          tokens,
+		devices:         devices,
+		RequireToken:    requireToken,
+		RequireApproval: requireApproval,
+	}
+}
+
+// CreateToken mints an enrollment token. userID binds enrolled devices to
+// that user (0 = whoever registers), ttl 0 means it never expires.
+// The plaintext token is only returned here.
+func (s *EnrollmentService) CreateToken(userID uint, group string, maxUses int, ttl time.Duration, createdBy uint) (string, *models.EnrollmentToken, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	record := &models.EnrollmentToken{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		Group:     group,
+		MaxUses:   maxUses,
+		CreatedBy: createdBy,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	if err := s.tokens.Create(record); err != nil {
+		return "", nil, err
+	}
+	return token, record, nil
+}
+
+// CheckToken looks up a token without using it up.
+func (s *EnrollmentService) CheckToken(token string) (*models.EnrollmentToken, error) {
+	if token == "" {
+		return nil, ErrEnrollmentTokenRequired
+	}
+	record, err := s.tokens.GetByTokenHash(hashToken(token))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidEnrollmentToken
+		}
+		return nil, err
+	}
+	if record.RevokedAt != nil || record.Uses >= record.MaxUses ||
+		(record.ExpiresAt != nil && time.Now().After(*record.ExpiresAt)) {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	return record, nil
+}
+
+// Register stores a new device. token may be nil when tokens are not
+// required. The device starts PENDING if approval is required.
+func (s *EnrollmentService) Register(device *models.Device, token *models.EnrollmentToken) error {
+	if token == nil && s.RequireToken {
+		return ErrEnrollmentTokenRequired
+	}
+	if token != nil {
+		ok, err := s.tokens.Use(token.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidEnrollmentToken
+		}
+		device.Group = token.Group
+	}
+
+	device.Status = models.DeviceStatusApproved
+	if s.RequireApproval {
+		device.Status = models.DeviceStatusPending
+	}
+	return s.devices.CreateDevice(device)
+}
+
+// Reissue records a new client certificate for an already registered
+// device. A token, if the owner proved themselves with one, is used up as
+// on first registration.
+func (s *EnrollmentService) Reissue(device *models.Device, serial string, token *models.EnrollmentToken) error {
+	if token != nil {
+		ok, err := s.tokens.Use(token.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidEnrollmentToken
+		}
+	}
+	device.CertSerial = serial
+	return s.devices.UpdateDevice(device)
+}
+
+func (s *EnrollmentService) GetDevice(deviceID string) (*models.Device, error) {
+	device, err := s.devices.GetDevice(deviceID)
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrDeviceNotFound
+	}
+	return device, err
+}
+
+// CertRequired reports whether a device was issued a client certificate, so
+// it may only connect with it. Unknown devices have none; a lookup error
+// counts as issued. Registered as server.DeviceCertRequired.
+func (s *EnrollmentService) CertRequired(deviceID string) bool {
+	device, err := s.devices.GetDevice(deviceID)
+	if err == gorm.ErrRecordNotFound {
+		return false
+	}
+	return err != nil || device.CertSerial != ""
+}
+
+// MarkSeen stores the last contact time and address of a connected device.
+// Registered as server.DeviceSeen.
+func (s *EnrollmentService) MarkSeen(deviceID, ip string) {
+	if err := s.devices.Touch(deviceID, ip, time.Now()); err != nil {
+		fmt.Printf("[Heartbeat] Failed to record last seen of %s: %v\n", deviceID, err)
+	}
+}
+
+// CheckHello records the agent version and capabilities a device reported
+// when it connected, then refuses it if the agent is older than
+// MinAgentVersion. Registered as server.DeviceHello.
+func (s *EnrollmentService) CheckHello(hello models.Hello) error {
+	err := s.devices.SetAgentInfo(hello.DeviceID, hello.AgentVersion, hello.Protocol,
+		models.JoinCommands(hello.Commands), strings.Join(hello.Capabilities, ","))
+	if err != nil {
+		fmt.Printf("[Hello] Failed to record agent of %s: %v\n", hello.DeviceID, err)
+	}
+
+	if s.MinAgentVersion != "" && compareVersions(hello.AgentVersion, s.MinAgentVersion) < 0 {
+		version := hello.AgentVersion
+		if version == "" {
+			version = "unknown"
+		}
+		return &models.HelloRejection{
+			Reason:     fmt.Sprintf("agent version %s is older than the minimum %s", version, s.MinAgentVersion),
+			MinVersion: s.MinAgentVersion,
+		}
+	}
+	return nil
+}
+
+// compareVersions compares dotted numeric versions ("1.10.2" > "1.9"),
+// returning -1, 0 or 1. Missing parts count as 0; an empty version is the
+// oldest.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(strings.TrimPrefix(a, "v"), "."), strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// ListDevices returns the registered devices among deviceIDs, with the agent
+// version each one last reported.
+func (s *EnrollmentService) ListDevices(deviceIDs []string) ([]models.Device, error) {
+	if len(deviceIDs) == 0 {
+		return nil, nil
+	}
+	return s.devices.ListDevicesByIDs(deviceIDs)
+}
+
+func (s *EnrollmentService) ListPending() ([]models.Device, error) {
+	return s.devices.ListDevicesByStatus(models.DeviceStatusPending)
+}
+
+// Approve lets the device log in. A non-empty group replaces the one
+// assigned by its enrollment token.
+func (s *EnrollmentService) Approve(deviceID, group string, reviewedBy uint) (*models.Device, error) {
+	device, err := s.GetDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		device.Group = group
+	}
+	return device, s.review(device, models.DeviceStatusApproved, reviewedBy)
+}
+
+// Reject blocks the device. The caller revokes its open sessions.
+func (s *EnrollmentService) Reject(deviceID string, reviewedBy uint) (*models.Device, error) {
+	device, err := s.GetDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return device, s.review(device, models.DeviceStatusRejected, reviewedBy)
+}
+
+func (s *EnrollmentService) review(device *models.Device, status string, reviewedBy uint) error {
+	now := time.Now()
+	device.Status = status
+	device.ReviewedBy = reviewedBy
+	device.ReviewedAt = &now
+	return s.devices.UpdateDevice(device)
+}
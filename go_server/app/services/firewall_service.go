@@ -22,7 +22,7 @@ func NewFirewallService(dRepo *repositories.DeviceRepository, fRepo *repositorie
 	}
 }
 
-func (s *FirewallService) UpdateConfig(deviceID string, enable bool, categories []int) error {
+func (s *FirewallService) UpdateConfig(deviceID string, enable bool, categories []int, updatedBy uint) error {
 	// Upsert Device Config
 	config, err := s.DeviceRepo.GetByDeviceID(deviceID)
 	if err != nil || config == nil {
@@ -39,7 +39,7 @@ func (s *FirewallService) UpdateConfig(deviceID string, enable bool, categories
 	}
 
 	// Notify Client
-	cmd, _ := s.CommandSvc.CreateCommand(deviceID, 0xE3, `{"command": "FIREWALL_UPDATE"}`)
+	cmd, _ := s.CommandSvc.CreateCommand(deviceID, 0xE3, `{"command": "FIREWALL_UPDATE"}`, updatedBy)
 	success := s.CommandSvc.TrySendImmediately(cmd)
 	if success {
 		fmt.Printf("[Service] Firewall Update Sent to %s\n", deviceID)
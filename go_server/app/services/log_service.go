@@ -21,6 +21,16 @@ func (s *LogService) StoreLog(deviceID, content string) error {
 	return s.Repo.Create(log)
 }
 
+// StoreCommandLog stores the result of a GET_LOGS command.
+func (s *LogService) StoreCommandLog(deviceID, content string, cmdID uint) error {
+	log := &models.Log{
+		DeviceID:  deviceID,
+		Content:   content,
+		CommandID: cmdID,
+	}
+	return s.Repo.Create(log)
+}
+
 func (s *LogService) GetRecentLogs(deviceID string, limit int) ([]models.Log, error) {
 	return s.Repo.GetRecent(deviceID, limit)
 }
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"demo/network/go_server/app/models"
+	"fmt"
+	"time"
+)
+
+// ReaperSettings are the stale transfer settings (config.yml
+// backup.reaper).
+type ReaperSettings struct {
+	Interval    time.Duration
+	ExpireAfter time.Duration // Idle transfers are expired after this
+	StuckAfter  time.Duration // Idle transfers are shown to admins as stuck after this
+}
+
+// ReaperService expires backup and restore transfers the agent stopped
+// working on, so they do not stay IN_PROGRESS forever with their partial
+// files on disk.
+type ReaperService struct {
+	backups  *BackupService
+	restores *RestoreService
+	settings ReaperSettings
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewReaperService(backups *BackupService, restores *RestoreService, settings ReaperSettings) *ReaperService {
+	if settings.Interval <= 0 {
+		settings.Interval = 10 * time.Minute
+	}
+	if settings.ExpireAfter <= 0 {
+		settings.ExpireAfter = 24 * time.Hour
+	}
+	if settings.StuckAfter <= 0 {
+		settings.StuckAfter = 15 * time.Minute
+	}
+	return &ReaperService{
+		backups:  backups,
+		restores: restores,
+		settings: settings,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Reap expires every transfer idle for longer than ExpireAfter.
+func (s *ReaperService) Reap() (int, int64, error) {
+	before := time.Now().Add(-s.settings.ExpireAfter)
+	backups, err := s.backups.ExpireIdle(before)
+	if err != nil {
+		return backups, 0, err
+	}
+	restores, err := s.restores.ExpireIdle(before)
+	if backups > 0 || restores > 0 {
+		fmt.Printf("[Reaper] Expired %d upload(s) and %d restore(s) idle since %s\n", backups, restores, before.Format(time.RFC3339))
+	}
+	return backups, restores, err
+}
+
+// Stuck lists the transfers idle for longer than idle (0 = StuckAfter).
+func (s *ReaperService) Stuck(idle time.Duration) ([]models.BackupSession, []models.RestoreSession, error) {
+	if idle <= 0 {
+		idle = s.settings.StuckAfter
+	}
+	before := time.Now().Add(-idle)
+	backups, err := s.backups.IdleSessions(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	restores, err := s.restores.IdleSessions(before)
+	return backups, restores, err
+}
+
+// ExpireAfter is how long a transfer may be idle before it is expired.
+func (s *ReaperService) ExpireAfter() time.Duration {
+	return s.settings.ExpireAfter
+}
+
+// RunReaper reaps now and then every interval until StopReaper, so transfers
+// left over from before a restart go first.
+func (s *ReaperService) RunReaper() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.settings.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := s.Reap(); err != nil {
+			fmt.Printf("[Reaper] Reap failed: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// StopReaper ends RunReaper and waits for a reap in progress. Call once, at
+// shutdown.
+func (s *ReaperService) StopReaper() {
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	db := newTestDB(t)
+	chunks, backends, _ := newTestChunks(t, db)
+	storagePath := t.TempDir()
+	backupRepo := repositories.NewBackupRepository(db)
+	restoreRepo := repositories.NewRestoreRepository(db)
+	backups := NewBackupService(backupRepo, chunks, backends, storagePath)
+	restores := NewRestoreService(backupRepo, restoreRepo, repositories.NewFileNodeRepository(db), chunks, backends)
+	reaper := NewReaperService(backups, restores, ReaperSettings{ExpireAfter: time.Hour, StuckAfter: 10 * time.Minute})
+
+	idle := time.Now().Add(-2 * time.Hour)
+	upload := func(fileUUID string, status models.BackupStatus, lastUpdate time.Time) (*models.BackupSession, string) {
+		t.Helper()
+		session := &models.BackupSession{TransferID: "t-" + fileUUID, DeviceID: "dev-a", FileUUID: fileUUID, FileName: "data.bin", Version: 1, Status: status, LastUpdateTime: lastUpdate}
+		if err := backupRepo.CreateSession(session); err != nil {
+			t.Fatal(err)
+		}
+		partial := filepath.Join(storagePath, "dev-a", fileUUID, "v1", "data.bin")
+		if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return session, partial
+	}
+	download := func(transferID string, status models.RestoreStatus, lastUpdate time.Time) {
+		t.Helper()
+		session := &models.RestoreSession{TransferID: transferID, DeviceID: "dev-a", FileUUID: "file-1", Version: 1, Status: status, LastUpdateTime: lastUpdate}
+		if err := db.Create(session).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stale, stalePartial := upload("stale", models.BackupInProgress, idle)
+	_, activePartial := upload("active", models.BackupInProgress, time.Now())
+	_, donePartial := upload("done", models.BackupDone, idle)
+	download("r-stale", models.RestoreInProgress, idle)
+	download("r-active", models.RestoreInProgress, time.Now())
+	download("r-done", models.RestoreDone, idle)
+
+	stuckBackups, stuckRestores, err := reaper.Stuck(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuckBackups) != 1 || stuckBackups[0].ID != stale.ID || len(stuckRestores) != 1 || stuckRestores[0].TransferID != "r-stale" {
+		t.Errorf("Stuck = %d upload(s), %d restore(s); want the stale one of each", len(stuckBackups), len(stuckRestores))
+	}
+
+	expiredBackups, expiredRestores, err := reaper.Reap()
+	if err != nil || expiredBackups != 1 || expiredRestores != 1 {
+		t.Fatalf("Reap = %d, %d, %v; want 1, 1", expiredBackups, expiredRestores, err)
+	}
+	for transferID, want := range map[string]models.BackupStatus{"t-stale": models.BackupExpired, "t-active": models.BackupInProgress, "t-done": models.BackupDone} {
+		session, err := backupRepo.GetSessionByTransferID(transferID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Status != want {
+			t.Errorf("%s is %s, want %s", transferID, session.Status, want)
+		}
+	}
+	var expired int64
+	db.Model(&models.RestoreSession{}).Where("status = ?", models.RestoreExpired).Count(&expired)
+	if expired != 1 {
+		t.Errorf("%d restore(s) expired, want 1", expired)
+	}
+	if _, err := os.Stat(stalePartial); !os.IsNotExist(err) {
+		t.Errorf("partial file of the expired upload kept: %v", err)
+	}
+	for _, path := range []string{activePartial, donePartial} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("partial file removed: %v", err)
+		}
+	}
+
+	// A chunk arriving after expiry does not bring the upload back
+	if err := backupRepo.UpdateSession(stale); !errors.Is(err, repositories.ErrSessionExpired) {
+		t.Errorf("UpdateSession of an expired upload = %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestExpireSession(t *testing.T) {
+	before := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		status     models.BackupStatus
+		lastUpdate time.Time
+		want       bool
+	}{
+		{"idle", models.BackupInProgress, before.Add(-time.Minute), true},
+		{"renewed since listed", models.BackupInProgress, before.Add(time.Minute), false},
+		{"finished", models.BackupDone, before.Add(-time.Minute), false},
+		{"canceled", models.BackupCanceled, before.Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupRepo := repositories.NewBackupRepository(newTestDB(t))
+			session := &models.BackupSession{TransferID: "t1", DeviceID: "dev-a", FileUUID: "file-1", FileName: "data.bin", Version: 1, Status: tt.status, LastUpdateTime: tt.lastUpdate}
+			if err := backupRepo.CreateSession(session); err != nil {
+				t.Fatal(err)
+			}
+			ok, err := backupRepo.ExpireSession(session.ID, before)
+			if err != nil || ok != tt.want {
+				t.Fatalf("ExpireSession = %v, %v; want %v", ok, err, tt.want)
+			}
+			got, err := backupRepo.GetSessionByTransferID("t1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expired := got.Status == models.BackupExpired; expired != tt.want {
+				t.Errorf("status = %s after ExpireSession", got.Status)
+			}
+		})
+	}
+}
@@ -3,9 +3,11 @@ package services
 import (
 	"demo/network/go_server/app/models"
 	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -15,13 +17,17 @@ type RestoreService struct {
 	repo         *repositories.BackupRepository // Reuse BackupRepository for snapshots
 	restoreRepo  *repositories.RestoreRepository
 	fileNodeRepo *repositories.FileNodeRepository
+	chunks       *ChunkService
+	backends     *storage.Backends
 }
 
-func NewRestoreService(repo *repositories.BackupRepository, restoreRepo *repositories.RestoreRepository, fileNodeRepo *repositories.FileNodeRepository) *RestoreService {
+func NewRestoreService(repo *repositories.BackupRepository, restoreRepo *repositories.RestoreRepository, fileNodeRepo *repositories.FileNodeRepository, chunks *ChunkService, backends *storage.Backends) *RestoreService {
 	return &RestoreService{
 		repo:         repo,
 		restoreRepo:  restoreRepo,
 		fileNodeRepo: fileNodeRepo,
+		chunks:       chunks,
+		backends:     backends,
 	}
 }
 
@@ -52,15 +58,20 @@ func (s *RestoreService) InitSession(deviceID, fileUUID string, version int) (*m
 
 	// 3. Create Restore Session
 	session := &models.RestoreSession{
-		TransferID: uuid.New().String(),
-		DeviceID:   deviceID,
-		FileUUID:   fileUUID,
-		FileName:   fileName,
-		Version:    snapshot.Version,
-		ServerPath: snapshot.ServerPath,
-		TotalSize:  snapshot.FileSize,
-		FileHash:   snapshot.FileHash,
-		Status:     models.RestoreInProgress,
+		TransferID:     uuid.New().String(),
+		DeviceID:       deviceID,
+		FileUUID:       fileUUID,
+		FileName:       fileName,
+		Version:        snapshot.Version,
+		ServerPath:     snapshot.ServerPath,
+		Backend:        snapshot.Backend,
+		StorageKey:     snapshot.StorageKey,
+		SnapshotID:     snapshot.ID,
+		Chunked:        snapshot.Chunked,
+		TotalSize:      snapshot.FileSize,
+		FileHash:       snapshot.FileHash,
+		Status:         models.RestoreInProgress,
+		LastUpdateTime: time.Now(),
 	}
 
 	if err := s.restoreRepo.CreateSession(session); err != nil {
@@ -70,29 +81,72 @@ func (s *RestoreService) InitSession(deviceID, fileUUID string, version int) (*m
 	return session, nil
 }
 
+// GetChunk reads up to size bytes of the snapshot at offset.
 func (s *RestoreService) GetChunk(transferID string, offset int64, size int) ([]byte, error) {
-	session, err := s.restoreRepo.GetSessionByTransferID(transferID)
+	chunk, n, err := s.OpenChunk(transferID, offset, int64(size))
 	if err != nil {
 		return nil, err
 	}
+	defer chunk.Close()
+
+	buffer := make([]byte, n)
+	if _, err := io.ReadFull(chunk, buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// OpenChunk opens up to size bytes of the snapshot at offset for streaming.
+// It returns the number of bytes the reader will yield (short at the end of
+// the file); the caller closes it.
+func (s *RestoreService) OpenChunk(transferID string, offset int64, size int64) (io.ReadCloser, int64, error) {
+	session, err := s.restoreRepo.GetSessionByTransferID(transferID)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	if session.Status != models.RestoreInProgress {
-		return nil, errors.New("session not in progress")
+		return nil, 0, errors.New("session not in progress")
 	}
+	s.restoreRepo.TouchSession(session.ID)
 
-	file, err := os.Open(session.ServerPath)
+	if session.Chunked {
+		// Reassembled from the snapshot's chunk manifest
+		n := clampChunk(session.TotalSize, offset, size)
+		r, err := s.chunks.OpenRange(session.SnapshotID, offset, n)
+		return r, n, err
+	}
+
+	if session.StorageKey == "" {
+		return nil, 0, fmt.Errorf("%w: %s is outside the storage path", storage.ErrNotExist, session.ServerPath)
+	}
+	backend, err := s.backends.Get(session.Backend)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	info, err := backend.Stat(session.StorageKey)
+	if err != nil {
+		return nil, 0, err
 	}
-	defer file.Close()
 
-	buffer := make([]byte, size)
-	n, err := file.ReadAt(buffer, offset)
-	if err != nil && err != io.EOF {
-		return nil, err
+	n := clampChunk(info.Size, offset, size)
+	r, err := backend.GetRange(session.StorageKey, offset, n)
+	if err != nil {
+		return nil, 0, err
 	}
+	return r, n, nil
+}
 
-	return buffer[:n], nil
+// clampChunk is how many of size bytes at offset a file of total bytes has.
+func clampChunk(total, offset, size int64) int64 {
+	n := total - offset
+	if n > size {
+		n = size
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
 }
 
 func (s *RestoreService) FinishSession(transferID string) error {
@@ -105,6 +159,11 @@ func (s *RestoreService) FinishSession(transferID string) error {
 	return s.restoreRepo.UpdateSession(session)
 }
 
+// GetSession looks up a transfer (used to check which device owns it).
+func (s *RestoreService) GetSession(transferID string) (*models.RestoreSession, error) {
+	return s.restoreRepo.GetSessionByTransferID(transferID)
+}
+
 func (s *RestoreService) ResumeSession(transferID string) (*models.RestoreSession, error) {
 	session, err := s.restoreRepo.GetSessionByTransferID(transferID)
 	if err != nil {
@@ -117,6 +176,19 @@ func (s *RestoreService) ResumeSession(transferID string) (*models.RestoreSessio
 	if session.Status != models.RestoreInProgress {
 		return nil, errors.New("session not in progress")
 	}
+	s.restoreRepo.TouchSession(session.ID)
 
 	return session, nil
 }
+
+// IdleSessions lists the restores with no activity since before.
+func (s *RestoreService) IdleSessions(before time.Time) ([]models.RestoreSession, error) {
+	return s.restoreRepo.GetIdleSessions(before)
+}
+
+// ExpireIdle expires the restores with no activity since before. Nothing is
+// stored for a restore on the server; expiring it releases the snapshot to
+// retention and makes the agent drop its partial download.
+func (s *RestoreService) ExpireIdle(before time.Time) (int64, error) {
+	return s.restoreRepo.ExpireIdleSessions(before)
+}
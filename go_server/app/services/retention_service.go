@@ -0,0 +1,330 @@
+package services
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRetentionRunning is returned when a run is asked for while another
+// one (e.g. the collector's) is still going.
+var ErrRetentionRunning = errors.New("a retention run is already in progress")
+
+// Why a snapshot was pruned
+const (
+	PruneRetention = "retention" // Not kept by the version rules
+	PruneDeleted   = "deleted"   // The file was deleted on the device long enough ago
+)
+
+// RetentionPolicy says which versions of a backed-up file to keep (see
+// config.RetentionPolicy). All zero keeps everything.
+type RetentionPolicy struct {
+	KeepLast          int
+	KeepDailyDays     int
+	KeepWeeklyWeeks   int
+	KeepMonthlyMonths int
+	KeepDeletedDays   int
+}
+
+// Prune returns the versions of one file the policy drops, and why.
+// snapshots are newest first; deletedAt is when the file was deleted on the
+// device, nil if it still exists. The newest version is only dropped with
+// the rest of a deleted file.
+func (p RetentionPolicy) Prune(snapshots []models.BackupSnapshot, deletedAt *time.Time, now time.Time) ([]models.BackupSnapshot, string) {
+	if deletedAt != nil && p.KeepDeletedDays > 0 && deletedAt.Before(now.AddDate(0, 0, -p.KeepDeletedDays)) {
+		return snapshots, PruneDeleted
+	}
+	if len(snapshots) == 0 || (p.KeepLast <= 0 && p.KeepDailyDays <= 0 && p.KeepWeeklyWeeks <= 0 && p.KeepMonthlyMonths <= 0) {
+		return nil, ""
+	}
+
+	keep := make([]bool, len(snapshots))
+	keep[0] = true
+	for i := 0; i < len(snapshots) && i < p.KeepLast; i++ {
+		keep[i] = true
+	}
+	if p.KeepDailyDays > 0 {
+		keepNewestPer(snapshots, keep, now.AddDate(0, 0, -p.KeepDailyDays), func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+	}
+	if p.KeepWeeklyWeeks > 0 {
+		keepNewestPer(snapshots, keep, now.AddDate(0, 0, -7*p.KeepWeeklyWeeks), func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		})
+	}
+	if p.KeepMonthlyMonths > 0 {
+		keepNewestPer(snapshots, keep, now.AddDate(0, -p.KeepMonthlyMonths, 0), func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+	}
+
+	var drop []models.BackupSnapshot
+	for i, snapshot := range snapshots {
+		if !keep[i] {
+			drop = append(drop, snapshot)
+		}
+	}
+	return drop, PruneRetention
+}
+
+// keepNewestPer keeps the newest snapshot of each period since the given
+// time; period names the day, week or month a time falls in.
+func keepNewestPer(snapshots []models.BackupSnapshot, keep []bool, since time.Time, period func(time.Time) string) {
+	seen := make(map[string]bool)
+	for i, snapshot := range snapshots {
+		if snapshot.CreatedAt.Before(since) {
+			continue
+		}
+		if key := period(snapshot.CreatedAt); !seen[key] {
+			seen[key] = true
+			keep[i] = true
+		}
+	}
+}
+
+// RetentionSettings are the collector's settings (config.yml
+// backup.retention).
+type RetentionSettings struct {
+	Interval   time.Duration
+	DryRun     bool          // The collector only records what it would prune
+	ChunkGrace time.Duration // Unreferenced chunks younger than this are kept
+	Default    RetentionPolicy
+	Groups     map[string]RetentionPolicy // By device group
+	Devices    map[string]RetentionPolicy // By device ID
+}
+
+type RetentionService struct {
+	repo        *repositories.RetentionRepository
+	backupRepo  *repositories.BackupRepository
+	restoreRepo *repositories.RestoreRepository
+	nodeRepo    *repositories.FileNodeRepository
+	devRepo     *repositories.DeviceRepository
+	chunks      *ChunkService
+	backends    *storage.Backends
+	settings    RetentionSettings
+	running     sync.Mutex // One run at a time
+	stop        chan struct{}
+}
+
+func NewRetentionService(repo *repositories.RetentionRepository, backupRepo *repositories.BackupRepository, restoreRepo *repositories.RestoreRepository, nodeRepo *repositories.FileNodeRepository, devRepo *repositories.DeviceRepository, chunks *ChunkService, backends *storage.Backends, settings RetentionSettings) *RetentionService {
+	if settings.Interval <= 0 {
+		settings.Interval = time.Hour
+	}
+	if settings.ChunkGrace <= 0 {
+		settings.ChunkGrace = 24 * time.Hour
+	}
+	return &RetentionService{
+		repo:        repo,
+		backupRepo:  backupRepo,
+		restoreRepo: restoreRepo,
+		nodeRepo:    nodeRepo,
+		devRepo:     devRepo,
+		chunks:      chunks,
+		backends:    backends,
+		settings:    settings,
+		stop:        make(chan struct{}),
+	}
+}
+
+// PolicyFor returns a device's policy: its own, else its group's, else the
+// default.
+func (s *RetentionService) PolicyFor(deviceID string) RetentionPolicy {
+	if policy, ok := s.settings.Devices[deviceID]; ok {
+		return policy
+	}
+	if len(s.settings.Groups) > 0 {
+		if device, err := s.devRepo.GetDevice(deviceID); err == nil && device.Group != "" {
+			if policy, ok := s.settings.Groups[device.Group]; ok {
+				return policy
+			}
+		}
+	}
+	return s.settings.Default
+}
+
+// Run applies the retention policies to one device's snapshots ("" = every
+// device), then deletes the chunks no snapshot uses any more. A dry run
+// deletes nothing and reports what a real run would. Every run is recorded
+// with the snapshots it pruned.
+func (s *RetentionService) Run(deviceID string, dryRun bool) (*models.RetentionRun, []models.PrunedSnapshot, error) {
+	if !s.running.TryLock() {
+		return nil, nil, ErrRetentionRunning
+	}
+	defer s.running.Unlock()
+
+	now := time.Now()
+	run := &models.RetentionRun{DeviceID: deviceID, DryRun: dryRun, StartedAt: now}
+	if err := s.repo.CreateRun(run); err != nil {
+		return nil, nil, err
+	}
+
+	pruned, chunked, err := s.prune(deviceID, dryRun, now)
+	for i := range pruned {
+		pruned[i].RunID = run.ID
+		run.SnapshotsPruned++
+		if !pruned[i].Chunked {
+			run.BytesFreed += pruned[i].FileSize
+		}
+	}
+
+	if err == nil {
+		var n int
+		var bytes int64
+		if dryRun {
+			n, bytes, err = s.chunks.Freed(chunked)
+			if err == nil {
+				var sn int
+				var sbytes int64
+				sn, sbytes, err = s.chunks.Sweep(now.Add(-s.settings.ChunkGrace), true)
+				n, bytes = n+sn, bytes+sbytes
+			}
+		} else {
+			n, bytes, err = s.chunks.Sweep(now.Add(-s.settings.ChunkGrace), false)
+		}
+		run.ChunksDeleted = n
+		run.BytesFreed += bytes
+	}
+
+	finished := time.Now()
+	run.FinishedAt = &finished
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if uerr := s.repo.UpdateRun(run); uerr != nil {
+		fmt.Printf("[Retention] Failed to record run %d: %v\n", run.ID, uerr)
+	}
+	if perr := s.repo.CreatePruned(pruned); perr != nil {
+		fmt.Printf("[Retention] Failed to record pruned snapshots of run %d: %v\n", run.ID, perr)
+	}
+
+	mode := ""
+	if dryRun {
+		mode = " (dry run)"
+	}
+	fmt.Printf("[Retention] Run %d%s: %d snapshot(s), %d chunk(s), %d bytes\n", run.ID, mode, run.SnapshotsPruned, run.ChunksDeleted, run.BytesFreed)
+	return run, pruned, err
+}
+
+// prune applies the policies and, unless dryRun, deletes the snapshots they
+// drop. It returns what it pruned and the IDs of the chunked snapshots
+// among them.
+func (s *RetentionService) prune(deviceID string, dryRun bool, now time.Time) ([]models.PrunedSnapshot, []uint, error) {
+	devices := []string{deviceID}
+	if deviceID == "" {
+		var err error
+		if devices, err = s.backupRepo.ListSnapshotDevices(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var pruned []models.PrunedSnapshot
+	var chunked []uint
+	for _, device := range devices {
+		policy := s.PolicyFor(device)
+		snapshots, err := s.backupRepo.GetDeviceSnapshots(device)
+		if err != nil {
+			return pruned, chunked, err
+		}
+
+		// One file at a time (snapshots come grouped by file)
+		for start := 0; start < len(snapshots); {
+			end := start + 1
+			for end < len(snapshots) && snapshots[end].FileUUID == snapshots[start].FileUUID {
+				end++
+			}
+			file := snapshots[start:end]
+			start = end
+
+			var deletedAt *time.Time
+			if policy.KeepDeletedDays > 0 {
+				// A deleted node is not updated again, so UpdatedAt is when it went
+				if node, err := s.nodeRepo.FindDeviceNode(device, file[0].FileUUID); err == nil && node.IsDeleted {
+					deletedAt = &node.UpdatedAt
+				}
+			}
+
+			drop, reason := policy.Prune(file, deletedAt, now)
+			for _, snapshot := range drop {
+				// Leave versions a device is downloading; the next run gets them
+				if busy, err := s.restoreRepo.IsRestoring(snapshot.DeviceID, snapshot.FileUUID, snapshot.Version); err != nil || busy {
+					continue
+				}
+				if !dryRun {
+					if err := s.deleteSnapshot(&snapshot); err != nil {
+						return pruned, chunked, fmt.Errorf("failed to delete %s v%d: %v", snapshot.FileUUID, snapshot.Version, err)
+					}
+				}
+				pruned = append(pruned, models.PrunedSnapshot{
+					DeviceID:  snapshot.DeviceID,
+					FileUUID:  snapshot.FileUUID,
+					Version:   snapshot.Version,
+					FileSize:  snapshot.FileSize,
+					Chunked:   snapshot.Chunked,
+					Reason:    reason,
+					TakenAt:   snapshot.CreatedAt,
+					CreatedAt: now,
+				})
+				if snapshot.Chunked {
+					chunked = append(chunked, snapshot.ID)
+				}
+			}
+		}
+	}
+	return pruned, chunked, nil
+}
+
+// deleteSnapshot removes a snapshot and its data. Chunks it used are left
+// for the sweep.
+func (s *RetentionService) deleteSnapshot(snapshot *models.BackupSnapshot) error {
+	if snapshot.Chunked {
+		return s.chunks.DeleteSnapshot(snapshot.ID)
+	}
+	if err := s.backupRepo.DeleteSnapshot(snapshot.ID); err != nil {
+		return err
+	}
+
+	if snapshot.StorageKey == "" {
+		// A legacy server_path outside the storage path: not ours to remove
+		fmt.Printf("[Retention] Not removing %s: outside the storage path\n", snapshot.ServerPath)
+		return nil
+	}
+	backend, err := s.backends.Get(snapshot.Backend)
+	if err == nil {
+		err = backend.Delete(snapshot.StorageKey)
+	}
+	if err != nil {
+		fmt.Printf("[Retention] Failed to remove %s from %s: %v\n", snapshot.StorageKey, snapshot.Backend, err)
+	}
+	return nil
+}
+
+// RunCollector applies the policies to every device each interval until
+// StopCollector.
+func (s *RetentionService) RunCollector() {
+	ticker := time.NewTicker(s.settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, _, err := s.Run("", s.settings.DryRun); err != nil && err != ErrRetentionRunning {
+				fmt.Printf("[Retention] Run failed: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// StopCollector ends RunCollector and waits for a run in progress. Call
+// once, at shutdown.
+func (s *RetentionService) StopCollector() {
+	close(s.stop)
+	s.running.Lock()
+	s.running.Unlock()
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyPrune(t *testing.T) {
+	// Wednesday; the week before starts on Monday 2026-03-02
+	now := time.Date(2026, 3, 11, 12, 0, 0, 0, time.UTC)
+	at := func(days, hours int) time.Time {
+		return now.AddDate(0, 0, -days).Add(-time.Duration(hours) * time.Hour)
+	}
+	deletedLongAgo := at(40, 0)
+	deletedRecently := at(1, 0)
+
+	tests := []struct {
+		name      string
+		policy    RetentionPolicy
+		taken     []time.Time // Newest first
+		deletedAt *time.Time
+		drop      []int // Versions dropped, newest first
+		reason    string
+	}{
+		{
+			name:   "no rules keeps everything",
+			taken:  []time.Time{at(0, 1), at(5, 0), at(400, 0)},
+			reason: "",
+		},
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 2},
+			taken:  []time.Time{at(0, 1), at(0, 2), at(0, 3), at(0, 4)},
+			drop:   []int{2, 1},
+			reason: PruneRetention,
+		},
+		{
+			name:   "newest is always kept",
+			policy: RetentionPolicy{KeepDailyDays: 1},
+			taken:  []time.Time{at(30, 0), at(31, 0)},
+			drop:   []int{1},
+			reason: PruneRetention,
+		},
+		{
+			name:   "daily keeps the newest of each day in range",
+			policy: RetentionPolicy{KeepDailyDays: 3},
+			// Days 11, 11, 10, 10, 9, then 5 (out of range)
+			taken:  []time.Time{at(0, 1), at(0, 2), at(1, 0), at(1, 2), at(2, 0), at(6, 0)},
+			drop:   []int{5, 3, 1},
+			reason: PruneRetention,
+		},
+		{
+			name:   "weekly keeps the newest of each ISO week in range",
+			policy: RetentionPolicy{KeepWeeklyWeeks: 2},
+			// Week 11 (Mon 9th on), week 10 twice, then week 9 (out of range)
+			taken:  []time.Time{at(1, 0), at(3, 0), at(8, 0), at(16, 0)},
+			drop:   []int{2, 1},
+			reason: PruneRetention,
+		},
+		{
+			name:   "monthly keeps the newest of each month in range",
+			policy: RetentionPolicy{KeepMonthlyMonths: 2},
+			// March, February twice, January (in range), then November
+			taken:  []time.Time{at(1, 0), at(15, 0), at(20, 0), at(50, 0), at(120, 0)},
+			drop:   []int{3, 1},
+			reason: PruneRetention,
+		},
+		{
+			name:   "rules combine",
+			policy: RetentionPolicy{KeepLast: 1, KeepDailyDays: 2, KeepMonthlyMonths: 3},
+			// Today twice, yesterday, then one in February and two in January
+			taken:  []time.Time{at(0, 1), at(0, 2), at(1, 0), at(20, 0), at(45, 0), at(50, 0)},
+			drop:   []int{5, 1},
+			reason: PruneRetention,
+		},
+		{
+			name:      "deleted long enough ago drops every version",
+			policy:    RetentionPolicy{KeepLast: 5, KeepDeletedDays: 30},
+			taken:     []time.Time{at(41, 0), at(42, 0)},
+			deletedAt: &deletedLongAgo,
+			drop:      []int{2, 1},
+			reason:    PruneDeleted,
+		},
+		{
+			name:      "recently deleted follows the version rules",
+			policy:    RetentionPolicy{KeepLast: 1, KeepDeletedDays: 30},
+			taken:     []time.Time{at(2, 0), at(3, 0)},
+			deletedAt: &deletedRecently,
+			drop:      []int{1},
+			reason:    PruneRetention,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshots := make([]models.BackupSnapshot, len(tt.taken))
+			for i, taken := range tt.taken {
+				snapshots[i] = models.BackupSnapshot{FileUUID: "file-1", Version: len(tt.taken) - i, CreatedAt: taken}
+			}
+			drop, reason := tt.policy.Prune(snapshots, tt.deletedAt, now)
+			var versions []int
+			for _, snapshot := range drop {
+				versions = append(versions, snapshot.Version)
+			}
+			if !reflect.DeepEqual(versions, tt.drop) || reason != tt.reason {
+				t.Errorf("Prune = %v, %q; want %v, %q", versions, reason, tt.drop, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRetentionRun(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&models.RetentionRun{}, &models.PrunedSnapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	chunks, backends, mem := newTestChunks(t, db)
+	backupRepo := repositories.NewBackupRepository(db)
+	settings := RetentionSettings{
+		ChunkGrace: time.Hour,
+		Default:    RetentionPolicy{KeepLast: 1, KeepDeletedDays: 7},
+	}
+	retention := NewRetentionService(repositories.NewRetentionRepository(db), backupRepo, repositories.NewRestoreRepository(db),
+		repositories.NewFileNodeRepository(db), repositories.NewDeviceRepository(db), chunks, backends, settings)
+
+	old := time.Now().AddDate(0, 0, -10)
+	store := func(deviceID, fileUUID string, version int) {
+		t.Helper()
+		data := []byte(deviceID + fileUUID + strings.Repeat("v", version))
+		hash := putChunk(t, chunks, deviceID, data)
+		snapshot := &models.BackupSnapshot{DeviceID: deviceID, FileUUID: fileUUID, Version: version, Chunked: true, FileSize: int64(len(data)), CreatedAt: old.Add(time.Duration(version) * time.Minute)}
+		if err := chunks.CreateSnapshot(snapshot, []models.SnapshotChunk{{ChunkHash: hash, Size: int64(len(data))}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dev-a keeps both its files; the same file UUID deleted on dev-b is
+	// not a deletion on dev-a
+	for v := 1; v <= 3; v++ {
+		store("dev-a", "file-1", v)
+		store("dev-a", "shared", v)
+		store("dev-b", "shared", v)
+	}
+	if err := db.Create(&models.FileNode{DeviceID: "dev-b", UUID: "shared", Name: "shared", Type: "file", IsDeleted: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.FileNode{}).Where("uuid = ?", "shared").UpdateColumn("updated_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.Chunk{}).Where("1 = 1").Update("created_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A version being restored is left for the next run
+	if err := db.Create(&models.RestoreSession{TransferID: "r1", DeviceID: "dev-a", FileUUID: "file-1", Version: 1, Status: models.RestoreInProgress, LastUpdateTime: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	dry, pruned, err := retention.Run("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.SnapshotsPruned != 6 || dry.ChunksDeleted != 6 || len(pruned) != 6 {
+		t.Fatalf("dry run pruned %d snapshot(s), %d chunk(s); want 6, 6", dry.SnapshotsPruned, dry.ChunksDeleted)
+	}
+	if objects, _ := mem.List("chunks/"); len(objects) != 9 {
+		t.Fatalf("dry run left %d of 9 chunks", len(objects))
+	}
+
+	run, pruned, err := retention.Run("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string][]int{}
+	for _, device := range []string{"dev-a", "dev-b"} {
+		snapshots, err := backupRepo.GetDeviceSnapshots(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, snapshot := range snapshots {
+			key := device + "/" + snapshot.FileUUID
+			kept[key] = append(kept[key], snapshot.Version)
+		}
+	}
+	want := map[string][]int{"dev-a/file-1": {3, 1}, "dev-a/shared": {3}}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	reasons := map[string]int{}
+	for _, p := range pruned {
+		reasons[p.DeviceID+" "+p.Reason]++
+	}
+	if want := map[string]int{"dev-a " + PruneRetention: 3, "dev-b " + PruneDeleted: 3}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("pruned %v, want %v", reasons, want)
+	}
+	if run.ChunksDeleted != 6 {
+		t.Errorf("run deleted %d chunks, want 6", run.ChunksDeleted)
+	}
+	if objects, _ := mem.List("chunks/"); len(objects) != 3 {
+		t.Errorf("%d chunks left, want 3", len(objects))
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"crypto/sha256"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// What checking stored backup data can find
+var (
+	ErrDataMissing   = errors.New("stored data missing")
+	ErrDataCorrupted = errors.New("stored data corrupted")
+)
+
+// ErrScrubRunning is returned when a scrub is asked for while one is going.
+var ErrScrubRunning = errors.New("a scrub is already in progress")
+
+// hashReader returns the SHA256 of stored data read from r (path names it
+// in errors), which must hold exactly size bytes.
+func hashReader(r io.Reader, path string, size int64) (string, error) {
+	sum := sha256.New()
+	n, err := io.Copy(sum, r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if n < size {
+		return "", fmt.Errorf("%w: %s has %d of %d bytes", ErrDataMissing, path, n, size)
+	}
+	if n > size {
+		return "", fmt.Errorf("%w: %s has %d bytes, expected %d", ErrDataCorrupted, path, n, size)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// hashFile is hashReader over a local file.
+func hashFile(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrDataMissing, path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f, path, size)
+}
+
+// hashObject is hashReader over a whole object of a storage backend.
+func hashObject(backends *storage.Backends, name, key string, size int64) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%w: not in the storage path", ErrDataMissing)
+	}
+	backend, err := backends.Get(name)
+	if err != nil {
+		return "", err
+	}
+	r, err := backend.GetRange(key, 0, -1)
+	if errors.Is(err, storage.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrDataMissing, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashReader(r, key, size)
+}
+
+// ScrubReport sums up one pass over the stored snapshots.
+type ScrubReport struct {
+	Checked   int       `json:"checked"`
+	Missing   int       `json:"missing"`
+	Corrupted int       `json:"corrupted"`
+	Bytes     int64     `json:"bytes"` // Snapshot bytes read
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+}
+
+// ScrubService re-reads stored snapshots and checks them against their
+// recorded hashes, so bit rot or lost files show up before a restore needs
+// them. Damaged snapshots are flagged (BackupSnapshot.Integrity) for admins.
+type ScrubService struct {
+	backupRepo *repositories.BackupRepository
+	chunks     *ChunkService
+	backends   *storage.Backends
+	interval   time.Duration
+	running    sync.Mutex // One scrub at a time
+	stop       chan struct{}
+}
+
+func NewScrubService(backupRepo *repositories.BackupRepository, chunks *ChunkService, backends *storage.Backends, interval time.Duration) *ScrubService {
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	return &ScrubService{backupRepo: backupRepo, chunks: chunks, backends: backends, interval: interval, stop: make(chan struct{})}
+}
+
+// Run checks every stored snapshot and records the result on each.
+func (s *ScrubService) Run() (*ScrubReport, error) {
+	if !s.running.TryLock() {
+		return nil, ErrScrubRunning
+	}
+	defer s.running.Unlock()
+
+	report := &ScrubReport{StartedAt: time.Now()}
+	var after uint
+	for {
+		snapshots, err := s.backupRepo.GetSnapshotsAfter(after, 200)
+		if err != nil {
+			return report, err
+		}
+		if len(snapshots) == 0 {
+			break
+		}
+		for i := range snapshots {
+			select {
+			case <-s.stop:
+				return report, errors.New("scrub stopped")
+			default:
+			}
+			snapshot := &snapshots[i]
+			after = snapshot.ID
+			if err := s.check(snapshot); err != nil {
+				return report, err
+			}
+			report.Checked++
+			report.Bytes += snapshot.FileSize
+			switch snapshot.Integrity {
+			case models.IntegrityMissing:
+				report.Missing++
+			case models.IntegrityCorrupted:
+				report.Corrupted++
+			}
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt).Round(time.Second).String()
+	fmt.Printf("[Scrub] Checked %d snapshot(s) in %s: %d missing, %d corrupted\n", report.Checked, report.Duration, report.Missing, report.Corrupted)
+	return report, nil
+}
+
+// check verifies one snapshot's data and saves the result. Only database
+// errors are returned; damaged data is a result.
+func (s *ScrubService) check(snapshot *models.BackupSnapshot) error {
+	var storedHash string
+	var err error
+	if snapshot.Chunked {
+		storedHash, err = s.chunks.VerifySnapshot(snapshot)
+	} else {
+		storedHash, err = hashObject(s.backends, snapshot.Backend, snapshot.StorageKey, snapshot.FileSize)
+	}
+
+	now := time.Now()
+	snapshot.VerifiedAt = &now
+	snapshot.IntegrityError = ""
+	switch {
+	case err == nil && snapshot.FileHash == "":
+		// Taken before finish checked hashes; trust what is there now
+		snapshot.FileHash = storedHash
+		snapshot.Integrity = models.IntegrityOK
+	case err == nil && storedHash == snapshot.FileHash:
+		snapshot.Integrity = models.IntegrityOK
+	case err == nil:
+		snapshot.Integrity = models.IntegrityCorrupted
+		snapshot.IntegrityError = fmt.Sprintf("content hashes to %s, recorded %s", storedHash, snapshot.FileHash)
+	case errors.Is(err, ErrDataMissing):
+		snapshot.Integrity = models.IntegrityMissing
+		snapshot.IntegrityError = err.Error()
+	case errors.Is(err, ErrDataCorrupted):
+		snapshot.Integrity = models.IntegrityCorrupted
+		snapshot.IntegrityError = err.Error()
+	default:
+		// Unreadable (permissions, I/O): report it, but it may be passing
+		snapshot.Integrity = models.IntegrityMissing
+		snapshot.IntegrityError = err.Error()
+	}
+
+	if snapshot.Integrity != models.IntegrityOK {
+		fmt.Printf("[Scrub] %s %s v%d is %s: %s\n", snapshot.DeviceID, snapshot.FileUUID, snapshot.Version, snapshot.Integrity, snapshot.IntegrityError)
+	}
+	return s.backupRepo.UpdateIntegrity(snapshot)
+}
+
+// Flagged lists the snapshots the last checks found damaged ("" = every
+// device).
+func (s *ScrubService) Flagged(deviceID string) ([]models.BackupSnapshot, error) {
+	return s.backupRepo.GetFlaggedSnapshots(deviceID)
+}
+
+// Start runs a scrub in the background, unless one is already going.
+func (s *ScrubService) Start() error {
+	if !s.running.TryLock() {
+		return ErrScrubRunning
+	}
+	s.running.Unlock()
+	go func() {
+		if _, err := s.Run(); err != nil && err != ErrScrubRunning {
+			fmt.Printf("[Scrub] Scrub failed: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// RunScrubber scrubs every interval until StopScrubber.
+func (s *ScrubService) RunScrubber() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Run(); err != nil && err != ErrScrubRunning {
+				fmt.Printf("[Scrub] Scrub failed: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// StopScrubber ends RunScrubber, interrupting a scrub in progress, and waits
+// for it. Call once, at shutdown.
+func (s *ScrubService) StopScrubber() {
+	close(s.stop)
+	s.running.Lock()
+	s.running.Unlock()
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	db := newTestDB(t)
+	chunks, backends, mem := newTestChunks(t, db)
+	backupRepo := repositories.NewBackupRepository(db)
+	scrub := NewScrubService(backupRepo, chunks, backends, time.Hour)
+
+	whole := func(fileUUID string, data []byte, fileHash string) {
+		t.Helper()
+		key := "dev-a/" + fileUUID + "/v1/" + fileUUID
+		if err := mem.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := &models.BackupSnapshot{DeviceID: "dev-a", FileUUID: fileUUID, Version: 1, Backend: "mem", StorageKey: key, FileSize: int64(len(data)), FileHash: fileHash}
+		if err := backupRepo.CreateSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunked := func(fileUUID string, parts ...[]byte) {
+		t.Helper()
+		var manifest []models.SnapshotChunk
+		var data []byte
+		for i, part := range parts {
+			hash := putChunk(t, chunks, "dev-a", part)
+			manifest = append(manifest, models.SnapshotChunk{Seq: i, FileOffset: int64(len(data)), ChunkHash: hash, Size: int64(len(part))})
+			data = append(data, part...)
+		}
+		snapshot := &models.BackupSnapshot{DeviceID: "dev-a", FileUUID: fileUUID, Version: 1, Chunked: true, FileSize: int64(len(data)), FileHash: hashOf(data)}
+		if err := chunks.CreateSnapshot(snapshot, manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overwrite := func(key string, data []byte) {
+		t.Helper()
+		if err := mem.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte("whole file content")
+	whole("ok", data, hashOf(data))
+	whole("unhashed", data, "")
+	whole("missing", data, hashOf(data))
+	mem.Delete("dev-a/missing/v1/missing")
+	whole("corrupted", data, hashOf(data))
+	overwrite("dev-a/corrupted/v1/corrupted", []byte("whole file CONTENT"))
+	whole("truncated", data, hashOf(data))
+	overwrite("dev-a/truncated/v1/truncated", data[:5])
+
+	chunked("chunked-ok", []byte("first chunk "), []byte("second chunk"))
+	chunked("chunked-missing", []byte("lost chunk a"), []byte("lost chunk b"))
+	mem.Delete(chunkKey(hashOf([]byte("lost chunk b"))))
+	chunked("chunked-corrupted", []byte("rotten chunk"))
+	overwrite(chunkKey(hashOf([]byte("rotten chunk"))), []byte("ROTTEN chunk"))
+
+	report, err := scrub.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 8 || report.Missing != 3 || report.Corrupted != 2 {
+		t.Errorf("report = %d checked, %d missing, %d corrupted; want 8, 3, 2", report.Checked, report.Missing, report.Corrupted)
+	}
+
+	want := map[string]models.IntegrityStatus{
+		"ok":                models.IntegrityOK,
+		"unhashed":          models.IntegrityOK,
+		"missing":           models.IntegrityMissing,
+		"corrupted":         models.IntegrityCorrupted,
+		"truncated":         models.IntegrityMissing,
+		"chunked-ok":        models.IntegrityOK,
+		"chunked-missing":   models.IntegrityMissing,
+		"chunked-corrupted": models.IntegrityCorrupted,
+	}
+	snapshots, err := backupRepo.GetDeviceSnapshots("dev-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Integrity != want[snapshot.FileUUID] {
+			t.Errorf("%s is %q (%s), want %q", snapshot.FileUUID, snapshot.Integrity, snapshot.IntegrityError, want[snapshot.FileUUID])
+		}
+		if snapshot.VerifiedAt == nil {
+			t.Errorf("%s not marked verified", snapshot.FileUUID)
+		}
+		if snapshot.FileUUID == "unhashed" && snapshot.FileHash != hashOf(data) {
+			t.Errorf("unhashed snapshot recorded hash %q, want the stored content's", snapshot.FileHash)
+		}
+	}
+
+	flagged, err := scrub.Flagged("dev-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 5 {
+		t.Errorf("%d snapshot(s) flagged, want 5", len(flagged))
+	}
+
+	// A repaired snapshot is cleared by the next scrub
+	overwrite("dev-a/corrupted/v1/corrupted", data)
+	if report, err = scrub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupted != 1 {
+		t.Errorf("rescrub found %d corrupted, want 1", report.Corrupted)
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// SessionService issues and validates session tokens.
+// A token is "<session-id>.<expiry-unix>.<hmac>": the HMAC lets us reject
+// forged or expired tokens without a DB hit, and the stored hash lets us
+// revoke them before they expire.
+type SessionService struct {
+	repo   *repositories.SessionRepository
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewSessionService(repo *repositories.SessionRepository, secret string, ttlMinutes int) *SessionService {
+	key := []byte(secret)
+	if len(key) == 0 {
+		// Tokens will not survive a restart, which is acceptable for dev setups
+		key = make([]byte, 32)
+		rand.Read(key)
+		fmt.Println("[Warning] server.session.token_secret is not set; using a random secret.")
+	}
+	if ttlMinutes <= 0 {
+		ttlMinutes = 12 * 60
+	}
+	return &SessionService{
+		repo:   repo,
+		secret: key,
+		ttl:    time.Duration(ttlMinutes) * time.Minute,
+	}
+}
+
+// Issue creates a session for the user. deviceID is empty for admin sessions.
+func (s *SessionService) Issue(user *models.User, deviceID string, isAdmin bool) (string, *models.Session, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	expiresAt := time.Now().Add(s.ttl)
+	body := hex.EncodeToString(id) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	token := body + "." + s.sign(body)
+
+	session := &models.Session{
+		TokenHash:              hashToken(token),
+		UserID:                 user.ID,
+		DeviceID:               deviceID,
+		IsAdmin:                isAdmin,
+		Role:                   user.Role,
+		PasswordChangeRequired: user.MustChangePassword,
+		ExpiresAt:              expiresAt,
+	}
+	if err := s.repo.Create(session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// Validate checks the token signature and expiry, then that it has not been
+// revoked server-side. The session carries the user's current role, so a
+// role change applies to live sessions and a deleted user's stop working.
+func (s *SessionService) Validate(token string) (*models.Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidSession
+	}
+	body := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(body))) {
+		return nil, ErrInvalidSession
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil, ErrInvalidSession
+	}
+
+	session, err := s.repo.GetByTokenHash(hashToken(token))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidSession
+		}
+		return nil, err
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+
+	role, err := s.repo.GetUserRole(session.UserID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidSession
+		}
+		return nil, err
+	}
+	session.Role = role
+	return session, nil
+}
+
+func (s *SessionService) Revoke(sessionID uint) error {
+	return s.repo.Revoke(sessionID)
+}
+
+// RevokeDevice revokes all active sessions of a device.
+func (s *SessionService) RevokeDevice(deviceID string) (int64, error) {
+	return s.repo.RevokeWhere("device_id = ?", deviceID)
+}
+
+// RevokeUser revokes all active sessions (device and admin) of a user.
+func (s *SessionService) RevokeUser(userID uint) (int64, error) {
+	return s.repo.RevokeWhere("user_id = ?", userID)
+}
+
+// PasswordChanged lifts the restriction on the current session and revokes
+// every other session of the user, which still used the old password.
+func (s *SessionService) PasswordChanged(sessionID, userID uint) error {
+	if err := s.repo.ClearPasswordChange(sessionID); err != nil {
+		return err
+	}
+	_, err := s.repo.RevokeWhere("user_id = ? AND id <> ?", userID, sessionID)
+	return err
+}
+
+func (s *SessionService) sign(body string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"crypto/subtle"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const MinPasswordLength = 8
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrWeakPassword    = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrSamePassword    = errors.New("new password must differ from the current one")
+)
+
+type UserService struct {
+	repo *repositories.UserRepository
+}
+
+func NewUserService(repo *repositories.UserRepository) *UserService {
+	return &UserService{repo: repo}
+}
+
+// HashPassword returns the bcrypt hash stored in User.Password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash tells bcrypt hashes apart from legacy plaintext rows.
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// checkPassword compares against the stored hash, or the legacy plaintext
+// value. The bool reports whether the row still needs upgrading.
+func checkPassword(stored, password string) (ok bool, legacy bool) {
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+}
+
+// Authenticate checks username/password. Plaintext rows left over from
+// before hashing are re-saved as bcrypt on the first successful login.
+func (s *UserService) Authenticate(username, password string) (*models.User, error) {
+	user, err := s.repo.GetByUsername(username)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	ok, legacy := checkPassword(user.Password, password)
+	if !ok {
+		return nil, ErrInvalidPassword
+	}
+
+	if legacy {
+		hash, err := HashPassword(password)
+		if err == nil {
+			user.Password = hash
+			err = s.repo.Update(user)
+		}
+		if err != nil {
+			fmt.Printf("[Auth] Failed to upgrade password hash for %s: %v\n", username, err)
+		} else {
+			fmt.Printf("[Auth] Upgraded password hash for %s\n", username)
+		}
+	}
+	return user, nil
+}
+
+// CreateUser adds an account that must change its password at first login.
+func (s *UserService) CreateUser(username, password, role string) (*models.User, error) {
+	if len(password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{
+		Username:           username,
+		Password:           hash,
+		Role:               role,
+		MustChangePassword: true,
+	}
+	if err := s.repo.Create(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangePassword is used by a logged-in user; it requires the current password.
+func (s *UserService) ChangePassword(userID uint, oldPassword, newPassword string) error {
+	user, err := s.repo.GetByID(userID)
+	if err != nil {
+		return ErrUserNotFound
+	}
+	if ok, _ := checkPassword(user.Password, oldPassword); !ok {
+		return ErrInvalidPassword
+	}
+	if oldPassword == newPassword {
+		return ErrSamePassword
+	}
+	return s.setPassword(user, newPassword, false)
+}
+
+// SetPassword sets a password without knowing the old one (server command).
+// With mustChange the user has to pick a new one at the next login.
+func (s *UserService) SetPassword(username, newPassword string, mustChange bool) error {
+	user, err := s.repo.GetByUsername(username)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	return s.setPassword(user, newPassword, mustChange)
+}
+
+func (s *UserService) setPassword(user *models.User, newPassword string, mustChange bool) error {
+	if len(newPassword) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	user.MustChangePassword = mustChange
+	return s.repo.Update(user)
+}
+
+func (s *UserService) GetByUsername(username string) (*models.User, error) {
+	user, err := s.repo.GetByUsername(username)
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *UserService) GetByID(id uint) (*models.User, error) {
+	user, err := s.repo.GetByID(id)
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
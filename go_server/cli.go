@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/app/repositories"
+	"demo/network/go_server/app/services"
+	"demo/network/go_server/config"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// runCommand handles one-shot maintenance commands given on the command line,
+// e.g. `server_go issue-cert ADMIN_CONSOLE admin`, `server_go passwd admin`
+// or `server_go useradd alice operator`.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "issue-cert":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: issue-cert <common-name> [output-prefix]")
+		}
+		prefix := args[1]
+		if len(args) > 2 {
+			prefix = args[2]
+		}
+		return issueCert(args[1], prefix)
+	case "passwd":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: passwd <username> [--reset]")
+		}
+		return setPassword(args[1], len(args) > 2 && args[2] == "--reset")
+	case "useradd":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: useradd <username> <admin|operator|auditor|user>")
+		}
+		return addUser(args[1], args[2])
+	case "role":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: role <username> <admin|operator|auditor|user>")
+		}
+		return setRole(args[1], args[2])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// issueCert writes <prefix>.crt and <prefix>.key signed by the server CA.
+func issueCert(commonName, prefix string) error {
+	tlsCfg := config.AppConfig.Server.TLS
+	certSvc, err := services.NewCertService(tlsCfg.CAFile, tlsCfg.CAKeyFile, tlsCfg.DeviceCertDays)
+	if err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := certSvc.IssueKeyPair(commonName)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(prefix+".crt", []byte(certPEM), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(prefix+".key", []byte(keyPEM), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Issued certificate for %s: %s.crt / %s.key\n", commonName, prefix, prefix)
+	return nil
+}
+
+// openDB connects with the configured DSN for maintenance commands.
+func openDB() (*gorm.DB, error) {
+	db, err := gorm.Open(mysql.Open(config.AppConfig.Server.DBDSN), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DB connection failed: %v", err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Session{}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// randomPassword returns a temporary password for new or reset accounts.
+func randomPassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// addUser creates an account with a temporary password.
+func addUser(username, role string) error {
+	if !models.ValidRole(role) {
+		return fmt.Errorf("unknown role %q (admin, operator, auditor, user)", role)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	userSvc := services.NewUserService(repositories.NewUserRepository(db))
+
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+	if _, err := userSvc.CreateUser(username, password, role); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s (%s). Temporary password: %s (must be changed at first login)\n", username, role, password)
+	return nil
+}
+
+// setPassword sets a user's password. The new password is read from stdin;
+// with reset a random temporary one is generated instead, and the user must
+// change it at the next login.
+func setPassword(username string, reset bool) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	userRepo := repositories.NewUserRepository(db)
+	userSvc := services.NewUserService(userRepo)
+
+	var password string
+	if reset {
+		password, err = randomPassword()
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("New password for %s: ", username)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimSpace(line)
+	}
+
+	if err := userSvc.SetPassword(username, password, reset); err != nil {
+		return err
+	}
+
+	// Sessions opened with the old password are no longer valid
+	if user, err := userRepo.GetByUsername(username); err == nil {
+		repositories.NewSessionRepository(db).RevokeWhere("user_id = ?", user.ID)
+	}
+
+	if reset {
+		fmt.Printf("Temporary password for %s: %s (must be changed at next login)\n", username, password)
+	} else {
+		fmt.Printf("Password updated for %s.\n", username)
+	}
+	return nil
+}
+
+// setRole changes a user's role. Open sessions are revoked so the new
+// permissions apply from the next login.
+func setRole(username, role string) error {
+	if !models.ValidRole(role) {
+		return fmt.Errorf("unknown role %q (admin, operator, auditor, user)", role)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	userRepo := repositories.NewUserRepository(db)
+
+	user, err := userRepo.GetByUsername(username)
+	if err != nil {
+		return fmt.Errorf("user %s not found", username)
+	}
+	user.Role = role
+	if err := userRepo.Update(user); err != nil {
+		return err
+	}
+	repositories.NewSessionRepository(db).RevokeWhere("user_id = ?", user.ID)
+
+	fmt.Printf("Role of %s set to %s.\n", username, role)
+	return nil
+}
@@ -8,15 +8,102 @@ import (
 
 type Config struct {
 	Server struct {
-		Port    int    `yaml:"port"`
-		APIPort int    `yaml:"api_port"`
-		DBDSN   string `yaml:"db_dsn"`
+		Port            int    `yaml:"port"`
+		APIPort         int    `yaml:"api_port"`
+		DBDSN           string `yaml:"db_dsn"`
+		MaxMessageSize  int    `yaml:"max_message_size"` // Bytes per notification message; 0 = 1 MiB
+		DuplicatePolicy string `yaml:"duplicate_policy"` // Device ID connecting twice: "replace" (old) or "reject" (new)
+		TLS             struct {
+			Enabled           bool   `yaml:"enabled"`
+			CertFile          string `yaml:"cert_file"`
+			KeyFile           string `yaml:"key_file"`
+			CAFile            string `yaml:"ca_file"`     // Verifies device certificates
+			CAKeyFile         string `yaml:"ca_key_file"` // Signs device certificates at registration
+			RequireClientCert bool   `yaml:"require_client_cert"`
+			DeviceCertDays    int    `yaml:"device_cert_days"`
+		} `yaml:"tls"`
+		Session struct {
+			TokenSecret string `yaml:"token_secret"` // HMAC key for session tokens
+			TTLMinutes  int    `yaml:"ttl_minutes"`
+		} `yaml:"session"`
+		Enrollment struct {
+			RequireToken    bool   `yaml:"require_token"`     // Registration needs an admin-issued enrollment token
+			RequireApproval bool   `yaml:"require_approval"`  // New devices stay PENDING until an admin approves them
+			MinAgentVersion string `yaml:"min_agent_version"` // Older agents are refused on connect; "" = any
+		} `yaml:"enrollment"`
+		Heartbeat struct {
+			IntervalSeconds int `yaml:"interval_seconds"` // Ping devices idle this long
+			TimeoutSeconds  int `yaml:"timeout_seconds"`  // Disconnect devices silent this long
+		} `yaml:"heartbeat"`
+		Limits struct {
+			APIWorkers     int                        `yaml:"api_workers"`      // Threads serving API requests
+			APIQueue       int                        `yaml:"api_queue"`        // Connections waiting for a worker before 503
+			MaxConnections int                        `yaml:"max_connections"`  // Concurrent notification connections
+			MaxRequestSize int                        `yaml:"max_request_size"` // Largest API request in bytes
+			RateLimit      RateLimitConfig            `yaml:"rate_limit"`       // Per device / console user
+			TypeRateLimits map[string]RateLimitConfig `yaml:"type_rate_limits"` // Extra limit per message type, e.g. "0xE6"
+		} `yaml:"limits"`
+		Shutdown struct {
+			GraceSeconds          int `yaml:"grace_seconds"`           // Wait this long for running requests on SIGTERM
+			ReconnectAfterSeconds int `yaml:"reconnect_after_seconds"` // Told to agents; they add jitter
+		} `yaml:"shutdown"`
 	} `yaml:"server"`
+	Commands struct {
+		DefaultTTLHours         int `yaml:"default_ttl_hours"` // For command types without a policy; 0 = never expire
+		MaxAttempts             int `yaml:"max_attempts"`
+		AckTimeoutSeconds       int `yaml:"ack_timeout_seconds"`
+		RetryBackoffSeconds     int `yaml:"retry_backoff_seconds"`
+		DispatchIntervalSeconds int `yaml:"dispatch_interval_seconds"`
+	} `yaml:"commands"`
 	Backup struct {
-		StoragePath string `yaml:"storage_path"`
+		StoragePath string `yaml:"storage_path"` // Partial uploads; also the local backend's root
+		Storage     struct {
+			Backend string `yaml:"backend"` // Where new backup data goes: "local" (default), "s3" or "memory"
+			S3      struct {
+				Endpoint  string `yaml:"endpoint"` // e.g. "https://s3.eu-west-1.amazonaws.com"
+				Region    string `yaml:"region"`
+				Bucket    string `yaml:"bucket"` // "" = no S3 backend
+				Prefix    string `yaml:"prefix"` // Prepended to every key
+				AccessKey string `yaml:"access_key"`
+				SecretKey string `yaml:"secret_key"`
+				PathStyle bool   `yaml:"path_style"` // Bucket in the path instead of the host name (MinIO)
+			} `yaml:"s3"`
+		} `yaml:"storage"`
+		Retention struct {
+			IntervalMinutes int                        `yaml:"interval_minutes"`  // How often the collector runs; 0 = 60
+			DryRun          bool                       `yaml:"dry_run"`           // Only record what would be pruned
+			ChunkGraceHours int                        `yaml:"chunk_grace_hours"` // Unreferenced chunks are kept this long (uploads in progress); 0 = 24
+			Default         RetentionPolicy            `yaml:"default"`
+			Groups          map[string]RetentionPolicy `yaml:"groups"`  // By device group, replaces the default
+			Devices         map[string]RetentionPolicy `yaml:"devices"` // By device ID, replaces group and default
+		} `yaml:"retention"`
+		Scrub struct {
+			IntervalHours int `yaml:"interval_hours"` // How often stored snapshots are re-verified; 0 = 24
+		} `yaml:"scrub"`
+		Reaper struct {
+			IntervalMinutes   int `yaml:"interval_minutes"`    // How often idle transfers are expired; 0 = 10
+			ExpireAfterHours  int `yaml:"expire_after_hours"`  // Idle uploads and restores are expired after this; 0 = 24
+			StuckAfterMinutes int `yaml:"stuck_after_minutes"` // Idle transfers are listed as stuck after this; 0 = 15
+		} `yaml:"reaper"`
 	} `yaml:"backup"`
 }
 
+// RetentionPolicy says which versions of a backed-up file to keep; all
+// zero keeps everything. The newest version is always kept.
+type RetentionPolicy struct {
+	KeepLast          int `yaml:"keep_last"`           // Newest N versions
+	KeepDailyDays     int `yaml:"keep_daily_days"`     // Newest version of each day, for N days
+	KeepWeeklyWeeks   int `yaml:"keep_weekly_weeks"`   // Newest version of each week, for N weeks
+	KeepMonthlyMonths int `yaml:"keep_monthly_months"` // Newest version of each month, for N months
+	KeepDeletedDays   int `yaml:"keep_deleted_days"`   // All versions of a file deleted on the device go after N days; 0 = never
+}
+
+// RateLimitConfig is a token bucket; requests_per_second 0 = unlimited.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
 var AppConfig Config
 
 func LoadConfig(path string) error {
@@ -9,19 +9,21 @@ import (
 	"demo/network/go_server/config"
 	"demo/network/go_server/global"
 	"demo/network/go_server/server"
+	"demo/network/go_server/storage"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-const (
-	MSG_LOGIN_REQ  = 0xA1
-	MSG_DEVICE_REQ = 0xC1
-)
-
 func main() {
 	fmt.Println("--- MSG-ROUTER GO SERVER ---")
 
@@ -30,6 +32,14 @@ func main() {
 		log.Fatalf("[Error] Failed to load config.yml: %v", err)
 	}
 
+	// Maintenance commands (no listeners started)
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("[Error] %v", err)
+		}
+		return
+	}
+
 	// Init DB (MySQL)
 	// User: root, Pass: root, DB: sagiri_guard
 	dsn := config.AppConfig.Server.DBDSN
@@ -53,6 +63,7 @@ func main() {
 			&models.Device{},
 			&models.Log{},
 			&models.Command{},
+			&models.CommandResult{},
 			&models.FirewallCategory{},
 			&models.FirewallDomain{},
 			&models.DeviceConfig{},
@@ -60,25 +71,57 @@ func main() {
 			&models.FileNode{},
 			&models.BackupSession{},
 			&models.BackupSnapshot{},
+			&models.Chunk{},
+			&models.ChunkOwner{},
+			&models.SnapshotChunk{},
 			&models.RestoreSession{},
+			&models.Session{},
+			&models.AuditEvent{},
+			&models.EnrollmentToken{},
+			&models.RetentionRun{},
+			&models.PrunedSnapshot{},
 		)
 
-		// Seed Admin
+		// Seed Admin (default passwords must be changed at first login)
 		var count int64
 		global.DB.Model(&models.User{}).Where("username = ?", "admin").Count(&count)
 		if count == 0 {
-			global.DB.Create(&models.User{Username: "admin", Password: "admin"})
+			hash, _ := services.HashPassword("admin")
+			global.DB.Create(&models.User{Username: "admin", Password: hash, Role: models.RoleAdmin, MustChangePassword: true})
 			fmt.Println("Seeded admin user.")
 		}
 
 		// seed user
 		global.DB.Model(&models.User{}).Where("username = ?", "user").Count(&count)
 		if count == 0 {
-			global.DB.Create(&models.User{Username: "user", Password: "user"})
-			fmt.Println("Seeded user user.")
+			hash, _ := services.HashPassword("user")
+			global.DB.Create(&models.User{Username: "user", Password: hash, Role: models.RoleUser, MustChangePassword: true})
 			fmt.Println("Seeded user user.")
 		}
 
+		// Accounts seeded before hashing still hold their plaintext default
+		// password; make them pick a new one on next login as well
+		global.DB.Model(&models.User{}).
+			Where("(username = ? AND password = ?) OR (username = ? AND password = ?)", "admin", "admin", "user", "user").
+			Update("must_change_password", true)
+
+		// Users created before roles existed: "admin" keeps console access,
+		// everyone else becomes a plain device user
+		global.DB.Model(&models.User{}).Where("username = ? AND (role = '' OR role IS NULL)", "admin").Update("role", models.RoleAdmin)
+		global.DB.Model(&models.User{}).Where("role = '' OR role IS NULL").Update("role", models.RoleUser)
+
+		// Commands queued before retry limits existed
+		global.DB.Model(&models.Command{}).Where("max_attempts = 0 OR max_attempts IS NULL").Update("max_attempts", 5)
+
+		// Devices registered before the approval queue existed stay usable
+		global.DB.Model(&models.Device{}).Where("status = '' OR status IS NULL").Update("status", models.DeviceStatusApproved)
+
+		// Backup data stored before storage backends is on the local disk
+		adoptLocalStorage(global.DB, config.AppConfig.Backup.StoragePath)
+
+		// Chunks stored before uploads were recorded per device
+		adoptChunkOwners(global.DB)
+
 		// Seed Firewall
 		if err := seeders.SeedFirewall(global.DB); err != nil {
 			log.Printf("[Warning] Firewall Seeding failed: %v", err)
@@ -87,12 +130,6 @@ func main() {
 		}
 	}
 
-	// Register Routes
-	// Register Routes
-	server.Router[MSG_LOGIN_REQ] = controllers.HandleLogin
-	server.Router[MSG_DEVICE_REQ] = controllers.HandleDeviceRegister
-	server.Router[0xB1] = controllers.HandleListUsers
-
 	// --- MVC INITIALIZATION ---
 	// 1. Repositories
 	cmdRepo := repositories.NewCommandRepository(global.DB)
@@ -103,10 +140,23 @@ func main() {
 	nodeRepo := repositories.NewFileNodeRepository(global.DB)
 	backupRepo := repositories.NewBackupRepository(global.DB)
 	restoreRepo := repositories.NewRestoreRepository(global.DB)
+	chunkRepo := repositories.NewChunkRepository(global.DB)
+	sessionRepo := repositories.NewSessionRepository(global.DB)
+	userRepo := repositories.NewUserRepository(global.DB)
+	auditRepo := repositories.NewAuditRepository(global.DB)
+	enrollRepo := repositories.NewEnrollmentRepository(global.DB)
+	retentionRepo := repositories.NewRetentionRepository(global.DB)
 
 	// 2. Services
 	// CommandSvc depends on CommandRepo
-	cmdSvc := services.NewCommandService(cmdRepo)
+	cmdCfg := config.AppConfig.Commands
+	cmdSvc := services.NewCommandService(cmdRepo, services.CommandSettings{
+		DefaultTTL:       time.Duration(cmdCfg.DefaultTTLHours) * time.Hour,
+		MaxAttempts:      cmdCfg.MaxAttempts,
+		AckTimeout:       time.Duration(cmdCfg.AckTimeoutSeconds) * time.Second,
+		RetryBackoff:     time.Duration(cmdCfg.RetryBackoffSeconds) * time.Second,
+		DispatchInterval: time.Duration(cmdCfg.DispatchIntervalSeconds) * time.Second,
+	})
 
 	// LogSvc depends on LogRepo
 	logSvc := services.NewLogService(logRepo)
@@ -123,50 +173,290 @@ func main() {
 	// DirectoryTreeSvc
 	treeSvc := services.NewDirectoryTreeService(nodeRepo)
 
+	// Storage backends for backup data (snapshots and chunks)
+	backends, err := storageBackends()
+	if err != nil {
+		log.Fatalf("[Error] %v", err)
+	}
+
+	// ChunkSvc (deduplicated chunk store shared by backup and restore)
+	chunkSvc := services.NewChunkService(chunkRepo, backends, config.AppConfig.Backup.StoragePath)
+
 	// BackupSvc
-	backupSvc := services.NewBackupService(backupRepo, config.AppConfig.Backup.StoragePath)
+	backupSvc := services.NewBackupService(backupRepo, chunkSvc, backends, config.AppConfig.Backup.StoragePath)
 
 	// RestoreSvc
-	restoreSvc := services.NewRestoreService(backupRepo, restoreRepo, nodeRepo)
+	restoreSvc := services.NewRestoreService(backupRepo, restoreRepo, nodeRepo, chunkSvc, backends)
+
+	// RetentionSvc (snapshot pruning and chunk garbage collection)
+	retCfg := config.AppConfig.Backup.Retention
+	groupPolicies := make(map[string]services.RetentionPolicy)
+	for group, p := range retCfg.Groups {
+		groupPolicies[group] = retentionPolicy(p)
+	}
+	devicePolicies := make(map[string]services.RetentionPolicy)
+	for deviceID, p := range retCfg.Devices {
+		devicePolicies[deviceID] = retentionPolicy(p)
+	}
+	retentionSvc := services.NewRetentionService(retentionRepo, backupRepo, restoreRepo, nodeRepo, devRepo, chunkSvc, backends, services.RetentionSettings{
+		Interval:   time.Duration(retCfg.IntervalMinutes) * time.Minute,
+		DryRun:     retCfg.DryRun,
+		ChunkGrace: time.Duration(retCfg.ChunkGraceHours) * time.Hour,
+		Default:    retentionPolicy(retCfg.Default),
+		Groups:     groupPolicies,
+		Devices:    devicePolicies,
+	})
+
+	// ScrubSvc (periodic re-verification of stored snapshots)
+	scrubSvc := services.NewScrubService(backupRepo, chunkSvc, backends, time.Duration(config.AppConfig.Backup.Scrub.IntervalHours)*time.Hour)
+
+	// ReaperSvc (expires uploads and restores the agent abandoned)
+	reaperCfg := config.AppConfig.Backup.Reaper
+	reaperSvc := services.NewReaperService(backupSvc, restoreSvc, services.ReaperSettings{
+		Interval:    time.Duration(reaperCfg.IntervalMinutes) * time.Minute,
+		ExpireAfter: time.Duration(reaperCfg.ExpireAfterHours) * time.Hour,
+		StuckAfter:  time.Duration(reaperCfg.StuckAfterMinutes) * time.Minute,
+	})
+
+	// UserSvc (password checks)
+	userSvc := services.NewUserService(userRepo)
+
+	// AuditSvc
+	auditSvc := services.NewAuditService(auditRepo)
+
+	// EnrollmentSvc (registration tokens, approval queue)
+	enrollCfg := config.AppConfig.Server.Enrollment
+	enrollSvc := services.NewEnrollmentService(enrollRepo, devRepo, enrollCfg.RequireToken, enrollCfg.RequireApproval)
+	enrollSvc.MinAgentVersion = enrollCfg.MinAgentVersion
+
+	// SessionSvc
+	sessionCfg := config.AppConfig.Server.Session
+	sessionSvc := services.NewSessionService(sessionRepo, sessionCfg.TokenSecret, sessionCfg.TTLMinutes)
 
 	// 3. Inject into Controllers
 	controllers.Init(fwSvc, adminSvc, logSvc, histSvc, treeSvc, backupSvc, restoreSvc)
 	controllers.SetDirectoryTreeService(treeSvc)
 	controllers.SetBackupService(backupSvc)
+	controllers.SetSessionService(sessionSvc)
+	controllers.SetUserService(userSvc)
+	controllers.SetAuditService(auditSvc)
+	controllers.SetEnrollmentService(enrollSvc)
+	controllers.SetCommandService(cmdSvc)
+	controllers.SetRetentionService(retentionSvc)
+	controllers.SetScrubService(scrubSvc)
+	controllers.SetReaperService(reaperSvc)
+
+	// Every non-public route needs a valid session token
+	server.Authenticate = controllers.Authenticate
+	server.Audit = controllers.RecordAudit
+
+	// Queued commands go out on connect and from the dispatcher (expiry, retries)
+	server.CommandDispatcher = cmdSvc.ProcessPendingCommands
+	go cmdSvc.RunDispatcher()
+
+	// Old snapshot versions and unused chunks are pruned in the background
+	go retentionSvc.RunCollector()
+
+	// Stored snapshots are re-checked against their hashes
+	go scrubSvc.RunScrubber()
+
+	// Uploads and restores nobody works on any more are expired
+	go reaperSvc.RunReaper()
+
+	// Heartbeats keep devices.last_seen_at / last_ip current
+	server.DeviceSeen = enrollSvc.MarkSeen
+
+	// Agent versions / capabilities from the hello; refuses outdated agents
+	server.DeviceHello = enrollSvc.CheckHello
+
+	// Devices issued a certificate must present it, even when optional
+	server.DeviceCertRequired = enrollSvc.CertRequired
 
 	fmt.Println("[Init] MVC Layer Initialized.")
 	// --------------------------
 
-	// Admin Flow
-	server.Router[0xD6] = controllers.HandleAdminLogin
-	server.Router[0xD1] = controllers.HandleAdminGetLogs
-	server.Router[0xD4] = controllers.HandleClientLogUpload
-	server.Router[0xD8] = controllers.HandleAdminGetStoredLogs
-	server.Router[0xDA] = controllers.HandleAdminGetCommandHistory
-	server.Router[0xDB] = controllers.HandleAdminGetCommandHistory // Actually response type usually not routed, but for consistency if reused.
-	server.Router[0xE1] = controllers.HandleAdminFirewallControl
-	server.Router[0xE4] = controllers.HandleClientGetFirewallConfig
-	server.Router[0xE6] = controllers.HandleClientFileSync   // New Route
-	server.Router[0xE8] = controllers.HandleAdminGetFileTree // New Route for Admin Tree
-	server.Router[0xF1] = controllers.HandleBackupInit
-	server.Router[0xF3] = controllers.HandleBackupChunk
-	server.Router[0xF5] = controllers.HandleBackupFinish
-	server.Router[0xF7] = controllers.HandleBackupCancel
-	server.Router[0xF8] = controllers.HandleBackupResume
-
-	// Restore Flow
-	server.Router[0x70] = controllers.HandleAdminRestore
-	server.Router[0x73] = controllers.HandleRestoreInit
-	server.Router[0x75] = controllers.HandleRestoreChunk
-	server.Router[0x77] = controllers.HandleRestoreFinish
-	server.Router[0x79] = controllers.HandleRestoreResume
+	// Register Routes (names, access and schemas live with the controllers)
+	server.Register(controllers.Routes...)
 
 	server.Init(config.AppConfig.Server.Port, config.AppConfig.Server.APIPort)
 	server.SetHandler(server.GoRequestHandler)
+	server.SetMaxMessageSize(config.AppConfig.Server.MaxMessageSize)
+	if err := server.SetDuplicatePolicy(config.AppConfig.Server.DuplicatePolicy); err != nil {
+		log.Fatalf("[Error] %v", err)
+	}
+	hbCfg := config.AppConfig.Server.Heartbeat
+	server.SetHeartbeat(hbCfg.IntervalSeconds, hbCfg.TimeoutSeconds)
+
+	// Worker pool, connection limit and per-device rate limits
+	limits := config.AppConfig.Server.Limits
+	server.SetLimits(limits.APIWorkers, limits.APIQueue, limits.MaxConnections, limits.MaxRequestSize)
+	limiter, err := newRateLimiter(limits.RateLimit, limits.TypeRateLimits)
+	if err != nil {
+		log.Fatalf("[Error] %v", err)
+	}
+	server.Limiter = limiter
+
+	// TLS (optional)
+	tlsCfg := config.AppConfig.Server.TLS
+	if tlsCfg.Enabled {
+		if err := server.EnableTLS(tlsCfg.CertFile, tlsCfg.KeyFile, tlsCfg.CAFile, tlsCfg.RequireClientCert); err != nil {
+			log.Fatalf("[Error] %v", err)
+		}
+		if tlsCfg.CAKeyFile != "" {
+			certSvc, err := services.NewCertService(tlsCfg.CAFile, tlsCfg.CAKeyFile, tlsCfg.DeviceCertDays)
+			if err != nil {
+				log.Fatalf("[Error] Failed to load CA for device certificates: %v", err)
+			}
+			controllers.SetCertService(certSvc)
+			fmt.Println("[Init] Device certificate issuing enabled.")
+		}
+	}
 
 	fmt.Printf("[Server] Starting on Ports %d (Notification) and %d (API)...\n", config.AppConfig.Server.Port, config.AppConfig.Server.APIPort)
 	server.Start()
 
-	// Block main thread
-	select {}
+	// Block until SIGINT / SIGTERM, then drain (rolling restarts)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Printf("[Server] Received %v, shutting down...\n", <-sig)
+	shutdown(cmdSvc, backupSvc, retentionSvc, scrubSvc, reaperSvc)
+}
+
+// shutdown stops taking work, waits for in-flight requests, then leaves the
+// database in a state the agents can resume from.
+func shutdown(cmdSvc *services.CommandService, backupSvc *services.BackupService, retentionSvc *services.RetentionService, scrubSvc *services.ScrubService, reaperSvc *services.ReaperService) {
+	cfg := config.AppConfig.Server.Shutdown
+	grace := cfg.GraceSeconds
+	if grace <= 0 {
+		grace = 30
+	}
+	reconnectAfter := cfg.ReconnectAfterSeconds
+	if reconnectAfter <= 0 {
+		reconnectAfter = 10
+	}
+
+	if pending := server.Shutdown(grace, reconnectAfter); pending > 0 {
+		fmt.Printf("[Shutdown] %d request(s) did not finish in time\n", pending)
+	}
+	cmdSvc.StopDispatcher()
+	retentionSvc.StopCollector()
+	scrubSvc.StopScrubber()
+	reaperSvc.StopReaper()
+
+	if n, err := backupSvc.Checkpoint(); err != nil {
+		fmt.Printf("[Shutdown] Failed to checkpoint uploads: %v\n", err)
+	} else if n > 0 {
+		fmt.Printf("[Shutdown] %d upload(s) left resumable\n", n)
+	}
+
+	if sqlDB, err := global.DB.DB(); err == nil {
+		sqlDB.Close()
+	}
+	fmt.Println("[Shutdown] Done.")
+}
+
+// storageBackends builds the backup storage backends from config. The local
+// one always exists, for data stored before another backend was chosen.
+func storageBackends() (*storage.Backends, error) {
+	cfg := config.AppConfig.Backup.Storage
+	backends := map[string]storage.Backend{
+		"local": storage.NewLocal(config.AppConfig.Backup.StoragePath),
+	}
+	if cfg.S3.Bucket != "" {
+		s3, err := storage.NewS3(storage.S3Config{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			Prefix:    cfg.S3.Prefix,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			PathStyle: cfg.S3.PathStyle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backends["s3"] = s3
+	}
+	active := cfg.Backend
+	if active == "" {
+		active = "local"
+	}
+	if active == "memory" {
+		fmt.Println("[Warning] Backup storage is in memory: backups are lost on restart")
+		backends["memory"] = storage.NewMemory()
+	}
+	return storage.NewBackends(active, backends)
+}
+
+// adoptLocalStorage records the local backend on backup data stored before
+// storage backends existed: chunks, and snapshots (plus restores of them)
+// whose server_path lies in the storage path. Others keep an empty key and
+// read as missing.
+func adoptLocalStorage(db *gorm.DB, storagePath string) {
+	db.Model(&models.Chunk{}).Where("backend = '' OR backend IS NULL").Update("backend", "local")
+
+	var snapshots []models.BackupSnapshot
+	db.Where("(backend = '' OR backend IS NULL) AND chunked = ? AND server_path <> ''", false).Find(&snapshots)
+	adopted := 0
+	for _, snapshot := range snapshots {
+		rel, err := filepath.Rel(storagePath, snapshot.ServerPath)
+		key := filepath.ToSlash(rel)
+		if err != nil || !storage.ValidKey(key) {
+			fmt.Printf("[Warning] Snapshot %d: %s is outside the storage path\n", snapshot.ID, snapshot.ServerPath)
+			continue
+		}
+		update := map[string]interface{}{"backend": "local", "storage_key": key}
+		db.Model(&models.BackupSnapshot{}).Where("id = ?", snapshot.ID).Updates(update)
+		db.Model(&models.RestoreSession{}).Where("snapshot_id = ? AND (backend = '' OR backend IS NULL)", snapshot.ID).Updates(update)
+		adopted++
+	}
+	if adopted > 0 {
+		fmt.Printf("[Init] %d snapshot(s) recorded on the local storage backend.\n", adopted)
+	}
+}
+
+// adoptChunkOwners records each device as the uploader of the chunks its
+// snapshots use. It runs once, while no upload has been recorded yet.
+func adoptChunkOwners(db *gorm.DB) {
+	var count int64
+	if db.Model(&models.ChunkOwner{}).Count(&count); count > 0 {
+		return
+	}
+	var owners []models.ChunkOwner
+	db.Model(&models.SnapshotChunk{}).Distinct("backup_snapshots.device_id, snapshot_chunks.chunk_hash").
+		Joins("JOIN backup_snapshots ON backup_snapshots.id = snapshot_chunks.snapshot_id").
+		Scan(&owners)
+	if len(owners) == 0 {
+		return
+	}
+	if err := db.CreateInBatches(owners, 500).Error; err != nil {
+		fmt.Printf("[Warning] Failed to record chunk uploaders: %v\n", err)
+		return
+	}
+	fmt.Printf("[Init] %d chunk(s) recorded as uploaded by the devices using them.\n", len(owners))
+}
+
+// retentionPolicy converts a config.yml retention policy.
+func retentionPolicy(p config.RetentionPolicy) services.RetentionPolicy {
+	return services.RetentionPolicy{
+		KeepLast:          p.KeepLast,
+		KeepDailyDays:     p.KeepDailyDays,
+		KeepWeeklyWeeks:   p.KeepWeeklyWeeks,
+		KeepMonthlyMonths: p.KeepMonthlyMonths,
+		KeepDeletedDays:   p.KeepDeletedDays,
+	}
+}
+
+// newRateLimiter builds the request limiter from config. Message types are
+// given as numbers, e.g. "0xE6".
+func newRateLimiter(def config.RateLimitConfig, perType map[string]config.RateLimitConfig) (*server.RateLimiter, error) {
+	types := make(map[int]server.RateLimit)
+	for key, limit := range perType {
+		msgType, err := strconv.ParseInt(key, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message type %q in server.limits.type_rate_limits", key)
+		}
+		types[int(msgType)] = server.RateLimit{Rate: limit.RequestsPerSecond, Burst: limit.Burst}
+	}
+	return server.NewRateLimiter(server.RateLimit{Rate: def.RequestsPerSecond, Burst: def.Burst}, types), nil
 }
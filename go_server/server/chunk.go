@@ -0,0 +1,101 @@
+package server
+
+/*
+#include <stdlib.h>
+#include "../../server/core.h"
+*/
+import "C"
+import (
+	"crypto/sha256"
+	"demo/network/protocol/wire"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unsafe"
+)
+
+// Chunk frames carry backup/restore data as raw bytes after a small JSON
+// header instead of hex inside JSON (see chunk_frame_build in
+// protocol/protocol.h): uint32 header length, the header, then the bytes.
+
+const chunkFrameMaxHeader = wire.ChunkFrameMaxHeader
+
+// ChunkHeader names one chunk of a transfer.
+type ChunkHeader struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+	DataLen    int64  `json:"data_len"`
+	SHA256     string `json:"sha256"` // Of the raw bytes, hex
+}
+
+var errBadChunkFrame = errors.New("invalid chunk frame")
+
+// splitChunkFrame returns the JSON header and the raw bytes of a frame, like
+// wire.ParseChunkFrame but without copying the payload.
+func splitChunkFrame(frame string) (string, string, error) {
+	if len(frame) < 4 {
+		return "", "", errBadChunkFrame
+	}
+	n := int(binary.BigEndian.Uint32([]byte(frame[:4])))
+	if n > chunkFrameMaxHeader || n > len(frame)-4 {
+		return "", "", errBadChunkFrame
+	}
+	return frame[4 : 4+n], frame[4+n:], nil
+}
+
+// RequestData returns the raw bytes of a chunk frame request (routes
+// declared Binary); the handler's payload is the frame's JSON header.
+func RequestData(sock int) io.Reader {
+	if req := currentRequest(sock); req != nil {
+		return strings.NewReader(req.Data)
+	}
+	return strings.NewReader("")
+}
+
+// SendChunk answers with a chunk frame whose header is the envelope (data =
+// header, with SHA256 filled in) followed by header.DataLen bytes read from
+// r. The bytes are read straight into the outgoing buffer, so a chunk is held
+// in memory once.
+func SendChunk(sock int, msgType int, header ChunkHeader, r io.Reader) error {
+	// The data goes after room for the largest header; the header is then
+	// written just in front of it
+	dataStart := 4 + chunkFrameMaxHeader
+	size := dataStart + int(header.DataLen)
+	mem := C.malloc(C.size_t(size))
+	if mem == nil {
+		SendError(sock, msgType, 500, CodeInternal, "Out of memory")
+		return errors.New("out of memory")
+	}
+	defer C.free(mem)
+	buf := unsafe.Slice((*byte)(mem), size)
+
+	sum := sha256.New()
+	if _, err := io.ReadFull(io.TeeReader(r, sum), buf[dataStart:]); err != nil {
+		SendError(sock, msgType, 500, CodeInternal, "Failed to read chunk")
+		return fmt.Errorf("read chunk: %v", err)
+	}
+	header.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	data, _ := json.Marshal(header)
+	env := Envelope{RequestID: requestID(sock), Code: CodeOK, Data: data}
+	head, _ := json.Marshal(env)
+	if len(head) > chunkFrameMaxHeader {
+		SendError(sock, msgType, 500, CodeInternal, "Chunk header too large")
+		return errors.New("chunk header too large")
+	}
+
+	start := dataStart - len(head) - 4
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(head)))
+	copy(buf[start+4:], head)
+
+	if req := currentRequest(sock); req != nil {
+		req.Status = 200
+		req.Code = CodeOK
+	}
+	C.server_send_response_len(C.int(sock), C.int(msgType), 200, (*C.char)(unsafe.Pointer(&buf[start])), C.uint32_t(size-start))
+	return nil
+}
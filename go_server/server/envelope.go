@@ -0,0 +1,126 @@
+package server
+
+import (
+	"demo/network/protocol/wire"
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes carried in the response envelope. Clients branch on these;
+// the message is only for people.
+const (
+	CodeOK                     = "OK"
+	CodeInvalidPayload         = "INVALID_PAYLOAD"
+	CodeUnauthenticated        = "UNAUTHENTICATED"
+	CodeForbidden              = "FORBIDDEN"
+	CodeNotFound               = "NOT_FOUND"
+	CodeConflict               = "CONFLICT"
+	CodeTooLarge               = "TOO_LARGE"
+	CodeRateLimited            = "RATE_LIMITED"
+	CodeInternal               = "INTERNAL"
+	CodeBusy                   = "BUSY"
+	CodeUnknownRoute           = "UNKNOWN_ROUTE"
+	CodePasswordChangeRequired = "PASSWORD_CHANGE_REQUIRED"
+	CodeDevicePending          = "DEVICE_PENDING"
+	CodeDeviceRejected         = "DEVICE_REJECTED"
+	CodeChecksumMismatch       = "CHECKSUM_MISMATCH"
+)
+
+// codeForStatus is the code used when a handler only gives a status.
+func codeForStatus(status int) string {
+	switch {
+	case status < 400:
+		return CodeOK
+	case status == 401:
+		return CodeUnauthenticated
+	case status == 403:
+		return CodeForbidden
+	case status == 404:
+		return CodeNotFound
+	case status == 409:
+		return CodeConflict
+	case status == 413:
+		return CodeTooLarge
+	case status == 429:
+		return CodeRateLimited
+	case status == 503:
+		return CodeBusy
+	case status >= 500:
+		return CodeInternal
+	}
+	return CodeInvalidPayload
+}
+
+// Envelope is the body of every API response (see protocol/envelope.h).
+type Envelope = wire.Envelope
+
+func newRequestID() string {
+	return wire.NewRequestID()
+}
+
+// requestID returns the ID of the request being served on sock, or a new
+// one for responses sent outside the router.
+func requestID(sock int) string {
+	if req := currentRequest(sock); req != nil {
+		return req.ID
+	}
+	return newRequestID()
+}
+
+// encodeData turns a handler's body into the envelope's data. Strings that
+// already hold JSON are passed through as is.
+func encodeData(body interface{}) json.RawMessage {
+	switch v := body.(type) {
+	case nil:
+		return nil
+	case string:
+		if json.Valid([]byte(v)) {
+			return json.RawMessage(v)
+		}
+	case json.RawMessage:
+		return v
+	}
+	data, _ := json.Marshal(body)
+	return data
+}
+
+// errorMessage pulls the "error" text out of an error body written in the
+// older {"error": "..."} style.
+func errorMessage(body interface{}) string {
+	switch v := body.(type) {
+	case map[string]string:
+		return v["error"]
+	case string:
+		var legacy struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal([]byte(v), &legacy) == nil && legacy.Error != "" {
+			return legacy.Error
+		}
+		return v
+	}
+	return ""
+}
+
+// SendError answers the request on sock with an error code and message.
+func SendError(sock int, msgType int, status int, code string, message string) {
+	sendEnvelope(sock, msgType, status, Envelope{Code: code, Message: message})
+}
+
+// SendErrorData is SendError with details the client can act on in data.
+func SendErrorData(sock int, msgType int, status int, code string, message string, data interface{}) {
+	sendEnvelope(sock, msgType, status, Envelope{Code: code, Message: message, Data: encodeData(data)})
+}
+
+func sendEnvelope(sock int, msgType int, status int, env Envelope) {
+	env.RequestID = requestID(sock)
+	if req := currentRequest(sock); req != nil {
+		req.Status = status
+		req.Code = env.Code
+	}
+	if status >= 400 {
+		fmt.Printf("[Go] %s %d %s: %s\n", env.RequestID, status, env.Code, env.Message)
+	}
+	bytes, _ := json.Marshal(env)
+	sendRaw(sock, msgType, status, string(bytes))
+}
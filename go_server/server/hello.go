@@ -0,0 +1,89 @@
+package server
+
+/*
+#include "../../server/core.h"
+*/
+import "C"
+import (
+	"demo/network/go_server/app/models"
+	"demo/network/go_server/global"
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// ProtocolVersion is the protocol spoken by this server (PROTOCOL_VERSION).
+const ProtocolVersion = 2
+
+// Capabilities this server offers to agents in its MSG_HELLO answer.
+var ServerCapabilities = []string{"binary_chunks", "persistent_api", "dedup_chunks"}
+
+// legacyCommands are the command types every protocol 1 agent handles; they
+// do not list them because they send no hello.
+var legacyCommands = []int{0x72, 0xD3, 0xE3} // RESTORE, GET_LOGS, FIREWALL_UPDATE
+
+// DeviceHello checks and records an agent's greeting (see models.Hello). A
+// *models.HelloRejection refuses the connection. Set in main.
+var DeviceHello func(hello models.Hello) error
+
+//export goClientHello
+func goClientHello(deviceID *C.char, hello *C.char, reply *C.char, replySize C.int) C.int {
+	h := models.Hello{DeviceID: C.GoString(deviceID), Protocol: 1}
+	if hello != nil {
+		if err := json.Unmarshal([]byte(C.GoString(hello)), &h); err != nil {
+			writeReply(reply, replySize, map[string]string{"error": "Invalid hello"})
+			return 0
+		}
+		h.DeviceID = C.GoString(deviceID)
+		if h.Protocol < 2 {
+			h.Protocol = 2
+		}
+	}
+
+	if DeviceHello != nil {
+		if err := DeviceHello(h); err != nil {
+			fmt.Printf("[Go] Refusing agent %s %q: %v\n", h.DeviceID, h.AgentVersion, err)
+			resp := map[string]string{"error": err.Error()}
+			if rej, ok := err.(*models.HelloRejection); ok && rej.MinVersion != "" {
+				resp["min_version"] = rej.MinVersion
+			}
+			writeReply(reply, replySize, resp)
+			return 0
+		}
+	}
+
+	writeReply(reply, replySize, map[string]interface{}{
+		"protocol":     ProtocolVersion,
+		"capabilities": ServerCapabilities,
+	})
+	return 1
+}
+
+// writeReply copies v as JSON into the C buffer, truncating if needed.
+func writeReply(reply *C.char, size C.int, v interface{}) {
+	if size <= 0 {
+		return
+	}
+	data, _ := json.Marshal(v)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(reply)), int(size))
+	n := copy(buf[:len(buf)-1], data)
+	buf[n] = 0
+}
+
+// DeviceSupports reports whether a device's agent handles a command type.
+// Protocol 1 agents (or devices that never connected) are assumed to handle
+// the commands that existed before the hello.
+func DeviceSupports(deviceID string, cmdType int) bool {
+	var device models.Device
+	err := global.DB.Select("protocol_version", "commands").Where("device_id = ?", deviceID).First(&device).Error
+	commands := legacyCommands
+	if err == nil && device.ProtocolVersion >= 2 {
+		commands = models.SplitCommands(device.Commands)
+	}
+	for _, c := range commands {
+		if c == cmdType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Rate requests per second on average, with
+// bursts of up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps one bucket per client (device, console user or address)
+// and, for message types with their own limit, one per client and type.
+type RateLimiter struct {
+	mu        sync.Mutex
+	def       RateLimit
+	perType   map[int]RateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// Idle buckets are refilled anyway, so they can be dropped after a while.
+const bucketIdleTTL = 10 * time.Minute
+
+func NewRateLimiter(def RateLimit, perType map[int]RateLimit) *RateLimiter {
+	if perType == nil {
+		perType = make(map[int]RateLimit)
+	}
+	return &RateLimiter{
+		def:       def,
+		perType:   perType,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for client from the default bucket and, if msgType
+// has its own limit, from that bucket too. When either is empty nothing is
+// taken and the wait until the next token is returned.
+func (l *RateLimiter) Allow(client string, msgType int) (bool, time.Duration) {
+	return l.allowAt(client, msgType, time.Now())
+}
+
+func (l *RateLimiter) allowAt(client string, msgType int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	keys := []string{client}
+	limits := []RateLimit{l.def}
+	if limit, ok := l.perType[msgType]; ok {
+		keys = append(keys, fmt.Sprintf("%s/%#x", client, msgType))
+		limits = append(limits, limit)
+	}
+
+	var wait time.Duration
+	var taken []*bucket
+	for i, key := range keys {
+		if limits[i].Rate <= 0 {
+			continue // Unlimited
+		}
+		b := l.refill(key, limits[i], now)
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / limits[i].Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+			continue
+		}
+		taken = append(taken, b)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+	return true, 0
+}
+
+func (l *RateLimiter) refill(key string, limit RateLimit, now time.Time) *bucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	return b
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketIdleTTL {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
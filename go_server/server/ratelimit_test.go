@@ -0,0 +1,142 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// Each step asks for a request at some time after the start; the limiter
+// is fed those times instead of the clock.
+type rateStep struct {
+	at      time.Duration
+	client  string
+	msgType int
+	allowed bool
+	wait    time.Duration // When refused
+}
+
+func TestRateLimiter(t *testing.T) {
+	const s = time.Second
+	tests := []struct {
+		name    string
+		def     RateLimit
+		perType map[int]RateLimit
+		steps   []rateStep
+	}{
+		{
+			name: "burst then refused",
+			def:  RateLimit{Rate: 1, Burst: 3},
+			steps: []rateStep{
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, false, s},
+			},
+		},
+		{
+			name: "refill at rate",
+			def:  RateLimit{Rate: 2, Burst: 1},
+			steps: []rateStep{
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, false, s / 2},
+				{s / 4, "a", 0xA1, false, s / 4},
+				{s / 2, "a", 0xA1, true, 0},
+				{s / 2, "a", 0xA1, false, s / 2},
+			},
+		},
+		{
+			name: "refill stops at burst",
+			def:  RateLimit{Rate: 10, Burst: 2},
+			steps: []rateStep{
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{time.Minute, "a", 0xA1, true, 0},
+				{time.Minute, "a", 0xA1, true, 0},
+				{time.Minute, "a", 0xA1, false, s / 10},
+			},
+		},
+		{
+			name: "burst defaults to rate",
+			def:  RateLimit{Rate: 2.5},
+			steps: []rateStep{
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, false, 400 * time.Millisecond},
+			},
+		},
+		{
+			name: "clients are isolated",
+			def:  RateLimit{Rate: 1, Burst: 1},
+			steps: []rateStep{
+				{0, "device:a", 0xA1, true, 0},
+				{0, "device:a", 0xA1, false, s},
+				{0, "device:b", 0xA1, true, 0},
+				{0, "user:1", 0xA1, true, 0},
+				{0, "device:b", 0xA1, false, s},
+			},
+		},
+		{
+			name:    "type limit on top of the default",
+			def:     RateLimit{Rate: 10, Burst: 10},
+			perType: map[int]RateLimit{0xF3: {Rate: 1, Burst: 1}},
+			steps: []rateStep{
+				{0, "a", 0xF3, true, 0},
+				{0, "a", 0xF3, false, s},
+				{0, "a", 0xA1, true, 0},
+				{0, "b", 0xF3, true, 0},
+				{s, "a", 0xF3, true, 0},
+			},
+		},
+		{
+			name:    "refused type takes no default token",
+			def:     RateLimit{Rate: 1, Burst: 2},
+			perType: map[int]RateLimit{0xF3: {Rate: 1, Burst: 1}},
+			steps: []rateStep{
+				{0, "a", 0xF3, true, 0},
+				{0, "a", 0xF3, false, s},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, false, s},
+			},
+		},
+		{
+			name: "zero rate is unlimited",
+			def:  RateLimit{},
+			steps: []rateStep{
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+				{0, "a", 0xA1, true, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.def, tt.perType)
+			start := time.Now()
+			for i, step := range tt.steps {
+				ok, wait := l.allowAt(step.client, step.msgType, start.Add(step.at))
+				if ok != step.allowed {
+					t.Fatalf("step %d: allowed = %v, want %v", i, ok, step.allowed)
+				}
+				if !ok && (wait < step.wait-time.Millisecond || wait > step.wait+time.Millisecond) {
+					t.Fatalf("step %d: wait = %v, want %v", i, wait, step.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 1, Burst: 1}, nil)
+	start := time.Now()
+	l.allowAt("old", 0xA1, start)
+	l.allowAt("new", 0xA1, start.Add(bucketIdleTTL+time.Second))
+
+	if _, ok := l.buckets["old"]; ok {
+		t.Fatal("idle bucket was kept")
+	}
+	if _, ok := l.buckets["new"]; !ok {
+		t.Fatal("active bucket was dropped")
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"demo/network/go_server/app/models"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Handler serves one request and answers it with SendResponse.
+type Handler func(sock int, payload string)
+
+// Route declares a message type once: its name for logs, the response type
+// used for errors, who may call it, the payload schema and the handler.
+type Route struct {
+	Type       int
+	Name       string
+	RespType   int
+	Public     bool              // No session token needed
+	Device     bool              // Sent by an agent for its own device_id
+	Permission models.Permission // Console route: needs an admin session with this permission
+	Schema     Schema            // Checked before the handler; nil = not checked
+	Binary     bool              // Payload is a chunk frame: the handler gets its header, RequestData the bytes
+	Handler    Handler
+}
+
+// Routes by message type, filled by Register.
+var Routes = make(map[int]*Route)
+
+// Register adds routes and derives the name / access tables from them.
+func Register(routes ...Route) {
+	for i := range routes {
+		route := routes[i]
+		if _, dup := Routes[route.Type]; dup {
+			panic(fmt.Sprintf("route 0x%X registered twice", route.Type))
+		}
+		Routes[route.Type] = &route
+		MsgNames[route.Type] = route.Name
+		if route.Public {
+			PublicRoutes[route.Type] = true
+		}
+		if route.Device {
+			DeviceRoutes[route.Type] = true
+		}
+		if route.Permission != "" {
+			AdminRoutes[route.Type] = true
+			RoutePermissions[route.Type] = route.Permission
+		}
+	}
+}
+
+// Request is the state of one API request as it passes the middleware.
+type Request struct {
+	ID        string // Sent back in the response envelope and logged
+	Sock      int
+	Route     *Route
+	Payload   string
+	Data      string     // Raw bytes of a chunk frame (Binary routes)
+	Principal *Principal // Set by authorize (nil for public routes)
+	Status    int        // Set when a response is sent (0 = no response yet)
+	Code      string     // Envelope code of the response
+}
+
+// Middleware runs around the rest of the chain; it calls next to continue
+// or answers the request itself to stop it.
+type Middleware func(req *Request, next func(*Request))
+
+// middleware is the chain every routed request goes through, outermost
+// first. Use appends to it.
+var middleware = []Middleware{logRequests, auditRequests, recoverPanics, verifyPeer, authorize, throttle, validatePayload}
+
+// Use adds middleware that runs after the built-in checks, just before the
+// handler. Call before Start.
+func Use(mw ...Middleware) {
+	middleware = append(middleware, mw...)
+}
+
+var (
+	requestsMu sync.Mutex
+	requests   = make(map[int]*Request) // In-flight requests by socket
+)
+
+func currentRequest(sock int) *Request {
+	requestsMu.Lock()
+	defer requestsMu.Unlock()
+	return requests[sock]
+}
+
+func trackRequest(req *Request) {
+	requestsMu.Lock()
+	requests[req.Sock] = req
+	requestsMu.Unlock()
+}
+
+func untrackRequest(req *Request) {
+	requestsMu.Lock()
+	// The socket number may already be reused by a newer request
+	if requests[req.Sock] == req {
+		delete(requests, req.Sock)
+	}
+	requestsMu.Unlock()
+}
+
+// dispatch runs a request through the middleware chain to its handler.
+func dispatch(sock int, msgType int, payload string) {
+	route, ok := Routes[msgType]
+	if !ok {
+		fmt.Printf("[Go] No route for 0x%X\n", msgType)
+		SendError(sock, 0, 400, CodeUnknownRoute, "Route Not Found") // 0 type means generic error resp
+		return
+	}
+
+	req := &Request{ID: newRequestID(), Sock: sock, Route: route, Payload: payload}
+	trackRequest(req)
+	defer untrackRequest(req)
+
+	if route.Binary {
+		header, data, err := splitChunkFrame(payload)
+		if err != nil {
+			SendError(sock, route.RespType, 400, CodeInvalidPayload, "Invalid chunk frame")
+			return
+		}
+		req.Payload, req.Data = header, data
+	}
+
+	var next func(i int) func(*Request)
+	next = func(i int) func(*Request) {
+		if i == len(middleware) {
+			return func(r *Request) { r.Route.Handler(r.Sock, r.Payload) }
+		}
+		return func(r *Request) { middleware[i](r, next(i+1)) }
+	}
+	next(0)(req)
+}
+
+// recoverPanics keeps a failing controller from taking the process down.
+func recoverPanics(req *Request, next func(*Request)) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("[Go] %s Panic in %s: %v\n%s", req.ID, req.Route.Name, r, debug.Stack())
+			if req.Status == 0 {
+				SendError(req.Sock, req.Route.RespType, 500, CodeInternal, "Internal Server Error")
+			}
+		}
+	}()
+	next(req)
+}
+
+func logRequests(req *Request, next func(*Request)) {
+	start := time.Now()
+	next(req)
+
+	status := "no response"
+	if req.Status != 0 {
+		status = fmt.Sprintf("%d %s", req.Status, req.Code)
+	}
+	fmt.Printf("[Go] %s %s -> %s (%v)\n", req.ID, req.Route.Name, status, time.Since(start).Round(time.Microsecond))
+}
+
+// auditRequests records every request once it is answered, with the caller
+// authorize found (none for public routes or a rejected token).
+func auditRequests(req *Request, next func(*Request)) {
+	next(req)
+	if Audit != nil {
+		Audit(req)
+	}
+}
+
+func verifyPeer(req *Request, next func(*Request)) {
+	if checkPeerIdentity(req.Sock, req.Route.Type, req.Payload) {
+		next(req)
+	}
+}
+
+// authorize is the one place sessions and role permissions are checked.
+func authorize(req *Request, next func(*Request)) {
+	if Authenticate == nil || req.Route.Public {
+		next(req)
+		return
+	}
+
+	principal, ok := Authenticate(req.Sock, req.Route.Type, req.Payload)
+	if !ok {
+		return
+	}
+	req.Principal = principal // Also for the audit of a denied request
+
+	if perm := req.Route.Permission; perm != "" && !models.HasPermission(principal.Role, perm) {
+		fmt.Printf("[Auth] User %d (%s) denied %s\n", principal.UserID, principal.Role, req.Route.Name)
+		SendError(req.Sock, 0, 403, CodeForbidden, "Permission denied")
+		return
+	}
+
+	next(req)
+}
+
+func throttle(req *Request, next func(*Request)) {
+	if checkRateLimit(req.Sock, req.Route.Type, req.Principal) {
+		next(req)
+	}
+}
+
+func validatePayload(req *Request, next func(*Request)) {
+	if req.Route.Schema == nil {
+		next(req)
+		return
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(req.Payload), &fields); err != nil {
+		SendError(req.Sock, req.Route.RespType, 400, CodeInvalidPayload, "Invalid Payload")
+		return
+	}
+	if err := req.Route.Schema.Check(fields); err != nil {
+		SendError(req.Sock, req.Route.RespType, 400, CodeInvalidPayload, "Invalid Payload: "+err.Error())
+		return
+	}
+	next(req)
+}
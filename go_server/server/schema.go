@@ -0,0 +1,79 @@
+package server
+
+import "fmt"
+
+// Kind is the JSON type of a payload field.
+type Kind int
+
+const (
+	Any Kind = iota
+	String
+	Number
+	Bool
+	Array
+	Object
+)
+
+func (k Kind) String() string {
+	switch k {
+	case String:
+		return "a string"
+	case Number:
+		return "a number"
+	case Bool:
+		return "a boolean"
+	case Array:
+		return "an array"
+	case Object:
+		return "an object"
+	}
+	return "any value"
+}
+
+// Field is the rule for one payload field.
+type Field struct {
+	Kind     Kind
+	Required bool // Must be present and not null (strings not empty)
+}
+
+func Required(kind Kind) Field { return Field{Kind: kind, Required: true} }
+func Optional(kind Kind) Field { return Field{Kind: kind} }
+
+// Schema lists the payload fields a route checks. Fields not listed (such
+// as session_token) are left to the handler.
+type Schema map[string]Field
+
+// Check validates a decoded JSON object against the schema.
+func (s Schema) Check(fields map[string]interface{}) error {
+	for name, rule := range s {
+		value, present := fields[name]
+		if !present || value == nil {
+			if rule.Required {
+				return fmt.Errorf("%s is required", name)
+			}
+			continue
+		}
+
+		ok := true
+		switch rule.Kind {
+		case String:
+			str, isStr := value.(string)
+			ok = isStr && (str != "" || !rule.Required)
+		case Number:
+			_, ok = value.(float64)
+		case Bool:
+			_, ok = value.(bool)
+		case Array:
+			_, ok = value.([]interface{})
+		case Object:
+			_, ok = value.(map[string]interface{})
+		}
+		if !ok {
+			if rule.Kind == String && rule.Required {
+				return fmt.Errorf("%s must be a non-empty string", name)
+			}
+			return fmt.Errorf("%s must be %s", name, rule.Kind)
+		}
+	}
+	return nil
+}
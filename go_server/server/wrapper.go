@@ -2,13 +2,14 @@ package server
 
 /*
 #cgo CFLAGS: -I../../
-#cgo LDFLAGS: ${SRCDIR}/../../server_core.o ${SRCDIR}/../../protocol.o ${SRCDIR}/../../shim.o
+#cgo LDFLAGS: ${SRCDIR}/../../server_core.o ${SRCDIR}/../../protocol.o ${SRCDIR}/../../envelope.o ${SRCDIR}/../../shim.o -lssl -lcrypto
 #include <stdlib.h>
 #include "../../server/core.h"
 #include "../../server/shim.h"
 */
 import "C"
 import (
+	"demo/network/go_server/app/models"
 	"encoding/json"
 	"fmt"
 	"unsafe"
@@ -16,54 +17,127 @@ import (
 
 var GlobalCtx *C.ServerContext
 
-// Router Map: MsgType -> ControllerFunc
-var Router = make(map[int]func(sock int, payload string))
-
-// Define Message Names
-var MsgNames = map[int]string{
-	0xA1: "MSG_LOGIN_REQ",
-	0xB1: "MSG_LIST_REQ",
-	0xC1: "MSG_DEVICE_REQ",
-	0xD1: "MSG_ADMIN_COMMAND_GETLOGS_REQ",
-	0xD4: "MSG_CLIENT_COMMAND_GETLOG_REQ",
-	0xD6: "MSG_ADMIN_LOGIN_REQ",
-	0xD8: "MSG_ADMIN_GET_STORED_LOGS_REQ",
-	0xDA: "MSG_ADMIN_GET_COMMAND_HISTORY_REQ",
-	0xDB: "MSG_ADMIN_GET_COMMAND_HISTORY_RESP",
-	0xE1: "MSG_ADMIN_FIREWALL_CONTROL_REQ",
-	0xE4: "MSG_CLIENT_GET_FIREWALL_CONFIG_REQ",
-	0xE6: "MSG_CLIENT_FILE_SYNC_REQ",
-	0xE8: "MSG_ADMIN_GET_FILE_TREE_REQ",
-	0xF1: "MSG_BACKUP_INIT_REQ",
-	0xF3: "MSG_BACKUP_CHUNK_REQ",
-	0xF5: "MSG_BACKUP_FINISH_REQ",
-	0xF7: "MSG_BACKUP_CANCEL_REQ",
-	0xF8: "MSG_BACKUP_RESUME_REQ",
-	0x70: "MSG_ADMIN_RESTORE_REQ",
-	0x73: "MSG_RESTORE_INIT_REQ",
-	0x75: "MSG_RESTORE_CHUNK_REQ",
-	0x77: "MSG_RESTORE_FINISH_REQ",
+// Route tables by message type, derived from the routes passed to Register.
+var (
+	MsgNames     = make(map[int]string)
+	PublicRoutes = make(map[int]bool) // Can be called without a session token
+	AdminRoutes  = make(map[int]bool) // Require a session opened with MSG_ADMIN_LOGIN_REQ
+	// DeviceRoutes are requests sent by agents on behalf of a device_id.
+	// With TLS enabled these must come from a certificate issued to that device.
+	DeviceRoutes = make(map[int]bool)
+	// RoutePermissions is the permission a console session's role needs for
+	// each admin route (see models.RolePermissions).
+	RoutePermissions = make(map[int]models.Permission)
+)
+
+var tlsEnabled, requireClientCert bool
+
+// Principal is the authenticated session behind a request.
+type Principal struct {
+	SessionID uint
+	UserID    uint
+	DeviceID  string // Empty for admin sessions
+	IsAdmin   bool
+	Role      string
 }
 
-//export goRequestHandler
-func goRequestHandler(sock C.int, msgType C.int, payload *C.char) {
-	name, ok := MsgNames[int(msgType)]
-	if !ok {
-		name = fmt.Sprintf("UNKNOWN(0x%X)", int(msgType))
+// Authenticate is called for every non-public route before the controller.
+// It returns the caller, or false after sending an error response itself.
+// Left nil, requests are not authenticated.
+var Authenticate func(sock int, msgType int, payload string) (*Principal, bool)
+
+// Audit records every dispatched request once answered, allowed or not.
+var Audit func(req *Request)
+
+// CurrentPrincipal returns the session that made the request on sock
+// (nil for public routes).
+func CurrentPrincipal(sock int) *Principal {
+	if req := currentRequest(sock); req != nil {
+		return req.Principal
+	}
+	return nil
+}
+
+// DeviceCertRequired reports whether a device was issued a client
+// certificate. Such a device must present it even when certificates are
+// optional. Set in main.
+var DeviceCertRequired func(deviceID string) bool
+
+//export goCertRequired
+func goCertRequired(deviceID *C.char) C.int {
+	if DeviceCertRequired != nil && DeviceCertRequired(C.GoString(deviceID)) {
+		return 1
+	}
+	return 0
+}
+
+// checkPeerIdentity rejects device requests whose client certificate does not
+// match the device_id in the payload, and requests without a certificate for
+// a device that was issued one. Returns false if a response was sent.
+func checkPeerIdentity(sock int, msgType int, payload string) bool {
+	if !tlsEnabled || !DeviceRoutes[msgType] {
+		return true
+	}
+
+	var claim struct {
+		DeviceID string `json:"device_id"`
 	}
-	fmt.Printf("[Go] Received Request Type: %s\n", name)
+	json.Unmarshal([]byte(payload), &claim)
 
-	goStr := C.GoString(payload)
+	cn := PeerIdentity(sock)
+	if cn == "" {
+		if requireClientCert || (claim.DeviceID != "" && DeviceCertRequired != nil && DeviceCertRequired(claim.DeviceID)) {
+			SendError(sock, 0, 401, CodeUnauthenticated, "Client certificate required")
+			return false
+		}
+		return true
+	}
 
-	// Routing Logic
-	if handler, ok := Router[int(msgType)]; ok {
-		handler(int(sock), goStr)
-	} else {
-		// Default 400
-		msg := C.CString("{\"error\": \"Route Not Found\"}")
-		C.server_send_response(sock, 0, 400, msg) // 0 type means generic error resp
-		C.free(unsafe.Pointer(msg))
+	if claim.DeviceID != "" && claim.DeviceID != cn {
+		fmt.Printf("[TLS] Certificate %s tried to act as device %s\n", cn, claim.DeviceID)
+		SendError(sock, 0, 403, CodeForbidden, "Certificate does not match device")
+		return false
 	}
+	return true
+}
+
+// Limiter throttles requests per device / console user (per address for
+// public routes). Nil disables rate limiting.
+var Limiter *RateLimiter
+
+// checkRateLimit answers 429 with a retry hint when the caller is over its
+// limit. Returns false if a response was sent.
+func checkRateLimit(sock int, msgType int, principal *Principal) bool {
+	if Limiter == nil {
+		return true
+	}
+
+	var client string
+	switch {
+	case principal != nil && principal.DeviceID != "":
+		client = "device:" + principal.DeviceID
+	case principal != nil:
+		client = fmt.Sprintf("user:%d", principal.UserID)
+	default:
+		client = "ip:" + PeerIP(sock)
+	}
+
+	ok, wait := Limiter.Allow(client, msgType)
+	if !ok {
+		fmt.Printf("[RateLimit] %s over limit for 0x%X\n", client, msgType)
+		sendEnvelope(sock, 0, 429, Envelope{
+			Code:         CodeRateLimited,
+			Message:      "Too many requests",
+			RetryAfterMs: wait.Milliseconds() + 1,
+		})
+		return false
+	}
+	return true
+}
+
+//export goRequestHandler
+func goRequestHandler(sock C.int, msgType C.int, payload *C.char, length C.uint32_t) {
+	dispatch(int(sock), int(msgType), C.GoStringN(payload, C.int(length)))
 }
 
 //export goClientConnect
@@ -75,15 +149,111 @@ func goClientConnect(deviceID *C.char) {
 	ProcessCommandQueue(id)
 }
 
+//export goClientSeen
+func goClientSeen(deviceID *C.char, ip *C.char) {
+	if DeviceSeen != nil {
+		DeviceSeen(C.GoString(deviceID), C.GoString(ip))
+	}
+}
+
 func Init(port, apiPort int) {
 	GlobalCtx = C.server_init(C.int(port), C.int(apiPort))
 }
 
-func SetHandler(handler func(sock C.int, msgType C.int, payload *C.char)) {
+// EnableTLS switches both listeners to TLS. Must be called before Start.
+func EnableTLS(certFile, keyFile, caFile string, clientCertRequired bool) error {
+	cCert := C.CString(certFile)
+	cKey := C.CString(keyFile)
+	cCA := C.CString(caFile)
+	defer C.free(unsafe.Pointer(cCert))
+	defer C.free(unsafe.Pointer(cKey))
+	defer C.free(unsafe.Pointer(cCA))
+
+	require := 0
+	if clientCertRequired {
+		require = 1
+	}
+	if C.server_enable_tls(GlobalCtx, cCert, cKey, cCA, C.int(require)) != 1 {
+		return fmt.Errorf("failed to load TLS certificate %s / key %s", certFile, keyFile)
+	}
+	tlsEnabled = true
+	requireClientCert = clientCertRequired
+	return nil
+}
+
+// SetHeartbeat sets how often idle devices are pinged and after how long a
+// silent one is disconnected, in seconds (0 = default 30 / 90).
+func SetHeartbeat(intervalSeconds, timeoutSeconds int) {
+	C.server_set_heartbeat(GlobalCtx, C.int(intervalSeconds), C.int(timeoutSeconds))
+}
+
+// SetDuplicatePolicy decides what happens when a device ID that is already
+// connected connects again: "replace" (default) drops the older connection,
+// "reject" refuses the new one.
+func SetDuplicatePolicy(policy string) error {
+	switch policy {
+	case "", "replace":
+		C.server_set_duplicate_policy(GlobalCtx, C.DUPLICATE_REPLACE)
+	case "reject":
+		C.server_set_duplicate_policy(GlobalCtx, C.DUPLICATE_REJECT)
+	default:
+		return fmt.Errorf("unknown duplicate_policy %q (replace, reject)", policy)
+	}
+	return nil
+}
+
+// SetMaxMessageSize limits a single message on the notification channel, in
+// bytes (0 = default). Larger device messages drop the connection and larger
+// commands are not sent.
+func SetMaxMessageSize(size int) {
+	C.server_set_max_message_size(GlobalCtx, C.uint32_t(size))
+}
+
+// PeerIdentity returns the CN of the verified client certificate on sock, or "".
+func PeerIdentity(sock int) string {
+	var buf [64]C.char
+	if C.server_get_peer_identity(C.int(sock), &buf[0], C.int(len(buf))) != 1 {
+		return ""
+	}
+	return C.GoString(&buf[0])
+}
+
+// PeerIP returns the remote address of sock, or "".
+func PeerIP(sock int) string {
+	var buf [64]C.char
+	if C.server_get_peer_ip(C.int(sock), &buf[0], C.int(len(buf))) != 1 {
+		return ""
+	}
+	return C.GoString(&buf[0])
+}
+
+// Shutdown drains the server: new connections are refused, agents are told
+// to reconnect after reconnectAfterSeconds, and accepted requests get up to
+// graceSeconds to finish. Returns the number of requests still running.
+func Shutdown(graceSeconds, reconnectAfterSeconds int) int {
+	if GlobalCtx == nil {
+		return 0
+	}
+	return int(C.server_shutdown(GlobalCtx, C.int(graceSeconds), C.int(reconnectAfterSeconds)))
+}
+
+// SetLimits bounds API workers, queued API connections, notification
+// connections and the API request size (0 = default). Call before Start.
+func SetLimits(apiWorkers, apiQueue, maxConnections, maxRequestSize int) {
+	C.server_set_limits(GlobalCtx, C.int(apiWorkers), C.int(apiQueue), C.int(maxConnections), C.uint32_t(maxRequestSize))
+}
+
+func SetHandler(handler func(sock C.int, msgType C.int, payload *C.char, length C.uint32_t)) {
 	// Register Request Handler Shim
 	C.server_set_handler(GlobalCtx, C.RequestHandler(C.request_handler_shim))
 	// Register Connect Callback Shim
 	C.server_set_on_connect(GlobalCtx, C.ClientConnectCallback(C.client_connect_shim))
+	// Register Seen Callback Shim (last_seen_at / last_ip)
+	C.server_set_on_seen(GlobalCtx, C.ClientSeenCallback(C.client_seen_shim))
+	// Register Hello Callback Shim (agent version, refusing old agents)
+	C.server_set_on_hello(GlobalCtx, C.ClientHelloCallback(C.client_hello_shim))
+	// Register Certificate Callback Shim (devices issued a certificate)
+	C.server_set_cert_required(GlobalCtx, C.ClientCertCallback(C.cert_required_shim))
 }
 
 var GoRequestHandler = goRequestHandler // Export for reference? Not needed if Shim calls raw export.
@@ -108,13 +278,19 @@ func SendToDevice(deviceID string, msgType int, payload string) bool {
 	return res == 1
 }
 
+// SendResponse answers the request on sock. body becomes the envelope's
+// data; for an error status, its "error" text becomes the message.
 func SendResponse(sock int, msgType int, status int, body interface{}) {
-	bytes, _ := json.Marshal(body)
-	cArgs := C.CString(string(bytes))
-	defer C.free(unsafe.Pointer(cArgs))
+	if status >= 400 {
+		SendError(sock, msgType, status, codeForStatus(status), errorMessage(body))
+		return
+	}
+	sendEnvelope(sock, msgType, status, Envelope{Code: CodeOK, Data: encodeData(body)})
+}
 
-	// User said "message type representing each router".
-	// Let's assume response type is RequestType + 1 (simple convention) or passed in.
+func sendRaw(sock int, msgType int, status int, body string) {
+	cArgs := C.CString(body)
+	defer C.free(unsafe.Pointer(cArgs))
 	C.server_send_response(C.int(sock), C.int(msgType), C.int(status), cArgs)
 }
 
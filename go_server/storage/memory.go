@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps objects in memory. It is meant for tests and trying things
+// out: everything is gone when the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func (m *Memory) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("short object %s: %d of %d bytes", key, len(data), size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	object, ok := m.objects[key]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+
+	// Objects are never modified in place, so the slice can be shared
+	data := object.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) Stat(key string) (ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	m.mu.RLock()
+	object, ok := m.objects[key]
+	m.mu.RUnlock()
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) List(prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var objects []ObjectInfo
+	for key, object := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
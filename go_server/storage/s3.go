@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config points at a bucket of an S3-compatible object store (AWS S3,
+// MinIO, Ceph RGW, ...).
+type S3Config struct {
+	Endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://minio:9000"
+	Region    string // Used for signing; "us-east-1" if empty
+	Bucket    string
+	Prefix    string // Prepended to every key, e.g. "backups/"
+	AccessKey string
+	SecretKey string
+	PathStyle bool // endpoint/bucket/key instead of bucket.endpoint/key (MinIO)
+}
+
+// s3PartSize is the part size of multipart uploads; objects up to it go up
+// in one PUT.
+var s3PartSize int64 = 64 * 1024 * 1024
+
+const (
+	// unsignedPayload lets bodies be streamed without hashing them first;
+	// TLS protects them in transit.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA256 of ""
+)
+
+// S3 stores objects in a bucket, signing requests with AWS Signature
+// Version 4.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Minute}, now: time.Now}, nil
+}
+
+// url builds the address of key ("" for the bucket itself).
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	object := ""
+	if key != "" {
+		object = s.cfg.Prefix + key
+	}
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/" + object
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + object
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request; payloadHash is the hex SHA256 of the body
+// or unsignedPayload.
+func (s *S3) do(method string, u *url.URL, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if size == 0 {
+		body = nil // Else an empty body is sent chunked, which S3 refuses
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = size
+	s.sign(req, payloadHash, s.now())
+	return s.client.Do(req)
+}
+
+// sign adds the SigV4 Authorization header, signing every header set on
+// the request plus host.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, as
+// SigV4 wants; slashes are kept unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery is the query string sorted by name, encoded for SigV4.
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Error is the body of an S3 error response.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// check turns a non-2xx response into an error (ErrNotExist for 404) and
+// closes it.
+func check(resp *http.Response, method, key string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+	var apiErr s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(body, &apiErr) != nil || apiErr.Code == "" {
+		apiErr.Code, apiErr.Message = resp.Status, strings.TrimSpace(string(body))
+	}
+	return fmt.Errorf("s3 %s %s: %s (%s)", method, key, apiErr.Message, apiErr.Code)
+}
+
+func (s *S3) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if size > s3PartSize {
+		return s.putMultipart(key, r, size)
+	}
+	resp, err := s.do(http.MethodPut, s.url(key, nil), nil, io.LimitReader(r, size), size, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	if err := check(resp, "PUT", key); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads a large object in s3PartSize parts, streaming each
+// from r; a failed upload is aborted so its parts are not billed.
+func (s *S3) putMultipart(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPost, s.url(key, url.Values{"uploads": {""}}), nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	if err := check(resp, "POST", key); err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("s3 POST %s: no upload ID in response", key)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	err = func() error {
+		for offset, number := int64(0), 1; offset < size; offset, number = offset+s3PartSize, number+1 {
+			n := min(s3PartSize, size-offset)
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+			resp, err := s.do(http.MethodPut, s.url(key, query), nil, io.LimitReader(r, n), n, unsignedPayload)
+			if err != nil {
+				return err
+			}
+			if err := check(resp, "PUT", key); err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		}
+
+		complete, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		sum := sha256.Sum256(complete)
+		resp, err := s.do(http.MethodPost, s.url(key, url.Values{"uploadId": {initiated.UploadID}}), nil,
+			bytes.NewReader(complete), int64(len(complete)), hex.EncodeToString(sum[:]))
+		if err != nil {
+			return err
+		}
+		if err := check(resp, "POST", key); err != nil {
+			return err
+		}
+		// A 200 can still carry an error once the parts are assembled
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		var apiErr s3Error
+		if xml.Unmarshal(body, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("s3 POST %s: %s (%s)", key, apiErr.Message, apiErr.Code)
+		}
+		return nil
+	}()
+	if err != nil {
+		if resp, aerr := s.do(http.MethodDelete, s.url(key, url.Values{"uploadId": {initiated.UploadID}}), nil, nil, 0, emptyPayload); aerr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+func (s *S3) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(http.MethodGet, s.url(key, nil), header, nil, 0, emptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil // Offset at or past the end
+	}
+	if err := check(resp, "GET", key); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(key string) (ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.do(http.MethodHead, s.url(key, nil), nil, nil, 0, emptyPayload)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := check(resp, "HEAD", key); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.url(key, nil), nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	if err := check(resp, "DELETE", key); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, s.url("", query), nil, nil, 0, emptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(resp, "GET", "?list-type=2"); err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %v", prefix, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: strings.TrimPrefix(c.Key, s.cfg.Prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,121 @@
+// Package storage keeps backup data (whole-file snapshots and chunks) behind
+// a Backend, so it can live on the local disk, in an S3-compatible object
+// store, or in memory for tests. Snapshot and chunk rows record the backend
+// they were written to by name, which lets old data move to cheaper storage
+// without the agents noticing.
+//
+// Keys are slash-separated relative paths, e.g. "dev-1/<uuid>/v3/report.pdf"
+// or "chunks/ab/abcdef...".
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned (wrapped) for a key that is not stored.
+var ErrNotExist = errors.New("object does not exist")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Backend stores objects by key. Implementations are safe for concurrent
+// use.
+type Backend interface {
+	// Put stores size bytes read from r under key, replacing any object
+	// there. The object only appears once complete.
+	Put(key string, r io.Reader, size int64) error
+	// GetRange reads length bytes of key from offset (length < 0: to the
+	// end). Fewer bytes come back if the object is shorter. The caller
+	// closes the reader.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	// Delete removes key; a key that is not stored is not an error.
+	Delete(key string) error
+	// List returns the objects whose key starts with prefix, by key.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// fileMover is implemented by backends that can take a local file without
+// copying it (the local backend renames it).
+type fileMover interface {
+	MoveFile(key, path string) error
+}
+
+// MoveFile stores the local file at path under key and removes the file.
+func MoveFile(b Backend, key, path string) error {
+	if m, ok := b.(fileMover); ok {
+		return m.MoveFile(key, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = b.Put(key, f, info.Size())
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ValidKey accepts relative slash-separated keys without empty, "." or ".."
+// segments, so a key can never leave a backend's root.
+func ValidKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func checkKey(key string) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	return nil
+}
+
+// Backends are the configured backends by name. New data goes to the
+// active one; existing data is read from whichever its row names.
+type Backends struct {
+	active   string
+	backends map[string]Backend
+}
+
+func NewBackends(active string, backends map[string]Backend) (*Backends, error) {
+	if backends[active] == nil {
+		return nil, fmt.Errorf("storage backend %q is not configured", active)
+	}
+	return &Backends{active: active, backends: backends}, nil
+}
+
+// Active returns the backend new data is written to, and its name.
+func (b *Backends) Active() (string, Backend) {
+	return b.active, b.backends[b.active]
+}
+
+// Get returns a backend by name.
+func (b *Backends) Get(name string) (Backend, error) {
+	backend := b.backends[name]
+	if backend == nil {
+		return nil, fmt.Errorf("storage backend %q is not configured", name)
+	}
+	return backend, nil
+}
@@ -0,0 +1,214 @@
+#include "envelope.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <openssl/rand.h>
+
+#define MAX_DEPTH 64
+
+void envelope_new_id(char out[ENVELOPE_ID_SIZE]) {
+    unsigned char raw[(ENVELOPE_ID_SIZE - 1) / 2];
+    if (RAND_bytes(raw, sizeof(raw)) != 1) {
+        for (size_t i = 0; i < sizeof(raw); i++) raw[i] = (unsigned char)rand();
+    }
+    for (size_t i = 0; i < sizeof(raw); i++) {
+        sprintf(out + i * 2, "%02x", raw[i]);
+    }
+}
+
+int envelope_escape(char *out, size_t size, const char *in) {
+    size_t n = 0;
+    for (; *in; in++) {
+        unsigned char c = (unsigned char)*in;
+        char tmp[8];
+        const char *piece = tmp;
+
+        switch (c) {
+        case '"':  piece = "\\\""; break;
+        case '\\': piece = "\\\\"; break;
+        case '\n': piece = "\\n"; break;
+        case '\r': piece = "\\r"; break;
+        case '\t': piece = "\\t"; break;
+        default:
+            if (c < 0x20) {
+                snprintf(tmp, sizeof(tmp), "\\u%04x", c);
+            } else {
+                tmp[0] = (char)c;
+                tmp[1] = '\0';
+            }
+        }
+
+        size_t len = strlen(piece);
+        if (n + len >= size) return -1;
+        memcpy(out + n, piece, len);
+        n += len;
+    }
+    if (n >= size) return -1;
+    out[n] = '\0';
+    return (int)n;
+}
+
+int envelope_format(char *out, size_t size, const char *request_id, const char *code, const char *message, const char *data) {
+    char escaped[ENVELOPE_MESSAGE_SIZE * 2];
+    if (envelope_escape(escaped, sizeof(escaped), message ? message : "") < 0) {
+        escaped[0] = '\0';
+    }
+
+    int n = snprintf(out, size, "{\"request_id\":\"%s\",\"code\":\"%s\",\"message\":\"%s\"%s%s}",
+                     request_id, code, escaped, data ? ",\"data\":" : "", data ? data : "");
+    return (n < 0 || (size_t)n >= size) ? -1 : n;
+}
+
+static const char *_skip_ws(const char *p) {
+    while (*p == ' ' || *p == '\t' || *p == '\n' || *p == '\r') p++;
+    return p;
+}
+
+// Decode the JSON string at p into out (NULL to just skip it). Returns the
+// position after the closing quote, or NULL if malformed.
+static const char *_parse_string(const char *p, char *out, size_t size) {
+    size_t n = 0;
+
+    if (*p != '"') return NULL;
+    p++;
+    while (*p && *p != '"') {
+        char c = *p++;
+        if (c == '\\') {
+            c = *p++;
+            switch (c) {
+            case 'n': c = '\n'; break;
+            case 'r': c = '\r'; break;
+            case 't': c = '\t'; break;
+            case 'b': c = '\b'; break;
+            case 'f': c = '\f'; break;
+            case '"': case '\\': case '/': break;
+            case 'u': {
+                unsigned v = 0;
+                for (int i = 0; i < 4; i++) {
+                    unsigned char h = (unsigned char)p[i];
+                    if (!isxdigit(h)) return NULL;
+                    v = v * 16 + (isdigit(h) ? h - '0' : tolower(h) - 'a' + 10);
+                }
+                c = v < 0x80 ? (char)v : '?'; // Messages are ASCII; no UTF-8 re-encoding
+                p += 4;
+                break;
+            }
+            default:
+                return NULL;
+            }
+        }
+        if (out && n + 1 < size) out[n++] = c;
+    }
+    if (*p != '"') return NULL;
+    if (out && size > 0) out[n] = '\0';
+    return p + 1;
+}
+
+// Skip one JSON value. Returns the position after it, or NULL if malformed.
+static const char *_skip_value(const char *p, int depth) {
+    if (depth > MAX_DEPTH) return NULL;
+    p = _skip_ws(p);
+
+    if (*p == '"') return _parse_string(p, NULL, 0);
+
+    if (*p == '{' || *p == '[') {
+        char close = (*p == '{') ? '}' : ']';
+        p = _skip_ws(p + 1);
+        if (*p == close) return p + 1;
+        for (;;) {
+            if (close == '}') {
+                p = _parse_string(p, NULL, 0);
+                if (!p) return NULL;
+                p = _skip_ws(p);
+                if (*p != ':') return NULL;
+                p++;
+            }
+            p = _skip_value(p, depth + 1);
+            if (!p) return NULL;
+            p = _skip_ws(p);
+            if (*p == close) return p + 1;
+            if (*p != ',') return NULL;
+            p = _skip_ws(p + 1);
+        }
+    }
+
+    // Number, true, false or null
+    const char *start = p;
+    while (isalnum((unsigned char)*p) || *p == '-' || *p == '+' || *p == '.') p++;
+    return p > start ? p : NULL;
+}
+
+int json_get_string(const char *body, const char *key, char *out, size_t size) {
+    const char *p = _skip_ws(body);
+    if (*p != '{') return 0;
+    p = _skip_ws(p + 1);
+
+    while (*p != '}') {
+        char name[64];
+        p = _parse_string(p, name, sizeof(name));
+        if (!p) return 0;
+        p = _skip_ws(p);
+        if (*p != ':') return 0;
+        const char *value = _skip_ws(p + 1);
+        p = _skip_value(value, 0);
+        if (!p) return 0;
+
+        if (*value == '"' && strcmp(name, key) == 0) {
+            return _parse_string(value, out, size) != NULL;
+        }
+
+        p = _skip_ws(p);
+        if (*p == ',') {
+            p = _skip_ws(p + 1);
+        } else if (*p != '}') {
+            return 0;
+        }
+    }
+    return 0;
+}
+
+int envelope_parse(const char *body, envelope_t *env) {
+    int has_code = 0;
+
+    memset(env, 0, sizeof(*env));
+    const char *p = _skip_ws(body);
+    if (*p != '{') return 0;
+    p = _skip_ws(p + 1);
+
+    while (*p != '}') {
+        char key[32];
+        p = _parse_string(p, key, sizeof(key));
+        if (!p) goto invalid;
+        p = _skip_ws(p);
+        if (*p != ':') goto invalid;
+        const char *value = _skip_ws(p + 1);
+        p = _skip_value(value, 0);
+        if (!p) goto invalid;
+
+        if (*value == '"' && strcmp(key, "request_id") == 0) {
+            _parse_string(value, env->request_id, sizeof(env->request_id));
+        } else if (*value == '"' && strcmp(key, "code") == 0) {
+            has_code = _parse_string(value, env->code, sizeof(env->code)) != NULL;
+        } else if (*value == '"' && strcmp(key, "message") == 0) {
+            _parse_string(value, env->message, sizeof(env->message));
+        } else if (strcmp(key, "retry_after_ms") == 0) {
+            env->retry_after_ms = strtol(value, NULL, 10);
+        } else if (strcmp(key, "data") == 0 && strncmp(value, "null", 4) != 0) {
+            env->data = value;
+            env->data_len = (size_t)(p - value);
+        }
+
+        p = _skip_ws(p);
+        if (*p == ',') {
+            p = _skip_ws(p + 1);
+        } else if (*p != '}') {
+            goto invalid;
+        }
+    }
+    if (has_code) return 1;
+
+invalid:
+    memset(env, 0, sizeof(*env));
+    return 0;
+}
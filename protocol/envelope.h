@@ -0,0 +1,43 @@
+#ifndef ENVELOPE_H
+#define ENVELOPE_H
+
+#include <stddef.h>
+
+// Every API response body is an envelope:
+//   {"request_id": "...", "code": "OK", "message": "...", "retry_after_ms": 0, "data": {...}}
+// code is "OK" on success or a machine-readable error such as "NOT_FOUND";
+// message is for humans; data is the route's payload and may be absent.
+
+#define ENVELOPE_ID_SIZE 17 // 16 hex chars + NUL
+#define ENVELOPE_CODE_SIZE 32
+#define ENVELOPE_MESSAGE_SIZE 256
+
+typedef struct {
+    char request_id[ENVELOPE_ID_SIZE];
+    char code[ENVELOPE_CODE_SIZE];
+    char message[ENVELOPE_MESSAGE_SIZE];
+    long retry_after_ms;
+    const char *data; // Raw JSON inside the parsed body (NULL if absent)
+    size_t data_len;
+} envelope_t;
+
+// Generate a random request ID
+void envelope_new_id(char out[ENVELOPE_ID_SIZE]);
+
+// Write an envelope; message and data may be NULL. Returns the length, or
+// -1 if it does not fit.
+int envelope_format(char *out, size_t size, const char *request_id, const char *code, const char *message, const char *data);
+
+// Parse a response body. Returns 0 if it is not an envelope (e.g. an older
+// server), with env cleared.
+int envelope_parse(const char *body, envelope_t *env);
+
+// Copy the top-level string field key of a JSON object into out. Returns 1
+// if found, 0 if absent, not a string or the body is not an object.
+int json_get_string(const char *body, const char *key, char *out, size_t size);
+
+// Escape a string for use inside JSON quotes. Returns the length, or -1 if
+// it does not fit.
+int envelope_escape(char *out, size_t size, const char *in);
+
+#endif
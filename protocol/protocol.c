@@ -1,4 +1,13 @@
 #include "protocol.h"
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <poll.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <time.h>
+#include <openssl/err.h>
+#include <openssl/x509.h>
 
 // Helper to send packet
 void send_packet(int sock, void *data, uint16_t len) {
@@ -6,31 +15,550 @@ void send_packet(int sock, void *data, uint16_t len) {
     header.type = MSG_SOCKET;
     header.len = htons(len);
 
-    write(sock, &header, sizeof(header));
-    write(sock, data, len);
+    proto_write(sock, &header, sizeof(header));
+    proto_write(sock, data, len);
 }
 
 // Helper to recv packet
 int recv_packet(int sock, char *buffer) {
-    proto_header_t header;
-    if (recv(sock, &header, sizeof(header), 0) <= 0) return -1;
-    
-    // if (header.type != MSG_SOCKET && header.type != MSG_SERVER_COMMAND_GETLOG && header.type != MSG_SERVER_FIREWALL_UPDATE_CMD) {
-    //     printf("Invalid packet type: 0x%02X\n", header.type);
-    //     // For now, return -1. Or should we allow it?
-    //     // Let's allow it if we want generic handling
-    //     // return -1;
-    // }
-
-    uint16_t len = ntohs(header.len);
-    if (len > BUFFER_SIZE) len = BUFFER_SIZE; // Cap to buffer
+    return recv_packet_type(sock, buffer, NULL);
+}
+
+int proto_recv_header(int sock, uint8_t *type, uint32_t *len) {
+    uint8_t first;
+    if (proto_read_full(sock, &first, 1) <= 0) return -1;
+
+    if (first == PROTOCOL_MAGIC_EXT) {
+        uint8_t ext_type;
+        uint32_t ext_len;
+        if (proto_read_full(sock, &ext_type, 1) <= 0) return -1;
+        if (proto_read_full(sock, &ext_len, sizeof(ext_len)) <= 0) return -1;
+        *type = ext_type;
+        *len = ntohl(ext_len);
+    } else {
+        uint16_t std_len;
+        if (proto_read_full(sock, &std_len, sizeof(std_len)) <= 0) return -1;
+        *type = first;
+        *len = ntohs(std_len);
+    }
+    return 0;
+}
+
+int proto_discard(int sock, uint32_t len) {
+    char scratch[BUFFER_SIZE];
+    while (len > 0) {
+        size_t chunk = len < sizeof(scratch) ? len : sizeof(scratch);
+        ssize_t r = proto_read(sock, scratch, chunk);
+        if (r <= 0) return -1;
+        len -= (uint32_t)r;
+    }
+    return 0;
+}
+
+int recv_packet_type(int sock, char *buffer, uint8_t *type) {
+    uint8_t t;
+    uint32_t len;
+    if (proto_recv_header(sock, &t, &len) < 0) return -1;
+    if (type) *type = t;
+
+    // Cap to buffer, but consume the rest so the next header is read in sync
+    uint32_t keep = len > BUFFER_SIZE ? BUFFER_SIZE : len;
 
     int total_read = 0;
-    while (total_read < len) {
-        int r = recv(sock, buffer + total_read, len - total_read, 0);
+    while (total_read < (int)keep) {
+        int r = proto_read(sock, buffer + total_read, keep - total_read);
         if (r <= 0) return -1;
         total_read += r;
     }
     buffer[total_read] = '\0';
+
+    if (len > keep && proto_discard(sock, len - keep) < 0) return -1;
     return total_read;
 }
+
+char *chunk_frame_build(const char *header, const void *data, uint32_t data_len, uint32_t *frame_len) {
+    uint32_t header_len = (uint32_t)strlen(header);
+    char *frame = malloc(sizeof(uint32_t) + header_len + data_len);
+    if (!frame) return NULL;
+
+    uint32_t n = htonl(header_len);
+    memcpy(frame, &n, sizeof(n));
+    memcpy(frame + sizeof(n), header, header_len);
+    if (data_len > 0) memcpy(frame + sizeof(n) + header_len, data, data_len);
+    *frame_len = sizeof(n) + header_len + data_len;
+    return frame;
+}
+
+int chunk_frame_parse(const char *frame, uint32_t frame_len, char *header_buf, size_t header_size, const char **data, uint32_t *data_len) {
+    uint32_t header_len;
+
+    if (frame_len < sizeof(header_len)) return -1;
+    memcpy(&header_len, frame, sizeof(header_len));
+    header_len = ntohl(header_len);
+    if (header_len > CHUNK_FRAME_MAX_HEADER || header_len >= header_size || header_len > frame_len - sizeof(header_len)) {
+        return -1;
+    }
+
+    memcpy(header_buf, frame + sizeof(header_len), header_len);
+    header_buf[header_len] = '\0';
+    *data = frame + sizeof(header_len) + header_len;
+    *data_len = frame_len - sizeof(header_len) - header_len;
+    return 0;
+}
+
+int send_message(int sock, uint8_t type, const void *data, uint32_t len) {
+    if (len > 0xFFFF) {
+        api_req_header_ext_t header;
+        header.magic = PROTOCOL_MAGIC_EXT;
+        header.type = type;
+        header.len = htonl(len);
+        if (proto_write(sock, &header, sizeof(header)) < 0) return -1;
+    } else {
+        proto_header_t header;
+        header.type = type;
+        header.len = htons((uint16_t)len);
+        if (proto_write(sock, &header, sizeof(header)) < 0) return -1;
+    }
+    if (len > 0 && proto_write(sock, data, len) < 0) return -1;
+    return 0;
+}
+
+int recv_message(int sock, uint8_t *type, char **out, uint32_t max_len) {
+    uint32_t len;
+    *out = NULL;
+    if (proto_recv_header(sock, type, &len) < 0) return -1;
+
+    if (len > max_len) {
+        printf("[Protocol] Message of %u bytes exceeds limit of %u\n", len, max_len);
+        return -2;
+    }
+
+    char *buffer = malloc((size_t)len + 1);
+    if (!buffer) return -1;
+    if (len > 0 && proto_read_full(sock, buffer, len) <= 0) {
+        free(buffer);
+        return -1;
+    }
+    buffer[len] = '\0';
+    *out = buffer;
+    return (int)len;
+}
+
+// --- Transport ---
+
+#define PROTO_MAX_FDS 65536
+
+// Longest a TLS wait sleeps before trying the SSL object again (see _proto_tls_wait)
+#define PROTO_TLS_POLL_MS 200
+
+// A TLS connection. Its socket is non-blocking once the handshake is done so
+// that no thread sleeps inside OpenSSL: each SSL_* call runs under io_lock
+// and returns straight away, and waiting for the socket happens unlocked.
+// One thread can then read while others write, without two calls ever
+// running on the same SSL object at once.
+//
+// Threads using a connection hold a reference (see _proto_conn), as does
+// the table. proto_close only drops the table's; the last reference frees
+// the SSL object and closes the socket, so neither goes away under a
+// thread still reading or writing.
+typedef struct {
+    SSL *ssl;
+    int sock;
+    pthread_mutex_t io_lock;
+    int closed; // Set by proto_close; guarded by io_lock
+    int refs;   // Guarded by conn_table_lock
+    char peer_cn[64];
+} proto_conn_t;
+
+// Indexed by socket fd; NULL means plain TCP
+static proto_conn_t *conn_table[PROTO_MAX_FDS];
+static pthread_mutex_t conn_table_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_once_t tls_init_once = PTHREAD_ONCE_INIT;
+
+static void _proto_tls_init(void) {
+    OPENSSL_init_ssl(0, NULL);
+}
+
+// The TLS connection on sock, with a reference the caller drops with
+// _proto_conn_put. NULL means plain TCP (or already closed).
+static proto_conn_t *_proto_conn(int sock) {
+    if (sock < 0 || sock >= PROTO_MAX_FDS) return NULL;
+    pthread_mutex_lock(&conn_table_lock);
+    proto_conn_t *conn = conn_table[sock];
+    if (conn) conn->refs++;
+    pthread_mutex_unlock(&conn_table_lock);
+    return conn;
+}
+
+static void _proto_conn_put(proto_conn_t *conn) {
+    if (!conn) return;
+    pthread_mutex_lock(&conn_table_lock);
+    int last = --conn->refs == 0;
+    pthread_mutex_unlock(&conn_table_lock);
+    if (!last) return;
+
+    SSL_free(conn->ssl);
+    pthread_mutex_destroy(&conn->io_lock);
+    close(conn->sock);
+    free(conn);
+}
+
+static void _proto_print_tls_error(const char *where) {
+    unsigned long err = ERR_get_error();
+    char msg[256];
+    if (err) {
+        ERR_error_string_n(err, msg, sizeof(msg));
+        fprintf(stderr, "[TLS] %s: %s\n", where, msg);
+    } else {
+        fprintf(stderr, "[TLS] %s failed\n", where);
+    }
+}
+
+static int _proto_load_identity(SSL_CTX *tls, const char *cert_file, const char *key_file) {
+    if (SSL_CTX_use_certificate_chain_file(tls, cert_file) != 1) {
+        _proto_print_tls_error("load certificate");
+        return 0;
+    }
+    if (SSL_CTX_use_PrivateKey_file(tls, key_file, SSL_FILETYPE_PEM) != 1) {
+        _proto_print_tls_error("load private key");
+        return 0;
+    }
+    if (SSL_CTX_check_private_key(tls) != 1) {
+        _proto_print_tls_error("check private key");
+        return 0;
+    }
+    return 1;
+}
+
+SSL_CTX *proto_tls_server_ctx(const char *cert_file, const char *key_file, const char *ca_file, int require_client_cert) {
+    pthread_once(&tls_init_once, _proto_tls_init);
+
+    SSL_CTX *tls = SSL_CTX_new(TLS_server_method());
+    if (!tls) {
+        _proto_print_tls_error("create server context");
+        return NULL;
+    }
+    SSL_CTX_set_min_proto_version(tls, TLS1_2_VERSION);
+
+    if (!_proto_load_identity(tls, cert_file, key_file)) {
+        SSL_CTX_free(tls);
+        return NULL;
+    }
+
+    if (ca_file && ca_file[0]) {
+        if (SSL_CTX_load_verify_locations(tls, ca_file, NULL) != 1) {
+            _proto_print_tls_error("load CA");
+            SSL_CTX_free(tls);
+            return NULL;
+        }
+        // Always ask for a client certificate. Devices that are not enrolled yet
+        // have none, so it is only mandatory when explicitly required.
+        int mode = SSL_VERIFY_PEER;
+        if (require_client_cert) mode |= SSL_VERIFY_FAIL_IF_NO_PEER_CERT;
+        SSL_CTX_set_verify(tls, mode, NULL);
+    }
+    return tls;
+}
+
+SSL_CTX *proto_tls_client_ctx(const char *ca_file, const char *cert_file, const char *key_file) {
+    pthread_once(&tls_init_once, _proto_tls_init);
+
+    SSL_CTX *tls = SSL_CTX_new(TLS_client_method());
+    if (!tls) {
+        _proto_print_tls_error("create client context");
+        return NULL;
+    }
+    SSL_CTX_set_min_proto_version(tls, TLS1_2_VERSION);
+
+    if (ca_file && ca_file[0]) {
+        if (SSL_CTX_load_verify_locations(tls, ca_file, NULL) != 1) {
+            _proto_print_tls_error("load CA");
+            SSL_CTX_free(tls);
+            return NULL;
+        }
+    }
+    SSL_CTX_set_verify(tls, SSL_VERIFY_PEER, NULL);
+
+    if (cert_file && cert_file[0] && key_file && key_file[0]) {
+        if (!_proto_load_identity(tls, cert_file, key_file)) {
+            SSL_CTX_free(tls);
+            return NULL;
+        }
+    }
+    return tls;
+}
+
+static int _proto_attach(int sock, SSL *ssl) {
+    if (sock < 0 || sock >= PROTO_MAX_FDS) return -1;
+
+    int flags = fcntl(sock, F_GETFL, 0);
+    if (flags < 0 || fcntl(sock, F_SETFL, flags | O_NONBLOCK) < 0) return -1;
+
+    proto_conn_t *conn = calloc(1, sizeof(proto_conn_t));
+    if (!conn) return -1;
+    conn->ssl = ssl;
+    conn->sock = sock;
+    conn->refs = 1; // The table's
+    pthread_mutex_init(&conn->io_lock, NULL);
+
+    X509 *peer = SSL_get1_peer_certificate(ssl);
+    if (peer) {
+        if (SSL_get_verify_result(ssl) == X509_V_OK) {
+            X509_NAME_get_text_by_NID(X509_get_subject_name(peer), NID_commonName,
+                                      conn->peer_cn, sizeof(conn->peer_cn));
+        }
+        X509_free(peer);
+    }
+
+    pthread_mutex_lock(&conn_table_lock);
+    conn_table[sock] = conn;
+    pthread_mutex_unlock(&conn_table_lock);
+    return 0;
+}
+
+int proto_tls_accept(SSL_CTX *tls, int sock) {
+    SSL *ssl = SSL_new(tls);
+    if (!ssl) return -1;
+    SSL_set_fd(ssl, sock);
+
+    if (SSL_accept(ssl) != 1) {
+        _proto_print_tls_error("handshake (accept)");
+        SSL_free(ssl);
+        return -1;
+    }
+    if (_proto_attach(sock, ssl) < 0) {
+        SSL_free(ssl);
+        return -1;
+    }
+    return 0;
+}
+
+int proto_tls_connect(SSL_CTX *tls, int sock, const char *server_name) {
+    SSL *ssl = SSL_new(tls);
+    if (!ssl) return -1;
+    SSL_set_fd(ssl, sock);
+
+    if (server_name && server_name[0]) {
+        SSL_set_tlsext_host_name(ssl, server_name);
+        SSL_set1_host(ssl, server_name);
+    }
+
+    if (SSL_connect(ssl) != 1) {
+        _proto_print_tls_error("handshake (connect)");
+        SSL_free(ssl);
+        return -1;
+    }
+    if (_proto_attach(sock, ssl) < 0) {
+        SSL_free(ssl);
+        return -1;
+    }
+    return 0;
+}
+
+int proto_peer_cn(int sock, char *buffer, size_t size) {
+    proto_conn_t *conn = _proto_conn(sock);
+    if (!conn || conn->peer_cn[0] == '\0' || size == 0) {
+        if (size > 0) buffer[0] = '\0';
+        _proto_conn_put(conn);
+        return 0;
+    }
+    strncpy(buffer, conn->peer_cn, size - 1);
+    buffer[size - 1] = '\0';
+    _proto_conn_put(conn);
+    return 1;
+}
+
+// The socket's SO_RCVTIMEO or SO_SNDTIMEO (optname) as a deadline from now.
+// TLS sockets are non-blocking, so _proto_tls_wait applies the timeout the
+// kernel would have. Returns 0 if none is set.
+static int _proto_deadline(int sock, int optname, struct timespec *deadline) {
+    struct timeval tv;
+    socklen_t tv_len = sizeof(tv);
+
+    if (getsockopt(sock, SOL_SOCKET, optname, &tv, &tv_len) < 0) return 0;
+    if (tv.tv_sec == 0 && tv.tv_usec == 0) return 0;
+
+    clock_gettime(CLOCK_MONOTONIC, deadline);
+    deadline->tv_sec += tv.tv_sec;
+    deadline->tv_nsec += (long)tv.tv_usec * 1000;
+    if (deadline->tv_nsec >= 1000000000L) {
+        deadline->tv_sec++;
+        deadline->tv_nsec -= 1000000000L;
+    }
+    return 1;
+}
+
+// Wait for the socket after an SSL call failed with err, outside io_lock.
+// Another thread's SSL call can take our record off the socket into the SSL
+// buffer, so the wait is sliced and the caller tries again after each slice.
+// Returns 0 to retry, -1 on a real error or when deadline (may be NULL) passed.
+static int _proto_tls_wait(int sock, int err, const struct timespec *deadline) {
+    if (err != SSL_ERROR_WANT_READ && err != SSL_ERROR_WANT_WRITE) return -1;
+
+    int timeout_ms = PROTO_TLS_POLL_MS;
+    if (deadline) {
+        struct timespec now;
+        clock_gettime(CLOCK_MONOTONIC, &now);
+        long left_ms = (deadline->tv_sec - now.tv_sec) * 1000 + (deadline->tv_nsec - now.tv_nsec) / 1000000;
+        if (left_ms <= 0) {
+            errno = EAGAIN;
+            return -1;
+        }
+        if (left_ms < timeout_ms) timeout_ms = (int)left_ms;
+    }
+
+    struct pollfd pfd;
+    pfd.fd = sock;
+    pfd.events = err == SSL_ERROR_WANT_READ ? POLLIN : POLLOUT;
+    pfd.revents = 0;
+    if (poll(&pfd, 1, timeout_ms) < 0 && errno != EINTR) return -1;
+    return 0;
+}
+
+ssize_t proto_read(int sock, void *buffer, size_t len) {
+    proto_conn_t *conn = _proto_conn(sock);
+    if (!conn) return recv(sock, buffer, len, 0);
+
+    struct timespec deadline;
+    int has_deadline = _proto_deadline(sock, SO_RCVTIMEO, &deadline);
+
+    ssize_t result;
+    for (;;) {
+        pthread_mutex_lock(&conn->io_lock);
+        int r = -1, err = SSL_ERROR_SSL;
+        if (!conn->closed) {
+            r = SSL_read(conn->ssl, buffer, (int)len);
+            err = r > 0 ? SSL_ERROR_NONE : SSL_get_error(conn->ssl, r);
+        }
+        pthread_mutex_unlock(&conn->io_lock);
+
+        if (r > 0) {
+            result = r;
+            break;
+        }
+        if (err == SSL_ERROR_ZERO_RETURN) {
+            result = 0;
+            break;
+        }
+        if (_proto_tls_wait(sock, err, has_deadline ? &deadline : NULL) < 0) {
+            result = -1;
+            break;
+        }
+    }
+    _proto_conn_put(conn);
+    return result;
+}
+
+ssize_t proto_write(int sock, const void *buffer, size_t len) {
+    proto_conn_t *conn = _proto_conn(sock);
+    size_t total_written = 0;
+    struct timespec deadline;
+    int has_deadline = conn ? _proto_deadline(sock, SO_SNDTIMEO, &deadline) : 0;
+
+    while (total_written < len) {
+        ssize_t n;
+        if (conn) {
+            // A retry after WANT_READ/WANT_WRITE repeats the same arguments, as OpenSSL requires
+            pthread_mutex_lock(&conn->io_lock);
+            n = -1;
+            int err = SSL_ERROR_SSL;
+            if (!conn->closed) {
+                n = SSL_write(conn->ssl, (const char *)buffer + total_written, (int)(len - total_written));
+                err = n > 0 ? SSL_ERROR_NONE : SSL_get_error(conn->ssl, (int)n);
+            }
+            pthread_mutex_unlock(&conn->io_lock);
+
+            if (n <= 0) {
+                if (_proto_tls_wait(sock, err, has_deadline ? &deadline : NULL) < 0) break;
+                continue;
+            }
+        } else {
+            // A peer that went away must fail the write, not kill the process
+            n = send(sock, (const char *)buffer + total_written, len - total_written, MSG_NOSIGNAL);
+        }
+        if (n <= 0) break;
+        total_written += (size_t)n;
+    }
+    _proto_conn_put(conn);
+    return total_written == len ? (ssize_t)total_written : -1;
+}
+
+int proto_read_full(int sock, void *buffer, size_t len) {
+    size_t total_read = 0;
+    while (total_read < len) {
+        ssize_t r = proto_read(sock, (char *)buffer + total_read, len - total_read);
+        if (r <= 0) return (int)r;
+        total_read += (size_t)r;
+    }
+    return (int)total_read;
+}
+
+int proto_wait_readable(int sock, int timeout_ms) {
+    proto_conn_t *conn = _proto_conn(sock);
+
+    int result;
+    for (;;) {
+        if (conn) {
+            pthread_mutex_lock(&conn->io_lock);
+            int pending = conn->closed ? 0 : SSL_pending(conn->ssl);
+            pthread_mutex_unlock(&conn->io_lock);
+            if (pending > 0) {
+                result = 1;
+                break;
+            }
+        }
+
+        // Sliced for TLS: a writer may have buffered our record (see _proto_tls_wait)
+        int slice_ms = timeout_ms;
+        if (conn && (slice_ms < 0 || slice_ms > PROTO_TLS_POLL_MS)) slice_ms = PROTO_TLS_POLL_MS;
+
+        struct pollfd pfd;
+        pfd.fd = sock;
+        pfd.events = POLLIN;
+        pfd.revents = 0;
+        int r = poll(&pfd, 1, slice_ms);
+        if (r < 0 && errno == EINTR) {
+            result = 0;
+            break;
+        }
+        if (r != 0) {
+            result = r < 0 ? -1 : 1;
+            break;
+        }
+        if (timeout_ms >= 0) {
+            timeout_ms -= slice_ms;
+            if (timeout_ms <= 0) {
+                result = 0;
+                break;
+            }
+        }
+    }
+    _proto_conn_put(conn);
+    return result;
+}
+
+void proto_close(int sock) {
+    if (sock < 0) return;
+
+    proto_conn_t *conn = NULL;
+    if (sock < PROTO_MAX_FDS) {
+        pthread_mutex_lock(&conn_table_lock);
+        conn = conn_table[sock];
+        conn_table[sock] = NULL;
+        pthread_mutex_unlock(&conn_table_lock);
+    }
+
+    if (conn) {
+        // Non-blocking: sends close_notify if the socket takes it, never waits
+        pthread_mutex_lock(&conn->io_lock);
+        SSL_shutdown(conn->ssl);
+        conn->closed = 1;
+        pthread_mutex_unlock(&conn->io_lock);
+        // Wakes threads waiting on the socket; the last one to let go of
+        // the connection closes it
+        shutdown(sock, SHUT_RDWR);
+        _proto_conn_put(conn);
+        return;
+    }
+    close(sock);
+}
@@ -5,13 +5,39 @@
 #include <unistd.h>
 #include <arpa/inet.h>
 #include <stdio.h>
+#include <openssl/ssl.h>
 
 #define PORT 8080
 #define API_PORT 8081
 #define BUFFER_SIZE 1024
 
+// Default cap for a single message on the notification channel (8080)
+#define PROTO_DEFAULT_MAX_MESSAGE (1024 * 1024)
+
 #define MSG_SOCKET 0x01
 
+// Heartbeat on the notification channel (empty body, either side may ping)
+#define MSG_PING 0x02
+#define MSG_PONG 0x03
+
+// Sent instead of the greeting when the server is at its connection limit
+#define MSG_BUSY 0x04
+
+// Server is going down; body is the number of seconds to wait before reconnecting
+#define MSG_SHUTDOWN 0x05
+
+// Versioned greeting on the notification channel. The agent's first message:
+//   {"device_id": "...", "protocol": 2, "agent_version": "1.6.0",
+//    "commands": [114, 211], "capabilities": ["binary_chunks"]}
+// commands are the server command types it handles. The server answers
+// MSG_HELLO with {"protocol": 2, "capabilities": [...]}, or MSG_HELLO_REJECT
+// with {"error": "...", "min_version": "..."} and closes the connection.
+// Agents that send their bare device ID as MSG_SOCKET instead are protocol 1
+// and get the old text greeting.
+#define MSG_HELLO 0x06
+#define MSG_HELLO_REJECT 0x07
+#define PROTOCOL_VERSION 2
+
 // Restore Flow
 #define MSG_ADMIN_RESTORE_REQ      0x70
 #define MSG_ADMIN_RESTORE_RESP     0x71
@@ -24,13 +50,33 @@
 #define MSG_RESTORE_FINISH_RESP    0x78
 #define MSG_RESTORE_RESUME_REQ     0x79
 #define MSG_RESTORE_RESUME_RESP     0x7A
+#define MSG_RESTORE_CHUNK_DATA_REQ  0x7B // Response body is a chunk frame
+#define MSG_RESTORE_CHUNK_DATA_RESP 0x7C
+#define MSG_ADMIN_RETENTION_RUN_REQ  0x7D
+#define MSG_ADMIN_RETENTION_RUN_RESP 0x7E
+#define MSG_ADMIN_STUCK_TRANSFERS_REQ  0x7F
+#define MSG_ADMIN_STUCK_TRANSFERS_RESP 0x80
 
 #define MSG_LOGIN_REQ 0xA1
 #define MSG_LOGIN_RESP 0xA2
+#define MSG_LOGOUT_REQ 0xA3
+#define MSG_LOGOUT_RESP 0xA4
+#define MSG_CHANGE_PASSWORD_REQ 0xA5
+#define MSG_CHANGE_PASSWORD_RESP 0xA6
 #define MSG_LIST_REQ 0xB1
 #define MSG_LIST_RESP 0xB2
 #define MSG_DEVICE_REQ 0xC1
 #define MSG_DEVICE_RESP 0xC2
+#define MSG_ADMIN_CREATE_ENROLLMENT_TOKEN_REQ 0xC3
+#define MSG_ADMIN_CREATE_ENROLLMENT_TOKEN_RESP 0xC4
+#define MSG_ADMIN_LIST_PENDING_DEVICES_REQ 0xC5
+#define MSG_ADMIN_LIST_PENDING_DEVICES_RESP 0xC6
+#define MSG_ADMIN_APPROVE_DEVICE_REQ 0xC7
+#define MSG_ADMIN_APPROVE_DEVICE_RESP 0xC8
+#define MSG_ADMIN_REJECT_DEVICE_REQ 0xC9
+#define MSG_ADMIN_REJECT_DEVICE_RESP 0xCA
+#define MSG_ADMIN_CANCEL_COMMAND_REQ 0xCB
+#define MSG_ADMIN_CANCEL_COMMAND_RESP 0xCC
 
 // Admin Command Flow
 #define MSG_ADMIN_COMMAND_GETLOGS_REQ 0xD1
@@ -44,6 +90,10 @@
 #define MSG_ADMIN_GET_STORED_LOGS_RESP 0xD9
 #define MSG_ADMIN_GET_COMMAND_HISTORY_REQ 0xDA
 #define MSG_ADMIN_GET_COMMAND_HISTORY_RESP 0xDB
+#define MSG_ADMIN_REVOKE_SESSION_REQ 0xDC
+#define MSG_ADMIN_REVOKE_SESSION_RESP 0xDD
+#define MSG_CLIENT_COMMAND_STATUS_REQ 0xDE
+#define MSG_CLIENT_COMMAND_STATUS_RESP 0xDF
 
 #define MSG_ADMIN_FIREWALL_CONTROL_REQ 0xE1
 #define MSG_ADMIN_FIREWALL_CONTROL_RESP 0xE2
@@ -67,11 +117,27 @@
 #define MSG_BACKUP_CANCEL_REQ      0xF7
 #define MSG_BACKUP_RESUME_REQ      0xF8
 #define MSG_BACKUP_RESUME_RESP     0xF9
+#define MSG_BACKUP_CHUNK_DATA_REQ  0xFA // Payload is a chunk frame
+#define MSG_BACKUP_CHUNK_DATA_RESP 0xFB
+
+// Deduplicated backup ("dedup_chunks" capability): the agent cuts the file
+// into content-defined chunks, asks which hashes the server lacks from this
+// device ({"transfer_id", "hashes": [...]} -> {"missing": [...]}), sends those as
+// chunk frames named by sha256, then finishes with the chunk list in
+// MSG_BACKUP_FINISH_REQ ("chunks": [{"hash", "size"}, ...]).
+#define MSG_BACKUP_CHUNK_QUERY_REQ  0xEA
+#define MSG_BACKUP_CHUNK_QUERY_RESP 0xEB
+#define MSG_BACKUP_CHUNK_PUT_REQ    0xEC // Payload is a chunk frame
+#define MSG_BACKUP_CHUNK_PUT_RESP   0xED
+#define MSG_ADMIN_BACKUP_INTEGRITY_REQ  0xEE
+#define MSG_ADMIN_BACKUP_INTEGRITY_RESP 0xEF
 
-// Callback type for receiving messages
-typedef void (*MessageCallback)(const char *message);
+// Callback type for receiving messages. type is the proto_header_t type
+// (e.g. MSG_SERVER_COMMAND_GETLOG, or MSG_SOCKET for plain text).
+typedef void (*MessageCallback)(uint8_t type, const char *message);
 
 #define PROTOCOL_MAGIC_EXT 0xFE
+#define PROTOCOL_MAGIC_MUX 0xFD
 
 typedef struct __attribute__((packed)) {
     uint8_t type;
@@ -102,10 +168,96 @@ typedef struct __attribute__((packed)) {
     uint16_t status;
 } api_resp_header_ext_t; // 8081 Extended
 
+// Multiplexed API connection (8081): a connection whose first byte is 0xFD
+// stays open and carries any number of requests, each framed with an ID the
+// client picks. Responses carry the same ID and may arrive in any order.
+// Every frame, in both directions, starts with the 0xFD magic.
+typedef struct __attribute__((packed)) {
+    uint8_t magic; // 0xFD
+    uint8_t type;
+    uint32_t request_id;
+    uint32_t len;
+} api_mux_req_header_t;
+
+typedef struct __attribute__((packed)) {
+    uint8_t magic; // 0xFD
+    uint8_t type;
+    uint32_t request_id;
+    uint32_t len;
+    uint16_t status;
+} api_mux_resp_header_t;
+
+// Chunk frame: backup/restore data as raw bytes instead of hex inside JSON.
+//   uint32 header_len | header_len bytes of JSON | raw bytes
+// The JSON header names the chunk (transfer_id, offset, data_len) and has
+// its "sha256" in hex. On a restore response the header is the envelope.
+#define CHUNK_FRAME_MAX_HEADER 4096
+
+// Build a frame (malloc'd, caller frees). Returns NULL on allocation failure.
+char *chunk_frame_build(const char *header, const void *data, uint32_t data_len, uint32_t *frame_len);
+
+// Split a frame. header is copied NUL-terminated into header_buf; *data
+// points into frame. Returns 0 on success, -1 if it is not a valid frame.
+int chunk_frame_parse(const char *frame, uint32_t frame_len, char *header_buf, size_t header_size, const char **data, uint32_t *data_len);
+
 // Helper to send packet
 void send_packet(int sock, void *data, uint16_t len);
 
 // Helper to recv packet
 int recv_packet(int sock, char *buffer);
 
+// Same, also returning the header type (type may be NULL).
+// Bodies over BUFFER_SIZE are truncated (the rest is discarded).
+int recv_packet_type(int sock, char *buffer, uint8_t *type);
+
+// Send a typed message on the notification channel. Bodies over 65535 bytes
+// use the extended header (0xFE, type, uint32 len). Returns 0 on success.
+int send_message(int sock, uint8_t type, const void *data, uint32_t len);
+
+// Read a request/notification header, either standard (type + uint16 len)
+// or extended (0xFE + type + uint32 len). Returns 0 on success.
+int proto_recv_header(int sock, uint8_t *type, uint32_t *len);
+
+// Read and drop len bytes (e.g. the body of a refused request)
+int proto_discard(int sock, uint32_t len);
+
+// Receive one message of either header form into a heap buffer (*out,
+// NUL-terminated, caller frees). Returns the body length, -1 on socket error,
+// or -2 if the announced length exceeds max_len (the stream is then out of
+// sync and the connection should be closed).
+int recv_message(int sock, uint8_t *type, char **out, uint32_t max_len);
+
+// --- Transport (plain TCP or TLS) ---
+// Sockets stay plain ints everywhere; a socket that completed a TLS handshake
+// is tracked internally and the proto_* I/O helpers route it through OpenSSL.
+// One thread may read a TLS socket while others write to it: every OpenSSL
+// call on it is serialized. SO_RCVTIMEO / SO_SNDTIMEO keep their meaning.
+
+// Build a server-side TLS context. ca_file is used to verify client
+// certificates; if require_client_cert is set, handshakes without one fail.
+SSL_CTX *proto_tls_server_ctx(const char *cert_file, const char *key_file, const char *ca_file, int require_client_cert);
+
+// Build a client-side TLS context. cert_file/key_file may be NULL or empty
+// when the client has no certificate yet (e.g. before device registration).
+SSL_CTX *proto_tls_client_ctx(const char *ca_file, const char *cert_file, const char *key_file);
+
+// Run the TLS handshake on an accepted/connected socket (returns 0 on success)
+int proto_tls_accept(SSL_CTX *tls, int sock);
+int proto_tls_connect(SSL_CTX *tls, int sock, const char *server_name);
+
+// Copy the CN of the verified peer certificate (returns 1 if present)
+int proto_peer_cn(int sock, char *buffer, size_t size);
+
+// I/O that works for both plain and TLS sockets
+ssize_t proto_read(int sock, void *buffer, size_t len);
+ssize_t proto_write(int sock, const void *buffer, size_t len);
+int proto_read_full(int sock, void *buffer, size_t len);
+
+// Wait up to timeout_ms for data (including bytes already buffered by TLS).
+// Returns 1 if readable, 0 on timeout, -1 on error.
+int proto_wait_readable(int sock, int timeout_ms);
+
+// Shut down TLS (if any) and close the socket
+void proto_close(int sock);
+
 #endif
@@ -0,0 +1,33 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ChunkFrameMaxHeader matches CHUNK_FRAME_MAX_HEADER.
+const ChunkFrameMaxHeader = 4096
+
+// ErrBadChunkFrame is returned for a frame whose header length does not fit.
+var ErrBadChunkFrame = errors.New("wire: invalid chunk frame")
+
+// AppendChunkFrame appends a chunk frame like chunk_frame_build:
+// uint32 header length, the JSON header, then the raw bytes.
+func AppendChunkFrame(dst []byte, header, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(header)))
+	dst = append(dst, header...)
+	return append(dst, data...)
+}
+
+// ParseChunkFrame splits a frame like chunk_frame_parse. Both results point
+// into frame.
+func ParseChunkFrame(frame []byte) (header, data []byte, err error) {
+	if len(frame) < 4 {
+		return nil, nil, ErrBadChunkFrame
+	}
+	n := binary.BigEndian.Uint32(frame)
+	if n > ChunkFrameMaxHeader || uint64(n) > uint64(len(frame)-4) {
+		return nil, nil, ErrBadChunkFrame
+	}
+	return frame[4 : 4+n], frame[4+n:], nil
+}
@@ -0,0 +1,222 @@
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxResponse matches API_RESPONSE_MAX in the C client.
+const DefaultMaxResponse = 64 * 1024 * 1024
+
+// DefaultMuxTimeout matches API_MUX_TIMEOUT_SEC.
+const DefaultMuxTimeout = 60 * time.Second
+
+// ErrClosed is returned by calls on a closed multiplexed connection.
+var ErrClosed = errors.New("wire: connection closed")
+
+// Response is one API response.
+type Response struct {
+	Type   uint8
+	Status uint16
+	Body   []byte
+}
+
+// Envelope decodes the response body.
+func (r Response) Envelope() (Envelope, error) {
+	var env Envelope
+	err := json.Unmarshal(r.Body, &env)
+	return env, err
+}
+
+// Client talks to the API port (8081) the way client/core.c does.
+type Client struct {
+	Addr string
+	// Dial opens the connection; nil uses net.Dial. Wrap tls.Dial here for
+	// servers with TLS enabled.
+	Dial func(network, addr string) (net.Conn, error)
+	// Timeout bounds a one-shot call, or the wait for a multiplexed response
+	// (0 = DefaultMuxTimeout there, no limit for one-shot calls)
+	Timeout     time.Duration
+	MaxResponse uint32 // 0 = DefaultMaxResponse
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial("tcp", c.Addr)
+	}
+	return net.Dial("tcp", c.Addr)
+}
+
+func (c *Client) maxResponse() uint32 {
+	if c.MaxResponse == 0 {
+		return DefaultMaxResponse
+	}
+	return c.MaxResponse
+}
+
+// Call sends one request on a new connection and reads its response.
+func (c *Client) Call(msgType uint8, payload []byte) (Response, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if err := WriteMessage(conn, msgType, payload); err != nil {
+		return Response{}, err
+	}
+	h, err := ReadRespHeader(conn)
+	if err != nil {
+		return Response{}, err
+	}
+	body, err := readBody(conn, h.Len, c.maxResponse())
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{Type: h.Type, Status: h.Status, Body: body}, nil
+}
+
+// MuxClient is a persistent multiplexed API connection. Calls may run
+// concurrently; responses are matched to them by request ID.
+type MuxClient struct {
+	conn        net.Conn
+	timeout     time.Duration
+	maxResponse uint32
+
+	writeMu sync.Mutex // One frame at a time
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan Response
+	err     error // Set once the connection is gone
+}
+
+// DialMux opens a multiplexed connection.
+func (c *Client) DialMux() (*MuxClient, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	m := &MuxClient{
+		conn:        conn,
+		timeout:     c.Timeout,
+		maxResponse: c.maxResponse(),
+		pending:     make(map[uint32]chan Response),
+	}
+	if m.timeout == 0 {
+		m.timeout = DefaultMuxTimeout
+	}
+	go m.read()
+	return m, nil
+}
+
+// Call sends a request and waits for its response.
+func (m *MuxClient) Call(msgType uint8, payload []byte) (Response, error) {
+	done := make(chan Response, 1)
+
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return Response{}, m.err
+	}
+	m.nextID++
+	if m.nextID == 0 {
+		m.nextID = 1 // 0 means the whole connection
+	}
+	id := m.nextID
+	m.pending[id] = done
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+
+	frame := AppendMuxHeader(make([]byte, 0, MuxHeaderSize+len(payload)), MuxHeader{Type: msgType, RequestID: id, Len: uint32(len(payload))})
+	m.writeMu.Lock()
+	_, err := m.conn.Write(append(frame, payload...))
+	m.writeMu.Unlock()
+	if err != nil {
+		m.Close()
+		return Response{}, err
+	}
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-done:
+		if !ok {
+			return Response{}, m.closeErr()
+		}
+		return resp, nil
+	case <-timer.C:
+		return Response{}, fmt.Errorf("wire: no response to 0x%02X after %v", msgType, m.timeout)
+	}
+}
+
+// Close closes the connection; waiting calls fail.
+func (m *MuxClient) Close() error {
+	m.fail(ErrClosed, nil)
+	return m.conn.Close()
+}
+
+func (m *MuxClient) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// fail ends the connection. Waiting calls get refusal if the server answered
+// for the whole connection, or see err otherwise.
+func (m *MuxClient) fail(err error, refusal *Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for id, done := range m.pending {
+		if refusal != nil {
+			done <- *refusal
+		}
+		close(done)
+		delete(m.pending, id)
+	}
+}
+
+func (m *MuxClient) read() {
+	for {
+		h, err := ReadMuxHeader(m.conn, true)
+		if err != nil {
+			m.fail(err, nil)
+			break
+		}
+		body, err := readBody(m.conn, h.Len, m.maxResponse)
+		if err != nil {
+			m.fail(err, nil)
+			break
+		}
+		resp := Response{Type: h.Type, Status: h.Status, Body: body}
+
+		if h.RequestID == 0 {
+			// The server refused the whole connection (e.g. busy)
+			m.fail(fmt.Errorf("wire: connection refused with status %d", h.Status), &resp)
+			break
+		}
+
+		m.mu.Lock()
+		if done, ok := m.pending[h.RequestID]; ok {
+			done <- resp
+			delete(m.pending, h.RequestID)
+		}
+		m.mu.Unlock()
+	}
+	m.conn.Close()
+}
@@ -0,0 +1,30 @@
+package wire
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Envelope is the body of every API response (see protocol/envelope.h).
+type Envelope struct {
+	RequestID    string          `json:"request_id"`
+	Code         string          `json:"code"`
+	Message      string          `json:"message,omitempty"`
+	RetryAfterMs int64           `json:"retry_after_ms,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+}
+
+// NewRequestID returns a random ID like envelope_new_id.
+func NewRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// ErrorBody is an envelope answering with an error code, as the C server
+// writes it for errors it raises itself (busy, too large, ...).
+func ErrorBody(code, message string) []byte {
+	body, _ := json.Marshal(Envelope{RequestID: NewRequestID(), Code: code, Message: message})
+	return body
+}
@@ -0,0 +1,205 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run one with e.g. go test ./protocol/wire -fuzz=FuzzReadMessage
+
+func FuzzParseHeader(f *testing.F) {
+	for _, seed := range []string{"a10005", "fefa00011170", "fd", "fe", "", "01ffff"} {
+		f.Add(mustHex(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, n, err := ParseHeader(b)
+		rh, rerr := ReadHeader(bytes.NewReader(b))
+		if (err == nil) != (rerr == nil) || (err == nil && h != rh) {
+			t.Fatalf("ParseHeader = %+v, %v; ReadHeader = %+v, %v", h, err, rh, rerr)
+		}
+		if err != nil {
+			return
+		}
+		// An extended header may announce a short body; the C writers never
+		// send one, so only the standard form must encode back the same
+		if n == ExtHeaderSize && !h.Extended() {
+			return
+		}
+		out, err := AppendHeader(nil, h)
+		if err != nil || !bytes.Equal(out, b[:n]) {
+			t.Fatalf("%+v encodes to %x, read from %x (%v)", h, out, b[:n], err)
+		}
+	})
+}
+
+func FuzzParseRespHeader(f *testing.F) {
+	for _, seed := range []string{"a2000500c8", "fe7c00011170019d", "fe7c", "a200"} {
+		f.Add(mustHex(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, n, err := ParseRespHeader(b)
+		rh, rerr := ReadRespHeader(bytes.NewReader(b))
+		if (err == nil) != (rerr == nil) || (err == nil && h != rh) {
+			t.Fatalf("ParseRespHeader = %+v, %v; ReadRespHeader = %+v, %v", h, err, rh, rerr)
+		}
+		if err != nil || (n == ExtRespHeaderSize && h.Len <= MaxStdLen) {
+			return
+		}
+		if out := AppendRespHeader(nil, h); !bytes.Equal(out, b[:n]) {
+			t.Fatalf("%+v encodes to %x, read from %x", h, out, b[:n])
+		}
+	})
+}
+
+func FuzzParseMuxHeader(f *testing.F) {
+	f.Add(mustHex("fdb10000000700000003"), false)
+	f.Add(mustHex("fdb2010203040001117001f7"), true)
+	f.Add(mustHex("feb2"), true)
+	f.Fuzz(func(t *testing.T, b []byte, resp bool) {
+		h, n, err := ParseMuxHeader(b, resp)
+		if err != nil {
+			return
+		}
+		out := AppendMuxHeader(nil, h)
+		if resp {
+			out = AppendMuxRespHeader(nil, h)
+		}
+		if !bytes.Equal(out, b[:n]) {
+			t.Fatalf("%+v encodes to %x, read from %x", h, out, b[:n])
+		}
+	})
+}
+
+// FuzzReadMessage feeds arbitrary streams, including truncated bodies and
+// lengths far over the limit, to the notification reader.
+func FuzzReadMessage(f *testing.F) {
+	f.Add(string(mustHex("a10005")) + "hello")
+	f.Add(string(mustHex("a10005")) + "hel")
+	f.Add(string(mustHex("fefa00011170")) + "short")
+	f.Add(string(mustHex("01ffff")))
+	f.Add(string(mustHex("fe01ffffffff")))
+	f.Fuzz(func(t *testing.T, stream string) {
+		const max = 4096
+		r := bytes.NewReader([]byte(stream))
+		for {
+			typ, body, err := ReadMessage(r, max)
+			var tooLarge *TooLargeError
+			switch {
+			case err == io.EOF:
+				if r.Len() != 0 {
+					t.Fatalf("EOF with %d bytes left", r.Len())
+				}
+				return
+			case errors.As(err, &tooLarge):
+				if tooLarge.Len <= max {
+					t.Fatalf("refused %d bytes under the limit", tooLarge.Len)
+				}
+				return
+			case err != nil:
+				return
+			}
+			if len(body) > max {
+				t.Fatalf("message 0x%X of %d bytes over the limit", typ, len(body))
+			}
+		}
+	})
+}
+
+func FuzzParseChunkFrame(f *testing.F) {
+	f.Add(mustHex("000000077b2261223a317d0102"))
+	f.Add(mustHex("00000007"))
+	f.Add(mustHex("ffffffff7b7d"))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		header, data, err := ParseChunkFrame(frame)
+		if err != nil {
+			return
+		}
+		if len(header) > ChunkFrameMaxHeader || 4+len(header)+len(data) != len(frame) {
+			t.Fatalf("header %d + data %d bytes from a frame of %d", len(header), len(data), len(frame))
+		}
+		if !bytes.Equal(AppendChunkFrame(nil, header, data), frame) {
+			t.Fatalf("frame does not round trip")
+		}
+	})
+}
+
+// FuzzServeConn sends arbitrary bytes to the API server as a client would.
+// Whatever arrives, the server must answer in well-formed frames and return.
+func FuzzServeConn(f *testing.F) {
+	f.Add(string(mustHex("a10005")) + "hello")
+	f.Add(string(mustHex("a1ffff")) + "trunc")
+	f.Add(string(mustHex("fea100100000")))
+	f.Add(string(mustHex("fdb10000000100000002")) + "hi" + string(mustHex("fdb1000000020000ffff")))
+	f.Add(string(mustHex("fdb100000001")) + string(mustHex("fe")))
+	f.Fuzz(func(t *testing.T, stream string) {
+		s := &Server{Handler: echo, MaxRequest: 1024, MaxInflight: 4}
+		conn := &bufConn{r: bytes.NewReader([]byte(stream))}
+
+		done := make(chan struct{})
+		go func() {
+			s.ServeConn(conn)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server did not return")
+		}
+
+		out := bytes.NewReader(conn.w.Bytes())
+		mux := len(stream) > 0 && stream[0] == MagicMux
+		for out.Len() > 0 {
+			var n uint32
+			if mux {
+				h, err := ReadMuxHeader(out, true)
+				if err != nil {
+					t.Fatalf("bad response frame: %v", err)
+				}
+				n = h.Len
+			} else {
+				h, err := ReadRespHeader(out)
+				if err != nil {
+					t.Fatalf("bad response header: %v", err)
+				}
+				n = h.Len
+			}
+			if Discard(out, n) != nil {
+				t.Fatalf("truncated response")
+			}
+		}
+	})
+}
+
+// bufConn is a net.Conn that reads a fixed stream and records what is written.
+type bufConn struct {
+	r  *bytes.Reader
+	mu sync.Mutex
+	w  bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(b)
+}
+func (c *bufConn) Close() error                     { return nil }
+func (c *bufConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *bufConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *bufConn) SetDeadline(time.Time) error      { return nil }
+func (c *bufConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *bufConn) SetWriteDeadline(time.Time) error { return nil }
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,209 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults of the C server (server/core.h)
+const (
+	DefaultMaxRequest  = 64 * 1024 * 1024 // DEFAULT_MAX_REQUEST_SIZE
+	DefaultMaxInflight = 64               // MUX_MAX_INFLIGHT
+)
+
+// Request is one API request. ID is the request ID on a multiplexed
+// connection and 0 for a one-shot connection.
+type Request struct {
+	Type    uint8
+	ID      uint32
+	Payload []byte
+	Conn    net.Conn
+}
+
+// Handler answers a request. It runs on its own goroutine for multiplexed
+// requests.
+type Handler func(req *Request) Response
+
+// Server serves the API port the way server/core.c does: a connection is
+// either one request and its response, or multiplexed when its first byte
+// is 0xFD.
+type Server struct {
+	Handler     Handler
+	MaxRequest  uint32        // 0 = DefaultMaxRequest
+	MaxInflight int           // Per multiplexed connection, 0 = DefaultMaxInflight
+	IdleTimeout time.Duration // Closes idle multiplexed connections, 0 = never
+}
+
+// Serve accepts connections until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+func (s *Server) maxRequest() uint32 {
+	if s.MaxRequest == 0 {
+		return DefaultMaxRequest
+	}
+	return s.MaxRequest
+}
+
+// ServeConn serves one accepted connection and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return
+	}
+	if first[0] == MagicMux {
+		s.serveMux(conn)
+		return
+	}
+
+	h, err := ReadHeader(&prefixReader{b: first[0], r: conn})
+	if err != nil {
+		return
+	}
+	payload, err := readBody(conn, h.Len, s.maxRequest())
+	var tooLarge *TooLargeError
+	if errors.As(err, &tooLarge) {
+		writeResponse(conn, Response{Status: 413, Body: ErrorBody("TOO_LARGE", "Request too large")})
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	writeResponse(conn, s.handle(&Request{Type: h.Type, Payload: payload, Conn: conn}))
+}
+
+func (s *Server) handle(req *Request) (resp Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = Response{Status: 500, Body: ErrorBody("INTERNAL", fmt.Sprint(r))}
+		}
+	}()
+	if s.Handler == nil {
+		return Response{Status: 400, Body: ErrorBody("UNKNOWN_ROUTE", "Unknown Request Type")}
+	}
+	return s.Handler(req)
+}
+
+func writeResponse(conn net.Conn, resp Response) error {
+	buf := AppendRespHeader(make([]byte, 0, ExtRespHeaderSize+len(resp.Body)), RespHeader{Type: resp.Type, Len: uint32(len(resp.Body)), Status: resp.Status})
+	_, err := conn.Write(append(buf, resp.Body...))
+	return err
+}
+
+// muxConn is the write side of a multiplexed connection.
+type muxConn struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	inflight sync.WaitGroup
+
+	mu    sync.Mutex
+	count int
+}
+
+func (m *muxConn) write(id uint32, resp Response) error {
+	buf := AppendMuxRespHeader(make([]byte, 0, MuxRespHeaderSize+len(resp.Body)), MuxHeader{Type: resp.Type, RequestID: id, Len: uint32(len(resp.Body)), Status: resp.Status})
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	_, err := m.conn.Write(append(buf, resp.Body...))
+	return err
+}
+
+// serveMux reads frames until the connection fails; the first magic byte
+// has been read.
+func (s *Server) serveMux(conn net.Conn) {
+	m := &muxConn{conn: conn}
+	maxInflight := s.MaxInflight
+	if maxInflight <= 0 {
+		maxInflight = DefaultMaxInflight
+	}
+	defer m.inflight.Wait() // Let running requests answer before the close
+
+	var r io.Reader = &prefixReader{b: MagicMux, r: conn}
+	for {
+		if s.IdleTimeout > 0 {
+			m.mu.Lock()
+			idle := m.count == 0
+			m.mu.Unlock()
+			if idle {
+				conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+		}
+		h, err := ReadMuxHeader(r, false)
+		if err != nil {
+			return
+		}
+		r = conn
+		conn.SetReadDeadline(time.Time{})
+
+		payload, err := readBody(conn, h.Len, s.maxRequest())
+		var tooLarge *TooLargeError
+		if errors.As(err, &tooLarge) {
+			m.write(h.RequestID, Response{Status: 413, Body: ErrorBody("TOO_LARGE", "Request too large")})
+			if Discard(conn, h.Len) != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		full := m.count >= maxInflight
+		if !full {
+			m.count++
+		}
+		m.mu.Unlock()
+		if full {
+			m.write(h.RequestID, Response{Status: 503, Body: ErrorBody("BUSY", "Too many requests in flight")})
+			continue
+		}
+
+		m.inflight.Add(1)
+		go func(req *Request) {
+			defer m.inflight.Done()
+			m.write(req.ID, s.handle(req))
+			m.mu.Lock()
+			m.count--
+			m.mu.Unlock()
+		}(&Request{Type: h.Type, ID: h.RequestID, Payload: payload, Conn: conn})
+	}
+}
+
+// prefixReader gives back a byte that was read ahead of a header.
+type prefixReader struct {
+	b    byte
+	r    io.Reader
+	done bool
+}
+
+func (p *prefixReader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if !p.done {
+		p.done = true
+		buf[0] = p.b
+		return 1, nil
+	}
+	return p.r.Read(buf)
+}
@@ -0,0 +1,315 @@
+// Package wire is a pure-Go implementation of the framing in
+// protocol/protocol.h. It reads and writes the same bytes as the C code, so
+// tools and tests can talk to the C endpoints (or stand in for them) without
+// cgo.
+//
+// All integers are big-endian. The notification channel (8080) and API
+// requests (8081) share one header:
+//
+//	type uint8 | len uint16                  bodies up to 65535 bytes
+//	0xFE | type uint8 | len uint32           longer bodies
+//
+// API responses add a uint16 status after the length. A multiplexed API
+// connection starts every frame, in both directions, with 0xFD:
+//
+//	0xFD | type uint8 | request_id uint32 | len uint32 [| status uint16]
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	MagicExt = 0xFE // PROTOCOL_MAGIC_EXT
+	MagicMux = 0xFD // PROTOCOL_MAGIC_MUX
+
+	// MaxStdLen is the longest body a standard header can announce; longer
+	// ones use the extended header.
+	MaxStdLen = 0xFFFF
+
+	HeaderSize        = 3  // proto_header_t, api_req_header_t
+	ExtHeaderSize     = 6  // api_req_header_ext_t
+	RespHeaderSize    = 5  // api_resp_header_t
+	ExtRespHeaderSize = 8  // api_resp_header_ext_t
+	MuxHeaderSize     = 10 // api_mux_req_header_t
+	MuxRespHeaderSize = 12 // api_mux_resp_header_t
+)
+
+// Notification channel message types
+const (
+	MsgSocket      = 0x01
+	MsgPing        = 0x02
+	MsgPong        = 0x03
+	MsgBusy        = 0x04
+	MsgShutdown    = 0x05
+	MsgHello       = 0x06
+	MsgHelloReject = 0x07
+
+	ProtocolVersion = 2 // PROTOCOL_VERSION
+)
+
+// DefaultMaxMessage matches PROTO_DEFAULT_MAX_MESSAGE.
+const DefaultMaxMessage = 1024 * 1024
+
+var (
+	// ErrReservedType is returned for a message type the standard header
+	// cannot carry because the reader would take it for a magic byte.
+	ErrReservedType = errors.New("wire: message type is a magic byte")
+	// ErrBadMagic is returned when a multiplexed frame does not start with 0xFD.
+	ErrBadMagic = errors.New("wire: bad frame magic")
+)
+
+// TooLargeError is returned when a header announces more than the reader's
+// limit. The body has not been read, so the stream is out of sync unless the
+// caller discards Len bytes.
+type TooLargeError struct {
+	Len, Max uint32
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("wire: message of %d bytes exceeds limit of %d", e.Len, e.Max)
+}
+
+// Header is a notification or API request header, standard or extended.
+type Header struct {
+	Type uint8
+	Len  uint32
+}
+
+// Extended reports whether the header needs the 0xFE form.
+func (h Header) Extended() bool { return h.Len > MaxStdLen }
+
+// AppendHeader appends h the way send_message and the C API client write it:
+// extended only when the body does not fit in a uint16.
+func AppendHeader(dst []byte, h Header) ([]byte, error) {
+	if h.Extended() {
+		dst = append(dst, MagicExt, h.Type)
+		return binary.BigEndian.AppendUint32(dst, h.Len), nil
+	}
+	if h.Type == MagicExt || h.Type == MagicMux {
+		return dst, ErrReservedType
+	}
+	dst = append(dst, h.Type)
+	return binary.BigEndian.AppendUint16(dst, uint16(h.Len)), nil
+}
+
+// ParseHeader decodes a header from the start of b and returns its size.
+// It returns io.ErrUnexpectedEOF if b is too short.
+func ParseHeader(b []byte) (Header, int, error) {
+	if len(b) < 1 {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	if b[0] == MagicExt {
+		if len(b) < ExtHeaderSize {
+			return Header{}, 0, io.ErrUnexpectedEOF
+		}
+		return Header{Type: b[1], Len: binary.BigEndian.Uint32(b[2:6])}, ExtHeaderSize, nil
+	}
+	if b[0] == MagicMux {
+		return Header{}, 0, ErrBadMagic
+	}
+	if len(b) < HeaderSize {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	return Header{Type: b[0], Len: uint32(binary.BigEndian.Uint16(b[1:3]))}, HeaderSize, nil
+}
+
+// ReadHeader reads a header like proto_recv_header. A first byte of 0xFD is
+// reported as ErrBadMagic; API servers check for it before calling this.
+func ReadHeader(r io.Reader) (Header, error) {
+	var buf [ExtHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return Header{}, err
+	}
+	n := HeaderSize
+	switch buf[0] {
+	case MagicExt:
+		n = ExtHeaderSize
+	case MagicMux:
+		return Header{}, ErrBadMagic
+	}
+	if _, err := io.ReadFull(r, buf[1:n]); err != nil {
+		return Header{}, noEOF(err)
+	}
+	h, _, err := ParseHeader(buf[:n])
+	return h, err
+}
+
+// WriteMessage writes a header and body in one write, like send_message.
+func WriteMessage(w io.Writer, msgType uint8, body []byte) error {
+	buf, err := AppendHeader(make([]byte, 0, ExtHeaderSize+len(body)), Header{Type: msgType, Len: uint32(len(body))})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// ReadMessage reads one message like recv_message. A body over max returns
+// a *TooLargeError with the body left unread.
+func ReadMessage(r io.Reader, max uint32) (uint8, []byte, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body, err := readBody(r, h.Len, max)
+	return h.Type, body, err
+}
+
+// RespHeader is an API response header, standard or extended.
+type RespHeader struct {
+	Type   uint8
+	Len    uint32
+	Status uint16
+}
+
+// AppendRespHeader appends h the way server_send_response writes it. The
+// response type is not checked against the magic bytes: clients only look
+// for 0xFE, and the C server sends whatever type the handler gives.
+func AppendRespHeader(dst []byte, h RespHeader) []byte {
+	if h.Len > MaxStdLen {
+		dst = append(dst, MagicExt, h.Type)
+		dst = binary.BigEndian.AppendUint32(dst, h.Len)
+	} else {
+		dst = append(dst, h.Type)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(h.Len))
+	}
+	return binary.BigEndian.AppendUint16(dst, h.Status)
+}
+
+// ParseRespHeader decodes a response header from the start of b and
+// returns its size.
+func ParseRespHeader(b []byte) (RespHeader, int, error) {
+	if len(b) < 1 {
+		return RespHeader{}, 0, io.ErrUnexpectedEOF
+	}
+	if b[0] == MagicExt {
+		if len(b) < ExtRespHeaderSize {
+			return RespHeader{}, 0, io.ErrUnexpectedEOF
+		}
+		return RespHeader{
+			Type:   b[1],
+			Len:    binary.BigEndian.Uint32(b[2:6]),
+			Status: binary.BigEndian.Uint16(b[6:8]),
+		}, ExtRespHeaderSize, nil
+	}
+	if len(b) < RespHeaderSize {
+		return RespHeader{}, 0, io.ErrUnexpectedEOF
+	}
+	return RespHeader{
+		Type:   b[0],
+		Len:    uint32(binary.BigEndian.Uint16(b[1:3])),
+		Status: binary.BigEndian.Uint16(b[3:5]),
+	}, RespHeaderSize, nil
+}
+
+// ReadRespHeader reads a response header the way the C API client does.
+func ReadRespHeader(r io.Reader) (RespHeader, error) {
+	var buf [ExtRespHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return RespHeader{}, err
+	}
+	n := RespHeaderSize
+	if buf[0] == MagicExt {
+		n = ExtRespHeaderSize
+	}
+	if _, err := io.ReadFull(r, buf[1:n]); err != nil {
+		return RespHeader{}, noEOF(err)
+	}
+	h, _, err := ParseRespHeader(buf[:n])
+	return h, err
+}
+
+// MuxHeader is a frame header on a multiplexed API connection. Status is
+// only on the wire for responses.
+type MuxHeader struct {
+	Type      uint8
+	RequestID uint32 // 0 in a response answers for the whole connection
+	Len       uint32
+	Status    uint16
+}
+
+// AppendMuxHeader appends a request frame header (api_mux_req_header_t).
+func AppendMuxHeader(dst []byte, h MuxHeader) []byte {
+	dst = append(dst, MagicMux, h.Type)
+	dst = binary.BigEndian.AppendUint32(dst, h.RequestID)
+	return binary.BigEndian.AppendUint32(dst, h.Len)
+}
+
+// AppendMuxRespHeader appends a response frame header (api_mux_resp_header_t).
+func AppendMuxRespHeader(dst []byte, h MuxHeader) []byte {
+	return binary.BigEndian.AppendUint16(AppendMuxHeader(dst, h), h.Status)
+}
+
+// ParseMuxHeader decodes a request frame header (resp false) or a response
+// frame header (resp true) from the start of b and returns its size.
+func ParseMuxHeader(b []byte, resp bool) (MuxHeader, int, error) {
+	n := MuxHeaderSize
+	if resp {
+		n = MuxRespHeaderSize
+	}
+	if len(b) > 0 && b[0] != MagicMux {
+		return MuxHeader{}, 0, ErrBadMagic
+	}
+	if len(b) < n {
+		return MuxHeader{}, 0, io.ErrUnexpectedEOF
+	}
+	h := MuxHeader{
+		Type:      b[1],
+		RequestID: binary.BigEndian.Uint32(b[2:6]),
+		Len:       binary.BigEndian.Uint32(b[6:10]),
+	}
+	if resp {
+		h.Status = binary.BigEndian.Uint16(b[10:12])
+	}
+	return h, n, nil
+}
+
+// ReadMuxHeader reads a frame header, magic byte included.
+func ReadMuxHeader(r io.Reader, resp bool) (MuxHeader, error) {
+	var buf [MuxRespHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return MuxHeader{}, err
+	}
+	if buf[0] != MagicMux {
+		return MuxHeader{}, ErrBadMagic
+	}
+	n := MuxHeaderSize
+	if resp {
+		n = MuxRespHeaderSize
+	}
+	if _, err := io.ReadFull(r, buf[1:n]); err != nil {
+		return MuxHeader{}, noEOF(err)
+	}
+	h, _, err := ParseMuxHeader(buf[:n], resp)
+	return h, err
+}
+
+// readBody reads n bytes, refusing more than max without reading them.
+func readBody(r io.Reader, n, max uint32) ([]byte, error) {
+	if n > max {
+		return nil, &TooLargeError{Len: n, Max: max}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, noEOF(err)
+	}
+	return body, nil
+}
+
+// Discard reads and drops n bytes, like proto_discard.
+func Discard(r io.Reader, n uint32) error {
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	return noEOF(err)
+}
+
+// noEOF turns a clean EOF in the middle of a frame into ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
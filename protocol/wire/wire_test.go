@@ -0,0 +1,267 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Golden headers below are the bytes the C code writes (send_message,
+// server_send_response_len, chunk_frame_build and the packed mux structs).
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+		wire string
+	}{
+		{"empty", Header{Type: 0x02, Len: 0}, "020000"},
+		{"standard", Header{Type: 0xA1, Len: 5}, "a10005"},
+		{"largest standard", Header{Type: 0x01, Len: 0xFFFF}, "01ffff"},
+		{"smallest extended", Header{Type: 0xFA, Len: 0x10000}, "fefa00010000"},
+		{"extended", Header{Type: 0xFA, Len: 70000}, "fefa00011170"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AppendHeader(nil, tt.h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tt.wire {
+				t.Fatalf("AppendHeader = %x, want %s", got, tt.wire)
+			}
+
+			raw, _ := hex.DecodeString(tt.wire)
+			h, n, err := ParseHeader(append(raw, 'x'))
+			if err != nil || h != tt.h || n != len(raw) {
+				t.Fatalf("ParseHeader = %+v, %d, %v", h, n, err)
+			}
+			if h, err := ReadHeader(bytes.NewReader(raw)); err != nil || h != tt.h {
+				t.Fatalf("ReadHeader = %+v, %v", h, err)
+			}
+		})
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	for _, typ := range []uint8{MagicExt, MagicMux} {
+		if _, err := AppendHeader(nil, Header{Type: typ, Len: 1}); err != ErrReservedType {
+			t.Errorf("type 0x%X: err = %v, want ErrReservedType", typ, err)
+		}
+	}
+
+	tests := []struct {
+		wire string
+		err  error
+	}{
+		{"", io.EOF},
+		{"a1", io.ErrUnexpectedEOF},
+		{"a100", io.ErrUnexpectedEOF},
+		{"fe", io.ErrUnexpectedEOF},
+		{"fefa000111", io.ErrUnexpectedEOF},
+		{"fd", ErrBadMagic},
+	}
+	for _, tt := range tests {
+		raw, _ := hex.DecodeString(tt.wire)
+		if _, err := ReadHeader(bytes.NewReader(raw)); err != tt.err {
+			t.Errorf("ReadHeader(%s) err = %v, want %v", tt.wire, err, tt.err)
+		}
+	}
+}
+
+func TestRespHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		h    RespHeader
+		wire string
+	}{
+		{"standard", RespHeader{Type: 0xA2, Len: 5, Status: 200}, "a2000500c8"},
+		{"error type", RespHeader{Type: 0, Len: 0, Status: 503}, "00000001f7"},
+		{"extended", RespHeader{Type: 0x7C, Len: 70000, Status: 413}, "fe7c00011170019d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(AppendRespHeader(nil, tt.h)); got != tt.wire {
+				t.Fatalf("AppendRespHeader = %s, want %s", got, tt.wire)
+			}
+			raw, _ := hex.DecodeString(tt.wire)
+			if h, err := ReadRespHeader(bytes.NewReader(raw)); err != nil || h != tt.h {
+				t.Fatalf("ReadRespHeader = %+v, %v", h, err)
+			}
+		})
+	}
+}
+
+func TestMuxHeader(t *testing.T) {
+	req := MuxHeader{Type: 0xB1, RequestID: 7, Len: 3}
+	if got := hex.EncodeToString(AppendMuxHeader(nil, req)); got != "fdb10000000700000003" {
+		t.Fatalf("AppendMuxHeader = %s", got)
+	}
+	resp := MuxHeader{Type: 0xB2, RequestID: 0x01020304, Len: 70000, Status: 503}
+	wire := "fdb2010203040001117001f7"
+	if got := hex.EncodeToString(AppendMuxRespHeader(nil, resp)); got != wire {
+		t.Fatalf("AppendMuxRespHeader = %s, want %s", got, wire)
+	}
+	raw, _ := hex.DecodeString(wire)
+	if h, err := ReadMuxHeader(bytes.NewReader(raw), true); err != nil || h != resp {
+		t.Fatalf("ReadMuxHeader = %+v, %v", h, err)
+	}
+	if _, err := ReadMuxHeader(bytes.NewReader([]byte{0xFE, 0}), false); err != ErrBadMagic {
+		t.Fatalf("ReadMuxHeader without magic: err = %v", err)
+	}
+}
+
+func TestChunkFrame(t *testing.T) {
+	frame := AppendChunkFrame(nil, []byte(`{"a":1}`), []byte{1, 2})
+	if got := hex.EncodeToString(frame); got != "000000077b2261223a317d0102" {
+		t.Fatalf("AppendChunkFrame = %s", got)
+	}
+	header, data, err := ParseChunkFrame(frame)
+	if err != nil || string(header) != `{"a":1}` || !bytes.Equal(data, []byte{1, 2}) {
+		t.Fatalf("ParseChunkFrame = %q, %v, %v", header, data, err)
+	}
+
+	for _, bad := range []string{"", "000000", "00000008" + "7b7d", "00001001"} {
+		raw, _ := hex.DecodeString(bad)
+		if _, _, err := ParseChunkFrame(raw); err != ErrBadChunkFrame {
+			t.Errorf("ParseChunkFrame(%s) err = %v", bad, err)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	WriteMessage(&buf, MsgHello, []byte(`{"device_id":"a"}`))
+	WriteMessage(&buf, MsgPing, nil)
+	big := bytes.Repeat([]byte("z"), 70000)
+	WriteMessage(&buf, MsgSocket, big)
+
+	if typ, body, err := ReadMessage(&buf, DefaultMaxMessage); err != nil || typ != MsgHello || string(body) != `{"device_id":"a"}` {
+		t.Fatalf("hello: %x %q %v", typ, body, err)
+	}
+	if typ, body, err := ReadMessage(&buf, DefaultMaxMessage); err != nil || typ != MsgPing || len(body) != 0 {
+		t.Fatalf("ping: %x %q %v", typ, body, err)
+	}
+	_, _, err := ReadMessage(&buf, 1000)
+	var tooLarge *TooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Len != 70000 {
+		t.Fatalf("over limit: err = %v", err)
+	}
+	if buf.Len() != 70000 {
+		t.Fatalf("body of a refused message was read")
+	}
+
+	// Truncated body
+	buf.Reset()
+	WriteMessage(&buf, MsgSocket, []byte("hello"))
+	buf.Truncate(buf.Len() - 1)
+	if _, _, err := ReadMessage(&buf, DefaultMaxMessage); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated: err = %v", err)
+	}
+}
+
+func startServer(t *testing.T, s *Server) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return &Client{Addr: l.Addr().String()}
+}
+
+func echo(req *Request) Response {
+	return Response{Type: req.Type + 1, Status: 200, Body: req.Payload}
+}
+
+func TestClientServer(t *testing.T) {
+	c := startServer(t, &Server{Handler: echo, MaxRequest: 100000})
+
+	for _, size := range []int{0, 10, 0xFFFF, 70000} {
+		payload := bytes.Repeat([]byte("p"), size)
+		resp, err := c.Call(0xA1, payload)
+		if err != nil || resp.Type != 0xA2 || resp.Status != 200 || !bytes.Equal(resp.Body, payload) {
+			t.Fatalf("size %d: %d %d %v", size, resp.Status, len(resp.Body), err)
+		}
+	}
+
+	resp, err := c.Call(0xA1, make([]byte, 100001))
+	if err != nil || resp.Status != 413 {
+		t.Fatalf("too large: %d %v", resp.Status, err)
+	}
+	if env, err := resp.Envelope(); err != nil || env.Code != "TOO_LARGE" {
+		t.Fatalf("too large envelope: %+v %v", env, err)
+	}
+}
+
+func TestMux(t *testing.T) {
+	c := startServer(t, &Server{Handler: echo, MaxRequest: 100000})
+	m, err := c.DialMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf("request %d %s", i, strings.Repeat("x", i*5000)))
+			resp, err := m.Call(0xB1, payload)
+			if err != nil || resp.Type != 0xB2 || !bytes.Equal(resp.Body, payload) {
+				t.Errorf("request %d: %d %v", i, len(resp.Body), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// An oversized request is refused without losing the connection
+	if resp, err := m.Call(0xB1, make([]byte, 100001)); err != nil || resp.Status != 413 {
+		t.Fatalf("too large: %d %v", resp.Status, err)
+	}
+	if resp, err := m.Call(0xB1, []byte("after")); err != nil || string(resp.Body) != "after" {
+		t.Fatalf("after refusal: %q %v", resp.Body, err)
+	}
+
+	m.Close()
+	if _, err := m.Call(0xB1, nil); err != ErrClosed {
+		t.Fatalf("closed: err = %v", err)
+	}
+}
+
+func TestMuxRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// What the C server sends when it is at its connection limit
+		ReadMuxHeader(conn, false)
+		body := ErrorBody("BUSY", "Server busy")
+		conn.Write(append(AppendMuxRespHeader(nil, MuxHeader{Len: uint32(len(body)), Status: 503}), body...))
+		conn.Close()
+	}()
+
+	m, err := (&Client{Addr: l.Addr().String()}).DialMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	resp, err := m.Call(0xB1, []byte("x"))
+	if err != nil || resp.Status != 503 {
+		t.Fatalf("refused: %d %v", resp.Status, err)
+	}
+}
@@ -1,8 +1,11 @@
 #include "core.h"
+#include "../protocol/envelope.h"
 #include <stdlib.h>
+#include <errno.h>
 #include <stdio.h>
 #include <string.h>
 #include <unistd.h>
+#include <sys/socket.h>
 
 // Internal struct to pass context to threads
 typedef struct {
@@ -14,93 +17,176 @@ typedef struct {
     ServerContext *ctx;
     int socket;
     char device_id[64];
+    char ip[64];
 } client_t;
 
-// --- Helper Functions (From old main.c but now using Context) ---
+// --- Session Table ---
+// ctx->lock guards the buckets, refcounts and last_seen/last_ping. Socket
+// writes only take the session's write_lock, so a slow device does not stall
+// sends to the others.
 
-void add_client_to_list(ServerContext *ctx, char *device_id, int socket) {
-    pthread_mutex_lock(&ctx->lock);
-    client_node_t *new_node = (client_node_t *)malloc(sizeof(client_node_t));
-    strncpy(new_node->device_id, device_id, 63);
-    new_node->device_id[63] = '\0';
-    new_node->socket = socket;
-    new_node->next = ctx->head;
-    ctx->head = new_node;
-    pthread_mutex_unlock(&ctx->lock);
+static unsigned _session_bucket(const char *device_id) {
+    unsigned h = 2166136261u; // FNV-1a
+    for (const unsigned char *p = (const unsigned char *)device_id; *p; p++) {
+        h = (h ^ *p) * 16777619u;
+    }
+    return h % SESSION_BUCKETS;
 }
 
-void remove_client_from_list(ServerContext *ctx, char *device_id) {
-    pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head, *prev = NULL;
+// Caller holds ctx->lock
+static client_session_t *_session_find(ServerContext *ctx, const char *device_id) {
+    client_session_t *s = ctx->sessions[_session_bucket(device_id)];
+    while (s != NULL && strcmp(s->device_id, device_id) != 0) {
+        s = s->next;
+    }
+    return s;
+}
+
+// Remove from the table and drop the table's reference (caller holds ctx->lock;
+// the owning thread still holds one, so this never frees)
+static void _session_unlink(ServerContext *ctx, client_session_t *session) {
+    client_session_t **link = &ctx->sessions[_session_bucket(session->device_id)];
+    while (*link != NULL && *link != session) {
+        link = &(*link)->next;
+    }
+    if (*link == session) {
+        *link = session->next;
+    }
+    session->next = NULL;
+    session->registered = 0;
+    session->refcount--;
+    ctx->session_count--;
+}
 
-    if (temp != NULL && strcmp(temp->device_id, device_id) == 0) {
-        ctx->head = temp->next;
-        free(temp);
+static void _session_free(client_session_t *session) {
+    proto_close(session->socket);
+    pthread_mutex_destroy(&session->write_lock);
+    free(session);
+}
+
+// Register a new connection, applying ctx->duplicate_policy if the device is
+// already connected. Returns the session with a reference for the caller, or
+// NULL if the connection was refused.
+client_session_t *session_register(ServerContext *ctx, char *device_id, int socket, char *ip) {
+    client_session_t *session = calloc(1, sizeof(client_session_t));
+    if (!session) return NULL;
+    strncpy(session->device_id, device_id, sizeof(session->device_id) - 1);
+    strncpy(session->ip, ip, sizeof(session->ip) - 1);
+    session->socket = socket;
+    session->last_seen = time(NULL);
+    session->refcount = 2; // Table + caller
+    session->registered = 1;
+    pthread_mutex_init(&session->write_lock, NULL);
+
+    pthread_mutex_lock(&ctx->lock);
+    client_session_t *old = _session_find(ctx, device_id);
+    if (old != NULL && ctx->duplicate_policy == DUPLICATE_REJECT) {
         pthread_mutex_unlock(&ctx->lock);
-        return;
+        pthread_mutex_destroy(&session->write_lock);
+        free(session);
+        return NULL;
+    }
+    if (old != NULL) {
+        old->refcount++; // Keep it alive until it has been told
+        _session_unlink(ctx, old);
     }
+    unsigned bucket = _session_bucket(device_id);
+    session->next = ctx->sessions[bucket];
+    ctx->sessions[bucket] = session;
+    ctx->session_count++;
+    pthread_mutex_unlock(&ctx->lock);
 
-    while (temp != NULL && strcmp(temp->device_id, device_id) != 0) {
-        prev = temp;
-        temp = temp->next;
+    if (old != NULL) {
+        // Its thread sees the read fail, cleans up and releases the socket
+        printf("[Notification] %s connected again from %s, closing the previous connection\n", device_id, ip);
+        const char *notice = "Replaced by a newer connection\n";
+        session_send(old, MSG_SOCKET, notice, strlen(notice));
+        shutdown(old->socket, SHUT_RDWR);
+        session_release(ctx, old);
     }
+    return session;
+}
 
-    if (temp == NULL) {
-        pthread_mutex_unlock(&ctx->lock);
-        return;
+// Take the session out of the table if it is still the registered one.
+// Returns 1 if it was (the device is now offline), 0 if it had been replaced.
+int session_unregister(ServerContext *ctx, client_session_t *session) {
+    pthread_mutex_lock(&ctx->lock);
+    int was_registered = session->registered;
+    if (was_registered) {
+        _session_unlink(ctx, session);
     }
+    pthread_mutex_unlock(&ctx->lock);
+    return was_registered;
+}
 
-    prev->next = temp->next;
-    free(temp);
+// Look up a connected device and take a reference (NULL if offline)
+client_session_t *session_acquire(ServerContext *ctx, const char *device_id) {
+    pthread_mutex_lock(&ctx->lock);
+    client_session_t *session = _session_find(ctx, device_id);
+    if (session) session->refcount++;
     pthread_mutex_unlock(&ctx->lock);
+    return session;
 }
 
+void session_release(ServerContext *ctx, client_session_t *session) {
+    pthread_mutex_lock(&ctx->lock);
+    int last = --session->refcount == 0;
+    pthread_mutex_unlock(&ctx->lock);
+    if (last) {
+        _session_free(session);
+    }
+}
+
+int session_send(client_session_t *session, uint8_t type, const void *data, uint32_t len) {
+    pthread_mutex_lock(&session->write_lock);
+    int r = send_message(session->socket, type, data, len);
+    pthread_mutex_unlock(&session->write_lock);
+    return r;
+}
+
+// Record traffic from a peer so the heartbeat does not evict it
+static void _session_touch(ServerContext *ctx, client_session_t *session) {
+    pthread_mutex_lock(&ctx->lock);
+    session->last_seen = time(NULL);
+    pthread_mutex_unlock(&ctx->lock);
+}
+
+// --- Helper Functions (From old main.c but now using Context) ---
 
 void print_online_users(ServerContext *ctx) {
     pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head;
     printf("Online Users: ");
-    while (temp != NULL) {
-        printf("%s ", temp->device_id);
-        temp = temp->next;
+    for (int i = 0; i < SESSION_BUCKETS; i++) {
+        for (client_session_t *s = ctx->sessions[i]; s != NULL; s = s->next) {
+            printf("%s ", s->device_id);
+        }
     }
     printf("\n");
     pthread_mutex_unlock(&ctx->lock);
 }
 
 int server_send_to_device(ServerContext *ctx, char *target_device_id, uint8_t type, char *payload) {
-    pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head;
-    while(temp != NULL) {
-        if (strcmp(temp->device_id, target_device_id) == 0) {
-            // Found
-            proto_header_t header;
-            header.type = type;
-            int len = strlen(payload);
-            header.len = htons(len);
-            write(temp->socket, &header, sizeof(header));
-            write(temp->socket, payload, len);
-            pthread_mutex_unlock(&ctx->lock);
-            return 1;
-        }
-        temp = temp->next;
+    size_t len = strlen(payload);
+    if (len > ctx->max_message_size) {
+        printf("[Notification] Not sending %zu bytes to %s: exceeds max message size %u\n", len, target_device_id, ctx->max_message_size);
+        return 0;
     }
-    pthread_mutex_unlock(&ctx->lock);
-    return 0;
+
+    client_session_t *session = session_acquire(ctx, target_device_id);
+    if (!session) return 0;
+    int ok = session_send(session, type, payload, (uint32_t)len) == 0;
+    session_release(ctx, session);
+    return ok;
 }
 
 void broadcast_message(ServerContext *ctx, char *sender_id, char *message) {
-    pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head;
-    while (temp != NULL) {
-        // Only send notifications to ADMIN_CONSOLE, and not back to sender
-        if ((sender_id == NULL || strcmp(temp->device_id, sender_id) != 0) &&
-            strcmp(temp->device_id, "ADMIN_CONSOLE") == 0) {
-            send_packet(temp->socket, message, strlen(message));
-        }
-        temp = temp->next;
-    }
-    pthread_mutex_unlock(&ctx->lock);
+    // Only send notifications to ADMIN_CONSOLE, and not back to sender
+    if (sender_id != NULL && strcmp(sender_id, "ADMIN_CONSOLE") == 0) return;
+
+    client_session_t *session = session_acquire(ctx, "ADMIN_CONSOLE");
+    if (!session) return;
+    session_send(session, MSG_SOCKET, message, strlen(message));
+    session_release(ctx, session);
 }
 
 // --- Handlers ---
@@ -111,75 +197,186 @@ void *handle_client(void *arg) {
     int sock = client_info->socket;
     char device_id[64];
     int read_size;
-    char client_message[BUFFER_SIZE];
+    char *client_message;
+    uint8_t msg_type;
     char message[BUFFER_SIZE];
 
-    // Read Device ID
-    char id_buffer[128];
-    if (recv_packet(sock, id_buffer) <= 0) {
-        close(sock);
+    if (ctx->tls && proto_tls_accept(ctx->tls, sock) < 0) {
+        printf("[Notification] TLS handshake failed\n");
+        proto_close(sock);
+        pthread_mutex_lock(&ctx->lock);
+        ctx->active_clients--;
+        pthread_mutex_unlock(&ctx->lock);
+        free(client_info);
+        return 0;
+    }
+
+    // Read the greeting: a MSG_HELLO, or the bare device ID from older agents
+    char *hello = NULL;
+    uint8_t hello_type = 0;
+    int hello_len = recv_message(sock, &hello_type, &hello, ctx->max_message_size);
+    if (hello_len > 0 && hello_type == MSG_HELLO &&
+        !json_get_string(hello, "device_id", device_id, sizeof(device_id))) {
+        hello_len = 0; // No device ID to register
+    }
+    if (hello_len <= 0) {
+        free(hello);
+        proto_close(sock);
+        pthread_mutex_lock(&ctx->lock);
+        ctx->active_clients--;
+        pthread_mutex_unlock(&ctx->lock);
+        free(client_info);
+        return 0;
+    }
+    if (hello_type != MSG_HELLO) {
+        strncpy(device_id, hello, 63);
+        device_id[63] = '\0';
+        free(hello);
+        hello = NULL; // Protocol 1
+    }
+
+    // With TLS, the certificate decides who the peer is, not the claimed ID.
+    // A device issued a certificate must present it even if it is optional.
+    if (ctx->tls) {
+        char peer_cn[64];
+        int has_cert = proto_peer_cn(sock, peer_cn, sizeof(peer_cn));
+        int need_cert = ctx->require_client_cert || (ctx->cert_required && ctx->cert_required(device_id));
+        if ((has_cert && strcmp(peer_cn, device_id) != 0) || (!has_cert && need_cert)) {
+            printf("[Notification] Rejecting %s: certificate CN '%s' does not match\n", device_id, has_cert ? peer_cn : "");
+            sprintf(message, "Certificate does not match device %s\n", device_id);
+            send_packet(sock, message, strlen(message));
+            proto_close(sock);
+            pthread_mutex_lock(&ctx->lock);
+            ctx->active_clients--;
+            pthread_mutex_unlock(&ctx->lock);
+            free(hello);
+            free(client_info);
+            return 0;
+        }
+    }
+
+    // Version check and capabilities; reply is the MSG_HELLO answer or the
+    // reason for refusing the agent
+    char reply[BUFFER_SIZE];
+    int accepted = 1;
+    snprintf(reply, sizeof(reply), "{\"protocol\":%d}", PROTOCOL_VERSION);
+    if (ctx->on_hello) {
+        accepted = ctx->on_hello(device_id, hello, reply, sizeof(reply));
+    }
+    int is_hello = (hello != NULL);
+    free(hello);
+    if (!accepted) {
+        printf("[Notification] Refusing %s: %s\n", device_id, reply);
+        if (is_hello) {
+            send_message(sock, MSG_HELLO_REJECT, reply, strlen(reply));
+        } else {
+            send_packet(sock, reply, strlen(reply));
+        }
+        proto_close(sock);
+        pthread_mutex_lock(&ctx->lock);
+        ctx->active_clients--;
+        pthread_mutex_unlock(&ctx->lock);
         free(client_info);
         return 0;
     }
-    // Just wrap it if needed or use directly
-    strncpy(device_id, id_buffer, 63);
-    device_id[63] = '\0';
     strcpy(client_info->device_id, device_id);
     
-    add_client_to_list(ctx, device_id, sock);
+    client_session_t *session = session_register(ctx, device_id, sock, client_info->ip);
+    if (!session) {
+        printf("[Notification] Rejecting %s: already connected\n", device_id);
+        sprintf(message, "Device %s is already connected\n", device_id);
+        send_packet(sock, message, strlen(message));
+        proto_close(sock);
+        pthread_mutex_lock(&ctx->lock);
+        ctx->active_clients--;
+        pthread_mutex_unlock(&ctx->lock);
+        free(client_info);
+        return 0;
+    }
     print_online_users(ctx);
     
-    // Broadcast join (Only to Admin)
     // Broadcast join (Only to Admin)
     sprintf(message, "Device %s Online\n", device_id);
     broadcast_message(ctx, device_id, message);
 
-    // Removed duplicate broadcast call
-
-
     // Call Go Callback if set
     if (ctx->on_connect) {
         ctx->on_connect(device_id);
     }
+    time_t last_reported = time(NULL);
+    if (ctx->on_seen) {
+        ctx->on_seen(device_id, client_info->ip);
+    }
+
+    if (is_hello) {
+        session_send(session, MSG_HELLO, reply, strlen(reply));
+    } else {
+        sprintf(message, "Hello %s from server handler\n", device_id);
+        session_send(session, MSG_SOCKET, message, strlen(message));
+    }
 
-    sprintf(message, "Hello %s from server handler\n", device_id);
-    send_packet(sock, message, strlen(message));
+    // Reading takes no lock: the transport keeps this thread's reads and the
+    // senders' session_send calls from overlapping inside OpenSSL
+    while ((read_size = recv_message(sock, &msg_type, &client_message, ctx->max_message_size)) >= 0) {
+        _session_touch(ctx, session);
+        if (ctx->on_seen && time(NULL) - last_reported >= SEEN_REPORT_INTERVAL) {
+            last_reported = time(NULL);
+            ctx->on_seen(device_id, client_info->ip);
+        }
 
-    while ((read_size = recv_packet(sock, client_message)) > 0) {
-        printf("Client %s: %s\n", device_id, client_message);
-        send_packet(sock, client_message, strlen(client_message)); // Echo back
+        if (msg_type == MSG_PING) {
+            session_send(session, MSG_PONG, NULL, 0);
+        } else if (msg_type != MSG_PONG && read_size > 0) {
+            printf("Client %s: %s\n", device_id, client_message);
+            session_send(session, MSG_SOCKET, client_message, (uint32_t)read_size); // Echo back
+        }
+        free(client_message);
     }
 
-    if (read_size == 0 || read_size == -1) {
+    if (read_size == -2) {
+         printf("Client %s sent an oversized message, disconnecting\n", device_id);
+    } else {
          printf("Client %s disconnected\n", device_id);
     }
 
-    remove_client_from_list(ctx, device_id);
+    // A replaced connection leaves the newer session alone
+    int went_offline = session_unregister(ctx, session);
+    session_release(ctx, session); // Closes the socket once no sender holds it
     print_online_users(ctx);
     
     // Broadcast leave
-    sprintf(message, "Device %s Offline\n", device_id);
-    broadcast_message(ctx, device_id, message);
+    if (went_offline) {
+        sprintf(message, "Device %s Offline\n", device_id);
+        broadcast_message(ctx, device_id, message);
+    }
 
     pthread_mutex_lock(&ctx->lock);
     ctx->active_clients--;
     printf("Total active clients: %d\n", ctx->active_clients);
     pthread_mutex_unlock(&ctx->lock);
 
-    close(sock);
     free(client_info);
     return 0;
 }
 
+static void _mux_accept(ServerContext *ctx, int sock);
+
 void *handle_api_request(void *arg) {
     ThreadArgs *args = (ThreadArgs*)arg;
     int sock = args->socket;
     ServerContext *ctx = args->ctx;
+
+    if (ctx->tls && proto_tls_accept(ctx->tls, sock) < 0) {
+        printf("[API] TLS handshake failed\n");
+        proto_close(sock);
+        free(arg);
+        return 0;
+    }
     
     // Read Header (1st byte)
     uint8_t first_byte;
-    if (recv(sock, &first_byte, 1, 0) <= 0) {
-        close(sock);
+    if (proto_read_full(sock, &first_byte, 1) <= 0) {
+        proto_close(sock);
         free(arg);
         return 0;
     }
@@ -187,14 +384,21 @@ void *handle_api_request(void *arg) {
     uint8_t req_type;
     uint32_t payload_len;
 
+    if (first_byte == PROTOCOL_MAGIC_MUX) {
+        // Long-lived connection: it gets its own reader and this worker moves on
+        _mux_accept(ctx, sock);
+        free(arg);
+        return 0;
+    }
+
     if (first_byte == PROTOCOL_MAGIC_EXT) {
         // Extended Header (0xFE + type + uint32_t len)
         struct {
             uint8_t type;
             uint32_t len;
         } __attribute__((packed)) ext;
-        if (recv(sock, &ext, sizeof(ext), 0) <= 0) {
-            close(sock);
+        if (proto_read_full(sock, &ext, sizeof(ext)) <= 0) {
+            proto_close(sock);
             free(arg);
             return 0;
         }
@@ -205,25 +409,32 @@ void *handle_api_request(void *arg) {
         // Standard Header (type + uint16_t len)
         req_type = first_byte;
         uint16_t len16;
-        if (recv(sock, &len16, sizeof(len16), 0) <= 0) {
-            close(sock);
+        if (proto_read_full(sock, &len16, sizeof(len16)) <= 0) {
+            proto_close(sock);
             free(arg);
             return 0;
         }
         payload_len = ntohs(len16);
     }
 
+    if (payload_len > ctx->max_request_size) {
+        printf("[API] Refusing request 0x%02X of %u bytes (limit %u)\n", req_type, payload_len, ctx->max_request_size);
+        server_send_error(sock, 0, 413, "TOO_LARGE", "Request too large");
+        free(arg);
+        return 0;
+    }
+
     // Read Body
     char *payload = malloc(payload_len + 1);
     if (!payload) {
-        close(sock);
+        proto_close(sock);
         free(arg);
         return 0;
     }
     
     uint32_t total_read = 0;
     while (total_read < payload_len) {
-        int r = recv(sock, payload + total_read, payload_len - total_read, 0);
+        int r = proto_read(sock, payload + total_read, payload_len - total_read);
         if (r <= 0) break;
         total_read += r;
     }
@@ -232,7 +443,7 @@ void *handle_api_request(void *arg) {
     // Delegate to Handler if set
     if (ctx->handler) {
         printf("[API] Delegating to Handler\n");
-        ctx->handler(sock, req_type, payload);
+        ctx->handler(sock, req_type, payload, total_read);
         // Handler is responsible for response and closing socket
         // But wait, if handler is async/go, we might need to be careful.
         // Assuming handler is blocking for this request.
@@ -243,52 +454,553 @@ void *handle_api_request(void *arg) {
         return 0;
     }
 
-    api_resp_header_t resp_header;
+    int status;
     char response_body[BUFFER_SIZE];
     
     if (req_type == MSG_LOGIN_REQ) {
         printf("[API] Login Request: %s\n", payload);
         if (strstr(payload, "\"username\": \"admin\"") && strstr(payload, "\"password\": \"admin\"")) {
-            resp_header.status = htons(200);
+            status = 200;
             sprintf(response_body, "{\"message\": \"Login Successful\"}");
         } else {
-            resp_header.status = htons(401);
-            sprintf(response_body, "{\"error\": \"Invalid Credentials\"}");
+            free(payload);
+            free(arg);
+            server_send_error(sock, MSG_LOGIN_RESP, 401, "UNAUTHENTICATED", "Invalid Credentials");
+            return 0;
         }
     } else if (req_type == MSG_LIST_REQ) {
         printf("[API] List Request\n");
         // Build JSON List
         strcpy(response_body, "{\"users\": [");
         pthread_mutex_lock(&ctx->lock);
-        client_node_t *temp = ctx->head;
-        while (temp != NULL) {
-            char id_str[64];
-            sprintf(id_str, "\"%s\"", temp->device_id); // Quote the string
-            strcat(response_body, id_str);
-            if (temp->next != NULL) strcat(response_body, ", ");
-            temp = temp->next;
+        int first = 1;
+        for (int i = 0; i < SESSION_BUCKETS; i++) {
+            for (client_session_t *temp = ctx->sessions[i]; temp != NULL; temp = temp->next) {
+                char id_str[72];
+                sprintf(id_str, "%s\"%s\"", first ? "" : ", ", temp->device_id); // Quote the string
+                if (strlen(response_body) + strlen(id_str) + 3 > sizeof(response_body)) break;
+                strcat(response_body, id_str);
+                first = 0;
+            }
         }
         pthread_mutex_unlock(&ctx->lock);
         strcat(response_body, "]}");
-        resp_header.status = htons(200);
+        status = 200;
 
     } else {
-         resp_header.status = htons(400); 
-         sprintf(response_body, "{\"error\": \"Unknown Request Type\"}");
+        free(payload);
+        free(arg);
+        server_send_error(sock, MSG_LOGIN_RESP, 400, "UNKNOWN_ROUTE", "Unknown Request Type");
+        return 0;
     }
-    
-    resp_header.type = MSG_LOGIN_RESP;
-    resp_header.len = htons(strlen(response_body));
-    
-    write(sock, &resp_header, sizeof(resp_header));
-    write(sock, response_body, strlen(response_body));
+
+    char id[ENVELOPE_ID_SIZE];
+    char envelope[BUFFER_SIZE + 256];
+    envelope_new_id(id);
+    envelope_format(envelope, sizeof(envelope), id, "OK", NULL, response_body);
+    server_send_response(sock, MSG_LOGIN_RESP, status, envelope);
 
     free(payload);
-    close(sock);
     free(arg);
     return 0;
 }
 
+// --- Limits ---
+
+#define BUSY_IO_TIMEOUT 2   // Seconds a refused peer gets per read or write
+#define BUSY_DEADLINE 5     // Seconds spent reading a refused peer's request in all
+#define BUSY_MAX_REJECTS 32 // Refusals answered at once; peers beyond are just closed
+#define API_IO_TIMEOUT 30   // A stalled API client must not hold a worker forever
+#define LISTEN_BACKLOG 128
+
+static void _set_io_timeout(int sock, int seconds) {
+    struct timeval tv;
+    tv.tv_sec = seconds;
+    tv.tv_usec = 0;
+    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
+    setsockopt(sock, SOL_SOCKET, SO_SNDTIMEO, (const char*)&tv, sizeof tv);
+}
+
+typedef struct {
+    ServerContext *ctx;
+    int sock;
+    int is_api;
+} busy_reject_t;
+
+static void *_reject_busy_thread(void *arg) {
+    busy_reject_t *reject = (busy_reject_t *)arg;
+    ServerContext *ctx = reject->ctx;
+    int sock = reject->sock;
+    time_t deadline = time(NULL) + BUSY_DEADLINE;
+
+    _set_io_timeout(sock, BUSY_IO_TIMEOUT);
+    if (ctx->tls && proto_tls_accept(ctx->tls, sock) < 0) {
+        proto_close(sock);
+    } else if (reject->is_api) {
+        // Consume the request so closing does not reset the connection
+        // before the client has read the status, unless it drags on
+        uint8_t type;
+        uint32_t len;
+        if (proto_recv_header(sock, &type, &len) == 0 && len <= ctx->max_request_size) {
+            char scratch[BUFFER_SIZE];
+            while (len > 0 && time(NULL) < deadline) {
+                ssize_t r = proto_read(sock, scratch, len < sizeof(scratch) ? len : sizeof(scratch));
+                if (r <= 0) break;
+                len -= (uint32_t)r;
+            }
+        }
+        server_send_error(sock, 0, 503, "BUSY", "Server busy");
+    } else {
+        const char *msg = "Server busy\n";
+        send_message(sock, MSG_BUSY, msg, strlen(msg));
+        proto_close(sock);
+    }
+
+    pthread_mutex_lock(&ctx->lock);
+    ctx->busy_rejects--;
+    pthread_mutex_unlock(&ctx->lock);
+    free(reject);
+    return 0;
+}
+
+// Tell a peer over the limits to back off. The handshake and the answer
+// happen on a detached thread, so the accept thread never waits on the
+// peer; with BUSY_MAX_REJECTS of those running the peer is closed unanswered.
+static void _reject_busy(ServerContext *ctx, int sock, int is_api) {
+    pthread_mutex_lock(&ctx->lock);
+    int spare = ctx->busy_rejects < BUSY_MAX_REJECTS;
+    if (spare) ctx->busy_rejects++;
+    pthread_mutex_unlock(&ctx->lock);
+
+    if (spare) {
+        busy_reject_t *reject = malloc(sizeof(busy_reject_t));
+        pthread_t thread;
+        if (reject) {
+            reject->ctx = ctx;
+            reject->sock = sock;
+            reject->is_api = is_api;
+            if (pthread_create(&thread, NULL, _reject_busy_thread, reject) == 0) {
+                pthread_detach(thread);
+                return;
+            }
+            free(reject);
+        }
+        pthread_mutex_lock(&ctx->lock);
+        ctx->busy_rejects--;
+        pthread_mutex_unlock(&ctx->lock);
+    }
+    close(sock); // Not handshaken yet, so there is no TLS state to shut down
+}
+
+// --- Multiplexed API connections ---
+// A reader thread per connection turns frames into requests, which wait in
+// the API queue as handles like any accepted socket. A worker runs the
+// handler; the response is framed with the request ID under the
+// connection's write lock, so requests finish in any order.
+
+#define ERROR_BODY_SIZE (ENVELOPE_MESSAGE_SIZE * 2 + 128)
+#define MUX_POLL_MS 1000
+
+typedef struct mux_conn {
+    ServerContext *ctx;
+    int socket;
+    int refcount;               // Reader + one per open stream, guarded by _mux_lock
+    int inflight;               // Open streams, guarded by _mux_lock
+    uint64_t inflight_bytes;    // Their payload bytes, guarded by _mux_lock
+    pthread_cond_t drained;     // Signalled when inflight_bytes drops
+    pthread_mutex_t write_lock; // One frame at a time; the reader needs no lock (see proto_read)
+    struct mux_conn *next;      // ctx->mux_conns
+} mux_conn_t;
+
+typedef struct {
+    mux_conn_t *conn;
+    uint32_t request_id;
+    uint8_t type;
+    char *payload;
+    uint32_t payload_len;
+    int answered;
+} mux_stream_t;
+
+// server_send_response has no context to find a stream in, so the table of
+// open streams (indexed by handle - MUX_HANDLE_BASE) is process-wide.
+static mux_stream_t *_mux_streams[MUX_MAX_STREAMS];
+static int _mux_next_slot;
+static pthread_mutex_t _mux_lock = PTHREAD_MUTEX_INITIALIZER;
+
+static void _error_body(char *body, size_t size, int status, const char *code, const char *message) {
+    char id[ENVELOPE_ID_SIZE];
+
+    envelope_new_id(id);
+    printf("[API] %s %d %s: %s\n", id, status, code, message);
+    envelope_format(body, size, id, code, message, NULL);
+}
+
+static int _is_mux_handle(int sock) {
+    return sock >= MUX_HANDLE_BASE && sock < MUX_HANDLE_BASE + MUX_MAX_STREAMS;
+}
+
+static int _mux_write(mux_conn_t *conn, uint8_t type, uint32_t request_id, int status, const char *body, uint32_t len) {
+    api_mux_resp_header_t header;
+
+    header.magic = PROTOCOL_MAGIC_MUX;
+    header.type = type;
+    header.request_id = htonl(request_id);
+    header.len = htonl(len);
+    header.status = htons(status);
+
+    pthread_mutex_lock(&conn->write_lock);
+    int r = proto_write(conn->socket, &header, sizeof(header));
+    if (r >= 0 && len > 0) r = proto_write(conn->socket, body, len);
+    pthread_mutex_unlock(&conn->write_lock);
+    return r < 0 ? -1 : 0;
+}
+
+static void _mux_write_error(mux_conn_t *conn, uint32_t request_id, int status, const char *code, const char *message) {
+    char body[ERROR_BODY_SIZE];
+
+    _error_body(body, sizeof(body), status, code, message);
+    _mux_write(conn, 0, request_id, status, body, (uint32_t)strlen(body));
+}
+
+static void _mux_conn_release(mux_conn_t *conn) {
+    pthread_mutex_lock(&_mux_lock);
+    int last = --conn->refcount == 0;
+    pthread_mutex_unlock(&_mux_lock);
+    if (last) {
+        proto_close(conn->socket);
+        pthread_mutex_destroy(&conn->write_lock);
+        pthread_cond_destroy(&conn->drained);
+        free(conn);
+    }
+}
+
+// Make room for a len byte request in the connection's byte budget, waiting
+// for earlier requests to finish if needed. One request always fits, so any
+// size up to max_request_size gets through.
+static void _mux_reserve(mux_conn_t *conn, uint32_t len) {
+    pthread_mutex_lock(&_mux_lock);
+    while (conn->inflight_bytes > 0 && conn->inflight_bytes + len > MUX_MAX_INFLIGHT_BYTES) {
+        pthread_cond_wait(&conn->drained, &_mux_lock);
+    }
+    conn->inflight_bytes += len;
+    pthread_mutex_unlock(&_mux_lock);
+}
+
+static void _mux_unreserve(mux_conn_t *conn, uint32_t len) {
+    pthread_mutex_lock(&_mux_lock);
+    conn->inflight_bytes -= len;
+    pthread_cond_signal(&conn->drained);
+    pthread_mutex_unlock(&_mux_lock);
+}
+
+// Register a request. Returns its handle, or -1 if the connection or the
+// server has too many in flight. Takes ownership of payload on success.
+static int _mux_open(mux_conn_t *conn, uint8_t type, uint32_t request_id, char *payload, uint32_t payload_len) {
+    mux_stream_t *stream = malloc(sizeof(mux_stream_t));
+    if (!stream) return -1;
+    stream->conn = conn;
+    stream->request_id = request_id;
+    stream->type = type;
+    stream->payload = payload;
+    stream->payload_len = payload_len;
+    stream->answered = 0;
+
+    int handle = -1;
+    pthread_mutex_lock(&_mux_lock);
+    if (conn->inflight < MUX_MAX_INFLIGHT) {
+        for (int i = 0; i < MUX_MAX_STREAMS; i++) {
+            int slot = (_mux_next_slot + i) % MUX_MAX_STREAMS;
+            if (!_mux_streams[slot]) {
+                _mux_streams[slot] = stream;
+                _mux_next_slot = (slot + 1) % MUX_MAX_STREAMS;
+                conn->inflight++;
+                conn->refcount++;
+                handle = MUX_HANDLE_BASE + slot;
+                break;
+            }
+        }
+    }
+    pthread_mutex_unlock(&_mux_lock);
+
+    if (handle == -1) free(stream);
+    return handle;
+}
+
+// Answer a request that never got a response, then forget it
+static void _mux_finish(int handle) {
+    pthread_mutex_lock(&_mux_lock);
+    mux_stream_t *stream = _mux_streams[handle - MUX_HANDLE_BASE];
+    int answered = stream->answered;
+    stream->answered = 1;
+    pthread_mutex_unlock(&_mux_lock);
+
+    if (!answered) {
+        _mux_write_error(stream->conn, stream->request_id, 500, "INTERNAL", "No response");
+    }
+
+    pthread_mutex_lock(&_mux_lock);
+    _mux_streams[handle - MUX_HANDLE_BASE] = NULL;
+    stream->conn->inflight--;
+    stream->conn->inflight_bytes -= stream->payload_len;
+    pthread_cond_signal(&stream->conn->drained);
+    pthread_mutex_unlock(&_mux_lock);
+
+    _mux_conn_release(stream->conn);
+    free(stream->payload);
+    free(stream);
+}
+
+// Called by server_send_response for a multiplexed handle
+static void _mux_respond(int handle, int type, int status, const char *body, uint32_t len) {
+    pthread_mutex_lock(&_mux_lock);
+    mux_stream_t *stream = _mux_streams[handle - MUX_HANDLE_BASE];
+    int answered = !stream || stream->answered;
+    if (stream) stream->answered = 1;
+    pthread_mutex_unlock(&_mux_lock);
+
+    if (answered) return; // One response per request
+    _mux_write(stream->conn, (uint8_t)type, stream->request_id, status, body, len);
+}
+
+// The real socket behind a handle (or the socket itself)
+static int _mux_socket(int sock) {
+    if (!_is_mux_handle(sock)) return sock;
+
+    pthread_mutex_lock(&_mux_lock);
+    mux_stream_t *stream = _mux_streams[sock - MUX_HANDLE_BASE];
+    int real = stream ? stream->conn->socket : -1;
+    pthread_mutex_unlock(&_mux_lock);
+    return real;
+}
+
+// Run one queued multiplexed request on a worker
+static void _mux_serve(ServerContext *ctx, int handle) {
+    mux_stream_t *stream = _mux_streams[handle - MUX_HANDLE_BASE]; // Only _mux_finish clears it
+
+    if (ctx->handler) {
+        ctx->handler(handle, stream->type, stream->payload, stream->payload_len);
+    } else {
+        server_send_error(handle, 0, 400, "UNKNOWN_ROUTE", "Unknown Request Type");
+    }
+    _mux_finish(handle);
+}
+
+static int _api_enqueue(ServerContext *ctx, int sock);
+
+// Read one frame after its magic byte and queue the request. Returns 0 to
+// keep reading, -1 when the connection must be closed.
+static int _mux_read_frame(mux_conn_t *conn) {
+    ServerContext *ctx = conn->ctx;
+    struct __attribute__((packed)) {
+        uint8_t type;
+        uint32_t request_id;
+        uint32_t len;
+    } header;
+
+    if (proto_read_full(conn->socket, &header, sizeof(header)) <= 0) return -1;
+    uint32_t request_id = ntohl(header.request_id);
+    uint32_t len = ntohl(header.len);
+
+    if (len > ctx->max_request_size) {
+        printf("[API] Refusing multiplexed request 0x%02X of %u bytes (limit %u)\n", header.type, len, ctx->max_request_size);
+        _mux_write_error(conn, request_id, 413, "TOO_LARGE", "Request too large");
+        return proto_discard(conn->socket, len) == 0 ? 0 : -1;
+    }
+
+    // The frame stays on the socket until there is room, so a peer cannot
+    // make us buffer much more than MUX_MAX_INFLIGHT_BYTES
+    _mux_reserve(conn, len);
+    char *payload = malloc(len + 1);
+    if (!payload) {
+        _mux_unreserve(conn, len);
+        return -1;
+    }
+    if (len > 0 && proto_read_full(conn->socket, payload, len) <= 0) {
+        _mux_unreserve(conn, len);
+        free(payload);
+        return -1;
+    }
+    payload[len] = '\0';
+
+    if (!ctx->running) {
+        _mux_write_error(conn, request_id, 503, "BUSY", "Server shutting down");
+        _mux_unreserve(conn, len);
+        free(payload);
+        return 0;
+    }
+
+    int handle = _mux_open(conn, header.type, request_id, payload, len);
+    if (handle == -1) {
+        _mux_write_error(conn, request_id, 503, "BUSY", "Too many requests in flight");
+        _mux_unreserve(conn, len);
+        free(payload);
+        return 0;
+    }
+    if (!_api_enqueue(ctx, handle)) {
+        printf("[API] All %d workers busy and queue full, answering 503\n", ctx->api_workers);
+        server_send_error(handle, 0, 503, "BUSY", "Server busy");
+        _mux_finish(handle);
+    }
+    return 0;
+}
+
+static void _mux_unregister(mux_conn_t *conn) {
+    ServerContext *ctx = conn->ctx;
+
+    pthread_mutex_lock(&ctx->lock);
+    for (mux_conn_t **p = &ctx->mux_conns; *p; p = &(*p)->next) {
+        if (*p == conn) {
+            *p = conn->next;
+            break;
+        }
+    }
+    ctx->mux_count--;
+    pthread_mutex_unlock(&ctx->lock);
+}
+
+static void *_mux_reader(void *arg) {
+    mux_conn_t *conn = (mux_conn_t *)arg;
+    ServerContext *ctx = conn->ctx;
+    int idle_ms = 0;
+    int have_magic = 1; // handle_api_request consumed the first one
+
+    for (;;) {
+        if (!have_magic) {
+            int r = proto_wait_readable(conn->socket, MUX_POLL_MS);
+            if (r < 0) break;
+            if (r == 0) {
+                // Idle connections are closed; the client reconnects when needed
+                pthread_mutex_lock(&_mux_lock);
+                int inflight = conn->inflight;
+                pthread_mutex_unlock(&_mux_lock);
+                idle_ms = inflight > 0 ? 0 : idle_ms + MUX_POLL_MS;
+                if (idle_ms >= ctx->heartbeat_timeout * 1000) break;
+                continue;
+            }
+
+            uint8_t magic;
+            if (proto_read_full(conn->socket, &magic, 1) <= 0) break;
+            if (magic != PROTOCOL_MAGIC_MUX) {
+                printf("[API] Bad frame on multiplexed connection, closing\n");
+                break;
+            }
+        }
+        have_magic = 0;
+        idle_ms = 0;
+        if (_mux_read_frame(conn) < 0) break;
+    }
+
+    _mux_unregister(conn);
+
+    // Requests still running answer into a dead socket; the last one closes it
+    shutdown(conn->socket, SHUT_RD);
+    _mux_conn_release(conn);
+    return 0;
+}
+
+static void _mux_accept(ServerContext *ctx, int sock) {
+    pthread_mutex_lock(&ctx->lock);
+    int full = ctx->mux_count >= ctx->max_connections;
+    pthread_mutex_unlock(&ctx->lock);
+
+    mux_conn_t *conn = full ? NULL : malloc(sizeof(mux_conn_t));
+    if (!conn) {
+        char body[ERROR_BODY_SIZE];
+        api_mux_resp_header_t header;
+
+        // Request ID 0 answers for the whole connection
+        _error_body(body, sizeof(body), 503, "BUSY", "Server busy");
+        header.magic = PROTOCOL_MAGIC_MUX;
+        header.type = 0;
+        header.request_id = 0;
+        header.len = htonl((uint32_t)strlen(body));
+        header.status = htons(503);
+        proto_write(sock, &header, sizeof(header));
+        proto_write(sock, body, strlen(body));
+        proto_close(sock);
+        return;
+    }
+
+    conn->ctx = ctx;
+    conn->socket = sock;
+    conn->refcount = 1;
+    conn->inflight = 0;
+    conn->inflight_bytes = 0;
+    pthread_mutex_init(&conn->write_lock, NULL);
+    pthread_cond_init(&conn->drained, NULL);
+
+    pthread_mutex_lock(&ctx->lock);
+    conn->next = ctx->mux_conns;
+    ctx->mux_conns = conn;
+    ctx->mux_count++;
+    pthread_mutex_unlock(&ctx->lock);
+
+    pthread_t thread;
+    if (pthread_create(&thread, NULL, _mux_reader, conn) != 0) {
+        _mux_unregister(conn);
+        _mux_conn_release(conn);
+        return;
+    }
+    pthread_detach(thread);
+    printf("[API] Multiplexed connection opened\n");
+}
+
+// Accepted API sockets and multiplexed request handles wait here for a
+// worker. Returns 0 if the queue is full.
+static int _api_enqueue(ServerContext *ctx, int sock) {
+    pthread_mutex_lock(&ctx->api_queue_lock);
+    if (ctx->api_queue_len >= ctx->api_queue_size) {
+        pthread_mutex_unlock(&ctx->api_queue_lock);
+        return 0;
+    }
+    ctx->api_queue[(ctx->api_queue_head + ctx->api_queue_len) % ctx->api_queue_size] = sock;
+    ctx->api_queue_len++;
+    pthread_cond_signal(&ctx->api_queue_cond);
+    pthread_mutex_unlock(&ctx->api_queue_lock);
+    return 1;
+}
+
+// Workers keep serving queued requests after server_shutdown stops the
+// accept loops, and exit once the queue is empty.
+void *run_api_worker(void *arg) {
+    ServerContext *ctx = (ServerContext *)arg;
+
+    for (;;) {
+        pthread_mutex_lock(&ctx->api_queue_lock);
+        while (ctx->api_queue_len == 0 && ctx->running) {
+            pthread_cond_wait(&ctx->api_queue_cond, &ctx->api_queue_lock);
+        }
+        if (ctx->api_queue_len == 0) {
+            pthread_mutex_unlock(&ctx->api_queue_lock);
+            break;
+        }
+        int sock = ctx->api_queue[ctx->api_queue_head];
+        ctx->api_queue_head = (ctx->api_queue_head + 1) % ctx->api_queue_size;
+        ctx->api_queue_len--;
+        ctx->api_active++;
+        pthread_mutex_unlock(&ctx->api_queue_lock);
+
+        if (_is_mux_handle(sock)) {
+            _mux_serve(ctx, sock);
+        } else {
+            ThreadArgs *args = malloc(sizeof(ThreadArgs));
+            if (args) {
+                args->ctx = ctx;
+                args->socket = sock;
+                handle_api_request(args); // Frees args
+            } else {
+                proto_close(sock);
+            }
+        }
+
+        pthread_mutex_lock(&ctx->api_queue_lock);
+        ctx->api_active--;
+        pthread_cond_broadcast(&ctx->api_queue_cond); // server_shutdown may be waiting
+        pthread_mutex_unlock(&ctx->api_queue_lock);
+    }
+    return 0;
+}
+
 void *run_notification_server(void *arg) {
     ServerContext *ctx = (ServerContext *)arg;
     int socket_desc, client_sock, c;
@@ -308,20 +1020,39 @@ void *run_notification_server(void *arg) {
         perror("[Notification] bind failed");
         return 0;
     }
-    listen(socket_desc, 3);
+    listen(socket_desc, LISTEN_BACKLOG);
+    ctx->notification_listener = socket_desc;
     
     printf("[Notification] Bind done on port %d\n", ctx->port);
     c = sizeof(struct sockaddr_in);
 
     while (ctx->running && (client_sock = accept(socket_desc, (struct sockaddr *)&client, (socklen_t*)&c))) {
+        if (client_sock < 0) continue;
+
         pthread_mutex_lock(&ctx->lock);
-        ctx->active_clients++;
+        int full = ctx->active_clients >= ctx->max_connections;
+        if (!full) ctx->active_clients++;
         pthread_mutex_unlock(&ctx->lock);
 
+        if (full) {
+            printf("[Notification] Connection limit (%d) reached, refusing peer\n", ctx->max_connections);
+            _reject_busy(ctx, client_sock, 0);
+            continue;
+        }
+
         pthread_t sniffer_thread;
         client_t *new_client = malloc(sizeof(client_t));
         new_client->socket = client_sock;
         new_client->ctx = ctx;
+        inet_ntop(AF_INET, &client.sin_addr, new_client->ip, sizeof(new_client->ip));
+
+        // A dead peer must neither block server_send_to_device (which holds
+        // ctx->lock) nor hold the thread before it has sent its device ID
+        struct timeval tv;
+        tv.tv_sec = ctx->heartbeat_timeout;
+        tv.tv_usec = 0;
+        setsockopt(client_sock, SOL_SOCKET, SO_SNDTIMEO, (const char*)&tv, sizeof tv);
+        setsockopt(client_sock, SOL_SOCKET, SO_RCVTIMEO, (const char*)&tv, sizeof tv);
 
         if (pthread_create(&sniffer_thread, NULL, handle_client, (void*)new_client) < 0) {
             perror("[Notification] could not create thread");
@@ -332,6 +1063,44 @@ void *run_notification_server(void *arg) {
     return 0;
 }
 
+// Ping idle peers and disconnect the ones that stopped answering. Closing is
+// left to handle_client: shutdown() makes its pending read fail.
+void *run_heartbeat(void *arg) {
+    ServerContext *ctx = (ServerContext *)arg;
+
+    while (ctx->running) {
+        sleep(1);
+        time_t now = time(NULL);
+
+        // Pings are written after dropping ctx->lock, so collect them first
+        pthread_mutex_lock(&ctx->lock);
+        int n = 0;
+        client_session_t **to_ping = malloc((ctx->session_count + 1) * sizeof(client_session_t *));
+        for (int i = 0; i < SESSION_BUCKETS && to_ping; i++) {
+            for (client_session_t *s = ctx->sessions[i]; s != NULL; s = s->next) {
+                time_t idle = now - s->last_seen;
+                if (idle >= ctx->heartbeat_timeout) {
+                    printf("[Heartbeat] %s silent for %lds, disconnecting\n", s->device_id, (long)idle);
+                    shutdown(s->socket, SHUT_RDWR);
+                    s->last_seen = now; // Evict once; the session goes away with handle_client
+                } else if (idle >= ctx->heartbeat_interval && now - s->last_ping >= ctx->heartbeat_interval) {
+                    s->last_ping = now;
+                    s->refcount++;
+                    to_ping[n++] = s;
+                }
+            }
+        }
+        pthread_mutex_unlock(&ctx->lock);
+
+        for (int i = 0; i < n; i++) {
+            session_send(to_ping[i], MSG_PING, NULL, 0);
+            session_release(ctx, to_ping[i]);
+        }
+        free(to_ping);
+    }
+    return 0;
+}
+
 void *run_api_server(void *arg) {
     ServerContext *ctx = (ServerContext *)arg;
     int socket_desc, client_sock, c;
@@ -351,22 +1120,19 @@ void *run_api_server(void *arg) {
         perror("[API] bind failed");
         return 0;
     }
-    listen(socket_desc, 3);
+    listen(socket_desc, LISTEN_BACKLOG);
+    ctx->api_listener = socket_desc;
     printf("[API] Bind done on port %d\n", ctx->api_port);
     c = sizeof(struct sockaddr_in);
 
     while (ctx->running && (client_sock = accept(socket_desc, (struct sockaddr *)&client, (socklen_t*)&c))) {
-        pthread_t api_thread;
-        
-        ThreadArgs *args = malloc(sizeof(ThreadArgs));
-        args->ctx = ctx;
-        args->socket = client_sock;
-
-        if (pthread_create(&api_thread, NULL, handle_api_request, (void*)args) < 0) {
-            perror("[API] could not create thread");
-            return 0;
+        if (client_sock < 0) continue;
+
+        _set_io_timeout(client_sock, API_IO_TIMEOUT);
+        if (!_api_enqueue(ctx, client_sock)) {
+            printf("[API] All %d workers busy and queue full, answering 503\n", ctx->api_workers);
+            _reject_busy(ctx, client_sock, 1);
         }
-        pthread_detach(api_thread);
     }
     return 0;
 }
@@ -378,14 +1144,48 @@ ServerContext* server_init(int port, int api_port) {
     ctx->port = port;
     ctx->api_port = api_port;
     ctx->active_clients = 0;
-    ctx->head = NULL;
+    memset(ctx->sessions, 0, sizeof(ctx->sessions));
+    ctx->session_count = 0;
+    ctx->duplicate_policy = DUPLICATE_REPLACE;
     ctx->running = 1;
     ctx->handler = NULL;
     ctx->on_connect = NULL;
+    ctx->on_seen = NULL;
+    ctx->on_hello = NULL;
+    ctx->cert_required = NULL;
+    ctx->tls = NULL;
+    ctx->require_client_cert = 0;
+    ctx->max_message_size = PROTO_DEFAULT_MAX_MESSAGE;
+    ctx->heartbeat_interval = DEFAULT_HEARTBEAT_INTERVAL;
+    ctx->heartbeat_timeout = DEFAULT_HEARTBEAT_TIMEOUT;
+    ctx->api_workers = DEFAULT_API_WORKERS;
+    ctx->api_queue_size = DEFAULT_API_QUEUE;
+    ctx->max_connections = DEFAULT_MAX_CONNECTIONS;
+    ctx->max_request_size = DEFAULT_MAX_REQUEST_SIZE;
+    ctx->api_queue = NULL;
+    ctx->api_queue_head = 0;
+    ctx->api_queue_len = 0;
+    ctx->api_active = 0;
+    ctx->mux_conns = NULL;
+    ctx->mux_count = 0;
+    ctx->busy_rejects = 0;
+    ctx->notification_listener = -1;
+    ctx->api_listener = -1;
     pthread_mutex_init(&ctx->lock, NULL);
+    pthread_mutex_init(&ctx->api_queue_lock, NULL);
+    pthread_cond_init(&ctx->api_queue_cond, NULL);
     return ctx;
 }
 
+int server_enable_tls(ServerContext *ctx, char *cert_file, char *key_file, char *ca_file, int require_client_cert) {
+    SSL_CTX *tls = proto_tls_server_ctx(cert_file, key_file, ca_file, require_client_cert);
+    if (!tls) return 0;
+    ctx->tls = tls;
+    ctx->require_client_cert = require_client_cert;
+    printf("[TLS] Enabled (client certificates %s)\n", require_client_cert ? "required" : "optional");
+    return 1;
+}
+
 void server_set_handler(ServerContext *ctx, RequestHandler handler) {
     ctx->handler = handler;
 }
@@ -394,8 +1194,59 @@ void server_set_on_connect(ServerContext *ctx, ClientConnectCallback cb) {
     ctx->on_connect = cb;
 }
 
+void server_set_on_seen(ServerContext *ctx, ClientSeenCallback cb) {
+    ctx->on_seen = cb;
+}
+
+void server_set_on_hello(ServerContext *ctx, ClientHelloCallback cb) {
+    ctx->on_hello = cb;
+}
+
+void server_set_cert_required(ServerContext *ctx, ClientCertCallback cb) {
+    ctx->cert_required = cb;
+}
+
+void server_set_limits(ServerContext *ctx, int api_workers, int api_queue_size, int max_connections, uint32_t max_request_size) {
+    ctx->api_workers = api_workers > 0 ? api_workers : DEFAULT_API_WORKERS;
+    ctx->api_queue_size = api_queue_size > 0 ? api_queue_size : DEFAULT_API_QUEUE;
+    ctx->max_connections = max_connections > 0 ? max_connections : DEFAULT_MAX_CONNECTIONS;
+    ctx->max_request_size = max_request_size > 0 ? max_request_size : DEFAULT_MAX_REQUEST_SIZE;
+}
+
+void server_set_duplicate_policy(ServerContext *ctx, int policy) {
+    ctx->duplicate_policy = policy == DUPLICATE_REJECT ? DUPLICATE_REJECT : DUPLICATE_REPLACE;
+}
+
+void server_set_heartbeat(ServerContext *ctx, int interval, int timeout) {
+    ctx->heartbeat_interval = interval > 0 ? interval : DEFAULT_HEARTBEAT_INTERVAL;
+    ctx->heartbeat_timeout = timeout > 0 ? timeout : DEFAULT_HEARTBEAT_TIMEOUT;
+    // Leave room for at least one ping to be answered
+    if (ctx->heartbeat_timeout <= ctx->heartbeat_interval) {
+        ctx->heartbeat_timeout = ctx->heartbeat_interval * 3;
+    }
+}
+
+void server_set_max_message_size(ServerContext *ctx, uint32_t max_size) {
+    ctx->max_message_size = max_size > 0 ? max_size : PROTO_DEFAULT_MAX_MESSAGE;
+}
+
 void server_start(ServerContext *ctx) {
-    pthread_t notification_thread, api_thread;
+    pthread_t notification_thread, api_thread, heartbeat_thread;
+
+    ctx->api_queue = malloc(ctx->api_queue_size * sizeof(int));
+    if (!ctx->api_queue) {
+        perror("Could not allocate api queue");
+        return;
+    }
+    for (int i = 0; i < ctx->api_workers; i++) {
+        pthread_t worker;
+        if (pthread_create(&worker, NULL, run_api_worker, (void*)ctx) < 0) {
+            perror("Could not create api worker");
+            return;
+        }
+        pthread_detach(worker);
+    }
+    printf("[API] %d workers, queue of %d\n", ctx->api_workers, ctx->api_queue_size);
 
     if (pthread_create(&notification_thread, NULL, run_notification_server, (void*)ctx) < 0) {
         perror("Could not create notification thread");
@@ -406,6 +1257,11 @@ void server_start(ServerContext *ctx) {
         perror("Could not create api thread");
         return;
     }
+
+    if (pthread_create(&heartbeat_thread, NULL, run_heartbeat, (void*)ctx) < 0) {
+        perror("Could not create heartbeat thread");
+        return;
+    }
     
     // In a real library, we might want to return thread IDs or allow joining.
     // For now, we detach or just let them run. 
@@ -414,17 +1270,95 @@ void server_start(ServerContext *ctx) {
     // We will detach them and let the caller decide when to stop.
     pthread_detach(notification_thread);
     pthread_detach(api_thread);
+    pthread_detach(heartbeat_thread);
 }
 
 void server_stop(ServerContext *ctx) {
+    server_shutdown(ctx, 0, 0);
+}
+
+// Take a reference on every registered session (caller releases them).
+static int _session_snapshot(ServerContext *ctx, client_session_t ***out) {
+    pthread_mutex_lock(&ctx->lock);
+    int n = 0;
+    client_session_t **list = malloc((ctx->session_count + 1) * sizeof(client_session_t *));
+    for (int i = 0; i < SESSION_BUCKETS && list; i++) {
+        for (client_session_t *s = ctx->sessions[i]; s != NULL; s = s->next) {
+            s->refcount++;
+            list[n++] = s;
+        }
+    }
+    pthread_mutex_unlock(&ctx->lock);
+    *out = list;
+    return n;
+}
+
+int server_shutdown(ServerContext *ctx, int grace_seconds, int reconnect_after) {
+    client_session_t **sessions;
+    char hint[16];
+    int n;
+
+    // 1. Stop accepting: shutdown() wakes the blocked accept() calls
     ctx->running = 0;
-    // Real cleanup would involve closing sockets to break accept loops
-    // and freeing list. For demo, just flipping flag.
+    if (ctx->notification_listener != -1) shutdown(ctx->notification_listener, SHUT_RDWR);
+    if (ctx->api_listener != -1) shutdown(ctx->api_listener, SHUT_RDWR);
+
+    // 2. Tell agents to come back later instead of hammering a dead port
+    snprintf(hint, sizeof(hint), "%d", reconnect_after);
+    n = _session_snapshot(ctx, &sessions);
+    for (int i = 0; i < n; i++) {
+        session_send(sessions[i], MSG_SHUTDOWN, hint, strlen(hint));
+        session_release(ctx, sessions[i]);
+    }
+    free(sessions);
+    printf("[Shutdown] Notified %d agent(s), draining API requests (up to %ds)\n", n, grace_seconds);
+
+    // 3. Let queued and running requests finish
+    struct timespec deadline;
+    clock_gettime(CLOCK_REALTIME, &deadline);
+    deadline.tv_sec += grace_seconds > 0 ? grace_seconds : 0;
+
+    pthread_mutex_lock(&ctx->api_queue_lock);
+    pthread_cond_broadcast(&ctx->api_queue_cond); // Idle workers exit
+    while (ctx->api_queue_len + ctx->api_active > 0) {
+        if (pthread_cond_timedwait(&ctx->api_queue_cond, &ctx->api_queue_lock, &deadline) == ETIMEDOUT) break;
+    }
+    int pending = ctx->api_queue_len + ctx->api_active;
+    pthread_mutex_unlock(&ctx->api_queue_lock);
+    if (pending > 0) {
+        printf("[Shutdown] Grace period over with %d request(s) still running\n", pending);
+    }
+
+    // 4. Disconnect agents that did not leave on their own; handle_client and
+    //    the multiplexed readers clean up
+    n = _session_snapshot(ctx, &sessions);
+    for (int i = 0; i < n; i++) {
+        shutdown(sessions[i]->socket, SHUT_RDWR);
+        session_release(ctx, sessions[i]);
+    }
+    free(sessions);
+    pthread_mutex_lock(&ctx->lock);
+    for (mux_conn_t *conn = ctx->mux_conns; conn; conn = conn->next) {
+        shutdown(conn->socket, SHUT_RDWR);
+    }
+    pthread_mutex_unlock(&ctx->lock);
+
+    // 5. Close the listeners
+    if (ctx->notification_listener != -1) {
+        close(ctx->notification_listener);
+        ctx->notification_listener = -1;
+    }
+    if (ctx->api_listener != -1) {
+        close(ctx->api_listener);
+        ctx->api_listener = -1;
+    }
+    printf("[Shutdown] Listeners closed\n");
+    return pending;
 }
 
 int server_get_online_users(ServerContext *ctx, char ***ids) {
     pthread_mutex_lock(&ctx->lock);
-    int count = ctx->active_clients;
+    int count = ctx->session_count;
     if (count == 0) {
         *ids = NULL;
         pthread_mutex_unlock(&ctx->lock);
@@ -433,11 +1367,11 @@ int server_get_online_users(ServerContext *ctx, char ***ids) {
     
     *ids = malloc(count * sizeof(char*));
     int i = 0;
-    client_node_t *temp = ctx->head;
-    while(temp != NULL && i < count) {
-        (*ids)[i] = strdup(temp->device_id); // Caller must free each string AND the array
-        i++;
-        temp = temp->next;
+    for (int b = 0; b < SESSION_BUCKETS && i < count; b++) {
+        for (client_session_t *temp = ctx->sessions[b]; temp != NULL && i < count; temp = temp->next) {
+            (*ids)[i] = strdup(temp->device_id); // Caller must free each string AND the array
+            i++;
+        }
     }
     pthread_mutex_unlock(&ctx->lock);
     return i; /* actual count */
@@ -455,7 +1389,14 @@ void server_broadcast(ServerContext *ctx, char *message) {
 }
 
 void server_send_response(int sock, int type, int status, char *message) {
-    uint32_t msg_len = (message != NULL) ? (uint32_t)strlen(message) : 0;
+    server_send_response_len(sock, type, status, message, message ? (uint32_t)strlen(message) : 0);
+}
+
+void server_send_response_len(int sock, int type, int status, const char *message, uint32_t msg_len) {
+    if (_is_mux_handle(sock)) {
+        _mux_respond(sock, type, status, message, msg_len);
+        return;
+    }
 
     if (msg_len > 65535) {
         api_resp_header_ext_t resp_header;
@@ -463,51 +1404,58 @@ void server_send_response(int sock, int type, int status, char *message) {
         resp_header.type = (uint8_t)type;
         resp_header.len = htonl(msg_len);
         resp_header.status = htons(status);
-        write(sock, &resp_header, sizeof(resp_header));
+        proto_write(sock, &resp_header, sizeof(resp_header));
     } else {
         api_resp_header_t resp_header;
         resp_header.type = (uint8_t)type;
         resp_header.status = htons(status);
         resp_header.len = htons((uint16_t)msg_len);
-        write(sock, &resp_header, sizeof(resp_header));
+        proto_write(sock, &resp_header, sizeof(resp_header));
     }
 
     if (msg_len > 0) {
-        uint32_t total_written = 0;
-        while (total_written < msg_len) {
-            ssize_t n = write(sock, message + total_written, msg_len - total_written);
-            if (n <= 0) break;
-            total_written += (uint32_t)n;
-        }
+        proto_write(sock, message, msg_len);
     }
-    close(sock);
+    proto_close(sock);
+}
+
+void server_send_error(int sock, int type, int status, const char *code, const char *message) {
+    char body[ERROR_BODY_SIZE];
+
+    _error_body(body, sizeof(body), status, code, message);
+    server_send_response(sock, type, status, body);
+}
+
+int server_get_peer_identity(int sock, char *buffer, int size) {
+    return proto_peer_cn(_mux_socket(sock), buffer, (size_t)size);
+}
+
+int server_get_peer_ip(int sock, char *buffer, int size) {
+    struct sockaddr_in addr;
+    socklen_t len = sizeof(addr);
+    if (getpeername(_mux_socket(sock), (struct sockaddr *)&addr, &len) < 0) return 0;
+    return inet_ntop(AF_INET, &addr.sin_addr, buffer, (socklen_t)size) != NULL;
 }
 
 int server_send_unicast(ServerContext *ctx, char *client_id, char *message) {
-    pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head;
-    while (temp != NULL) {
-        if (strcmp(temp->device_id, client_id) == 0) {
-             send_packet(temp->socket, message, strlen(message));
-             pthread_mutex_unlock(&ctx->lock);
-             return 1; // Success
-        }
-        temp = temp->next;
-    }
-    pthread_mutex_unlock(&ctx->lock);
-    return 0; // Not found
+    client_session_t *session = session_acquire(ctx, client_id);
+    if (!session) return 0; // Not found
+
+    session_send(session, MSG_SOCKET, message, strlen(message));
+    session_release(ctx, session);
+    return 1; // Success
 }
 
 int server_get_device_id_by_sock(ServerContext *ctx, int sock, char *buffer) {
     pthread_mutex_lock(&ctx->lock);
-    client_node_t *temp = ctx->head;
-    while(temp != NULL) {
-        if (temp->socket == sock) {
-            strcpy(buffer, temp->device_id);
-            pthread_mutex_unlock(&ctx->lock);
-            return 1;
+    for (int i = 0; i < SESSION_BUCKETS; i++) {
+        for (client_session_t *temp = ctx->sessions[i]; temp != NULL; temp = temp->next) {
+            if (temp->socket == sock) {
+                strcpy(buffer, temp->device_id);
+                pthread_mutex_unlock(&ctx->lock);
+                return 1;
+            }
         }
-        temp = temp->next;
     }
     pthread_mutex_unlock(&ctx->lock);
     return 0;
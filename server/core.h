@@ -2,27 +2,103 @@
 #define SERVER_CORE_H
 
 #include <pthread.h>
+#include <time.h>
 #include "../protocol/protocol.h"
 
-typedef struct client_node {
+#define SESSION_BUCKETS 256
+
+// Default limits (see server_set_limits)
+#define DEFAULT_API_WORKERS 16
+#define DEFAULT_API_QUEUE 64
+#define DEFAULT_MAX_CONNECTIONS 1024
+#define DEFAULT_MAX_REQUEST_SIZE (64 * 1024 * 1024) // Backup chunks are 16 MiB before base64
+
+// Multiplexed API connections (see api_mux_req_header_t). Each request on
+// one is given a handle from MUX_HANDLE_BASE up that stands in for the socket
+// in RequestHandler, server_send_response and the peer lookups.
+#define MUX_HANDLE_BASE 0x100000
+#define MUX_MAX_STREAMS 4096 // Requests in flight over all multiplexed connections
+#define MUX_MAX_INFLIGHT 64  // Requests in flight on one connection
+#define MUX_MAX_INFLIGHT_BYTES (128u * 1024 * 1024) // Request bytes buffered for one connection
+
+// What to do when a device ID connects while it already has a session
+#define DUPLICATE_REPLACE 0 // Drop the older connection, keep the new one
+#define DUPLICATE_REJECT  1 // Keep the older connection, refuse the new one
+
+// A device connected to the notification channel. Sessions live in a hash
+// table keyed by device ID and are reference counted: the table and the
+// connection's thread each hold a reference, as does anyone sending to it
+// (session_acquire / session_release). The socket is closed with the last one.
+typedef struct client_session {
     char device_id[64];
     int socket;
-    struct client_node *next;
-} client_node_t;
+    char ip[64];
+    time_t last_seen; // Last message from the peer (any type)
+    time_t last_ping; // Last MSG_PING we sent
+    int refcount;     // Guarded by ServerContext.lock
+    int registered;   // Still in the table (not replaced or disconnected)
+    pthread_mutex_t write_lock; // One message at a time; reads need no lock (see proto_read)
+    struct client_session *next; // Bucket chain
+} client_session_t;
 
-// Callback for API Requests (Socket, Type, Payload)
-typedef void (*RequestHandler)(int socket, int type, char *payload);
+// Callback for API Requests (Socket, Type, Payload, Length). The payload is
+// NUL-terminated but may hold binary data (chunk frames), so use len. The
+// socket may be a multiplexed request handle; only pass it back to the
+// server_* functions.
+typedef void (*RequestHandler)(int socket, int type, char *payload, uint32_t len);
 typedef void (*ClientConnectCallback)(char *device_id);
+// Device is alive (on connect, then at most every SEEN_REPORT_INTERVAL seconds)
+typedef void (*ClientSeenCallback)(char *device_id, char *ip);
+// Agent greeting (see MSG_HELLO), before the device is registered. hello is
+// NULL for protocol 1 agents. Return 1 to accept with the MSG_HELLO answer in
+// reply, or 0 to refuse with the reason in reply (reply_size bytes).
+typedef int (*ClientHelloCallback)(char *device_id, char *hello, char *reply, int reply_size);
+// Whether a device was issued a client certificate, which it must then
+// present even when certificates are optional (1 = yes)
+typedef int (*ClientCertCallback)(char *device_id);
+
+#define SEEN_REPORT_INTERVAL 60
+#define DEFAULT_HEARTBEAT_INTERVAL 30
+#define DEFAULT_HEARTBEAT_TIMEOUT 90
 
 typedef struct {
     int port;
     int api_port;
     int active_clients;
-    client_node_t *head;
-    pthread_mutex_t lock;
+    client_session_t *sessions[SESSION_BUCKETS];
+    int session_count;
+    int duplicate_policy;      // DUPLICATE_REPLACE or DUPLICATE_REJECT
+    pthread_mutex_t lock;      // Guards the session table, not socket writes
     int running; 
     RequestHandler handler; // Logic Delegate
     ClientConnectCallback on_connect;
+    ClientSeenCallback on_seen;
+    ClientHelloCallback on_hello;
+    ClientCertCallback cert_required;
+    SSL_CTX *tls; // NULL = plain TCP
+    int require_client_cert;
+    uint32_t max_message_size; // Largest message accepted/sent on the notification channel
+    int heartbeat_interval;    // Ping peers idle this long (seconds)
+    int heartbeat_timeout;     // Drop peers silent this long (seconds)
+    // Limits
+    int api_workers;           // Threads serving API requests
+    int api_queue_size;        // Accepted API sockets waiting for a worker
+    int max_connections;       // Concurrent notification connections
+    uint32_t max_request_size; // Largest API request body
+    // API queue (ring buffer, allocated by server_start)
+    int *api_queue;
+    int api_queue_head;
+    int api_queue_len;
+    int api_active;            // Requests currently inside a handler
+    pthread_mutex_t api_queue_lock;
+    pthread_cond_t api_queue_cond; // Signalled on new work and when a request finishes
+    int busy_rejects;          // Peers over the limits being refused, guarded by lock
+    // Multiplexed API connections, guarded by lock (at most max_connections)
+    struct mux_conn *mux_conns;
+    int mux_count;
+    // Listening sockets (-1 until bound), closed by server_shutdown
+    int notification_listener;
+    int api_listener;
 } ServerContext;
 
 // Initialize server context
@@ -31,6 +107,29 @@ ServerContext* server_init(int port, int api_port);
 // Set logic handler
 void server_set_handler(ServerContext *ctx, RequestHandler handler);
 void server_set_on_connect(ServerContext *ctx, ClientConnectCallback cb);
+void server_set_on_seen(ServerContext *ctx, ClientSeenCallback cb);
+void server_set_on_hello(ServerContext *ctx, ClientHelloCallback cb);
+void server_set_cert_required(ServerContext *ctx, ClientCertCallback cb);
+
+// Heartbeat on the notification channel (0 = default). Idle peers are pinged
+// every interval seconds; peers silent for timeout seconds are disconnected.
+void server_set_heartbeat(ServerContext *ctx, int interval, int timeout);
+
+// Bound the server's resources (0 = default; call before server_start).
+// Requests beyond the worker queue get status 503 and notification
+// connections beyond max_connections get MSG_BUSY, so clients back off.
+void server_set_limits(ServerContext *ctx, int api_workers, int api_queue_size, int max_connections, uint32_t max_request_size);
+
+// Choose what happens when an already connected device ID connects again
+void server_set_duplicate_policy(ServerContext *ctx, int policy);
+
+// Limit the size of a single notification-channel message (0 = default).
+// Larger incoming messages drop the connection; larger outgoing ones are refused.
+void server_set_max_message_size(ServerContext *ctx, uint32_t max_size);
+
+// Enable TLS on both listeners (must be called before server_start).
+// Returns 1 on success, 0 if the certificate/key/CA could not be loaded.
+int server_enable_tls(ServerContext *ctx, char *cert_file, char *key_file, char *ca_file, int require_client_cert);
 
 // Start server threads (Non-blocking: returns after spawning threads)
 void server_start(ServerContext *ctx);
@@ -38,6 +137,12 @@ void server_start(ServerContext *ctx);
 // Stop server (Cleanup)
 void server_stop(ServerContext *ctx);
 
+// Drain and stop: refuse new connections, send MSG_SHUTDOWN to every agent
+// (reconnect_after seconds), wait up to grace_seconds for accepted API
+// requests to finish, then disconnect agents and close the listeners.
+// Returns the number of requests still running when the grace period ended.
+int server_shutdown(ServerContext *ctx, int grace_seconds, int reconnect_after);
+
 // --- CGo Helpers ---
 
 // Get online user IDs (Caller must free *ids)
@@ -50,9 +155,36 @@ void server_broadcast(ServerContext *ctx, char *message);
 // Send message to specific client
 int server_send_unicast(ServerContext *ctx, char *client_id, char *message);
 void broadcast_message(ServerContext *ctx, char *sender_id, char *message);
+
+// --- Session Table ---
+
+// Register a connection for device_id, applying the duplicate policy.
+// Returns the session with a reference for the caller, or NULL if refused.
+client_session_t *session_register(ServerContext *ctx, char *device_id, int socket, char *ip);
+// Remove the session from the table if it is still registered (returns 1)
+int session_unregister(ServerContext *ctx, client_session_t *session);
+// Reference a connected device's session (NULL if offline); pair with session_release
+client_session_t *session_acquire(ServerContext *ctx, const char *device_id);
+void session_release(ServerContext *ctx, client_session_t *session);
+// Send one message under the session's write lock (returns 0 on success)
+int session_send(client_session_t *session, uint8_t type, const void *data, uint32_t len);
+// Returns 1 if sent, 0 if the device is offline or the payload exceeds max_message_size
 int server_send_to_device(ServerContext *ctx, char *target_device_id, uint8_t type, char *payload);
 
-// Send API Response (Header + JSON) and Close Socket
+// Send API Response (Header + JSON) and Close Socket. For a multiplexed
+// request the response is framed with its ID and the connection stays open.
 void server_send_response(int sock, int type, int status, char *message);
+// Same for a body that may contain NUL bytes
+void server_send_response_len(int sock, int type, int status, const char *body, uint32_t len);
+
+// Send an error envelope (see protocol/envelope.h) with a new request ID,
+// which is also logged, and close the socket
+void server_send_error(int sock, int type, int status, const char *code, const char *message);
+
+// CN of the client certificate presented on this socket (returns 1 if any)
+int server_get_peer_identity(int sock, char *buffer, int size);
+
+// Remote address of the socket (returns 1 on success)
+int server_get_peer_ip(int sock, char *buffer, int size);
 
 #endif
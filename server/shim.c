@@ -1,13 +1,28 @@
 #include "shim.h"
 
 // Forward declarations of exported Go functions
-extern void goRequestHandler(int sock, int msg_type, char *payload);
+extern void goRequestHandler(int sock, int msg_type, char *payload, uint32_t len);
 extern void goClientConnect(char *device_id);
+extern void goClientSeen(char *device_id, char *ip);
+extern int goClientHello(char *device_id, char *hello, char *reply, int reply_size);
+extern int goCertRequired(char *device_id);
 
-void request_handler_shim(int sock, int msg_type, char *payload) {
-    goRequestHandler(sock, msg_type, payload);
+void request_handler_shim(int sock, int msg_type, char *payload, uint32_t len) {
+    goRequestHandler(sock, msg_type, payload, len);
 }
 
 void client_connect_shim(char *device_id) {
     goClientConnect(device_id);
 }
+
+void client_seen_shim(char *device_id, char *ip) {
+    goClientSeen(device_id, ip);
+}
+
+int client_hello_shim(char *device_id, char *hello, char *reply, int reply_size) {
+    return goClientHello(device_id, hello, reply, reply_size);
+}
+
+int cert_required_shim(char *device_id) {
+    return goCertRequired(device_id);
+}
@@ -3,7 +3,10 @@
 
 #include "core.h"
 
-void request_handler_shim(int sock, int msg_type, char *payload);
+void request_handler_shim(int sock, int msg_type, char *payload, uint32_t len);
 void client_connect_shim(char *device_id);
+void client_seen_shim(char *device_id, char *ip);
+int client_hello_shim(char *device_id, char *hello, char *reply, int reply_size);
+int cert_required_shim(char *device_id);
 
 #endif